@@ -379,6 +379,11 @@ func atcaGenKey(ctx context.Context, dc dev.DevConn) error {
 		outputFileName = args[2]
 	}
 
+	keyFormat, err := x509utils.GetKeyFormat(*flags.KeyFormat, outputFileName)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
 	_, cfg, err := atca.Connect(ctx, dc)
 	if err != nil {
 		return errors.Annotatef(err, "Connect")
@@ -392,9 +397,9 @@ func atcaGenKey(ctx context.Context, dc dev.DevConn) error {
 			return errors.Trace(err)
 		}
 		if pubKeyData == nil { // dry run
-			err = nil
+			return nil
 		}
-		err = x509utils.WritePubKey(pubKeyData, outputFileName)
+		err = x509utils.WritePubKeyFormat(pubKeyData, keyFormat, outputFileName)
 	} else {
 		reportf("Slot %d is a non-ECC key slot", slot)
 		keyData := make([]byte, 32)
@@ -670,6 +675,10 @@ func atcaGetPubKey(ctx context.Context, dc dev.DevConn) error {
 	if len(args) == 3 {
 		outputFileName = args[2]
 	}
+	keyFormat, err := x509utils.GetKeyFormat(*flags.KeyFormat, outputFileName)
+	if err != nil {
+		return errors.Trace(err)
+	}
 	if _, _, err := atca.Connect(ctx, dc); err != nil {
 		return errors.Annotatef(err, "Connect")
 	}
@@ -677,5 +686,5 @@ func atcaGetPubKey(ctx context.Context, dc dev.DevConn) error {
 	if err != nil {
 		return errors.Annotatef(err, "getPubKey")
 	}
-	return x509utils.WritePubKey(pubKey, outputFileName)
+	return x509utils.WritePubKeyFormat(pubKey, keyFormat, outputFileName)
 }
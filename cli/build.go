@@ -26,11 +26,13 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
-	"unicode"
 
 	"github.com/juju/errors"
 	flag "github.com/spf13/pflag"
@@ -38,15 +40,19 @@ import (
 	glog "k8s.io/klog/v2"
 
 	"github.com/mongoose-os/mos/cli/build"
+	"github.com/mongoose-os/mos/cli/builder"
 	moscommon "github.com/mongoose-os/mos/cli/common"
-	"github.com/mongoose-os/mos/cli/common/paths"
 	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/errcode"
 	"github.com/mongoose-os/mos/cli/flags"
-	"github.com/mongoose-os/mos/cli/interpreter"
-	"github.com/mongoose-os/mos/cli/mosgit"
+	"github.com/mongoose-os/mos/cli/flash/esp32"
+	"github.com/mongoose-os/mos/cli/manifest_parser"
 	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/cli/size_report"
+	"github.com/mongoose-os/mos/cli/trace"
 	"github.com/mongoose-os/mos/cli/update"
 	"github.com/mongoose-os/mos/common/fwbundle"
+	"github.com/mongoose-os/mos/common/ourio"
 	"github.com/mongoose-os/mos/version"
 )
 
@@ -55,17 +61,41 @@ var (
 	// Don't want to move this to BuildParams to avoid trivial command line injection.
 	buildCmdExtra = flag.StringArray("build-cmd-extra", []string{}, "extra make flags, added at the end of the make command. Can be used multiple times.")
 
-	// In-memory buffer containing all the log messages.  It has to be
-	// thread-safe, because it's used in compProviderReal, which is an
-	// implementation of the manifest_parser.ComponentProvider interface, whose
-	// methods are called concurrently.
-	logBuf threadSafeBuffer
+	maxFWSize    = flag.Int64("max-fw-size", 0, "Fail the build if the size of the app part of the firmware exceeds this many bytes")
+	maxFWSizePct = flag.Float64("max-fw-size-pct", 0, "Fail the build if the size of the app part of the firmware exceeds this percentage of the app partition size (ESP32 only)")
 
-	// Log writer which always writes to the build.log file, os.Stderr and logBuf
-	logWriterStderr io.Writer
+	sizeReport        = flag.Bool("size-report", false, "After the build, print firmware size breakdown: ELF sections and firmware parts. Use --json for JSON output")
+	sizeBaseline      = flag.String("size-baseline", "", "Compare firmware size against the report previously saved with --size-report --json and print the deltas")
+	sizeRegression    = flag.String("size-regression-threshold", "", `With --size-baseline, fail the build if any of the sizes grows by more than this many bytes, or percent if followed by "%"`)
+	sizeReportObjects = flag.Int("size-report-objects", 0, "With --size-report, also print this many biggest object files, using the linker map file")
+	symbolSizes       = flag.String("symbol-sizes", "", "After the build, write sizes of the symbols from the linker map file (build/objs/fw.map) to this CSV file, biggest first")
 
-	// The same as logWriterStderr, but skips os.Stderr unless --verbose is given
-	logWriter io.Writer
+	dumpMakeVars = flag.Bool("dump-make-vars", false, "Print the resolved make variables and the make command line. Use with --build-dry-run to exit without building")
+
+	remoteBuildTimeout = flag.Duration("build-timeout", 0, "Remote build: ask the server to abort the build after this much time. 0 means server's default")
+	buildUploadRetries = flag.Int("build-upload-retries", 3, "Remote build: retry the sources upload this many times on network errors, 5xx and 429 responses, with exponential backoff. Each retry uploads the full sources again")
+
+	buildSummaryOnly = flag.Bool("summary-only", false, "Suppress build progress output and print a one-line summary at the end. Full log is still written to build.log")
+
+	libOutput = flag.String("lib-output", "", "When building a lib, also copy the resulting lib archive to this path. See also --output for firmware builds.")
+
+	depsManifestOut = flag.String("deps-manifest-out", "", "Write the deps manifest (exact versions of the libs and modules, SHA256 of the binary blobs) to this file. Use --format json for JSON")
+
+	cacheLibsManifest = flag.Bool("cache-libs-manifest", false, "Local build: save the resolved manifest in --manifest-cache-dir and reuse it while the manifests of the app and libs, source dirs and referenced env vars are unchanged. Libs are not updated on a cache hit, entries expire after --libs-update-interval. See also mos cache-stats")
+
+	traceProfile = flag.String("trace-profile", "", "Local build: write the timing trace of manifest parsing (lib preparation, fetches, conds expansion) and build to this file, in Chrome tracing format. Open it in chrome://tracing or ui.perfetto.dev")
+
+	depsJSON = flag.String("deps-json", "", "Write the resolved dependency graph (libs with their locations, versions and paths, edges and init order) to this file as JSON. For remote builds, libs are also fetched locally for that")
+
+	depsLock       = flag.String("deps-lock", "", "YAML file with lib and module name -> version (git hash) to use instead of the versions in the manifests. See mos deps-lock")
+	strictDepsLock = flag.Bool("strict-deps-lock", false, "With --deps-lock, fail if a lib or module has no entry in the lock file, instead of a warning")
+
+	fsCache = flag.Bool("fs-cache", false, "Local build: keep the filesystem image in build/fs_cache and reuse it while the FS files, config schema and build vars are unchanged")
+
+	explainInitDeps    = flag.Bool("explain-init-deps", false, "Resolve the manifest, print init dependencies of each lib, telling explicit ones from implicit, and exit.")
+	printEffectiveLibs = flag.Bool("print-effective-libs", false, "Resolve the manifest (including conds for the given --board and --platform), print the libs that would be included in the build and exit.")
+	printBuildParams   = flag.Bool("print-build-params", false, "Print the effective build params as YAML, in the format accepted by --build-params, and exit.")
+	listBoards         = flag.Bool("list-boards", false, "Print the BOARD values defined by the boards lib for the --platform and exit")
 )
 
 const (
@@ -78,16 +108,22 @@ func init() {
 
 // Build {{{
 
+// credentialsEnvPrefix is the prefix of env vars with per-host credentials:
+// MOS_CREDENTIALS_GITHUB_COM=token or user:password. In the host part, _ stands
+// for . and __ for -, e.g. MOS_CREDENTIALS_MY__GIT_EXAMPLE_COM is my-git.example.com.
+const credentialsEnvPrefix = "MOS_CREDENTIALS_"
+
+// getCredentialsFromCLI returns credentials from --credentials and the
+// MOS_CREDENTIALS_* env vars. For the same host, entries given on the command
+// line take precedence over the env vars, which take precedence over the
+// entries from the credentials file (--credentials @file).
 func getCredentialsFromCLI() (map[string]build.Credentials, error) {
 	credsStr := *flags.Credentials
 	if credsStr == "" && *flags.GHToken != "" {
 		credsStr = *flags.GHToken
 		glog.Errorf("--gh-token is deprecated, please use --credentials")
 	}
-	if credsStr == "" {
-		return nil, nil
-	}
-	var entries []string
+	var fileEntries, cliEntries []string
 	if strings.HasPrefix(credsStr, "@") {
 		f, err := os.Open(credsStr[1:])
 		if err != nil {
@@ -97,11 +133,36 @@ func getCredentialsFromCLI() (map[string]build.Credentials, error) {
 		scanner := bufio.NewScanner(f)
 		scanner.Split(bufio.ScanLines)
 		for scanner.Scan() {
-			entries = append(entries, scanner.Text())
+			fileEntries = append(fileEntries, scanner.Text())
 		}
-	} else {
-		entries = strings.Split(credsStr, ",")
+	} else if credsStr != "" {
+		cliEntries = strings.Split(credsStr, ",")
 	}
+	fileCreds, err := parseCredentialsEntries(fileEntries)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	envCreds, err := getCredentialsFromEnv(os.Environ())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cliCreds, err := parseCredentialsEntries(cliEntries)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var result map[string]build.Credentials
+	for _, m := range []map[string]build.Credentials{fileCreds, envCreds, cliCreds} {
+		for host, creds := range m {
+			if result == nil {
+				result = map[string]build.Credentials{}
+			}
+			result[host] = creds
+		}
+	}
+	return result, nil
+}
+
+func parseCredentialsEntries(entries []string) (map[string]build.Credentials, error) {
 	result := map[string]build.Credentials{}
 	for _, e := range entries {
 		host := ""
@@ -124,23 +185,184 @@ func getCredentialsFromCLI() (map[string]build.Credentials, error) {
 		default:
 			return nil, errors.Errorf("invalid credentials entry %q", e)
 		}
+		ourutil.RegisterSecret(creds.Pass)
 		result[host] = creds
 	}
 	return result, nil
 }
 
+// getCredentialsFromEnv returns credentials from MOS_CREDENTIALS_* entries of
+// the given environment.
+func getCredentialsFromEnv(environ []string) (map[string]build.Credentials, error) {
+	result := map[string]build.Credentials{}
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, credentialsEnvPrefix) {
+			continue
+		}
+		parts := strings.SplitN(kv[len(credentialsEnvPrefix):], "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		host := strings.ToLower(parts[0])
+		host = strings.Replace(host, "__", "-", -1)
+		host = strings.Replace(host, "_", ".", -1)
+		creds := build.Credentials{User: "mos"}
+		switch vv := strings.Split(parts[1], ":"); len(vv) {
+		case 1:
+			creds.Pass = strings.TrimSpace(vv[0])
+		case 2:
+			creds.User = strings.TrimSpace(vv[0])
+			creds.Pass = strings.TrimSpace(vv[1])
+		default:
+			return nil, errors.Errorf("invalid value of %s%s, expected token or user:password", credentialsEnvPrefix, parts[0])
+		}
+		ourutil.RegisterSecret(creds.Pass)
+		result[host] = creds
+	}
+	return result, nil
+}
+
+// loadEnvFile reads KEY=VALUE lines from the given file and sets environment
+// variables which are not set yet. Empty lines and lines starting with # are
+// ignored, values may be quoted.
+func loadEnvFile(fname string) error {
+	if fname == "" {
+		return nil
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return errors.Errorf("%s:%d: expected KEY=VALUE", fname, n)
+		}
+		k, v := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		if _, ok := os.LookupEnv(k); ok {
+			glog.V(1).Infof("%s: %s is already set in the environment", fname, k)
+			continue
+		}
+		os.Setenv(k, v)
+	}
+	return errors.Trace(scanner.Err())
+}
+
+func getGitHubAPIURLsFromCLI() (map[string]string, error) {
+	if *flags.GitHubAPIURL == "" {
+		return nil, nil
+	}
+	result := map[string]string{}
+	for _, e := range strings.Split(*flags.GitHubAPIURL, ",") {
+		host, apiURL := "", strings.TrimSpace(e)
+		if parts := strings.SplitN(e, "=", 2); len(parts) == 2 {
+			// host=url
+			host, apiURL = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		}
+		if u, err := url.Parse(apiURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, errors.Errorf("invalid GitHub API URL entry %q", e)
+		}
+		result[host] = apiURL
+	}
+	return result, nil
+}
+
+func getDepOverridesFromCLI() (map[string]build.DepOverride, error) {
+	if len(*flags.DepOverrides) == 0 {
+		return nil, nil
+	}
+	result := map[string]build.DepOverride{}
+	for _, e := range *flags.DepOverrides {
+		name, do, err := build.ParseDepOverride(e)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		// Absolutize local paths
+		if !isURL(do.Location) {
+			if do.Location, err = filepath.Abs(do.Location); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		result[name] = *do
+	}
+	return result, nil
+}
+
+func getSourcesFromCLI() ([]string, []string, error) {
+	if *flags.SourcesFile == "" {
+		return nil, nil, nil
+	}
+	fname, err := filepath.Abs(*flags.SourcesFile)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return build.ParseSourcesFile(data, filepath.Dir(fname))
+}
+
+func getForbiddenLibsFromCLI() ([]build.ForbiddenLib, error) {
+	var res []build.ForbiddenLib
+	if *flags.ForbidLibFile != "" {
+		data, err := ioutil.ReadFile(*flags.ForbidLibFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		res, err = build.ParseDepPolicy(data)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	for _, name := range *flags.ForbidLib {
+		res = append(res, build.ForbiddenLib{Name: name})
+	}
+	return res, nil
+}
+
 // Build command handler {{{
 func buildHandler(ctx context.Context, devConn dev.DevConn) error {
+	if err := loadEnvFile(*flags.EnvFile); err != nil {
+		return errors.Annotatef(err, "--env-file")
+	}
+
+	if *printEffectiveLibs {
+		return errors.Trace(printEffectiveLibsHandler())
+	}
+
+	if *explainInitDeps {
+		return errors.Trace(explainInitDepsHandler())
+	}
+
+	if *listBoards {
+		return errors.Trace(listBoardsHandler())
+	}
+
 	var bParams build.BuildParams
 	if *flags.BuildParams != "" {
 		buildParamsBytes, err := ioutil.ReadFile(*flags.BuildParams)
 		if err != nil {
 			return errors.Annotatef(err, "error reading --build-params file")
 		}
-		if err := yaml.Unmarshal(buildParamsBytes, &bParams); err != nil {
+		bp, err := build.ParseBuildParams(buildParamsBytes, *flags.BuildParams)
+		if err != nil {
 			return errors.Annotatef(err, "error parsing --build-params file")
 		}
-		return errors.Trace(doBuild(ctx, &bParams))
+		if *printBuildParams {
+			return errors.Trace(printBuildParamsHandler(bp))
+		}
+		return errors.Trace(doBuild(ctx, bp))
 	}
 
 	// Create map of given lib locations, via --lib flag(s)
@@ -173,24 +395,53 @@ func buildHandler(ctx context.Context, devConn dev.DevConn) error {
 		return errors.Trace(err)
 	}
 
+	depOverrides, err := getDepOverridesFromCLI()
+	if err != nil {
+		return errors.Annotatef(err, "--dep-override")
+	}
+
 	credentials, err := getCredentialsFromCLI()
 	if err != nil {
 		return errors.Annotatef(err, "error parsing --credentials")
 	}
 
+	extraSources, extraIncludes, err := getSourcesFromCLI()
+	if err != nil {
+		return errors.Annotatef(err, "--sources-file")
+	}
+
+	gitHubAPIURLs, err := getGitHubAPIURLsFromCLI()
+	if err != nil {
+		return errors.Annotatef(err, "error parsing --github-api-url")
+	}
+
+	forbiddenLibs, err := getForbiddenLibsFromCLI()
+	if err != nil {
+		return errors.Annotatef(err, "--forbid-lib-file")
+	}
+
 	libsUpdateIntvl := *flags.LibsUpdateInterval
-	if *flags.NoLibsUpdate {
+	if *flags.NoLibsUpdate || *flags.Offline {
 		libsUpdateIntvl = 0
 	}
 
 	bParams = build.BuildParams{
 		ManifestAdjustments: build.ManifestAdjustments{
 			Platform:  flags.Platform(),
+			Env:       *flags.Env,
 			BuildVars: buildVarsFromCLI,
 			CDefs:     cdefsFromCLI,
 			CFlags:    *flags.CFlagsExtra,
 			CXXFlags:  *flags.CXXFlagsExtra,
 			ExtraLibs: libsFromCLI,
+
+			MosRepoURL:   *flags.MosRepoURL,
+			DepOverrides: depOverrides,
+
+			ExtraSources:  extraSources,
+			ExtraIncludes: extraIncludes,
+
+			FailOnWarning: *flags.FailOnManifestWarning,
 		},
 		Clean:                 *flags.Clean,
 		DryRun:                *flags.BuildDryRun,
@@ -199,10 +450,14 @@ func buildHandler(ctx context.Context, devConn dev.DevConn) error {
 		CustomLibLocations:    cll,
 		CustomModuleLocations: cml,
 		LibsUpdateInterval:    libsUpdateIntvl,
+		Offline:               *flags.Offline,
 		NoPlatformCheck:       *flags.NoPlatformCheck,
 		SaveBuildStat:         *flags.SaveBuildStat,
 		PreferPrebuiltLibs:    *flags.PreferPrebuiltLibs,
+		IncludeBuildInfo:      *flags.IncludeBuildInfo,
+		ForbiddenLibs:         forbiddenLibs,
 		Credentials:           credentials,
+		GitHubAPIURLs:         gitHubAPIURLs,
 	}
 
 	if *flags.DepsVersions != "" {
@@ -218,22 +473,94 @@ func buildHandler(ctx context.Context, devConn dev.DevConn) error {
 		bParams.ManifestAdjustments.StrictDepsVersions = *flags.StrictDepsVersions
 	}
 
+	if *depsLock != "" {
+		if *flags.DepsVersions != "" {
+			return errors.Errorf("--deps-lock and --deps-versions are mutually exclusive")
+		}
+		data, err := ioutil.ReadFile(*depsLock)
+		if err != nil {
+			return errors.Annotatef(err, "error reading --deps-lock file")
+		}
+		dl, err := build.ParseDepsLock(data)
+		if err != nil {
+			return errors.Annotatef(err, "error parsing --deps-lock file")
+		}
+		bParams.ManifestAdjustments.DepsVersions = dl.DepsManifest()
+		bParams.ManifestAdjustments.StrictDepsVersions = *strictDepsLock
+	}
+
+	if *printBuildParams {
+		return errors.Trace(printBuildParamsHandler(&bParams))
+	}
+
 	return errors.Trace(doBuild(ctx, &bParams))
 }
 
-func doBuild(ctx context.Context, bParams *build.BuildParams) error {
-	var err error
-	buildDir := moscommon.GetBuildDir(projectDir)
+// printBuildParamsHandler prints the build params as YAML, in the format
+// accepted by --build-params. Passwords are redacted.
+func printBuildParamsHandler(bParams *build.BuildParams) error {
+	bp := *bParams
+	if len(bp.Credentials) > 0 {
+		bp.Credentials = map[string]build.Credentials{}
+		for host, c := range bParams.Credentials {
+			if c.Pass != "" {
+				c.Pass = "REDACTED"
+			}
+			bp.Credentials[host] = c
+		}
+	}
+	data, err := yaml.Marshal(&bp)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Print(string(data))
+	return nil
+}
 
-	if bParams.BuildTarget == "" {
-		bParams.BuildTarget = moscommon.BuildTargetDefault
+// buildSummary is printed at the end of the build with --summary-only.
+type buildSummary struct {
+	app, platform, version string
+	output                 string
+}
+
+func printBuildSummary(s *buildSummary, start time.Time, logFile string, err error) {
+	d := time.Since(start).Round(100 * time.Millisecond)
+	if code, _ := errcode.Get(err); code == errcode.BuildSkipped {
+		ourutil.Reportf("Build skipped: platform %s, %s", s.platform, d)
+		return
 	}
+	if err != nil {
+		ourutil.Reportf("Build FAILED: platform %s, %s, log: %s", s.platform, d, logFile)
+		return
+	}
+	what := fmt.Sprintf("platform %s", s.platform)
+	if s.app != "" {
+		what = fmt.Sprintf("%s/%s version %s", s.app, s.platform, s.version)
+	}
+	ourutil.Reportf("Build OK: %s, %s, output: %s", what, d, s.output)
+}
+
+func doBuild(ctx context.Context, bParams *build.BuildParams) (err error) {
+	buildDir := moscommon.GetBuildDir(projectDir)
 
 	start := time.Now()
+	summary := &buildSummary{platform: bParams.Platform}
+	if *buildSummaryOnly {
+		defer func() {
+			printBuildSummary(summary, start, moscommon.GetBuildLogFilePath(buildDir), err)
+		}()
+	}
+
+	if bParams.Offline && !*flags.Local {
+		return errors.Errorf("--offline requires --local")
+	}
+	if *traceProfile != "" && !*flags.Local {
+		return errors.Errorf("--trace-profile requires --local")
+	}
 
 	// Request server version in parallel
 	serverVersionCh := make(chan *version.VersionJson, 1)
-	if true || !*flags.Local {
+	if !bParams.Offline {
 		go func() {
 			v, err := update.GetServerMosVersion(string(update.GetUpdateChannel()), bParams.Platform, bParams.BuildVars["BOARD"])
 			if err != nil {
@@ -244,84 +571,157 @@ func doBuild(ctx context.Context, bParams *build.BuildParams) error {
 		}()
 	}
 
-	if err := os.MkdirAll(buildDir, 0777); err != nil {
-		return errors.Trace(err)
-	}
-
-	blog := moscommon.GetBuildLogFilePath(buildDir)
-	logFile, err := os.Create(blog)
-	if err != nil {
-		return errors.Trace(err)
+	var logw, reportw io.Writer = ioutil.Discard, os.Stderr
+	if *buildSummaryOnly {
+		reportw = ioutil.Discard
+	} else if bParams.Verbose {
+		logw = os.Stderr
 	}
 
-	// Remove local log, ignore any errors
-	os.RemoveAll(moscommon.GetBuildLogLocalFilePath(buildDir))
-
-	logWriterStderr = io.MultiWriter(logFile, &logBuf, os.Stderr)
-	logWriter = io.MultiWriter(logFile, &logBuf)
-
-	if bParams.Verbose {
-		logWriter = logWriterStderr
+	if *traceProfile != "" {
+		trace.Start()
+		// Written even if the build fails, the trace of a failed parse is just as useful.
+		defer func() {
+			if err := trace.Write(*traceProfile); err != nil {
+				ourutil.Reportf("Failed to write trace profile: %s", err)
+				return
+			}
+			ourutil.Freportf(reportw, "Trace profile written to %s", *traceProfile)
+		}()
 	}
 
-	// Fail fast if there is no manifest
-	if _, err := os.Stat(moscommon.GetManifestFilePath(projectDir)); os.IsNotExist(err) {
-		return errors.Errorf("No mos.yml file")
-	}
+	// When make runs with -j and we interrupt the container with Ctrl+C, make
+	// becomes a runaway process eating 100% of one CPU core. So on SIGINT or
+	// SIGTERM the build is cancelled, which kills the container. Not all the
+	// build steps can be cancelled, the second signal terminates mos.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	go func() {
+		select {
+		case <-sigCh:
+			signal.Stop(sigCh)
+			ourutil.Reportf("\nCancelling the build...")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	if *flags.Local {
-		err = buildLocal(ctx, bParams)
-	} else {
-		err = buildRemote(bParams)
+	depsVersionsFile := *depsLock
+	if depsVersionsFile == "" {
+		depsVersionsFile = *flags.DepsVersions
 	}
+	res, err := builder.Build(ctx, builder.BuildParams{
+		BuildParams:   *bParams,
+		Local:         *flags.Local,
+		Server:        *server,
+		Timeout:       *remoteBuildTimeout,
+		UploadRetries: *buildUploadRetries,
+		MakeArgsExtra: *buildCmdExtra,
+		DumpMakeVars:  *dumpMakeVars,
+		SinceGit:      *flags.SinceGit,
+		EnvFile:       *flags.EnvFile,
+		CacheManifest: *cacheLibsManifest,
+		FSCache:       *fsCache,
+		DepsGraph:     *depsJSON != "",
+
+		BuildImage:       *flags.BuildImage,
+		DockerExtra:      *flags.BuildDockerExtra,
+		DockerNoMounts:   *flags.BuildDockerNoMounts,
+		Parallelism:      *flags.BuildParalellism,
+		LibsDir:          *flags.LibsDir,
+		DepsDir:          *flags.DepsDir,
+		ModulesDir:       *flags.ModulesDir,
+		ManifestCacheDir: *flags.ManifestCacheDir,
+		KeepTempFiles:    *flags.KeepTempFiles,
+		DepsVersionsFile: depsVersionsFile,
+
+		Logger: builder.NewLogger(logw, reportw),
+	})
 	if err != nil {
+		printBuildLogOnFailure(res, bParams.Verbose, err)
 		return errors.Trace(err)
 	}
+	if !*flags.Local && bParams.Verbose {
+		printBuildLog(res.LogPath)
+	}
 	if bParams.DryRun {
 		return nil
 	}
 
-	if bParams.BuildTarget == moscommon.BuildTargetDefault {
-		// We were building a firmware, so perform the required actions with moving
-		// firmware around, etc.
-		fwFilename := moscommon.GetFirmwareZipFilePath(buildDir)
+	if fw := res.Firmware; fw != nil {
+		summary.app, summary.platform, summary.version = fw.Name, fw.Platform, fw.Version
+		summary.output = res.FirmwarePath
 
-		fw, err := fwbundle.ReadZipFirmwareBundle(fwFilename)
-		if err != nil {
-			return errors.Trace(err)
+		if fw.Platform == hostPlatform {
+			exe, err := extractHostExecutable(fw, buildDir)
+			if err != nil {
+				return errors.Annotatef(err, "failed to extract host executable")
+			}
+			ourutil.Freportf(reportw, "Host executable saved to %s, use \"mos run\" to run it", exe)
 		}
 
-		end := time.Now()
+		if err := checkFWSize(fw, logw); err != nil {
+			return errors.Trace(err)
+		}
 
-		if bParams.SaveBuildStat {
-			bstat := moscommon.BuildStat{
-				ArchOld:     fw.Platform,
-				Platform:    fw.Platform,
-				AppName:     fw.Name,
-				BuildTimeMS: int(end.Sub(start) / time.Millisecond),
+		if *sizeReport {
+			if err := printSizeReport(fw, buildDir); err != nil {
+				return errors.Annotatef(err, "failed to generate size report")
 			}
+		}
 
-			data, err := json.MarshalIndent(&bstat, "", "  ")
-			if err != nil {
+		if *sizeBaseline != "" {
+			if err := compareSizeWithBaseline(fw, buildDir, reportw); err != nil {
 				return errors.Trace(err)
 			}
+		}
 
-			ioutil.WriteFile(moscommon.GetBuildStatFilePath(buildDir), data, 0666)
+		if *symbolSizes != "" {
+			if res.MapFile == "" {
+				return errors.Errorf("--symbol-sizes: linker map file is not available")
+			}
+			if err := writeSymbolSizes(res.MapFile, *symbolSizes); err != nil {
+				return errors.Annotatef(err, "failed to write symbol sizes")
+			}
+			ourutil.Freportf(reportw, "Symbol sizes written to %s", *symbolSizes)
+		}
+
+		if *flags.Output != "" {
+			if err := copyBuildOutput(res.FirmwarePath, *flags.Output); err != nil {
+				return errors.Annotatef(err, "failed to copy firmware to %s", *flags.Output)
+			}
+			ourutil.Freportf(reportw, "Firmware copied to %s", *flags.Output)
+			summary.output = *flags.Output
 		}
+	} else if res.LibPath != "" {
+		summary.output = res.LibPath
 
-		if *flags.Local || !bParams.Verbose {
-			if err == nil {
-				freportf(logWriter, "Success, built %s/%s version %s (%s).", fw.Name, fw.Platform, fw.Version, fw.BuildID)
+		if *libOutput != "" {
+			if err := copyBuildOutput(res.LibPath, *libOutput); err != nil {
+				return errors.Annotatef(err, "failed to copy lib to %s", *libOutput)
 			}
+			ourutil.Freportf(reportw, "Lib copied to %s", *libOutput)
+		}
+	}
 
-			fullPath, _ := filepath.Abs(fwFilename)
-			freportf(logWriterStderr, "Firmware saved to %s", fullPath)
+	if *depsManifestOut != "" {
+		if res.Deps == nil {
+			return errors.Errorf("deps manifest is not available")
+		}
+		if err := writeDepsManifest(res.Deps, *depsManifestOut, *flags.Format); err != nil {
+			return errors.Annotatef(err, "failed to write deps manifest to %s", *depsManifestOut)
 		}
-	} else if p := moscommon.GetOrigLibArchiveFilePath(buildDir, bParams.Platform); bParams.BuildTarget == p {
-		freportf(logWriterStderr, "Lib saved to %s", moscommon.GetLibArchiveFilePath(buildDir))
-	} else {
-		// We were building some custom target, so just report that we succeeded.
-		freportf(logWriterStderr, "Target %s is built successfully", bParams.BuildTarget)
+		ourutil.Freportf(reportw, "Deps manifest written to %s", *depsManifestOut)
+	}
+
+	if *depsJSON != "" && res.DepsGraph != nil {
+		if err := writeDepsJSON(res.DepsGraph, *depsJSON); err != nil {
+			return errors.Annotatef(err, "failed to write deps graph to %s", *depsJSON)
+		}
+		ourutil.Freportf(reportw, "Deps graph written to %s", *depsJSON)
 	}
 
 	// If received server version, compare it with the local one and notify the
@@ -333,13 +733,340 @@ func doBuild(ctx context.Context, bParams *build.BuildParams) error {
 
 		if (update.GetUpdateChannel() == update.UpdateChannelRelease && serverVer != localVer) ||
 			(update.GetUpdateChannel() == update.UpdateChannelLatest && strings.Compare(serverVer, localVer) > 0) {
-			freportf(logWriterStderr, "By the way, there is a newer version available: %q (you use %q). "+
+			ourutil.Freportf(reportw, "By the way, there is a newer version available: %q (you use %q). "+
 				`Run "mos update" to upgrade.`, serverVer, localVer)
 		}
 	default:
 	}
 
-	return err
+	return nil
+}
+
+// printBuildLogOnFailure prints the build log if the build failed and the log
+// was not shown already: for local builds it's shown with --verbose, remote
+// build log is only available after the build.
+func printBuildLogOnFailure(res *builder.BuildResult, verbose bool, err error) {
+	if res == nil || res.LogPath == "" {
+		return
+	}
+	code, _ := errcode.Get(err)
+	if *flags.Local {
+		if !verbose && code != errcode.BuildSkipped {
+			printBuildLog(res.LogPath)
+		}
+	} else if code == errcode.BuildFailed {
+		printBuildLog(res.LogPath)
+	}
+}
+
+func printBuildLog(fname string) {
+	log, err := os.Open(fname)
+	if err != nil {
+		glog.Errorf("can't read build log: %s", err)
+		return
+	}
+	defer log.Close()
+	io.Copy(os.Stdout, log)
+}
+
+func getSizeReport(fw *fwbundle.FirmwareBundle, buildDir string, maxObjects int) (*size_report.Report, error) {
+	objsDir := moscommon.GetObjectDir(buildDir)
+	elfFile := ""
+	for _, try := range []string{"fw.elf", fmt.Sprintf("%s.elf", fw.Name)} {
+		if _, err := os.Stat(filepath.Join(objsDir, try)); err == nil {
+			elfFile = filepath.Join(objsDir, try)
+			break
+		}
+	}
+	r, err := size_report.GetReport(fw, elfFile, size_report.FindMapFile(objsDir), maxObjects)
+	return r, errors.Trace(err)
+}
+
+// printSizeReport prints the size breakdown of the firmware which was just
+// built to stdout.
+func printSizeReport(fw *fwbundle.FirmwareBundle, buildDir string) error {
+	r, err := getSizeReport(fw, buildDir, *sizeReportObjects)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if *jsonOutput {
+		return errors.Trace(r.WriteJSON(os.Stdout))
+	}
+	return errors.Trace(r.WriteText(os.Stdout))
+}
+
+// writeSymbolSizes parses the linker map file and writes the symbol sizes CSV.
+func writeSymbolSizes(mapFile, fname string) error {
+	f, err := os.Open(mapFile)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	syms, err := size_report.ParseMapFileSymbols(f)
+	if err != nil {
+		return errors.Annotatef(err, "%s", mapFile)
+	}
+	out, err := os.Create(fname)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := size_report.WriteSymbolSizesCSV(out, syms); err != nil {
+		out.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(out.Close())
+}
+
+// compareSizeWithBaseline prints size deltas against --size-baseline and
+// fails if any of them exceeds --size-regression-threshold.
+func compareSizeWithBaseline(fw *fwbundle.FirmwareBundle, buildDir string, w io.Writer) error {
+	threshold, err := size_report.ParseThreshold(*sizeRegression)
+	if err != nil {
+		return errors.Annotatef(err, "--size-regression-threshold")
+	}
+	base, err := size_report.ReadReport(*sizeBaseline)
+	if err != nil {
+		return errors.Annotatef(err, "--size-baseline")
+	}
+	cur, err := getSizeReport(fw, buildDir, 0)
+	if err != nil {
+		return errors.Annotatef(err, "failed to generate size report")
+	}
+	freportf(w, "Size compared to %s:", *sizeBaseline)
+	exceeded, err := size_report.WriteDiff(w, size_report.Compare(base, cur), threshold)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(exceeded) > 0 {
+		var names []string
+		for _, d := range exceeded {
+			names = append(names, fmt.Sprintf("%s (%+d)", d.Name, d.Diff()))
+		}
+		return errors.Errorf("size regression exceeds %s: %s", threshold, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// getAppPart returns the part named "app" or, failing that, the first part
+// of type "app".
+func getAppPart(fw *fwbundle.FirmwareBundle) *fwbundle.FirmwarePart {
+	if app := fw.Parts["app"]; app != nil {
+		return app
+	}
+	for _, p := range fw.PartsByAddr() {
+		if p.Type == "app" {
+			return p
+		}
+	}
+	return nil
+}
+
+// checkFWSize verifies that the app part of the firmware fits into the size
+// budget given by --max-fw-size and --max-fw-size-pct.
+func checkFWSize(fw *fwbundle.FirmwareBundle, logWriter io.Writer) error {
+	if *maxFWSize <= 0 && *maxFWSizePct <= 0 {
+		return nil
+	}
+	app := getAppPart(fw)
+	if app == nil {
+		return errors.Errorf("no app part in the firmware, cannot check its size")
+	}
+	data, err := fw.GetPartData(app.Name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	size := int64(len(data))
+
+	limit, limitDescr := *maxFWSize, fmt.Sprintf("--max-fw-size %d", *maxFWSize)
+	if *maxFWSizePct > 0 {
+		if app.ESP32PartitionName == "" {
+			return errors.Errorf("--max-fw-size-pct: app partition size is unknown for %s", fw.Platform)
+		}
+		pti, err := esp32.GetPartitionInfo(fw, app.ESP32PartitionName)
+		if err != nil {
+			return errors.Annotatef(err, "--max-fw-size-pct")
+		}
+		pctLimit := int64(float64(pti.Pos.Size) * *maxFWSizePct / 100)
+		if limit <= 0 || pctLimit < limit {
+			limit = pctLimit
+			limitDescr = fmt.Sprintf("%g%% of %d bytes partition %q", *maxFWSizePct, pti.Pos.Size, app.ESP32PartitionName)
+		}
+	}
+
+	if size > limit {
+		return errors.Errorf("%s is %d bytes, which exceeds the limit of %d bytes (%s) by %d bytes",
+			app.Name, size, limit, limitDescr, size-limit)
+	}
+	freportf(logWriter, "%s size: %d bytes, limit: %d bytes (%s)", app.Name, size, limit, limitDescr)
+	return nil
+}
+
+// copyBuildOutput copies the build artifact to the location given by the
+// user, creating parent directories as needed.
+func copyBuildOutput(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return errors.Trace(err)
+	}
+	// Existing file may be a link to a previous artifact, don't overwrite that.
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ourio.CopyFile(src, dst))
+}
+
+func writeDepsManifest(dm *build.DepsManifest, fname, format string) error {
+	var data []byte
+	var err error
+	switch format {
+	case "", "yaml":
+		data, err = yaml.Marshal(dm)
+	case "json":
+		data, err = json.MarshalIndent(dm, "", "  ")
+		data = append(data, '\n')
+	default:
+		return errors.Errorf("invalid --format %q, must be yaml or json", format)
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(fname), 0777); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(fname, data, 0666))
+}
+
+func writeDepsJSON(g *manifest_parser.DepsGraph, fname string) error {
+	var buf bytes.Buffer
+	if err := g.WriteJSON(&buf); err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(fname), 0777); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(fname, buf.Bytes(), 0666))
+}
+
+// printEffectiveLibsHandler prints names of the libs included into the build
+// after all conds are expanded, one per line, sorted by name, so that sets
+// produced for different boards can be compared directly.
+func printEffectiveLibsHandler() error {
+	manifest, _, _, err := readFinalManifestFromFlags()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var libs []string
+	for _, lh := range manifest.LibsHandled {
+		name, err := lh.Lib.GetName()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if lh.Lib.Variant != "" {
+			name = fmt.Sprintf("%s (%s)", name, lh.Lib.Variant)
+		}
+		libs = append(libs, name)
+	}
+	sort.Strings(libs)
+
+	for _, l := range libs {
+		fmt.Println(l)
+	}
+
+	return nil
+}
+
+// listBoardsHandler prints the BOARD values that the boards lib used by the
+// app has conds for, on the app's platform.
+func listBoardsHandler() error {
+	manifest, _, interp, err := readFinalManifestFromFlags()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	boards, ok, err := manifest_parser.GetBoards(manifest, interp)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !ok {
+		return errors.Errorf("the app does not use the boards lib")
+	}
+	if len(boards) == 0 {
+		ourutil.Reportf("No boards defined for %s", manifest.Platform)
+	}
+	for _, b := range boards {
+		fmt.Println(b)
+	}
+	return nil
+}
+
+// explainInitDepsHandler prints, for the app and each lib, its init deps and
+// where they come from: init_after / init_before (explicit) or dependencies
+// and core (implicit), and whether implicit deps were disabled with
+// no_implicit_init_deps.
+func explainInitDepsHandler() error {
+	manifest, _, _, err := readFinalManifestFromFlags()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	writeInitDepsExplanation(os.Stdout, manifest)
+	return nil
+}
+
+func writeInitDepsExplanation(w io.Writer, manifest *build.FWAppManifest) {
+	nodes := append([]string{manifest_parser.DepsApp}, manifest.InitDeps...)
+	info := map[string]*build.InitDepsInfo{}
+	for _, n := range nodes {
+		info[n] = &build.InitDepsInfo{}
+		if idi := manifest.InitDepsInfo[n]; idi != nil {
+			*info[n] = *idi
+		}
+	}
+	// init_before entries can be globs or names of libs that are not present,
+	// attribute them to the matching libs.
+	var unmatched []string
+	for n, idi := range manifest.InitDepsInfo {
+		if info[n] != nil {
+			continue
+		}
+		matched := false
+		for _, ln := range manifest.InitDeps {
+			if m, _ := path.Match(n, ln); m {
+				info[ln].Explicit = append(info[ln].Explicit, idi.Explicit...)
+				matched = true
+			}
+		}
+		if !matched {
+			unmatched = append(unmatched, n)
+		}
+	}
+	sort.Strings(unmatched)
+
+	fmtDeps := func(deps []build.InitDep) string {
+		var parts []string
+		for _, d := range deps {
+			parts = append(parts, fmt.Sprintf("%s (%s)", d.Name, d.Reason))
+		}
+		return strings.Join(parts, ", ")
+	}
+	for _, n := range nodes {
+		idi := info[n]
+		fmt.Fprintln(w, n)
+		if len(idi.Explicit) > 0 {
+			fmt.Fprintf(w, "  explicit: %s\n", fmtDeps(idi.Explicit))
+		}
+		if idi.ImplicitSuppressed {
+			fmt.Fprintf(w, "  implicit: suppressed (no_implicit_init_deps)\n")
+		} else if len(idi.Implicit) > 0 {
+			fmt.Fprintf(w, "  implicit: %s\n", fmtDeps(idi.Implicit))
+		}
+		if len(idi.Explicit) == 0 && len(idi.Implicit) == 0 && !idi.ImplicitSuppressed {
+			fmt.Fprintf(w, "  no init deps\n")
+		}
+	}
+	if len(unmatched) > 0 {
+		fmt.Fprintf(w, "\nIgnored init_before entries (no matching libs): %s\n", strings.Join(unmatched, ", "))
+	}
+	fmt.Fprintf(w, "\nInit order: %s\n", strings.Join(manifest.InitDeps, ", "))
 }
 
 func parseVarsSlice(varsSlice []string, vars map[string]string) error {
@@ -393,47 +1120,27 @@ func getLibsFromCLI() ([]build.SWModule, error) {
 		}
 		res = append(res, m)
 	}
-	return res, nil
-}
-
-type fileTransformer func(r io.ReadCloser) (io.ReadCloser, error)
-
-func fixupAppName(appName string) (string, error) {
-	if appName == "" {
-		wd, err := getCodeDirAbs()
+	for _, dir := range *flags.LibsExtraDir {
+		entries, err := ioutil.ReadDir(dir)
 		if err != nil {
-			return "", errors.Trace(err)
+			return nil, errors.Annotatef(err, "invalid --lib-extra-dir value %q", dir)
 		}
-		appName = filepath.Base(wd)
-	}
-
-	for _, c := range appName {
-		if unicode.IsSpace(c) {
-			return "", errors.Errorf("app name (%q) should not contain spaces", appName)
-		}
-	}
-
-	return appName, nil
-}
-
-func getCodeDirAbs() (string, error) {
-	absCodeDir, err := filepath.Abs(projectDir)
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-
-	absCodeDir, err = filepath.EvalSymlinks(absCodeDir)
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-
-	for _, c := range absCodeDir {
-		if unicode.IsSpace(c) {
-			return "", errors.Errorf("code dir (%q) should not contain spaces", absCodeDir)
+		// ReadDir returns entries sorted by name, so the order is stable.
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			libDir, err := filepath.Abs(filepath.Join(dir, e.Name()))
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if _, err := os.Stat(moscommon.GetManifestFilePath(libDir)); err != nil {
+				continue
+			}
+			res = append(res, build.SWModule{Location: libDir})
 		}
 	}
-
-	return absCodeDir, nil
+	return res, nil
 }
 
 func isURL(s string) bool {
@@ -461,237 +1168,3 @@ func getCustomLocations(entries []string) (map[string]string, error) {
 	}
 	return res, nil
 }
-
-func newMosVars() *interpreter.MosVars {
-	ret := interpreter.NewMosVars()
-	ret.SetVar(interpreter.GetMVarNameMosVersion(), version.GetMosVersion())
-	return ret
-}
-
-// manifest_parser.ComponentProvider implementation {{{
-type compProviderReal struct {
-	bParams   *build.BuildParams
-	logWriter io.Writer
-}
-
-func (lpr *compProviderReal) GetLibLocalPath(
-	m *build.SWModule, rootAppDir, libsDefVersion, platform string,
-) (string, error) {
-
-	name, err := m.GetName()
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-
-	creds := lpr.bParams.GetCredentialsForHost(m.GetHostName())
-	m.SetCredentials(creds)
-
-	gitinst := mosgit.NewOurGit(build.BuildCredsToGitCreds(creds))
-
-	appDir, err := getCodeDirAbs()
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-
-	// --lib has the highest precedence.
-	customLoc, ok := lpr.bParams.CustomLibLocations[name]
-	if ok && !isURL(customLoc) {
-		ourutil.Freportf(lpr.logWriter, "%s: Using %q (--lib)", name, customLoc)
-		return customLoc, nil
-	}
-
-	// Check --libs-dir.
-	if !ok && len(*flags.LibsDir) > 0 {
-		name2, _ := m.GetName2()
-		for _, libsDir := range *flags.LibsDir {
-			libDir := filepath.Join(libsDir, name2)
-			glog.V(2).Infof("%s (%s): Trying %s...", name, name2, libDir)
-			if fi, err := os.Stat(libDir); err == nil && fi.IsDir() {
-				ourutil.Freportf(lpr.logWriter, "%s: Using %q (--libs-dir)", name, libDir)
-				return libDir, nil
-			}
-		}
-	}
-
-	// Check for version overrides.
-	if lpr.bParams.ManifestAdjustments.DepsVersions != nil {
-		dve := lpr.bParams.ManifestAdjustments.DepsVersions.FindLibEntry(name)
-		if dve == nil {
-			ourutil.Reportf("%s: No deps manifest entry found [%s]", name, m.Location)
-			if lpr.bParams.StrictDepsVersions {
-				return "", fmt.Errorf("no dep manifest entry found for %q [%s] (strict mode)", name, m.Location)
-			}
-		} else {
-			if dve.RepoVersion != "" {
-				glog.V(1).Infof("%s: forcing version %s", name, dve.RepoVersion)
-				m.SetVersionOverride(dve.RepoVersion)
-			}
-		}
-	}
-
-	// Try to fetch into --deps-dir.
-	if ok {
-		m.Location = customLoc
-	}
-	libDirAbs := ""
-	depsDir := paths.GetDepsDir(appDir)
-	for {
-		localDir, err := m.GetLocalDir(depsDir, libsDefVersion)
-		if err != nil {
-			return "", errors.Trace(err)
-		}
-
-		updateIntvl := lpr.bParams.LibsUpdateInterval
-
-		// Try to get current hash, ignoring errors
-		curHash := ""
-		if m.GetType() == build.SWModuleTypeGit {
-			curHash, _ = gitinst.GetCurrentHash(localDir)
-		}
-
-		libDirAbs, err = m.PrepareLocalDir(depsDir, lpr.logWriter, true, libsDefVersion, updateIntvl, 0)
-		if err != nil {
-			if m.Version == "" && libsDefVersion != "latest" {
-				// We failed to fetch lib at the default version (mos.version),
-				// which is not "latest", and the lib in manifest does not have
-				// version specified explicitly. This might happen when some
-				// latest app is built with older mos tool.
-
-				serverVersion := libsDefVersion
-				v, err := update.GetServerMosVersion(string(update.GetUpdateChannel()))
-				if err == nil {
-					serverVersion = v.BuildVersion
-				}
-
-				ourutil.Freportf(logWriterStderr,
-					"WARNING: the lib %q does not have version %s. Resorting to latest, but the build might fail.\n"+
-						"It usually happens if you clone the latest version of some example app, and try to build it with the mos tool which is older than the lib (in this case, %q).", name, libsDefVersion, name,
-				)
-
-				if serverVersion != version.GetMosVersion() {
-					// There is a newer version of the mos tool available, so
-					// suggest upgrading.
-
-					ourutil.Freportf(logWriterStderr,
-						"There is a newer version of the mos tool available: %s, try to update mos tool (mos update), and build again. "+
-							"Alternatively, you can build the version %s of the app (git checkout %s).", serverVersion, libsDefVersion, libsDefVersion,
-					)
-				} else {
-					// Current mos is at the newest released version, so the only
-					// alternatives are: build older (released) version of the app,
-					// or use latest mos.
-
-					ourutil.Freportf(logWriterStderr,
-						"Consider using the version %s of the app (git checkout %s), or using latest mos tool (mos update latest).", libsDefVersion, libsDefVersion,
-					)
-				}
-
-				// In any case, retry with the latest lib version and cross fingers.
-
-				libsDefVersion = "latest"
-				continue
-			}
-			return "", errors.Annotatef(err, "%s: preparing local copy", name)
-		}
-
-		if m.GetType() == build.SWModuleTypeGit && updateIntvl != 0 {
-			if newHash, _, err := m.GetRepoVersion(); err == nil && newHash != curHash {
-				freportf(logWriter, "%s: Hash is updated: %s -> %s", name, curHash, newHash)
-				// The current repo hash has changed after the pull, so we need to
-				// vanish binary lib(s) we might have downloaded before
-				bLibs, _ := filepath.Glob(moscommon.GetBinaryLibFilePath(moscommon.GetBuildDir(appDir), name, "*", "*"))
-				for _, bl := range bLibs {
-					if os.Remove(bl) == nil {
-						freportf(logWriterStderr, "%s: Removed %s because the repo has been updated", name, bl)
-					}
-				}
-			} else {
-				freportf(logWriter, "%s: Hash unchanged at %s (dir %q)", name, curHash, libDirAbs)
-			}
-		}
-
-		break
-	}
-	ourutil.Freportf(lpr.logWriter, "%s: Prepared local dir: %q", name, libDirAbs)
-
-	return libDirAbs, nil
-}
-
-func (lpr *compProviderReal) GetModuleLocalPath(
-	m *build.SWModule, rootAppDir, modulesDefVersion, platform string,
-) (string, error) {
-	name, err := m.GetName()
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-
-	m.SetCredentials(lpr.bParams.GetCredentialsForHost(m.GetHostName()))
-
-	customLoc, ok := lpr.bParams.CustomModuleLocations[name]
-	if ok && !isURL(customLoc) {
-		freportf(logWriter, "Using module %q located at %q", name, customLoc)
-	}
-
-	if ok {
-		m.Location = customLoc
-	}
-
-	// Check for version overrides.
-	if lpr.bParams.ManifestAdjustments.DepsVersions != nil {
-		dve := lpr.bParams.ManifestAdjustments.DepsVersions.FindModuleEntry(name)
-		if dve == nil {
-			ourutil.Reportf("%s: No deps manifest entry found [%s]", name, m.Location)
-			if lpr.bParams.StrictDepsVersions {
-				return "", fmt.Errorf("no dep manifest entry found for %q [%s] (strict mode)", name, m.Location)
-			}
-		} else {
-			if dve.RepoVersion != "" {
-				glog.V(1).Infof("%s: forcing version %s", name, dve.RepoVersion)
-				m.SetVersionOverride(dve.RepoVersion)
-			}
-		}
-	}
-
-	// Custom module location wasn't provided on the command line, so, we'll
-	// use the module name and will clone/pull it if necessary
-	freportf(logWriter, "%s: Going to fetch module from %s", name, m.Location)
-
-	appDir, err := getCodeDirAbs()
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-
-	updateIntvl := lpr.bParams.LibsUpdateInterval
-
-	targetDir, err := m.PrepareLocalDir(paths.GetModulesDir(appDir), logWriter, true, modulesDefVersion, updateIntvl, 0)
-	if err != nil {
-		return "", errors.Annotatef(err, "preparing local copy of the module %q", name)
-	}
-
-	return targetDir, nil
-}
-
-// }}}
-
-// Thread-safe bytes.Buffer {{{
-
-type threadSafeBuffer struct {
-	buf bytes.Buffer
-	mtx sync.Mutex
-}
-
-func (b *threadSafeBuffer) Write(p []byte) (n int, err error) {
-	b.mtx.Lock()
-	defer b.mtx.Unlock()
-
-	return b.buf.Write(p)
-}
-
-func (b *threadSafeBuffer) Bytes() []byte {
-	b.mtx.Lock()
-	defer b.mtx.Unlock()
-
-	return b.buf.Bytes()
-}
-
-// }}}
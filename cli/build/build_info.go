@@ -0,0 +1,97 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package build
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BuildInfoFileName is the name of the build info file in the device
+// filesystem, see --include-build-info.
+const BuildInfoFileName = "build_info.json"
+
+// BuildInfo is the content of the build info file.
+type BuildInfo struct {
+	App            string            `json:"app"`
+	Version        string            `json:"version"`
+	BuildID        string            `json:"build_id"`
+	BuildTimestamp string            `json:"build_timestamp"`
+	GitHash        string            `json:"git_hash,omitempty"`
+	GitDirty       bool              `json:"git_dirty,omitempty"`
+	Libs           map[string]string `json:"libs,omitempty"`
+}
+
+// GitInfo describes the state of the app's git repo. It is collected where
+// the app's repo is, i.e. on the client for remote builds.
+type GitInfo struct {
+	// Output of git describe --tags --always.
+	Describe string `yaml:"describe" json:"describe"`
+	// Current branch, empty if HEAD is detached.
+	Branch string `yaml:"branch,omitempty" json:"branch,omitempty"`
+	Hash   string `yaml:"hash" json:"hash"`
+	Dirty  bool   `yaml:"dirty,omitempty" json:"dirty,omitempty"`
+}
+
+// GenerateBuildInfo returns the build info for the manifest. gi is nil if
+// the app is not in a git repo. Build id is derived the same way as by
+// fw_meta.py gen_build_info, which generates the build id of the firmware.
+func GenerateBuildInfo(manifest *FWAppManifest, gi *GitInfo, ts time.Time) *BuildInfo {
+	ts = ts.UTC()
+	bi := &BuildInfo{
+		App:            manifest.Name,
+		Version:        manifest.Version,
+		BuildTimestamp: ts.Format(time.RFC3339),
+		Libs:           map[string]string{},
+	}
+	bi.BuildID = ts.Format("20060102-150405")
+	if gi != nil && gi.Describe != "" {
+		bi.GitHash, bi.GitDirty = gi.Hash, gi.Dirty
+		headHash := gi.Hash
+		if len(headHash) > 7 {
+			headHash = headHash[:7]
+		}
+		var parts []string
+		// Most recent tag + offset.
+		if !strings.HasPrefix(gi.Describe, headHash) {
+			parts = append(parts, gi.Describe)
+		}
+		// Current hash, it is not there if HEAD is exactly at the tag.
+		if !strings.Contains(gi.Describe, headHash) || strings.HasPrefix(gi.Describe, headHash) {
+			parts = append(parts, fmt.Sprintf("g%s", headHash))
+		}
+		if gi.Branch != "" {
+			parts = append(parts, gi.Branch)
+		}
+		if gi.Dirty {
+			parts = append(parts, "dirty")
+		}
+		bi.BuildID += "/" + strings.Join(parts, "-")
+	}
+	for _, lh := range manifest.LibsHandled {
+		v := lh.RepoVersion
+		if v == "" {
+			v = lh.Version
+		}
+		if lh.RepoDirty {
+			v += "-dirty"
+		}
+		bi.Libs[lh.Lib.Name] = v
+	}
+	return bi
+}
@@ -0,0 +1,59 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package build
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGenerateBuildInfo(t *testing.T) {
+	m := &FWAppManifest{
+		AppManifest: AppManifest{Name: "app", Version: "1.2"},
+		LibsHandled: []FWAppManifestLibHandled{
+			{Lib: SWModule{Name: "core"}, Version: "2.20.0", RepoVersion: "0123456789abcdef"},
+			{Lib: SWModule{Name: "local"}, Version: "latest", RepoDirty: true},
+		},
+	}
+	ts := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	bi := GenerateBuildInfo(m, nil, ts)
+	if bi.BuildID != "20210304-050607" || bi.BuildTimestamp != "2021-03-04T05:06:07Z" {
+		t.Errorf("unexpected build id / timestamp: %q %q", bi.BuildID, bi.BuildTimestamp)
+	}
+	if bi.Libs["core"] != "0123456789abcdef" || bi.Libs["local"] != "latest-dirty" {
+		t.Errorf("unexpected libs: %+v", bi.Libs)
+	}
+
+	// Examples from fw_meta.py gen_build_info.
+	for _, c := range []struct {
+		gi      GitInfo
+		buildID string
+	}{
+		{GitInfo{Describe: "c2393b3", Hash: "c2393b3d0a", Branch: "master"}, "20210304-050607/gc2393b3-master"},
+		{GitInfo{Describe: "c2393b3", Hash: "c2393b3d0a", Branch: "master", Dirty: true}, "20210304-050607/gc2393b3-master-dirty"},
+		{GitInfo{Describe: "2.0.0", Hash: "c2393b3d0a", Branch: "master"}, "20210304-050607/2.0.0-gc2393b3-master"},
+		{GitInfo{Describe: "2.0.0", Hash: "c2393b3d0a", Branch: "master", Dirty: true}, "20210304-050607/2.0.0-gc2393b3-master-dirty"},
+		{GitInfo{Describe: "2.0.0-1-g02e78c7", Hash: "02e78c7f1e", Branch: "master"}, "20210304-050607/2.0.0-1-g02e78c7-master"},
+		{GitInfo{Describe: "2.0.0-1-g02e78c7", Hash: "02e78c7f1e"}, "20210304-050607/2.0.0-1-g02e78c7"},
+	} {
+		bi = GenerateBuildInfo(m, &c.gi, ts)
+		if bi.BuildID != c.buildID || bi.GitHash != c.gi.Hash || bi.GitDirty != c.gi.Dirty {
+			t.Errorf("%+v: unexpected build id / hash: %q %q", c.gi, bi.BuildID, bi.GitHash)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package build
+
+import (
+	"sort"
+
+	"github.com/juju/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DepsLock pins libs and modules to exact versions, normally git hashes:
+// name -> version.
+type DepsLock map[string]string
+
+// ParseDepsLock parses a deps lock file, a YAML map of name -> version.
+func ParseDepsLock(data []byte) (DepsLock, error) {
+	var dl DepsLock
+	if err := yaml.UnmarshalStrict(data, &dl); err != nil {
+		return nil, errors.Trace(err)
+	}
+	for name, v := range dl {
+		if v == "" {
+			return nil, errors.Errorf("%s: version is empty", name)
+		}
+	}
+	return dl, nil
+}
+
+// DepsManifest returns the deps manifest with the repo version requirements,
+// as used by ManifestAdjustments.DepsVersions. Each entry applies to both
+// a lib and a module with that name. The lock does not record binary blobs,
+// so they are not validated.
+func (dl DepsLock) DepsManifest() *DepsManifest {
+	dm := &DepsManifest{ManifestVersion: DepsManifestVersion, NoBlobs: true}
+	names := make([]string, 0, len(dl))
+	for name := range dl {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dm.Libs = append(dm.Libs, &DepsManifestEntry{Name: name, RepoVersion: dl[name]})
+		dm.Modules = append(dm.Modules, &DepsManifestEntry{Name: name, RepoVersion: dl[name]})
+	}
+	return dm
+}
+
+// DepsLockFromManifest returns the lock with the current repo versions of the
+// libs (LibsHandled) and modules of the resolved manifest. Names of the libs
+// and modules without a repo version (e.g. not git checkouts) and with local
+// changes are also returned, the lock can't reproduce them.
+func DepsLockFromManifest(manifest *FWAppManifest) (dl DepsLock, unpinned, dirty []string) {
+	dl = DepsLock{}
+	add := func(name, rv string, isDirty bool) {
+		if rv == "" {
+			unpinned = append(unpinned, name)
+			return
+		}
+		if isDirty {
+			dirty = append(dirty, name)
+		}
+		dl[name] = rv
+	}
+	for _, lh := range manifest.LibsHandled {
+		add(lh.Lib.Name, lh.RepoVersion, lh.RepoDirty)
+	}
+	for _, m := range manifest.Modules {
+		rv, isDirty, _ := m.GetRepoVersion()
+		add(m.Name, rv, isDirty)
+	}
+	sort.Strings(unpinned)
+	sort.Strings(dirty)
+	return dl, unpinned, dirty
+}
+
+// Marshal returns the lock in the format accepted by ParseDepsLock.
+func (dl DepsLock) Marshal() ([]byte, error) {
+	// yaml.v2 sorts map keys.
+	data, err := yaml.Marshal(map[string]string(dl))
+	return data, errors.Trace(err)
+}
@@ -0,0 +1,106 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package build
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDepsLock(t *testing.T) {
+	dl, err := ParseDepsLock([]byte("core: 0123abcd\nmongoose-os: 4567ef01\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := dl.DepsManifest()
+	if e := dm.FindLibEntry("core"); e == nil || e.RepoVersion != "0123abcd" {
+		t.Errorf("unexpected lib entry %+v", e)
+	}
+	if e := dm.FindModuleEntry("mongoose-os"); e == nil || e.RepoVersion != "4567ef01" {
+		t.Errorf("unexpected module entry %+v", e)
+	}
+	if e := dm.FindLibEntry("wifi"); e != nil {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	if _, err := ParseDepsLock([]byte("core: \"\"\n")); err == nil {
+		t.Errorf("empty version must be rejected")
+	}
+	if _, err := ParseDepsLock([]byte("- core\n")); err == nil {
+		t.Errorf("list must be rejected")
+	}
+}
+
+func TestDepsLockFromManifest(t *testing.T) {
+	mos := SWModule{Name: "mongoose-os"}
+	mos.SetLocalPathAndRepoVersion("/deps/mongoose-os", "4567ef01", false)
+	manifest := &FWAppManifest{
+		LibsHandled: []FWAppManifestLibHandled{
+			{Lib: SWModule{Name: "core"}, RepoVersion: "0123abcd"},
+			{Lib: SWModule{Name: "wifi"}, RepoVersion: "89abcdef", RepoDirty: true},
+			{Lib: SWModule{Name: "local_lib"}},
+		},
+		Modules: []SWModule{mos},
+	}
+	dl, unpinned, dirty := DepsLockFromManifest(manifest)
+	if exp := (DepsLock{"core": "0123abcd", "wifi": "89abcdef", "mongoose-os": "4567ef01"}); !reflect.DeepEqual(dl, exp) {
+		t.Errorf("expected %v, got %v", exp, dl)
+	}
+	if !reflect.DeepEqual(unpinned, []string{"local_lib"}) {
+		t.Errorf("unexpected unpinned %v", unpinned)
+	}
+	if !reflect.DeepEqual(dirty, []string{"wifi"}) {
+		t.Errorf("unexpected dirty %v", dirty)
+	}
+	data, err := dl.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "core: 0123abcd\nmongoose-os: 4567ef01\nwifi: 89abcdef\n"; string(data) != exp {
+		t.Errorf("expected %q, got %q", exp, data)
+	}
+	dl2, err := ParseDepsLock(data)
+	if err != nil || !reflect.DeepEqual(dl2, dl) {
+		t.Errorf("round trip failed: %v %v", dl2, err)
+	}
+}
+
+func TestDepsLockBinaryLib(t *testing.T) {
+	dl := DepsLock{"core": "0123abcd", "ota-common": "89abcdef"}
+	have := &DepsManifest{
+		Libs: []*DepsManifestEntry{
+			{Name: "core", RepoVersion: "0123abcd"},
+			{Name: "ota-common", Version: "1.2", RepoVersion: "89abcdef", Blobs: []*DepsBlobEntry{
+				{Name: "lib_ota-common.a", Size: 1234, SHA256: "0000"},
+			}},
+		},
+	}
+	if err := ValidateDepsRequirements(have, dl.DepsManifest()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	have.Libs[1].RepoVersion = "fedcba98"
+	if err := ValidateDepsRequirements(have, dl.DepsManifest()); err == nil {
+		t.Errorf("expected a repo version mismatch")
+	}
+	// Full deps manifests still check the blobs.
+	want := &DepsManifest{Libs: []*DepsManifestEntry{{Name: "core"}, {Name: "ota-common"}}}
+	have.Libs[1].RepoVersion = "89abcdef"
+	if err := ValidateDepsRequirements(have, want); err == nil || !strings.Contains(err.Error(), "lib_ota-common.a: no entry found") {
+		t.Errorf("expected a blob error, got %v", err)
+	}
+}
@@ -37,13 +37,17 @@ type DepsManifest struct {
 	Modules []*DepsManifestEntry `yaml:"modules,omitempty" json:"modules,omitempty"`
 
 	ManifestVersion string `yaml:"manifest_version,omitempty" json:"manifest_version,omitempty"`
+
+	// If set, binary blobs are not checked: the requirements only pin repo
+	// versions (see DepsLock).
+	NoBlobs bool `yaml:"no_blobs,omitempty" json:"no_blobs,omitempty"`
 }
 
 type DepsManifestEntry struct {
 	Name        string           `yaml:"name,omitempty" json:"name,omitempty"`
 	Location    string           `yaml:"location,omitempty" json:"location,omitempty"`
 	Version     string           `yaml:"version,omitempty" json:"version,omitempty"`
-	UserVersion string           `yaml:"user_version,omitempty" json:"version,omitempty"`
+	UserVersion string           `yaml:"user_version,omitempty" json:"user_version,omitempty"`
 	RepoVersion string           `yaml:"repo_version,omitempty" json:"repo_version,omitempty"`
 	RepoDirty   bool             `yaml:"repo_dirty,omitempty" json:"repo_dirty,omitempty"`
 	Blobs       []*DepsBlobEntry `yaml:"blobs,omitempty" json:"blobs,omitempty"`
@@ -160,6 +164,9 @@ func ValidateDepsRequirements(have, want *DepsManifest) error {
 			failures = append(failures, fmt.Sprintf("%s: repo is dirty", name))
 		}
 		for _, haveBlob := range haveLib.Blobs {
+			if want.NoBlobs {
+				break
+			}
 			blobName := haveBlob.Name
 			wantBlob := want.FindBlobEntry(name, blobName)
 			if wantBlob == nil {
@@ -0,0 +1,133 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package build
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/common/ourgit"
+)
+
+const cloneProgressInterval = 2 * time.Second
+
+// cloneRepo clones origin into targetDir, reporting the progress to
+// logWriter. The clone can be aborted by SIGINT. If the clone fails for
+// whatever reason, targetDir is removed so that a partial clone does not
+// break subsequent builds.
+func cloneRepo(
+	name string, gitinst ourgit.OurGit, origin, targetDir string,
+	opts ourgit.CloneOptions, logWriter io.Writer,
+) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	defer signal.Stop(sigCh)
+	go func() {
+		select {
+		case <-sigCh:
+			freportf(logWriter, "%s: Interrupted, aborting clone...", name)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	pw := &cloneProgressWriter{name: name, logWriter: logWriter}
+	opts.Progress = pw
+	err := gitinst.Clone(ctx, origin, targetDir, opts)
+	pw.flush()
+	if err != nil {
+		if rerr := os.RemoveAll(targetDir); rerr != nil {
+			freportf(logWriter, "%s: failed to remove %q: %s", name, targetDir, rerr)
+		}
+		if ctx.Err() != nil {
+			return errors.Errorf("%s: clone interrupted", name)
+		}
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// cloneProgressWriter receives progress output from git, which is a stream of
+// lines separated by '\r' (same line updated) or '\n', and reports them no
+// more often than once per cloneProgressInterval, unless the stage changes.
+type cloneProgressWriter struct {
+	name      string
+	logWriter io.Writer
+
+	buf        bytes.Buffer
+	lastLine   string
+	lastStage  string
+	lastReport time.Time
+}
+
+func (pw *cloneProgressWriter) Write(data []byte) (int, error) {
+	pw.buf.Write(data)
+	for {
+		b := pw.buf.Bytes()
+		i := bytes.IndexAny(b, "\r\n")
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(b[:i]))
+		pw.buf.Next(i + 1)
+		if line != "" {
+			pw.handleLine(line)
+		}
+	}
+	return len(data), nil
+}
+
+func (pw *cloneProgressWriter) handleLine(line string) {
+	line = strings.TrimPrefix(line, "remote: ")
+	stage := line
+	if i := strings.Index(line, ":"); i > 0 {
+		stage = line[:i]
+	}
+	pw.lastLine = line
+	if stage == pw.lastStage && time.Since(pw.lastReport) < cloneProgressInterval &&
+		!strings.HasSuffix(line, "done.") {
+		return
+	}
+	pw.report()
+	pw.lastStage = stage
+}
+
+func (pw *cloneProgressWriter) report() {
+	freportf(pw.logWriter, "%s: %s", pw.name, pw.lastLine)
+	pw.lastReport = time.Now()
+	pw.lastLine = ""
+}
+
+// flush reports the last line, if it was throttled.
+func (pw *cloneProgressWriter) flush() {
+	if line := strings.TrimSpace(pw.buf.String()); line != "" {
+		pw.lastLine = line
+	}
+	if pw.lastLine != "" {
+		pw.report()
+	}
+}
@@ -16,6 +16,12 @@
 //
 package build
 
+import (
+	"path"
+
+	"github.com/juju/errors"
+)
+
 const (
 	ManifestTypeApp = "app"
 	ManifestTypeLib = "lib"
@@ -63,17 +69,19 @@ type FWAppManifestLibHandled struct {
 type FWAppManifest struct {
 	AppManifest `yaml:",inline"`
 	// arch was deprecated at 2017/08/15 and should eventually be removed.
-	ArchOld     string   `yaml:"arch,omitempty" json:"arch"`
-	Platform    string   `yaml:"platform,omitempty" json:"platform"`
-	Platforms   []string `yaml:"platforms,omitempty" json:"platforms"`
-	Author      string   `yaml:"author,omitempty" json:"author"`
-	Description string   `yaml:"description,omitempty" json:"description"`
-	Sources     []string `yaml:"sources,omitempty" json:"sources"`
-	Includes    []string `yaml:"includes,omitempty" json:"includes"`
+	ArchOld     string     `yaml:"arch,omitempty" json:"arch"`
+	Platform    string     `yaml:"platform,omitempty" json:"platform"`
+	Platforms   []string   `yaml:"platforms,omitempty" json:"platforms"`
+	Author      string     `yaml:"author,omitempty" json:"author"`
+	Description string     `yaml:"description,omitempty" json:"description"`
+	Sources     SourceList `yaml:"sources,omitempty" json:"sources"`
+	Includes    []string   `yaml:"includes,omitempty" json:"includes"`
 	// Globs of files to include.
 	Filesystem []string `yaml:"filesystem,omitempty" json:"filesystem"`
 	// File filters. Only supported on the app level.
-	// Consists of glob patterns that include or exclude files by their name.
+	// Consists of glob patterns that include or exclude files by their name
+	// or, if the pattern contains a slash, by the path relative to the
+	// filesystem dir, e.g. "conf/secret.json". The first matching entry wins.
 	// If file does not match any of the filters, it is included by default.
 	FSFilters []*FSFilterEntry `yaml:"fs_filters,omitempty" json:"fs_filters"`
 
@@ -117,9 +125,88 @@ type FWAppManifest struct {
 	// Origin of this manifest - file name or something else that will help user identify the location.
 	// This field is not persisted and is only kept at runtime.
 	Origin string `yaml:"-" json:"-"`
+
+	// Dependency graph of libs: name -> names of the libs it depends on
+	// directly, including the app itself. Only kept at runtime.
+	Deps map[string][]string `yaml:"-" json:"-"`
+
+	// Init dependencies of each lib (and the app) with their origin, for
+	// diagnostics. Keys may be globs (from init_before). Only kept at runtime.
+	InitDepsInfo map[string]*InitDepsInfo `yaml:"-" json:"-"`
+}
+
+// InitDepsInfo describes where init dependencies of a lib come from.
+type InitDepsInfo struct {
+	// Set via init_after in the lib's manifest or init_before in other libs.
+	Explicit []InitDep
+	// Added implicitly: on the libs it depends on and on core.
+	Implicit []InitDep
+	// no_implicit_init_deps is set in the lib's manifest.
+	ImplicitSuppressed bool
+}
+
+type InitDep struct {
+	Name   string
+	Reason string
 }
 
 type FSFilterEntry struct {
 	Include string `yaml:"include,omitempty" json:"include"`
 	Exclude string `yaml:"exclude,omitempty" json:"exclude"`
 }
+
+// SourceList is a list of source paths: files, dirs and globs.
+// In addition to strings, the manifest can contain source dirs with their
+// own globs, which are used instead of --source-glob:
+//
+//	sources:
+//	  - src
+//	  - dir: src/cxx
+//	    globs: ["*.cc", "*.cxx"]
+//
+// Those are converted to globs ("src/cxx/*.cc", "src/cxx/*.cxx") when parsed.
+type SourceList []string
+
+type SourceDir struct {
+	Dir   string   `yaml:"dir"`
+	Globs []string `yaml:"globs"`
+}
+
+func (sl *SourceList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var items []sourceListItem
+	if err := unmarshal(&items); err != nil {
+		return err
+	}
+	res := SourceList{}
+	for _, item := range items {
+		res = append(res, item...)
+	}
+	*sl = res
+	return nil
+}
+
+// sourceListItem is a single entry of SourceList, expanded to paths.
+type sourceListItem []string
+
+func (si *sourceListItem) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var p string
+	if err := unmarshal(&p); err == nil {
+		*si = sourceListItem{p}
+		return nil
+	}
+	var sd SourceDir
+	if err := unmarshal(&sd); err != nil {
+		return errors.Errorf("sources: expected a path or {dir, globs}")
+	}
+	if sd.Dir == "" {
+		return errors.Errorf("sources: dir is not set")
+	}
+	if len(sd.Globs) == 0 {
+		*si = sourceListItem{sd.Dir}
+		return nil
+	}
+	for _, g := range sd.Globs {
+		*si = append(*si, path.Join(sd.Dir, g))
+	}
+	return nil
+}
@@ -1,10 +1,22 @@
 package build
 
-import "time"
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	yaml "gopkg.in/yaml.v2"
+)
 
 // Last-minute adjustments for the manifest, typically constructed from command line
 type ManifestAdjustments struct {
 	Platform  string
+	Env       string
 	BuildVars map[string]string
 	CDefs     map[string]string
 	CFlags    []string
@@ -14,6 +26,111 @@ type ManifestAdjustments struct {
 	// Libs and module version requirements.
 	DepsVersions       *DepsManifest
 	StrictDepsVersions bool
+
+	// If set, used instead of MosDefaultRepo, e.g. for internal mirrors.
+	MosRepoURL string
+
+	// Lib name -> location and version to use instead of the ones specified
+	// in manifests. Applies to all libs, including transitive ones.
+	DepOverrides map[string]DepOverride
+
+	// Source files and include dirs to add to the app's, used as is
+	// (no globbing). Paths are absolute.
+	ExtraSources  []string
+	ExtraIncludes []string
+
+	// Treat warnings in app and lib manifests as errors.
+	FailOnWarning bool
+}
+
+type DepOverride struct {
+	Location string
+	Version  string
+}
+
+// ParseDepOverride parses a "name=location[@version]" dep override spec.
+func ParseDepOverride(s string) (string, *DepOverride, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", nil, errors.Errorf("invalid dep override %q, expected name=location[@version]", s)
+	}
+	do := &DepOverride{Location: parts[1]}
+	// Only consider @ in the last path component, URLs may contain user@host.
+	if i := strings.LastIndex(do.Location, "@"); i > strings.LastIndex(do.Location, "/") {
+		do.Location, do.Version = do.Location[:i], do.Location[i+1:]
+	}
+	if do.Location == "" {
+		return "", nil, errors.Errorf("invalid dep override %q: empty location", s)
+	}
+	return parts[0], do, nil
+}
+
+// ParseSourcesFile parses the list of source files and include dirs, one per
+// line. Include dirs are prefixed with -I, empty lines and lines starting
+// with # are ignored. Relative paths are relative to dir.
+func ParseSourcesFile(data []byte, dir string) ([]string, []string, error) {
+	var sources, includes []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for ln := 1; sc.Scan(); ln++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		isInclude := false
+		if strings.HasPrefix(line, "-I") {
+			line, isInclude = strings.TrimSpace(line[2:]), true
+			if line == "" {
+				return nil, nil, errors.Errorf("line %d: include dir is empty", ln)
+			}
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(dir, line)
+		}
+		if isInclude {
+			includes = append(includes, line)
+		} else {
+			sources = append(sources, line)
+		}
+	}
+	return sources, includes, errors.Trace(sc.Err())
+}
+
+// ForbiddenLib is a dependency policy rule: a lib matching it fails the build.
+// Name is matched exactly, Location is a regular expression. If both are set,
+// both must match.
+type ForbiddenLib struct {
+	Name     string `yaml:"name,omitempty" json:"name,omitempty"`
+	Location string `yaml:"location,omitempty" json:"location,omitempty"`
+	Reason   string `yaml:"reason,omitempty" json:"reason,omitempty"`
+}
+
+type depPolicyFile struct {
+	Forbid []ForbiddenLib `yaml:"forbid"`
+}
+
+// ParseDepPolicy parses a dependency policy file, e.g.:
+//
+//	forbid:
+//	  - name: old_lib
+//	    reason: deprecated, use new_lib instead
+//	  - location: "github.com/someorg/.*"
+//	    reason: GPL
+func ParseDepPolicy(data []byte) ([]ForbiddenLib, error) {
+	var pf depPolicyFile
+	if err := yaml.UnmarshalStrict(data, &pf); err != nil {
+		return nil, errors.Trace(err)
+	}
+	for i, fl := range pf.Forbid {
+		if fl.Name == "" && fl.Location == "" {
+			return nil, errors.Errorf("rule %d: either name or location must be specified", i+1)
+		}
+		if fl.Location != "" {
+			if _, err := regexp.Compile(fl.Location); err != nil {
+				return nil, errors.Annotatef(err, "rule %d: invalid location regex", i+1)
+			}
+		}
+	}
+	return pf.Forbid, nil
 }
 
 // Note: this struct gets transmitted to the server
@@ -26,12 +143,23 @@ type BuildParams struct {
 	CustomLibLocations    map[string]string
 	CustomModuleLocations map[string]string
 	LibsUpdateInterval    time.Duration
+	Offline               bool
 	NoPlatformCheck       bool
 	SaveBuildStat         bool
 	PreferPrebuiltLibs    bool
+	IncludeBuildInfo      bool
+	// State of the app's git repo for the build info, collected by the client.
+	GitInfo *GitInfo
+
+	// Libs that must not be present anywhere in the dependency tree.
+	ForbiddenLibs []ForbiddenLib
 
 	// Host -> credentials, used for authentication when fetching libs.
 	Credentials map[string]Credentials
+
+	// Host -> GitHub API base URL, used when fetching assets from GitHub
+	// Enterprise hosts.
+	GitHubAPIURLs map[string]string
 }
 
 type Credentials struct {
@@ -57,3 +185,38 @@ func GetCredentialsForHost(credsMap map[string]Credentials, host string) *Creden
 func (bp *BuildParams) GetCredentialsForHost(host string) *Credentials {
 	return GetCredentialsForHost(bp.Credentials, host)
 }
+
+// GetGitHubAPIURLForHost returns GitHub API base URL configured for the
+// given host, or an empty string if the default should be used.
+func (bp *BuildParams) GetGitHubAPIURLForHost(host string) string {
+	if u, ok := bp.GitHubAPIURLs[host]; ok {
+		return u
+	}
+	if host == "github.com" {
+		return ""
+	}
+	return bp.GitHubAPIURLs[""]
+}
+
+// ParseBuildParams parses build params file, which can be either YAML or
+// JSON. JSON is used if the file name ends with .json or the content starts
+// with {. In both cases the field names are the same as in YAML: JSON is
+// converted to YAML first.
+func ParseBuildParams(data []byte, fname string) (*BuildParams, error) {
+	if strings.HasSuffix(strings.ToLower(fname), ".json") || bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, errors.Annotatef(err, "invalid JSON")
+		}
+		yamlData, err := yaml.Marshal(v)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		data = yamlData
+	}
+	var bParams BuildParams
+	if err := yaml.Unmarshal(data, &bParams); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &bParams, nil
+}
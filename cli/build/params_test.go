@@ -0,0 +1,138 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package build
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDepOverride(t *testing.T) {
+	for _, c := range []struct {
+		s, name, loc, version string
+		fail                  bool
+	}{
+		{s: "foo=https://github.com/us/foo", name: "foo", loc: "https://github.com/us/foo"},
+		{s: "foo=https://github.com/us/foo@fix", name: "foo", loc: "https://github.com/us/foo", version: "fix"},
+		{s: "foo=https://me@git.example.com/us/foo", name: "foo", loc: "https://me@git.example.com/us/foo"},
+		{s: "foo=/src/foo@v1", name: "foo", loc: "/src/foo", version: "v1"},
+		{s: "foo", fail: true},
+		{s: "=https://github.com/us/foo", fail: true},
+		{s: "foo=@fix", fail: true},
+	} {
+		name, do, err := ParseDepOverride(c.s)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%q: expected an error", c.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", c.s, err)
+			continue
+		}
+		if name != c.name || do.Location != c.loc || do.Version != c.version {
+			t.Errorf("%q: got %q %+v", c.s, name, do)
+		}
+	}
+}
+
+func TestParseSourcesFile(t *testing.T) {
+	data := "# generated\n" +
+		"src/main.c\n" +
+		"\n" +
+		"  /gen/proto.pb.c  \n" +
+		"-I include\n" +
+		"-I/gen\n"
+	sources, includes, err := ParseSourcesFile([]byte(data), "/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sources, []string{"/app/src/main.c", "/gen/proto.pb.c"}) {
+		t.Errorf("unexpected sources: %q", sources)
+	}
+	if !reflect.DeepEqual(includes, []string{"/app/include", "/gen"}) {
+		t.Errorf("unexpected includes: %q", includes)
+	}
+	if _, _, err := ParseSourcesFile([]byte("-I\n"), "/app"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestParseBuildParams(t *testing.T) {
+	yamlData := []byte(`
+manifestadjustments:
+  platform: esp32
+  buildvars:
+    FOO: "on"
+clean: true
+libsupdateinterval: 3600000000000
+`)
+	jsonData := []byte(`{
+  "manifestadjustments": {"platform": "esp32", "buildvars": {"FOO": "on"}},
+  "clean": true,
+  "libsupdateinterval": 3600000000000
+}`)
+	for _, c := range []struct {
+		data  []byte
+		fname string
+	}{
+		{yamlData, "params.yml"},
+		{jsonData, "params.json"},
+		{jsonData, "params"},
+	} {
+		bp, err := ParseBuildParams(c.data, c.fname)
+		if err != nil {
+			t.Fatalf("%s: %s", c.fname, err)
+		}
+		if bp.Platform != "esp32" || bp.BuildVars["FOO"] != "on" || !bp.Clean || bp.LibsUpdateInterval != time.Hour {
+			t.Errorf("%s: unexpected params: %+v", c.fname, bp)
+		}
+	}
+	if _, err := ParseBuildParams([]byte(`{"clean": `), "params.json"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestParseDepPolicy(t *testing.T) {
+	rules, err := ParseDepPolicy([]byte(`
+forbid:
+  - name: old_lib
+    reason: deprecated
+  - location: "github.com/someorg/.*"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []ForbiddenLib{
+		{Name: "old_lib", Reason: "deprecated"},
+		{Location: "github.com/someorg/.*"},
+	}
+	if !reflect.DeepEqual(rules, exp) {
+		t.Errorf("unexpected rules: %+v", rules)
+	}
+	for _, s := range []string{
+		"forbid:\n  - reason: no name\n",
+		"forbid:\n  - location: \"(\"\n",
+		"forbid:\n  - nmae: typo\n",
+	} {
+		if _, err := ParseDepPolicy([]byte(s)); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
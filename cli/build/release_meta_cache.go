@@ -0,0 +1,97 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/juju/errors"
+	glog "k8s.io/klog/v2"
+)
+
+// Release metadata is fetched once per URL and reused for all the assets
+// (i.e. lib variants) of the release: API calls are rate-limited.
+type releaseMetaEntry struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+var (
+	releaseMetaCache     = map[string]*releaseMetaEntry{}
+	releaseMetaCacheLock sync.Mutex
+)
+
+// fetchReleaseMeta returns the body of relMetaURL, fetching it if it's not
+// in the cache yet. authHeader, if not empty, is added to the request with
+// the authValue. Successful responses and missing releases are cached, other
+// errors are not.
+func fetchReleaseMeta(relMetaURL, authHeader, authValue string) ([]byte, error) {
+	key := fmt.Sprintf("%s %s %s", relMetaURL, authHeader, authValue)
+	releaseMetaCacheLock.Lock()
+	e := releaseMetaCache[key]
+	if e == nil {
+		e = &releaseMetaEntry{}
+		releaseMetaCache[key] = e
+	}
+	releaseMetaCacheLock.Unlock()
+
+	e.once.Do(func() {
+		e.data, e.err = fetchReleaseMetaUncached(relMetaURL, authHeader, authValue)
+	})
+	if e.err != nil {
+		if os.IsNotExist(errors.Cause(e.err)) {
+			return nil, e.err
+		}
+		// Allow retrying.
+		releaseMetaCacheLock.Lock()
+		if releaseMetaCache[key] == e {
+			delete(releaseMetaCache, key)
+		}
+		releaseMetaCacheLock.Unlock()
+		return nil, e.err
+	}
+	glog.V(1).Infof("Release metadata for %s: %d bytes", relMetaURL, len(e.data))
+	return e.data, nil
+}
+
+func fetchReleaseMetaUncached(relMetaURL, authHeader, authValue string) ([]byte, error) {
+	client := &http.Client{}
+	req, err := http.NewRequest("GET", relMetaURL, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if authValue != "" {
+		req.Header.Add(authHeader, authValue)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to fetch %s", relMetaURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errors.Annotatef(os.ErrNotExist, "got %d status code when fetching %s (note: private repos may need --credentials)", resp.StatusCode, relMetaURL)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("got %d status code when fetching %s (note: private repos may need --credentials)", resp.StatusCode, relMetaURL)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,56 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package build
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/juju/errors"
+)
+
+func TestFetchReleaseMetaCached(t *testing.T) {
+	numReqs := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numReqs++
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"path": %q}`, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		data, err := fetchReleaseMeta(srv.URL+"/rel", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != `{"path": "/rel"}` {
+			t.Errorf("unexpected data %q", data)
+		}
+		if _, err := fetchReleaseMeta(srv.URL+"/missing", "", ""); !os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("expected not found error, got %v", err)
+		}
+	}
+	if numReqs != 2 {
+		t.Errorf("expected 2 requests, got %d", numReqs)
+	}
+}
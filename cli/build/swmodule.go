@@ -17,14 +17,18 @@
 package build
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -47,6 +51,7 @@ type SWModule struct {
 	Variant   string `yaml:"variant,omitempty" json:"variant,omitempty"`
 
 	// API used to download binary assets. If not specified, will take a guess based on location.
+	// "auto" tries all the supported APIs.
 	AssetAPI SWModuleAssetAPIType `yaml:"asset_api,omitempty" json:"asset_api,omitempty"`
 
 	versionOverride string
@@ -57,13 +62,25 @@ type SWModule struct {
 
 	// Credential must be provided externally and never serialized in a manifest.
 	credentials *Credentials
+
+	// GitHub API base URL, if not the default one.
+	gitHubAPIURL string
+
+	// If set, never access the network: only use what is present locally.
+	offline bool
+
+	// Dir which relative local locations are resolved against.
+	appDir string
 }
 
 type SWModuleAssetAPIType string
 
 const (
-	AssetAPIGitHub SWModuleAssetAPIType = "github"
-	AssetAPIGitLab                      = "gitlab"
+	AssetAPIGitHub    SWModuleAssetAPIType = "github"
+	AssetAPIGitLab    SWModuleAssetAPIType = "gitlab"
+	AssetAPIBitbucket SWModuleAssetAPIType = "bitbucket"
+	// Try all of the above, in order.
+	AssetAPIAuto SWModuleAssetAPIType = "auto"
 )
 
 type SWModuleType int
@@ -90,9 +107,12 @@ var (
 	boardsLibNewName = "zz_boards"
 )
 
-func parseGitLocation(loc string) (string, string, string, string, string, string, error) {
+// parseGitLocation returns repo host, repo path, repo name, lib name, repo URL,
+// path within the repo and, for GitHub and GitLab tree URLs, the branch or tag
+// (a single path component, names with slashes are not supported).
+func parseGitLocation(loc string) (string, string, string, string, string, string, string, error) {
 	isShort := false
-	var repoPath, repoName, libName, repoURL, pathWithinRepo string
+	var repoPath, repoName, libName, repoURL, pathWithinRepo, ref string
 	u, err := url.Parse(loc)
 	if err != nil {
 		if sm := gitSSHShortRegex.FindAllStringSubmatch(loc, 1); sm != nil {
@@ -103,7 +123,7 @@ func parseGitLocation(loc string) (string, string, string, string, string, strin
 			}
 			isShort = true
 		} else {
-			return "", "", "", "", "", "", errors.Errorf("%q is not a Git location spec 1", loc)
+			return "", "", "", "", "", "", "", errors.Errorf("%q is not a Git location spec 1", loc)
 		}
 	} else if u.Host == "" && u.Opaque != "" {
 		/* Git short-hand repo path w/o user@, i.e. server:name */
@@ -113,12 +133,12 @@ func parseGitLocation(loc string) (string, string, string, string, string, strin
 		}
 		isShort = true
 	} else if u.Scheme == "" {
-		return "", "", "", "", "", "", errors.Errorf("%q is not a Git location spec 2", loc)
+		return "", "", "", "", "", "", "", errors.Errorf("%q is not a Git location spec 2", loc)
 	}
 
 	parts := strings.Split(u.Path, "/")
 	if len(parts) == 0 {
-		return "", "", "", "", "", "", errors.Errorf("path is empty in %q", loc)
+		return "", "", "", "", "", "", "", errors.Errorf("path is empty in %q", loc)
 	}
 	libName = parts[len(parts)-1]
 	if strings.HasSuffix(libName, ".git") {
@@ -132,6 +152,7 @@ func parseGitLocation(loc string) (string, string, string, string, string, strin
 				repoPath = strings.Join(parts[1:3], "/")
 				repoName = parts[2]
 				u.Path = strings.Join(parts[:3], "/")
+				ref = parts[4]
 				pathWithinRepo = filepath.Join(parts[5:]...)
 			}
 		} else {
@@ -141,6 +162,7 @@ func parseGitLocation(loc string) (string, string, string, string, string, strin
 					repoPath = strings.Join(parts[1:i-1], "/")
 					repoName = parts[i-2]
 					u.Path = strings.Join(parts[:i-1], "/")
+					ref = parts[i+1]
 					pathWithinRepo = filepath.Join(parts[i+2:]...)
 				}
 			}
@@ -178,7 +200,7 @@ func parseGitLocation(loc string) (string, string, string, string, string, strin
 		repoURL = u.String()
 	}
 
-	return u.Host, repoPath, repoName, libName, repoURL, pathWithinRepo, nil
+	return u.Host, repoPath, repoName, libName, repoURL, pathWithinRepo, ref, nil
 }
 
 func (m *SWModule) Normalize() error {
@@ -223,9 +245,9 @@ func (m *SWModule) PrepareLocalDir(
 		if err != nil {
 			return "", errors.Trace(err)
 		}
-		_, _, _, _, repoURL, pathWithinRepo, err := parseGitLocation(m.Location)
+		_, _, _, _, repoURL, pathWithinRepo, _, err := parseGitLocation(m.Location)
 		version := m.getVersionGit(defaultVersion)
-		if repoVersion, isDirty, err = prepareLocalCopyGit(n, repoURL, version, localRepoPath, logWriter, deleteIfFailed, pullInterval, cloneDepth, m.credentials); err != nil {
+		if repoVersion, isDirty, err = prepareLocalCopyGit(n, repoURL, version, localRepoPath, logWriter, deleteIfFailed, pullInterval, cloneDepth, m.credentials, m.offline); err != nil {
 			return "", errors.Annotatef(err, "%s: failed to prepare local copy (version %s)", n, version)
 		}
 
@@ -261,11 +283,15 @@ func (m *SWModule) FetchPrebuiltBinary(platform, defaultVersion, tgt string) err
 	version := m.GetVersion(defaultVersion)
 	switch m.GetType() {
 	case SWModuleTypeGit:
-		repoHost, repoPath, _, libName, _, _, err := parseGitLocation(m.Location)
+		repoHost, repoPath, _, libName, _, _, _, err := parseGitLocation(m.Location)
 		if err != nil {
 			return errors.Trace(err)
 		}
 		assetName := fmt.Sprintf("lib%s-%s.a", libName, platform)
+		if m.offline {
+			return errors.Errorf("%s: prebuilt binary %s (version %s) is not present in %q, fetching is not possible in offline mode",
+				libName, assetName, version, tgt)
+		}
 		assetAPIType := m.AssetAPI
 		if assetAPIType == "" {
 			switch {
@@ -273,36 +299,51 @@ func (m *SWModule) FetchPrebuiltBinary(platform, defaultVersion, tgt string) err
 				assetAPIType = AssetAPIGitHub
 			case strings.Contains(m.Location, "gitlab"):
 				assetAPIType = AssetAPIGitLab
+			case strings.Contains(m.Location, "bitbucket"):
+				assetAPIType = AssetAPIBitbucket
 			default:
-				return errors.Annotatef(err, "%s: asset_api not specified and could not be guessed", libName)
+				return errors.Errorf("%s: asset_api not specified and could not be guessed (use asset_api: auto to try all)", libName)
 			}
 		}
 		var assetData []byte
-		switch assetAPIType {
-		case AssetAPIGitHub:
-			token := ""
-			if m.credentials != nil {
-				token = m.credentials.Pass
-			}
-			for i := 1; i <= 3; i++ {
-				assetData, err = fetchGitHubAsset(m.Location, repoHost, repoPath, version, assetName, token)
-				if err == nil || os.IsNotExist(errors.Cause(err)) {
+		if assetAPIType == AssetAPIAuto {
+			var errs []string
+			var fetchErr error
+			for _, t := range []SWModuleAssetAPIType{AssetAPIGitHub, AssetAPIGitLab, AssetAPIBitbucket} {
+				assetData, err = m.fetchAsset(t, repoHost, repoPath, version, assetName)
+				if err == nil {
+					// Some hosts respond with a web page instead of a 404.
+					if ct := http.DetectContentType(assetData); strings.HasPrefix(ct, "text/html") {
+						err = errors.Errorf("got %s instead of the asset", ct)
+					}
+				}
+				if err == nil {
+					glog.Infof("%s: fetched %s using %s asset API", libName, assetName, t)
+					assetAPIType = t
 					break
 				}
-				// Sometimes asset downloads fail. GitHub doesn't like us, or rate limiting or whatever.
-				// Try a couple times.
-				glog.Errorf("GitHub asset %s download failed (attempt %d): %s", assetName, i, err)
-				time.Sleep(1 * time.Second)
+				glog.Infof("%s: %s asset API failed: %s", libName, t, err)
+				errs = append(errs, fmt.Sprintf("%s: %s", t, err))
+				// The asset is known not to exist only if none of the APIs failed for another reason.
+				if fetchErr == nil || os.IsNotExist(errors.Cause(fetchErr)) {
+					fetchErr = err
+				}
 			}
-		case AssetAPIGitLab:
-			token := ""
-			if m.credentials != nil {
-				token = m.credentials.Pass
+			if err != nil {
+				return errors.Annotatef(fetchErr, "%s: failed to download asset %s (%s)", libName, assetName, strings.Join(errs, "; "))
+			}
+		} else {
+			assetData, err = m.fetchAsset(assetAPIType, repoHost, repoPath, version, assetName)
+			if err != nil {
+				return errors.Annotatef(err, "%s: failed to download %s asset %s", libName, assetAPIType, assetName)
 			}
-			assetData, err = fetchGitLabAsset(repoHost, repoPath, version, assetName, token)
 		}
+
+		assetData, err = verifyAsset(func(name string) ([]byte, error) {
+			return m.fetchAsset(assetAPIType, repoHost, repoPath, version, name)
+		}, assetName, assetData)
 		if err != nil {
-			return errors.Annotatef(err, "%s: failed to download %s asset %s", libName, assetAPIType, assetName)
+			return errors.Annotatef(err, "%s", libName)
 		}
 
 		if err := os.MkdirAll(filepath.Dir(tgt), 0755); err != nil {
@@ -319,14 +360,117 @@ func (m *SWModule) FetchPrebuiltBinary(platform, defaultVersion, tgt string) err
 	return errors.Errorf("unable to fetch prebuilt binary for %q", name)
 }
 
+func (m *SWModule) fetchAsset(assetAPIType SWModuleAssetAPIType, repoHost, repoPath, version, assetName string) ([]byte, error) {
+	token := ""
+	if m.credentials != nil {
+		token = m.credentials.Pass
+	}
+	var assetData []byte
+	var err error
+	switch assetAPIType {
+	case AssetAPIGitHub:
+		attempts := 1
+		if repoHost == "github.com" {
+			attempts = 3
+		}
+		for i := 1; i <= attempts; i++ {
+			assetData, err = fetchGitHubAsset(m.Location, repoHost, repoPath, version, assetName, token, m.gitHubAPIURL)
+			if err == nil || os.IsNotExist(errors.Cause(err)) || i == attempts {
+				break
+			}
+			// Sometimes asset downloads fail. GitHub doesn't like us, or rate limiting or whatever.
+			// Try a couple times.
+			glog.Errorf("GitHub asset %s download failed (attempt %d): %s", assetName, i, err)
+			time.Sleep(1 * time.Second)
+		}
+	case AssetAPIGitLab:
+		assetData, err = fetchGitLabAsset(repoHost, repoPath, version, assetName, token)
+	case AssetAPIBitbucket:
+		assetData, err = fetchBitbucketAsset(repoHost, repoPath, version, assetName, token)
+	default:
+		err = errors.Errorf("unknown asset_api %q", assetAPIType)
+	}
+	return assetData, err
+}
+
+// verifyAsset checks data against the companion <assetName>.sha256 asset,
+// if there is one. On mismatch the asset is downloaded once again, since
+// truncated downloads do happen. The file is expected to be in the sha256sum
+// format, only the first field is used.
+func verifyAsset(fetch func(assetName string) ([]byte, error), assetName string, data []byte) ([]byte, error) {
+	sumName := assetName + ".sha256"
+	sumData, err := fetch(sumName)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			glog.V(1).Infof("%s: no checksum", assetName)
+			return data, nil
+		}
+		return nil, errors.Annotatef(err, "failed to download %s", sumName)
+	}
+	fields := strings.Fields(string(sumData))
+	if len(fields) == 0 {
+		return nil, errors.Errorf("%s is empty", sumName)
+	}
+	expected, err := hex.DecodeString(fields[0])
+	if err != nil || len(expected) != sha256.Size {
+		return nil, errors.Errorf("%s: invalid checksum %q", sumName, fields[0])
+	}
+	check := func(data []byte) error {
+		if actual := sha256.Sum256(data); !bytes.Equal(actual[:], expected) {
+			return errors.Errorf("%s: checksum mismatch: expected %x, got %x (%d bytes)", assetName, expected, actual, len(data))
+		}
+		return nil
+	}
+	if err = check(data); err == nil {
+		return data, nil
+	}
+	glog.Errorf("%s, downloading again", err)
+	if data, err = fetch(assetName); err != nil {
+		return nil, errors.Annotatef(err, "failed to download %s", assetName)
+	}
+	if err = check(data); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return data, nil
+}
+
+// GetVersion returns the version of the module. Explicit version takes
+// precedence over the branch or tag in the location's tree URL, which takes
+// precedence over defaultVersion.
 func (m *SWModule) GetVersion(defaultVersion string) string {
 	version := m.Version
+	if version == "" && m.GetType() == SWModuleTypeGit {
+		_, _, _, _, _, _, version, _ = parseGitLocation(m.Location)
+	}
 	if version == "" {
 		version = defaultVersion
 	}
 	return version
 }
 
+// ResolveVersionFile replaces version of the form "@file" with the first line
+// of the file. Relative paths are relative to the rootAppDir.
+func (m *SWModule) ResolveVersionFile(rootAppDir string) error {
+	if !strings.HasPrefix(m.Version, "@") {
+		return nil
+	}
+	fname := m.Version[1:]
+	if !filepath.IsAbs(fname) {
+		fname = filepath.Join(rootAppDir, fname)
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return errors.Annotatef(err, "failed to read version file")
+	}
+	version := strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+	if version == "" {
+		return errors.Errorf("version file %q is empty", fname)
+	}
+	glog.V(1).Infof("%s: version %s -> %s", m.Location, m.Version, version)
+	m.Version = version
+	return nil
+}
+
 func (m *SWModule) SetVersionOverride(version string) {
 	m.versionOverride = version
 }
@@ -342,11 +486,95 @@ func (m *SWModule) getVersionGit(defaultVersion string) string {
 	return version
 }
 
+// GetLatestVersion returns the latest version of a Git module: the highest
+// version tag of the repo or, if there are no version tags, the hash of the
+// master branch. The repo is queried remotely, nothing is cloned.
+func (m *SWModule) GetLatestVersion() (string, error) {
+	if m.GetType() != SWModuleTypeGit {
+		return "", errors.Errorf("%q is not a Git lib", m.Location)
+	}
+	_, _, _, _, repoURL, _, _, err := parseGitLocation(m.Location)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	gitinst := mosgit.NewOurGit(BuildCredsToGitCreds(m.credentials))
+	refs, err := gitinst.ListRemoteRefs(repoURL)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	version := latestVersionFromRefs(refs)
+	if version == "" {
+		return "", errors.Errorf("%s: no version tags and no master branch", repoURL)
+	}
+	return version, nil
+}
+
+// latestVersionFromRefs picks the highest version tag (1.2, v1.2.3, etc) from
+// the refs returned by ListRemoteRefs. Tags which do not look like versions
+// are ignored. If there are no version tags, hash of master is returned.
+func latestVersionFromRefs(refs map[string]string) string {
+	var latest string
+	var latestParts []int
+	for ref := range refs {
+		if !strings.HasPrefix(ref, "refs/tags/") {
+			continue
+		}
+		tag := strings.TrimPrefix(ref, "refs/tags/")
+		parts := parseVersionTag(tag)
+		if parts == nil {
+			continue
+		}
+		if c := compareVersionParts(parts, latestParts); c > 0 || (c == 0 && tag > latest) {
+			latest, latestParts = tag, parts
+		}
+	}
+	if latest != "" {
+		return latest
+	}
+	if h, ok := refs["refs/heads/master"]; ok {
+		return h
+	}
+	return refs["HEAD"]
+}
+
+// parseVersionTag returns numeric components of a tag like "1.2" or "v1.2.3",
+// nil if the tag is not a version.
+func parseVersionTag(tag string) []int {
+	var res []int
+	for _, p := range strings.Split(strings.TrimPrefix(tag, "v"), ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil
+		}
+		res = append(res, n)
+	}
+	return res
+}
+
+func compareVersionParts(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var va, vb int
+		if i < len(a) {
+			va = a[i]
+		}
+		if i < len(b) {
+			vb = b[i]
+		}
+		if va != vb {
+			if va > vb {
+				return 1
+			}
+			return -1
+		}
+	}
+	return len(a) - len(b)
+}
+
 func (m *SWModule) getLocalGitRepoDir(libsDir, defaultVersion string) (string, error) {
 	if m.GetType() != SWModuleTypeGit {
 		return "", errors.Errorf("%q is not a Git lib", m.Location)
 	}
-	_, _, repoName, _, _, _, err := parseGitLocation(m.Location)
+	_, _, repoName, _, _, _, _, err := parseGitLocation(m.Location)
 	if err != nil {
 		return "", errors.Trace(err)
 	}
@@ -360,12 +588,16 @@ func (m *SWModule) GetLocalDir(libsDir, defaultVersion string) (string, error) {
 		if err != nil {
 			return "", errors.Trace(err)
 		}
-		_, _, _, _, _, pathWithinRepo, _ := parseGitLocation(m.Location)
+		_, _, _, _, _, pathWithinRepo, _, _ := parseGitLocation(m.Location)
 		return filepath.Join(localRepoPath, pathWithinRepo), nil
 
 	case SWModuleTypeLocal:
 		if m.Location != "" {
-			originAbs, err := filepath.Abs(m.Location)
+			loc := m.Location
+			if !filepath.IsAbs(loc) && m.appDir != "" {
+				loc = filepath.Join(m.appDir, loc)
+			}
+			originAbs, err := filepath.Abs(loc)
 			if err != nil {
 				return "", errors.Trace(err)
 			}
@@ -387,6 +619,12 @@ func (m *SWModule) GetRepoVersion() (string, bool, error) {
 	return m.repoVersion, m.isDirty, nil
 }
 
+// GetLocalPath returns the path where the module resides locally, empty
+// until the local dir is prepared.
+func (m *SWModule) GetLocalPath() string {
+	return m.localPath
+}
+
 // For testing
 func (m *SWModule) SetLocalPathAndRepoVersion(localPath, repoVersion string, isDirty bool) {
 	m.localPath = localPath
@@ -426,7 +664,7 @@ func (m *SWModule) getName() (string, error) {
 
 	switch m.GetType() {
 	case SWModuleTypeGit:
-		_, _, _, libName, _, _, err := parseGitLocation(m.Location)
+		_, _, _, libName, _, _, _, err := parseGitLocation(m.Location)
 		return libName, err
 	case SWModuleTypeLocal:
 		_, name := filepath.Split(m.Location)
@@ -443,7 +681,7 @@ func (m *SWModule) getName() (string, error) {
 func (m *SWModule) GetHostName() string {
 	switch m.GetType() {
 	case SWModuleTypeGit:
-		libHost, _, _, _, _, _, _ := parseGitLocation(m.Location)
+		libHost, _, _, _, _, _, _, _ := parseGitLocation(m.Location)
 		return libHost
 	case SWModuleTypeLocal:
 		return ""
@@ -492,6 +730,27 @@ func (m *SWModule) SetCredentials(creds *Credentials) {
 	m.credentials = creds
 }
 
+// SetOffline makes PrepareLocalDir fail instead of cloning, fetching or
+// pulling anything.
+func (m *SWModule) SetOffline(offline bool) {
+	m.offline = offline
+}
+
+// SetAppDir sets the dir which relative local locations are resolved
+// against, so that they do not depend on the current dir. This is the dir
+// of the manifest which declares the module.
+func (m *SWModule) SetAppDir(appDir string) {
+	m.appDir = appDir
+}
+
+func (m *SWModule) GetAppDir() string {
+	return m.appDir
+}
+
+func (m *SWModule) SetGitHubAPIURL(apiURL string) {
+	m.gitHubAPIURL = apiURL
+}
+
 func (m *SWModule) GetCredentials() *Credentials {
 	return m.credentials
 }
@@ -505,7 +764,7 @@ func prepareLocalCopyGit(
 	name, origin, version, targetDir string,
 	logWriter io.Writer, deleteIfFailed bool,
 	pullInterval time.Duration, cloneDepth int,
-	creds *Credentials,
+	creds *Credentials, offline bool,
 ) (string, bool, error) {
 
 	repoLocksLock.Lock()
@@ -517,18 +776,46 @@ func prepareLocalCopyGit(
 	repoLocksLock.Unlock()
 	lock.Lock()
 	defer lock.Unlock()
-	return prepareLocalCopyGitLocked(name, origin, version, targetDir, logWriter, deleteIfFailed, pullInterval, cloneDepth, creds)
+	return prepareLocalCopyGitLocked(name, origin, version, targetDir, logWriter, deleteIfFailed, pullInterval, cloneDepth, creds, offline)
+}
+
+func offlineError(name, origin, version, targetDir, problem string) error {
+	return errors.Errorf("%s: %s; version %s of %s is expected in %q, fetching is not possible in offline mode",
+		name, problem, version, origin, targetDir)
+}
+
+// checkGitRepo verifies that dir is a usable git repository on its own: it
+// has a HEAD and git does not fall back to some enclosing repository.
+func checkGitRepo(gitinst ourgit.OurGit, dir string) error {
+	topDir, err := gitinst.GetToplevelDir(dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	dirAbs, _ := filepath.Abs(dir)
+	dirAbs, _ = filepath.EvalSymlinks(dirAbs)
+	topDir, _ = filepath.EvalSymlinks(topDir)
+	if filepath.Clean(topDir) != filepath.Clean(dirAbs) {
+		return errors.Errorf("not a git repository (belongs to %q)", topDir)
+	}
+	if _, err := gitinst.GetCurrentHash(dir); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
 }
 
 func prepareLocalCopyGitLocked(
 	name, origin, version, targetDir string,
 	logWriter io.Writer, deleteIfFailed bool,
 	pullInterval time.Duration, cloneDepth int,
-	creds *Credentials,
+	creds *Credentials, offline bool,
 ) (string, bool, error) {
 	gitinst := mosgit.NewOurGit(BuildCredsToGitCreds(creds))
 	// version is already converted from "" or "latest" to "master" here.
 
+	if offline {
+		pullInterval = 0
+	}
+
 	// Check if we should clone or pull git repo inside of targetDir.
 	// Valid cases are:
 	//
@@ -541,8 +828,20 @@ func prepareLocalCopyGitLocked(
 	if _, err := os.Stat(targetDir); err == nil {
 		// targetDir exists; let's see if it's a git repo
 		if _, err := os.Stat(filepath.Join(targetDir, ".git")); err == nil {
-			// Yes it is a git repo
-			repoExists = true
+			// Yes it is a git repo, but it may be a leftover of an interrupted
+			// clone (e.g. with no HEAD yet).
+			if err := checkGitRepo(gitinst, targetDir); err == nil {
+				repoExists = true
+			} else if !deleteIfFailed {
+				return "", false, errors.Annotatef(err, "%s: %q is a broken git repository; remove it or use --repair-deps", name, targetDir)
+			} else if pullInterval == 0 {
+				return "", false, errors.Annotatef(err, "%s: %q is a broken git repository and fetching is not allowed", name, targetDir)
+			} else {
+				freportf(logWriter, "%s: %q is a broken git repository (%s), removing it", name, targetDir, err)
+				if err := os.RemoveAll(targetDir); err != nil {
+					return "", false, errors.Annotatef(err, "%s: failed to delete %q", name, targetDir)
+				}
+			}
 		} else {
 			// No it's not a git repo; let's see if it's empty; if not, it's an error.
 			files, err := ioutil.ReadDir(targetDir)
@@ -555,7 +854,9 @@ func prepareLocalCopyGitLocked(
 			}
 		}
 	} else if os.IsNotExist(err) {
-		if pullInterval == 0 {
+		if offline {
+			return "", false, offlineError(name, origin, version, targetDir, "local copy does not exist")
+		} else if pullInterval == 0 {
 			return "", false, fmt.Errorf("%s: Local copy in %q does not exist and fetching is not allowed", name, targetDir)
 		}
 	} else {
@@ -574,8 +875,11 @@ func prepareLocalCopyGitLocked(
 	}
 
 	if !repoExists {
+		if offline {
+			return "", false, offlineError(name, origin, version, targetDir, "local copy does not exist")
+		}
 		freportf(logWriter, "%s: Does not exist, cloning from %q...", name, origin)
-		err := gitinst.Clone(origin, targetDir, cloneOpts)
+		err := cloneRepo(name, gitinst, origin, targetDir, cloneOpts, logWriter)
 		if err != nil {
 			return "", false, errors.Trace(err)
 		}
@@ -596,11 +900,14 @@ func prepareLocalCopyGitLocked(
 			return "", false, errors.Trace(err)
 		} else {
 			if curOrigin != origin {
+				if offline {
+					return "", false, offlineError(name, origin, version, targetDir, fmt.Sprintf("local copy is a clone of %q", curOrigin))
+				}
 				freportf(logWriter, "%s: Origin changed from %q to %q, re-cloning...", name, curOrigin, origin)
 				if err = os.RemoveAll(targetDir); err != nil {
 					return "", false, errors.Annotatef(err, "%s: failed to delete %q", name, targetDir)
 				}
-				err := gitinst.Clone(origin, targetDir, cloneOpts)
+				err := cloneRepo(name, gitinst, origin, targetDir, cloneOpts, logWriter)
 				if err != nil {
 					return "", false, errors.Trace(err)
 				}
@@ -660,6 +967,9 @@ func prepareLocalCopyGitLocked(
 
 	// If the desired mongoose-os version isn't a known branch, do git fetch
 	if !looksLikeSHA && !branchExists && !tagExists {
+		if offline {
+			return "", false, offlineError(name, origin, version, targetDir, "version is not present in the local copy")
+		}
 		glog.V(2).Infof("%s: %s is neither a branch nor a tag, fetching...", name, version)
 		err = gitinst.Fetch(targetDir, version, ourgit.FetchOptions{Depth: 1})
 		if err != nil {
@@ -699,7 +1009,7 @@ func prepareLocalCopyGitLocked(
 	freportf(logWriter, "%s: Checking out %s...", name, version)
 	err = gitinst.Checkout(targetDir, version, refType)
 	if err != nil {
-		if refType == ourgit.RefTypeHash {
+		if refType == ourgit.RefTypeHash && !offline {
 			// Try fetching this particular hash and retry.
 			localRef := fmt.Sprintf("mos_%s", version)
 			glog.V(2).Infof("%s: trying to fetch %s to %s...", name, version, localRef)
@@ -734,7 +1044,9 @@ func prepareLocalCopyGitLocked(
 			}
 		}
 
-		if wantPull {
+		if wantPull && offline {
+			glog.Infof("%s: offline, not pulling", name)
+		} else if wantPull {
 			freportf(logWriter, "%s: Pulling...", name)
 			err = gitinst.Pull(targetDir, version)
 			if err != nil {
@@ -0,0 +1,87 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/juju/errors"
+	glog "k8s.io/klog/v2"
+
+	"github.com/mongoose-os/mos/cli/ourutil"
+)
+
+// bitbucketAssetName returns the name of the asset in the Downloads section.
+// Bitbucket downloads are not associated with tags, so the version is made
+// part of the name: libfoo-esp32.a at 1.2.3 is libfoo-esp32-1.2.3.a
+// (and its checksum is libfoo-esp32-1.2.3.a.sha256).
+// The unversioned name is only used for "latest".
+func bitbucketAssetName(assetName, tag string) string {
+	if tag == "" || tag == "latest" {
+		return assetName
+	}
+	name, suffix := assetName, ""
+	if strings.HasSuffix(name, ".sha256") {
+		name, suffix = strings.TrimSuffix(name, ".sha256"), ".sha256"
+	}
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s-%s%s%s", strings.TrimSuffix(name, ext), tag, ext, suffix)
+}
+
+// fetchBitbucketAsset fetches the asset from the repo's Downloads section.
+func fetchBitbucketAsset(host, repoPath, tag, assetName, token string) ([]byte, error) {
+	assetName = bitbucketAssetName(assetName, tag)
+	var assetURL string
+	if host == "bitbucket.org" {
+		assetURL = fmt.Sprintf("https://api.bitbucket.org/2.0/repositories/%s/downloads/%s", repoPath, assetName)
+	} else {
+		assetURL = fmt.Sprintf("https://%s/%s/downloads/%s", host, repoPath, assetName)
+	}
+	glog.Infof("%s/%s/%s: Asset URL: %s", repoPath, tag, assetName, assetURL)
+	ourutil.Reportf("Fetching %s (%s) from %s...", assetName, tag, assetURL)
+
+	client := &http.Client{}
+	req, err := http.NewRequest("GET", assetURL, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if token != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to fetch %s", assetURL)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errors.Annotatef(os.ErrNotExist, "%s: no asset %s found in downloads", repoPath, assetName)
+	default:
+		return nil, errors.Errorf("got %d status code when fetching %s (note: private repos may need --credentials)", resp.StatusCode, assetURL)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return data, nil
+}
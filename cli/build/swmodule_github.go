@@ -30,9 +30,11 @@ import (
 	"github.com/mongoose-os/mos/cli/ourutil"
 )
 
-func fetchGitHubAsset(loc, host, repoPath, tag, assetName, token string) ([]byte, error) {
+func fetchGitHubAsset(loc, host, repoPath, tag, assetName, token, apiURL string) ([]byte, error) {
 	var apiURLPrefix string
-	if host == "github.com" {
+	if apiURL != "" {
+		apiURLPrefix = strings.TrimSuffix(apiURL, "/")
+	} else if host == "github.com" {
 		// Try public URL first. Most of our repos (and therefore assets) are public.
 		// API access limits do not apply to public asset access.
 		if strings.HasPrefix(loc, "https://") {
@@ -47,24 +49,15 @@ func fetchGitHubAsset(loc, host, repoPath, tag, assetName, token string) ([]byte
 		apiURLPrefix = fmt.Sprintf("https://%s/api/v3", host)
 	}
 	relMetaURL := fmt.Sprintf("%s/repos/%s/releases/tags/%s", apiURLPrefix, repoPath, tag)
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", relMetaURL, nil)
+	authValue := ""
 	if token != "" {
-		req.Header.Add("Authorization", fmt.Sprintf("token %s", token))
+		authValue = fmt.Sprintf("token %s", token)
 	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, errors.Annotatef(err, "failed to fetch %s", relMetaURL)
-	}
-	defer resp.Body.Close()
-	assetURL := ""
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("got %d status code when fetching %s (note: private repos may need --credentials)", resp.StatusCode, relMetaURL)
-	}
-	relMetaData, err := ioutil.ReadAll(resp.Body)
+	relMetaData, err := fetchReleaseMeta(relMetaURL, "Authorization", authValue)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	assetURL := ""
 	glog.V(4).Infof("%s/%s/%s: Release metadata: %s", repoPath, tag, assetName, string(relMetaData))
 	var relMeta struct {
 		ID     int `json:"id"`
@@ -19,8 +19,6 @@ package build
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"net/url"
 	"os"
 	"regexp"
@@ -35,20 +33,7 @@ var mdLinkRegex = regexp.MustCompile(`\[([^\]]+)\]\(([^\)]+)\)`)
 func fetchGitLabAsset(host, repoPath, tag, assetName, token string) ([]byte, error) {
 	apiURLPrefix := fmt.Sprintf("https://%s/api/v4/projects/%s", host, url.QueryEscape(repoPath))
 	relMetaURL := fmt.Sprintf("%s/releases/%s", apiURLPrefix, tag)
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", relMetaURL, nil)
-	if token != "" {
-		req.Header.Add("PRIVATE-TOKEN", token)
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, errors.Annotatef(err, "failed to fetch %s", relMetaURL)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("got %d status code when fetching %s (note: private repos may need --credentials)", resp.StatusCode, relMetaURL)
-	}
-	relMetaData, err := ioutil.ReadAll(resp.Body)
+	relMetaData, err := fetchReleaseMeta(relMetaURL, "PRIVATE-TOKEN", token)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
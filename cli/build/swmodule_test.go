@@ -17,7 +17,17 @@
 package build
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/juju/errors"
 )
 
 func TestParseGitLocation(t *testing.T) {
@@ -25,6 +35,7 @@ func TestParseGitLocation(t *testing.T) {
 		loc                       string
 		fail                      bool
 		rh, rp, rn, ln, url, path string
+		ref                       string
 	}{
 		{loc: "", fail: true},
 		{loc: "foo", fail: true},
@@ -59,29 +70,218 @@ func TestParseGitLocation(t *testing.T) {
 		{loc: "https://github.com/foo/bar",
 			rh: "github.com", rp: "foo/bar", rn: "bar", ln: "bar", url: "https://github.com/foo/bar", path: ""},
 		{loc: "https://github.com/foo/bar/tree/master/baz",
-			rh: "github.com", rp: "foo/bar", rn: "bar", ln: "baz", url: "https://github.com/foo/bar", path: "baz"},
+			rh: "github.com", rp: "foo/bar", rn: "bar", ln: "baz", url: "https://github.com/foo/bar", path: "baz", ref: "master"},
 		{loc: "https://github.com/foo/bar/tree/master/baz/boo",
-			rh: "github.com", rp: "foo/bar", rn: "bar", ln: "boo", url: "https://github.com/foo/bar", path: "baz/boo"},
+			rh: "github.com", rp: "foo/bar", rn: "bar", ln: "boo", url: "https://github.com/foo/bar", path: "baz/boo", ref: "master"},
 		{loc: "https://gitlab.example.org/foo/-/tree/master/bar",
-			rh: "gitlab.example.org", rp: "foo", rn: "foo", ln: "bar", url: "https://gitlab.example.org/foo", path: "bar"},
+			rh: "gitlab.example.org", rp: "foo", rn: "foo", ln: "bar", url: "https://gitlab.example.org/foo", path: "bar", ref: "master"},
 		{loc: "https://gitlab.example.org/foo/bar/-/tree/master/baz",
-			rh: "gitlab.example.org", rp: "foo/bar", rn: "bar", ln: "baz", url: "https://gitlab.example.org/foo/bar", path: "baz"},
+			rh: "gitlab.example.org", rp: "foo/bar", rn: "bar", ln: "baz", url: "https://gitlab.example.org/foo/bar", path: "baz", ref: "master"},
 		{loc: "https://gitlab.example.org/foo/-/tree/master/bar/baz",
-			rh: "gitlab.example.org", rp: "foo", rn: "foo", ln: "baz", url: "https://gitlab.example.org/foo", path: "bar/baz"},
+			rh: "gitlab.example.org", rp: "foo", rn: "foo", ln: "baz", url: "https://gitlab.example.org/foo", path: "bar/baz", ref: "master"},
+		{loc: "https://gitlab.example.org/foo/-/tree/v1.2/bar/baz",
+			rh: "gitlab.example.org", rp: "foo", rn: "foo", ln: "baz", url: "https://gitlab.example.org/foo", path: "bar/baz", ref: "v1.2"},
 	}
 
 	for _, c := range cases {
-		repoHost, repoPath, repoName, libName, repoURL, pathWithinRepo, err := parseGitLocation(c.loc)
+		repoHost, repoPath, repoName, libName, repoURL, pathWithinRepo, ref, err := parseGitLocation(c.loc)
 		if !c.fail {
 			if err != nil {
 				t.Errorf("%q: expected %q %q %q %q %q, got error instead (%s)", c.loc, c.rp, c.rn, c.ln, c.url, c.path, err)
-			} else if repoHost != c.rh || repoPath != c.rp || repoName != c.rn || libName != c.ln || repoURL != c.url || pathWithinRepo != c.path {
-				t.Errorf("%q: expected %q %q %q %q %q %q, got %q %q %q %q %q %q instead",
-					c.loc, c.rh, c.rp, c.rn, c.ln, c.url, c.path,
-					repoHost, repoPath, repoName, libName, repoURL, pathWithinRepo)
+			} else if repoHost != c.rh || repoPath != c.rp || repoName != c.rn || libName != c.ln || repoURL != c.url || pathWithinRepo != c.path || ref != c.ref {
+				t.Errorf("%q: expected %q %q %q %q %q %q %q, got %q %q %q %q %q %q %q instead",
+					c.loc, c.rh, c.rp, c.rn, c.ln, c.url, c.path, c.ref,
+					repoHost, repoPath, repoName, libName, repoURL, pathWithinRepo, ref)
 			}
 		} else if err == nil {
 			t.Errorf("%q: expected an error, got %q %q %q %q instead", c.loc, repoName, libName, repoURL, pathWithinRepo)
 		}
 	}
 }
+
+func TestGetVersion(t *testing.T) {
+	for _, c := range []struct {
+		m   SWModule
+		exp string
+	}{
+		{m: SWModule{Location: "https://github.com/foo/bar"}, exp: "def"},
+		{m: SWModule{Location: "https://github.com/foo/bar/tree/fix/baz"}, exp: "fix"},
+		{m: SWModule{Location: "https://github.com/foo/bar/tree/fix/baz", Version: "v1"}, exp: "v1"},
+		{m: SWModule{Location: "/src/foo"}, exp: "def"},
+	} {
+		if v := c.m.GetVersion("def"); v != c.exp {
+			t.Errorf("%q %q: expected %q, got %q", c.m.Location, c.m.Version, c.exp, v)
+		}
+	}
+}
+
+func TestGetLocalDirRelative(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appDir := filepath.Join(cwd, "app")
+	for _, c := range []struct {
+		loc, appDir, exp string
+	}{
+		{"libs/foo", appDir, filepath.Join(appDir, "libs", "foo")},
+		{"../foo", appDir, filepath.Join(appDir, "..", "foo")},
+		{"libs/foo", "", filepath.Join(cwd, "libs", "foo")},
+		{cwd, appDir, cwd},
+	} {
+		m := &SWModule{Location: c.loc}
+		m.SetAppDir(c.appDir)
+		if d, err := m.GetLocalDir("/deps", ""); err != nil {
+			t.Errorf("%q %q: %s", c.loc, c.appDir, err)
+		} else if d != c.exp {
+			t.Errorf("%q %q: expected %q, got %q", c.loc, c.appDir, c.exp, d)
+		}
+	}
+}
+
+func TestLatestVersionFromRefs(t *testing.T) {
+	for i, c := range []struct {
+		refs map[string]string
+		exp  string
+	}{
+		{refs: map[string]string{
+			"HEAD":              "aaa",
+			"refs/heads/master": "aaa",
+			"refs/tags/1.9":     "bbb",
+			"refs/tags/1.10":    "ccc",
+			"refs/tags/1.2.3":   "ddd",
+			"refs/tags/latest":  "eee",
+		}, exp: "1.10"},
+		{refs: map[string]string{
+			"refs/heads/master": "aaa",
+			"refs/tags/v2.0":    "bbb",
+			"refs/tags/v2.0.1":  "ccc",
+		}, exp: "v2.0.1"},
+		{refs: map[string]string{
+			"HEAD":              "aaa",
+			"refs/heads/master": "aaa",
+			"refs/tags/foo":     "bbb",
+		}, exp: "aaa"},
+		{refs: map[string]string{}, exp: ""},
+	} {
+		if v := latestVersionFromRefs(c.refs); v != c.exp {
+			t.Errorf("%d: expected %q, got %q", i, c.exp, v)
+		}
+	}
+}
+
+func TestPrepareLocalDirOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "swmodule_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An empty dir would normally be cloned into.
+	if err := os.Mkdir(filepath.Join(dir, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		loc, expDir string
+	}{
+		{"https://github.com/foo/missing", filepath.Join(dir, "missing")},
+		{"https://github.com/foo/empty", filepath.Join(dir, "empty")},
+	} {
+		m := &SWModule{Location: c.loc, Version: "1.2"}
+		m.SetOffline(true)
+		_, err := m.PrepareLocalDir(dir, ioutil.Discard, true, "latest", time.Hour, 0)
+		if err == nil {
+			t.Errorf("%s: expected an error", c.loc)
+			continue
+		}
+		for _, s := range []string{"local copy does not exist", "version 1.2 of " + c.loc, c.expDir, "offline"} {
+			if !strings.Contains(err.Error(), s) {
+				t.Errorf("%s: %q not found in the error: %s", c.loc, s, err)
+			}
+		}
+	}
+}
+
+type fakeAssetFetcher struct {
+	assets  map[string][][]byte // Name -> data returned by consecutive fetches.
+	fetches map[string]int
+}
+
+func (f *fakeAssetFetcher) fetch(name string) ([]byte, error) {
+	if f.fetches == nil {
+		f.fetches = map[string]int{}
+	}
+	data := f.assets[name]
+	if len(data) == 0 {
+		return nil, errors.Annotatef(os.ErrNotExist, "no asset %s", name)
+	}
+	i := f.fetches[name]
+	f.fetches[name]++
+	if i >= len(data) {
+		i = len(data) - 1
+	}
+	return data[i], nil
+}
+
+func TestVerifyAsset(t *testing.T) {
+	good := []byte("!<arch>\nlibfoo")
+	bad := good[:8]
+	goodSum := sha256.Sum256(good)
+	sumFile := []byte(hex.EncodeToString(goodSum[:]) + "  libfoo-esp32.a\n")
+	const name = "libfoo-esp32.a"
+
+	// No checksum asset: data is accepted as is.
+	f := &fakeAssetFetcher{assets: map[string][][]byte{name: {bad}}}
+	if data, err := verifyAsset(f.fetch, name, bad); err != nil || !bytes.Equal(data, bad) {
+		t.Errorf("no checksum: %q %v", data, err)
+	}
+
+	// Checksum matches the first time.
+	f = &fakeAssetFetcher{assets: map[string][][]byte{name: {good}, name + ".sha256": {sumFile}}}
+	if data, err := verifyAsset(f.fetch, name, good); err != nil || !bytes.Equal(data, good) {
+		t.Errorf("good: %q %v", data, err)
+	}
+	if f.fetches[name] != 0 {
+		t.Errorf("good: unexpected re-download")
+	}
+
+	// Truncated first time, re-downloaded successfully.
+	f = &fakeAssetFetcher{assets: map[string][][]byte{name: {good}, name + ".sha256": {sumFile}}}
+	if data, err := verifyAsset(f.fetch, name, bad); err != nil || !bytes.Equal(data, good) {
+		t.Errorf("retry: %q %v", data, err)
+	}
+	if f.fetches[name] != 1 {
+		t.Errorf("retry: expected one re-download, got %d", f.fetches[name])
+	}
+
+	// Still bad after re-download: must fail, and not as "not found"
+	// (which would make the caller create a tombstone).
+	f = &fakeAssetFetcher{assets: map[string][][]byte{name: {bad}, name + ".sha256": {sumFile}}}
+	_, err := verifyAsset(f.fetch, name, bad)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") || os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("mismatch: unexpected error %v", err)
+	}
+	if f.fetches[name] != 1 {
+		t.Errorf("mismatch: expected one re-download, got %d", f.fetches[name])
+	}
+
+	// Malformed checksum file.
+	f = &fakeAssetFetcher{assets: map[string][][]byte{name + ".sha256": {[]byte("<html>")}}}
+	if _, err := verifyAsset(f.fetch, name, good); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestBitbucketAssetName(t *testing.T) {
+	for _, c := range []struct{ name, tag, res string }{
+		{"libfoo-esp32.a", "latest", "libfoo-esp32.a"},
+		{"libfoo-esp32.a", "", "libfoo-esp32.a"},
+		{"libfoo-esp32.a", "1.2.3", "libfoo-esp32-1.2.3.a"},
+		{"libfoo-esp32.a.sha256", "1.2.3", "libfoo-esp32-1.2.3.a.sha256"},
+		{"foo-esp32.zip", "v1.0", "foo-esp32-v1.0.zip"},
+	} {
+		if res := bitbucketAssetName(c.name, c.tag); res != c.res {
+			t.Errorf("%q @ %q: expected %q, got %q", c.name, c.tag, c.res, res)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mongoose-os/mos/cli/build"
+	"github.com/mongoose-os/mos/cli/flags"
+)
+
+func TestGetCredentialsFromEnv(t *testing.T) {
+	creds, err := getCredentialsFromEnv([]string{
+		"PATH=/bin",
+		"MOS_CREDENTIALS_GITHUB_COM=token1",
+		"MOS_CREDENTIALS_MY__GIT_EXAMPLE_COM=user:pass",
+		"MOS_CREDENTIALS_EMPTY_COM=",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]build.Credentials{
+		"github.com":         {User: "mos", Pass: "token1"},
+		"my-git.example.com": {User: "user", Pass: "pass"},
+	}
+	if !reflect.DeepEqual(creds, exp) {
+		t.Errorf("expected %+v, got %+v", exp, creds)
+	}
+
+	if _, err := getCredentialsFromEnv([]string{"MOS_CREDENTIALS_GITHUB_COM=a:b:c"}); err == nil {
+		t.Errorf("expected an error for an invalid value")
+	}
+}
+
+func TestGetCredentialsPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	credsFile := filepath.Join(dir, "creds")
+	ioutil.WriteFile(credsFile, []byte("github.com:file1\ngitlab.com:file2\n"), 0600)
+
+	oldCreds := *flags.Credentials
+	defer func() { *flags.Credentials = oldCreds }()
+	os.Setenv("MOS_CREDENTIALS_GITHUB_COM", "env1")
+	os.Setenv("MOS_CREDENTIALS_EXAMPLE_COM", "env2")
+	defer os.Unsetenv("MOS_CREDENTIALS_GITHUB_COM")
+	defer os.Unsetenv("MOS_CREDENTIALS_EXAMPLE_COM")
+
+	// Env takes precedence over the file.
+	*flags.Credentials = "@" + credsFile
+	creds, err := getCredentialsFromCLI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]build.Credentials{
+		"github.com":  {User: "mos", Pass: "env1"},
+		"gitlab.com":  {User: "mos", Pass: "file2"},
+		"example.com": {User: "mos", Pass: "env2"},
+	}
+	if !reflect.DeepEqual(creds, exp) {
+		t.Errorf("expected %+v, got %+v", exp, creds)
+	}
+
+	// Command line takes precedence over env.
+	*flags.Credentials = "github.com:cli1,default"
+	if creds, err = getCredentialsFromCLI(); err != nil {
+		t.Fatal(err)
+	}
+	exp = map[string]build.Credentials{
+		"":            {User: "mos", Pass: "default"},
+		"github.com":  {User: "mos", Pass: "cli1"},
+		"example.com": {User: "mos", Pass: "env2"},
+	}
+	if !reflect.DeepEqual(creds, exp) {
+		t.Errorf("expected %+v, got %+v", exp, creds)
+	}
+
+	// Nothing is set.
+	*flags.Credentials = ""
+	os.Unsetenv("MOS_CREDENTIALS_GITHUB_COM")
+	os.Unsetenv("MOS_CREDENTIALS_EXAMPLE_COM")
+	if creds, err = getCredentialsFromCLI(); err != nil || creds != nil {
+		t.Errorf("expected no credentials, got %+v %v", creds, err)
+	}
+}
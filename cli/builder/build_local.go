@@ -14,22 +14,21 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 //
-package main
+package builder
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
-	"syscall"
 	"time"
 
 	"context"
@@ -37,38 +36,18 @@ import (
 	"github.com/juju/errors"
 	"github.com/mongoose-os/mos/cli/build"
 	moscommon "github.com/mongoose-os/mos/cli/common"
-	"github.com/mongoose-os/mos/cli/flags"
+	"github.com/mongoose-os/mos/cli/errcode"
 	"github.com/mongoose-os/mos/cli/interpreter"
 	"github.com/mongoose-os/mos/cli/manifest_parser"
 	"github.com/mongoose-os/mos/cli/mosgit"
 	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/cli/trace"
 	"github.com/mongoose-os/mos/common/multierror"
 	"github.com/mongoose-os/mos/common/ourio"
 	yaml "gopkg.in/yaml.v2"
 	glog "k8s.io/klog/v2"
 )
 
-func buildLocal(ctx context.Context, bParams *build.BuildParams) error {
-	if isInDockerToolbox() {
-		freportf(logWriterStderr, "Docker Toolbox detected")
-	}
-
-	buildDir := moscommon.GetBuildDir(projectDir)
-
-	buildErr := buildLocal2(ctx, bParams)
-
-	if !bParams.Verbose && buildErr != nil {
-		log, err := os.Open(moscommon.GetBuildLogFilePath(buildDir))
-		if err != nil {
-			glog.Errorf("can't read build log: %s", err)
-		} else {
-			io.Copy(os.Stdout, log)
-		}
-	}
-
-	return buildErr
-}
-
 func generateCflags(cflags []string, cdefs map[string]string) string {
 	kk := []string{}
 	for k, _ := range cdefs {
@@ -80,7 +59,7 @@ func generateCflags(cflags []string, cdefs map[string]string) string {
 		cflags = append(cflags, fmt.Sprintf("-D%s=%s", k, v))
 	}
 
-	return strings.Join(append(cflags), " ")
+	return strings.Join(cflags, " ")
 }
 
 func absPathSlice(slice []string, checkExist bool) ([]string, error) {
@@ -106,7 +85,7 @@ func absPathSlice(slice []string, checkExist bool) ([]string, error) {
 	return ret, nil
 }
 
-func buildLocal2(ctx context.Context, bParams *build.BuildParams) (err error) {
+func (b *builder) buildLocal(ctx context.Context, bParams *build.BuildParams) (err error) {
 	gitinst := mosgit.NewOurGit(nil)
 
 	buildDir := moscommon.GetBuildDir(projectDir)
@@ -130,7 +109,8 @@ func buildLocal2(ctx context.Context, bParams *build.BuildParams) (err error) {
 	if bParams.Clean {
 		// Cleanup build dir, but leave build log intact, because we're already
 		// writing to it.
-		if err := ourio.RemoveFromDir(buildDir, []string{moscommon.GetBuildLogFilePath("")}); err != nil {
+		// FS image cache is keyed by the hash of the inputs, so it is kept too.
+		if err := ourio.RemoveFromDir(buildDir, []string{moscommon.GetBuildLogFilePath(""), moscommon.GetFSImageCacheDir("")}); err != nil {
 			return errors.Trace(err)
 		}
 	} else {
@@ -146,24 +126,45 @@ func buildLocal2(ctx context.Context, bParams *build.BuildParams) (err error) {
 	}
 
 	compProvider := compProviderReal{
-		bParams:   bParams,
-		logWriter: logWriter,
+		p:               b.p,
+		logWriter:       b.logWriter,
+		logWriterStderr: b.logWriterStderr,
 	}
 
-	interp := interpreter.NewInterpreter(newMosVars())
+	interp := interpreter.NewInterpreter(NewMosVars())
 
-	appDir, err := getCodeDirAbs()
+	appDir, err := GetCodeDirAbs()
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	manifest, fp, err := manifest_parser.ReadManifestFinal(
-		appDir, &bParams.ManifestAdjustments, logWriter, interp,
-		&manifest_parser.ReadManifestCallbacks{ComponentProvider: &compProvider},
-		true /* requireArch */, bParams.PreferPrebuiltLibs, bParams.LibsUpdateInterval)
+	manifest, fp, err := b.readManifestFinal(appDir, bParams, interp, &compProvider)
 	if err != nil {
 		return errors.Annotatef(err, "error parsing manifest")
 	}
+	b.manifest = manifest
+
+	if board := bParams.BuildVars["BOARD"]; board != "" {
+		boards, ok, err := manifest_parser.GetBoards(manifest, interp)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if ok && len(boards) > 0 {
+			if err := manifest_parser.CheckBoard(board, boards); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	if err := manifest_parser.CheckDepPolicy(manifest, bParams.ForbiddenLibs); err != nil {
+		return errors.Trace(err)
+	}
+
+	if b.p.SinceGit != "" {
+		if err := b.checkChangedSinceGit(gitinst, appDir, manifest, fp); err != nil {
+			return errors.Trace(err)
+		}
+	}
 
 	// Write final manifest to build dir
 	manifestUpdated, err := ourio.WriteYAMLFileIfDifferent(moscommon.GetMosFinalFilePath(buildDirAbs), manifest, 0666)
@@ -172,10 +173,10 @@ func buildLocal2(ctx context.Context, bParams *build.BuildParams) (err error) {
 	}
 	// Force clean rebuild if manifest was updated
 	if manifestUpdated && !bParams.Clean {
-		freportf(logWriter, "== Manifest has changed, forcing a clean rebuild...")
+		ourutil.Freportf(b.logWriter, "== Manifest has changed, forcing a clean rebuild...")
 		bParams2 := *bParams
 		bParams2.Clean = true
-		return buildLocal2(ctx, &bParams2)
+		return b.buildLocal(ctx, &bParams2)
 	}
 
 	switch manifest.Type {
@@ -183,7 +184,7 @@ func buildLocal2(ctx context.Context, bParams *build.BuildParams) (err error) {
 		// Fine
 	case build.ManifestTypeLib:
 		bParams.BuildTarget = moscommon.GetOrigLibArchiveFilePath(buildDir, manifest.Platform)
-		*buildCmdExtra = append(*buildCmdExtra, "MGOS_MAIN_COMPONENT=moslib")
+		b.makeArgsExtra = append(b.makeArgsExtra, "MGOS_MAIN_COMPONENT=moslib")
 	default:
 		return errors.Errorf("invalid project type: %q", manifest.Type)
 	}
@@ -244,6 +245,17 @@ func buildLocal2(ctx context.Context, bParams *build.BuildParams) (err error) {
 		return errors.Trace(err)
 	}
 
+	// Build info changes with every build, it does not invalidate the FS cache.
+	fsHashFiles := appFSFiles
+
+	if bParams.IncludeBuildInfo && manifest.Type == build.ManifestTypeApp {
+		biFile, err := b.writeBuildInfo(genDir, manifest, bParams.GitInfo)
+		if err != nil {
+			return errors.Annotatef(err, "failed to generate build info")
+		}
+		appFSFiles = append(appFSFiles, biFile)
+	}
+
 	appBinLibs, err := absPathSlice(manifest.BinaryLibs, true /* checkExist */)
 	if err != nil {
 		return errors.Trace(err)
@@ -264,13 +276,13 @@ func buildLocal2(ctx context.Context, bParams *build.BuildParams) (err error) {
 		return errors.Trace(err)
 	}
 
-	freportf(logWriter, "Sources: %v", appSources)
-	freportf(logWriter, "Include dirs: %v", appIncludes)
-	freportf(logWriter, "Binary libs: %v", appBinLibs)
+	ourutil.Freportf(b.logWriter, "Sources: %v", appSources)
+	ourutil.Freportf(b.logWriter, "Include dirs: %v", appIncludes)
+	ourutil.Freportf(b.logWriter, "Binary libs: %v", appBinLibs)
 
 	appName := manifest.Name
 
-	freportf(logWriter, "Building %s...", appName)
+	ourutil.Freportf(b.logWriter, "Building %s...", appName)
 
 	var errs error
 	for k, v := range map[string]string{
@@ -306,7 +318,7 @@ func buildLocal2(ctx context.Context, bParams *build.BuildParams) (err error) {
 		}
 	}
 
-	appPath, err := getCodeDirAbs()
+	appPath, err := GetCodeDirAbs()
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -317,6 +329,29 @@ func buildLocal2(ctx context.Context, bParams *build.BuildParams) (err error) {
 		makeVarsFileSupported = bytes.Contains(data, []byte("MGOS_VARS_FILE"))
 	}
 
+	// FS image cache {{{
+	fsHash := ""
+	var fsCacheIdx *fsCacheIndex
+	if b.p.FSCache && manifest.Type == build.ManifestTypeApp && bParams.BuildTarget == moscommon.BuildTargetDefault {
+		var confSchemaFiles []string
+		if curConfSchemaFName != "" {
+			confSchemaFiles = append(confSchemaFiles, curConfSchemaFName)
+		}
+		fsVars := map[string]string{}
+		for k, v := range manifest.BuildVars {
+			if !fsCacheIgnoredVars[k] {
+				fsVars[k] = v
+			}
+		}
+		if fsHash, err = fsInputsHash(fsHashFiles, confSchemaFiles, fsVars); err != nil {
+			return errors.Annotatef(err, "failed to hash FS files")
+		}
+		if !bParams.DryRun {
+			fsCacheIdx = b.restoreFSImages(buildDirAbs, fsHash)
+		}
+	}
+	// }}}
+
 	appSubdir := ""
 
 	// Invoke actual build (docker or make) {{{
@@ -329,11 +364,11 @@ func buildLocal2(ctx context.Context, bParams *build.BuildParams) (err error) {
 
 		gitToplevelDir, _ := gitinst.GetToplevelDir(appPath)
 
-		if *flags.BuildDockerNoMounts {
+		if b.p.DockerNoMounts {
 			// User wants no mounts, just use paths directly.
 			dockerAppPath = appPath
 			dockerMgosPath = fp.MosDirEffective
-			if len(*flags.BuildDockerExtra) == 0 {
+			if len(b.p.DockerExtra) == 0 {
 				glog.Warning("--build-docker-no-mounts specified but no --build-docker-extra " +
 					"arguments given, build will most likely fail.")
 			}
@@ -361,39 +396,39 @@ func buildLocal2(ctx context.Context, bParams *build.BuildParams) (err error) {
 			// original path outside the container, whatever it may be, so that absolute
 			// path references continue to work (e.g. Git submodules are known to use
 			// abs. paths).
-			mp.addMountPoint(appMountPath, dockerAppPath)
-			mp.addMountPoint(fp.MosDirEffective, dockerMgosPath)
-			mp.addMountPoint(fp.MosDirEffective, ourutil.GetPathForDocker(fp.MosDirEffective))
+			mp.addMountPoint(appMountPath, dockerAppPath, b.logWriter)
+			mp.addMountPoint(fp.MosDirEffective, dockerMgosPath, b.logWriter)
+			mp.addMountPoint(fp.MosDirEffective, ourutil.GetPathForDocker(fp.MosDirEffective), b.logWriter)
 
 			manifest.BuildVars["MGOS_PATH"] = ourutil.GetPathForDocker(fp.MosDirEffective)
 
 			// Mount build dir
-			mp.addMountPoint(buildDirAbs, ourutil.GetPathForDocker(buildDirAbs))
+			mp.addMountPoint(buildDirAbs, ourutil.GetPathForDocker(buildDirAbs), b.logWriter)
 
 			// Mount all dirs with source files
 			for _, d := range appSourceDirs {
-				mp.addMountPoint(d, ourutil.GetPathForDocker(d))
+				mp.addMountPoint(d, ourutil.GetPathForDocker(d), b.logWriter)
 			}
 
 			// Mount all include paths
 			for _, d := range appIncludes {
-				mp.addMountPoint(d, ourutil.GetPathForDocker(d))
+				mp.addMountPoint(d, ourutil.GetPathForDocker(d), b.logWriter)
 			}
 
 			// Mount all dirs with filesystem files
 			for _, d := range appFSDirs {
-				mp.addMountPoint(d, ourutil.GetPathForDocker(d))
+				mp.addMountPoint(d, ourutil.GetPathForDocker(d), b.logWriter)
 			}
 
 			// Mount all dirs with binary libs
 			for _, d := range appBinLibDirs {
-				mp.addMountPoint(d, ourutil.GetPathForDocker(d))
+				mp.addMountPoint(d, ourutil.GetPathForDocker(d), b.logWriter)
 			}
 
 			// If generated config schema file is present, mount its dir as well
 			if curConfSchemaFName != "" {
 				d := filepath.Dir(curConfSchemaFName)
-				mp.addMountPoint(d, ourutil.GetPathForDocker(d))
+				mp.addMountPoint(d, ourutil.GetPathForDocker(d), b.logWriter)
 			}
 
 			for containerPath, hostPath := range mp {
@@ -425,11 +460,11 @@ func buildLocal2(ctx context.Context, bParams *build.BuildParams) (err error) {
 		}
 
 		// Add extra docker args
-		dockerRunArgs = append(dockerRunArgs, (*flags.BuildDockerExtra)...)
+		dockerRunArgs = append(dockerRunArgs, b.p.DockerExtra...)
 
 		sdkVersionFile := moscommon.GetSdkVersionFile(fp.MosDirEffective, manifest.Platform)
 
-		buildImage := *flags.BuildImage
+		buildImage := b.p.BuildImage
 
 		if buildImage == "" {
 			// Get build image name and tag from the repo.
@@ -445,23 +480,28 @@ func buildLocal2(ctx context.Context, bParams *build.BuildParams) (err error) {
 
 		dockerRunArgs = append(dockerRunArgs, buildImage)
 
-		makeArgs, err := getMakeArgs(
+		makeArgs, err := b.getMakeArgs(
 			filepath.ToSlash(fmt.Sprintf("%s%s", dockerAppPath, appSubdir)),
 			makeFilePath,
 			bParams.BuildTarget,
 			buildDirAbs,
 			manifest,
 			makeVarsFileSupported,
+			false, /* inContainer */
 		)
 		if err != nil {
 			return errors.Trace(err)
 		}
 
+		if b.p.DumpMakeVars {
+			b.printMakeVars(manifest, "make '"+strings.Join(makeArgs, "' '")+"'")
+		}
+
 		dockerRunArgs = append(dockerRunArgs,
 			"/bin/bash", "-c", "nice make '"+strings.Join(makeArgs, "' '")+"'",
 		)
 
-		if err := runDockerBuild(dockerRunArgs, bParams.DryRun); err != nil {
+		if err := b.runDockerBuild(ctx, dockerRunArgs, bParams.DryRun); err != nil {
 			return errors.Trace(err)
 		}
 		if bParams.DryRun {
@@ -472,28 +512,38 @@ func buildLocal2(ctx context.Context, bParams *build.BuildParams) (err error) {
 
 		manifest.BuildVars["MGOS_PATH"] = fp.MosDirEffective
 
-		makeArgs, err := getMakeArgs(
+		makeArgs, err := b.getMakeArgs(
 			appPath,
 			makeFilePath,
 			bParams.BuildTarget,
 			buildDirAbs,
 			manifest,
 			makeVarsFileSupported,
+			true, /* inContainer */
 		)
 		if err != nil {
 			return errors.Trace(err)
 		}
 
-		freportf(logWriter, "Make arguments: %s", strings.Join(makeArgs, " "))
+		ourutil.Freportf(b.logWriter, "Make arguments: %s", strings.Join(makeArgs, " "))
+
+		if b.p.DumpMakeVars {
+			b.printMakeVars(manifest, "make "+strings.Join(makeArgs, " "))
+		}
 
 		if bParams.DryRun {
 			return nil
 		}
 
-		cmd := exec.Command("make", makeArgs...)
-		err = runCmd(cmd, logWriter)
+		cmd := exec.CommandContext(ctx, "make", makeArgs...)
+		endMake := trace.Span("build", "make")
+		err = runCmd(cmd, b.logWriter)
+		endMake()
+		if ctx.Err() != nil {
+			return errors.Annotatef(ctx.Err(), "build aborted")
+		}
 		if err != nil {
-			return errors.Trace(err)
+			return errcode.Wrap(errors.Trace(err), errcode.BuildFailed, nil)
 		}
 	}
 	// }}}
@@ -510,6 +560,12 @@ func buildLocal2(ctx context.Context, bParams *build.BuildParams) (err error) {
 		if err != nil {
 			return errors.Trace(err)
 		}
+
+		if fsHash != "" {
+			if err := b.updateFSImages(buildDirAbs, fwFilename, fsHash, fsCacheIdx); err != nil {
+				return errors.Annotatef(err, "failed to update the FS image cache")
+			}
+		}
 	} else if p := moscommon.GetOrigLibArchiveFilePath(buildDir, manifest.Platform); bParams.BuildTarget == p {
 		// Copy lib to build/lib.a
 		err = ourio.LinkOrCopyFile(
@@ -527,10 +583,18 @@ func isInDockerToolbox() bool {
 	return os.Getenv("DOCKER_HOST") != ""
 }
 
-func getMakeArgs(dir, makeFilePath, target, buildDirAbs string, manifest *build.FWAppManifest, makeVarsFileSupported bool) ([]string, error) {
-	j := *flags.BuildParalellism
+// getMakeArgs returns make arguments. inContainer is true when make is invoked
+// directly inside the build container: only then the cgroup CPU quota can be
+// seen, and is used to limit parallelism.
+func (b *builder) getMakeArgs(dir, makeFilePath, target, buildDirAbs string, manifest *build.FWAppManifest, makeVarsFileSupported, inContainer bool) ([]string, error) {
+	j := b.p.Parallelism
 	if j == 0 {
 		j = runtime.NumCPU()
+		// NumCPU reports host CPUs even if the container is limited.
+		if n := cgroupCPULimit(cgroupRoot); inContainer && n > 0 && n < j {
+			ourutil.Freportf(b.logWriter, "Limiting build parallelism to %d according to the cgroup CPU quota", n)
+			j = n
+		}
 	}
 
 	// If target contains a slash, assume it's a path name, and absolutize it
@@ -568,13 +632,22 @@ func getMakeArgs(dir, makeFilePath, target, buildDirAbs string, manifest *build.
 		makeArgs = append(makeArgs, getMakeVars(manifest.BuildVars, false /* escHash */)...)
 	}
 	// Add extra make args
-	if buildCmdExtra != nil {
-		makeArgs = append(makeArgs, (*buildCmdExtra)...)
-	}
+	makeArgs = append(makeArgs, b.makeArgsExtra...)
 
 	return makeArgs, nil
 }
 
+// printMakeVars prints the resolved make vars and the make command line,
+// for debugging.
+func (b *builder) printMakeVars(manifest *build.FWAppManifest, makeCmd string) {
+	ourutil.Freportf(b.logWriterStderr, "Make variables:")
+	for _, v := range getMakeVars(manifest.BuildVars, false /* escHash */) {
+		ourutil.Freportf(b.logWriterStderr, "  %s", v)
+	}
+	ourutil.Freportf(b.logWriterStderr, "Make command line:")
+	ourutil.Freportf(b.logWriterStderr, "  %s", makeCmd)
+}
+
 func getMakeVars(vars map[string]string, escHash bool) []string {
 	kk := []string{}
 	for k, _ := range vars {
@@ -599,7 +672,7 @@ type mountPoints map[string]string
 // addMountPoint adds a mount point from given hostPath to containerPath. If
 // something is already mounted to the given containerPath, then it's compared
 // to the new hostPath value; if they are not equal, an error is returned.
-func (mp mountPoints) addMountPoint(hostPath, containerPath string) error {
+func (mp mountPoints) addMountPoint(hostPath, containerPath string, logWriter io.Writer) error {
 	// Do not mount non-existent paths. This can happen for auto-generated paths
 	// such as src/${platform} where no platform-specific sources exist.
 	if _, err := os.Stat(hostPath); err != nil {
@@ -612,7 +685,7 @@ func (mp mountPoints) addMountPoint(hostPath, containerPath string) error {
 		hostPath = ourutil.GetPathForDocker(hostPath)
 	}
 
-	freportf(logWriter, "mount from %q to %q", hostPath, containerPath)
+	ourutil.Freportf(logWriter, "mount from %q to %q", hostPath, containerPath)
 	if v, ok := mp[containerPath]; ok {
 		if hostPath != v {
 			return errors.Errorf("adding mount point from %q to %q, but it already mounted from %q", hostPath, containerPath, v)
@@ -640,6 +713,21 @@ func addBuildVar(manifest *build.FWAppManifest, name, value string) error {
 	return nil
 }
 
+// writeBuildInfo generates build info file in the genDir, returns its path.
+func (b *builder) writeBuildInfo(genDir string, manifest *build.FWAppManifest, gi *build.GitInfo) (string, error) {
+	bi := build.GenerateBuildInfo(manifest, gi, time.Now())
+	data, err := json.MarshalIndent(bi, "", "  ")
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	fname := filepath.Join(genDir, build.BuildInfoFileName)
+	if err := ioutil.WriteFile(fname, data, 0666); err != nil {
+		return "", errors.Trace(err)
+	}
+	ourutil.Freportf(b.logWriter, "Build info: %s", bi.BuildID)
+	return fname, nil
+}
+
 // getPathsForDocker calls ourutil.GetPathForDocker for each paths in the slice,
 // and returns modified slice
 func getPathsForDocker(p []string) []string {
@@ -650,7 +738,9 @@ func getPathsForDocker(p []string) []string {
 	return ret
 }
 
-func runDockerBuild(dockerRunArgs []string, dryRun bool) error {
+// runDockerBuild runs the build container. If ctx is done before the build
+// finishes, the container is killed.
+func (b *builder) runDockerBuild(ctx context.Context, dockerRunArgs []string, dryRun bool) error {
 	containerName := fmt.Sprintf(
 		"mos_build_%s_%d", time.Now().Format("2006-01-02T15-04-05-00"), rand.Int(),
 	)
@@ -659,45 +749,55 @@ func runDockerBuild(dockerRunArgs []string, dryRun bool) error {
 		[]string{"run", "--name", containerName}, dockerRunArgs...,
 	)
 
-	freportf(logWriter, "Docker arguments: %s", strings.Join(dockerArgs, " "))
+	ourutil.Freportf(b.logWriter, "Docker arguments: %s", strings.Join(dockerArgs, " "))
 
 	if dryRun {
 		return nil
 	}
 
-	// When make runs with -j and we interrupt the container with Ctrl+C, make
-	// becomes a runaway process eating 100% of one CPU core. So far we failed
-	// to fix it properly, so the workaround is to kill the container on the
-	// reception of SIGINT or SIGTERM.
-	signals := []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	defer trace.Span("build", "docker")()
 
-	sigCh := make(chan os.Signal, 1)
+	if _, err := exec.LookPath("docker"); err != nil {
+		return errcode.Wrap(errors.Annotatef(err, "docker is required for local builds"), errcode.DockerUnavailable, nil)
+	}
+
+	if ctx.Err() != nil {
+		return errors.Annotatef(ctx.Err(), "build aborted")
+	}
 
-	// Signal handler goroutine: on SIGINT and SIGTERM it will kill the container
-	// and exit(1). When the sigCh is closed, goroutine returns.
+	// Killing the docker client is not enough, the container will keep running.
+	// The container may not be created yet when ctx is done, so keep killing it
+	// until the client exits: it is run with --rm, so it is gone by then.
+	doneCh := make(chan struct{})
+	defer close(doneCh)
 	go func() {
-		if _, ok := <-sigCh; !ok {
+		select {
+		case <-ctx.Done():
+			ourutil.Freportf(b.logWriterStderr, "Build aborted, killing the container %q...", containerName)
+		case <-doneCh:
 			return
 		}
-
-		freportf(logWriterStderr, "\nCleaning up the container %q...", containerName)
-		cmd := exec.Command("docker", "kill", containerName)
-		cmd.Run()
-
-		os.Exit(1)
-	}()
-
-	signal.Notify(sigCh, signals...)
-	defer func() {
-		// Unsubscribe from the signals and close the channel so that the signal
-		// handler goroutine is properly cleaned up
-		signal.Reset(signals...)
-		close(sigCh)
+		for {
+			exec.Command("docker", "kill", containerName).Run()
+			select {
+			case <-time.After(time.Second):
+			case <-doneCh:
+				return
+			}
+		}
 	}()
 
 	cmd := exec.Command("docker", dockerArgs...)
-	if err := runCmd(cmd, logWriter); err != nil {
-		return errors.Trace(err)
+	err := runCmd(cmd, b.logWriter)
+	if ctx.Err() != nil {
+		return errors.Annotatef(ctx.Err(), "build aborted")
+	}
+	if err != nil {
+		// Docker itself uses exit code 125 for its own (not the command's) errors.
+		if ee, ok := errors.Cause(err).(*exec.ExitError); ok && ee.ExitCode() != 125 {
+			return errcode.Wrap(errors.Trace(err), errcode.BuildFailed, nil)
+		}
+		return errcode.Wrap(errors.Trace(err), errcode.DockerUnavailable, nil)
 	}
 
 	return nil
@@ -14,16 +14,18 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 //
-package main
+package builder
 
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -36,7 +38,7 @@ import (
 	"github.com/mongoose-os/mos/cli/build/archive"
 	moscommon "github.com/mongoose-os/mos/cli/common"
 	"github.com/mongoose-os/mos/cli/common/paths"
-	"github.com/mongoose-os/mos/cli/flags"
+	"github.com/mongoose-os/mos/cli/errcode"
 	"github.com/mongoose-os/mos/cli/interpreter"
 	"github.com/mongoose-os/mos/cli/manifest_parser"
 	"github.com/mongoose-os/mos/cli/ourutil"
@@ -50,14 +52,20 @@ const (
 	localLibsDir = "local_libs"
 )
 
-func buildRemote(bParams *build.BuildParams) error {
-	appDir, err := getCodeDirAbs()
+func (b *builder) buildRemote(ctx context.Context, bParams *build.BuildParams) error {
+	appDir, err := GetCodeDirAbs()
 	if err != nil {
 		return errors.Trace(err)
 	}
 
 	buildDir := moscommon.GetBuildDir(projectDir)
 
+	// Build context name and stat of the previous build are sent to the server
+	// so that it can update the context incrementally instead of starting from
+	// scratch. Read them before the build dir is wiped.
+	buildCtxName, _ := ioutil.ReadFile(moscommon.GetBuildCtxFilePath(buildDir))
+	buildStat, _ := ioutil.ReadFile(moscommon.GetBuildStatFilePath(buildDir))
+
 	os.RemoveAll(buildDir)
 	if err := os.MkdirAll(buildDir, 0755); err != nil {
 		return errors.Annotatef(err, "failed to create build directory")
@@ -69,11 +77,13 @@ func buildRemote(bParams *build.BuildParams) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
-	if !*flags.KeepTempFiles {
+	if !b.p.KeepTempFiles {
 		defer os.RemoveAll(appStagingDir)
+	} else {
+		defer paths.ReleaseTempDir(appStagingDir)
 	}
 	if bParams.Verbose {
-		ourutil.Reportf("Using %s as staging dir", appStagingDir)
+		ourutil.Freportf(b.logWriterStderr, "Using %s as staging dir", appStagingDir)
 	}
 
 	// Since we're going to copy sources to the temp dir, make sure that nobody
@@ -86,11 +96,23 @@ func buildRemote(bParams *build.BuildParams) error {
 		return errors.Trace(err)
 	}
 
+	// Local dep overrides are uploaded the same way as --lib.
+	for n, do := range bParams.DepOverrides {
+		if isURL(do.Location) {
+			continue
+		}
+		if bParams.CustomLibLocations == nil {
+			bParams.CustomLibLocations = map[string]string{}
+		}
+		bParams.CustomLibLocations[n] = do.Location
+		delete(bParams.DepOverrides, n)
+	}
+
 	// Copy CustomLibLocations and CustomModuleLocations to deps
 	for n, libDir := range bParams.CustomLibLocations {
 		libDirStaging := filepath.Join(appStagingDir, depsDir, n)
 		if bParams.Verbose {
-			ourutil.Reportf("Copying %s", libDir)
+			ourutil.Freportf(b.logWriterStderr, "Copying %s", libDir)
 		}
 		if err := ourio.CopyDir(libDir, libDirStaging, []string{".git"}); err != nil {
 			return errors.Annotatef(err, "failed to copy lib %s", n)
@@ -100,7 +122,7 @@ func buildRemote(bParams *build.BuildParams) error {
 	for n, moduleDir := range bParams.CustomModuleLocations {
 		moduleDirStaging := filepath.Join(appStagingDir, depsDir, "modules", n)
 		if bParams.Verbose {
-			ourutil.Reportf("Copying %s", moduleDir)
+			ourutil.Freportf(b.logWriterStderr, "Copying %s", moduleDir)
 		}
 		if err := ourio.CopyDir(moduleDir, moduleDirStaging, []string{".git"}); err != nil {
 			return errors.Annotatef(err, "failed to copy module %s", n)
@@ -108,12 +130,15 @@ func buildRemote(bParams *build.BuildParams) error {
 	}
 	bParams.CustomModuleLocations = nil
 
-	interp := interpreter.NewInterpreter(newMosVars())
+	interp := interpreter.NewInterpreter(NewMosVars())
 
 	manifest, _, err := manifest_parser.ReadManifest(appStagingDir, &bParams.ManifestAdjustments, interp)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	// mos.<env>.yml is merged into the manifest which is uploaded instead of
+	// the original one, the server must not apply it again.
+	bParams.Env = ""
 
 	if manifest.Platform == "" {
 		return errors.Errorf("--platform must be specified or mos.yml should contain a platform key")
@@ -139,20 +164,26 @@ func buildRemote(bParams *build.BuildParams) error {
 		return errors.Errorf("invalid project type: %q", manifest.Type)
 	}
 
+	// Extra sources become part of the manifest, local paths mean nothing
+	// to the server.
+	manifest.Sources = append(manifest.Sources, bParams.ExtraSources...)
+	manifest.Includes = append(manifest.Includes, bParams.ExtraIncludes...)
+	bParams.ExtraSources, bParams.ExtraIncludes = nil, nil
+
 	// Copy all external code (which is outside of the appDir) under appStagingDir {{{
-	if err := copyExternalCodeAll(&manifest.Sources, appDir, appStagingDir); err != nil {
+	if err := b.copyExternalCodeAll(manifest.Sources, appDir, appStagingDir); err != nil {
 		return errors.Trace(err)
 	}
 
-	if err := copyExternalCodeAll(&manifest.Includes, appDir, appStagingDir); err != nil {
+	if err := b.copyExternalCodeAll(manifest.Includes, appDir, appStagingDir); err != nil {
 		return errors.Trace(err)
 	}
 
-	if err := copyExternalCodeAll(&manifest.Filesystem, appDir, appStagingDir); err != nil {
+	if err := b.copyExternalCodeAll(manifest.Filesystem, appDir, appStagingDir); err != nil {
 		return errors.Trace(err)
 	}
 
-	if err := copyExternalCodeAll(&manifest.BinaryLibs, appDir, appStagingDir); err != nil {
+	if err := b.copyExternalCodeAll(manifest.BinaryLibs, appDir, appStagingDir); err != nil {
 		return errors.Trace(err)
 	}
 	// }}}
@@ -180,6 +211,7 @@ func buildRemote(bParams *build.BuildParams) error {
 		if err != nil {
 			return errors.Trace(err)
 		}
+		l.SetAppDir(appDir)
 		libDir, err := l.GetLocalDir("XX", "")
 		if err != nil {
 			return errors.Trace(err)
@@ -192,7 +224,7 @@ func buildRemote(bParams *build.BuildParams) error {
 			if err := os.MkdirAll(lld, 0755); err != nil {
 				return errors.Trace(err)
 			}
-			freportf(logWriter, "Copying %s -> %s", libDir, lld)
+			ourutil.Freportf(b.logWriter, "Copying %s -> %s", libDir, lld)
 			if err = ourio.CopyDir(libDir, lld, nil); err != nil {
 				return errors.Annotatef(err, "failed to relocate %q from %q to %q", libName, libDir, lld)
 			}
@@ -210,6 +242,12 @@ func buildRemote(bParams *build.BuildParams) error {
 		return errors.Trace(err)
 	}
 
+	// The server has a different environment, expand env vars here.
+	manifestData, err = expandEnvVarsInYAML(manifestData)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
 	err = ioutil.WriteFile(
 		moscommon.GetManifestFilePath(appStagingDir),
 		manifestData,
@@ -240,7 +278,7 @@ func buildRemote(bParams *build.BuildParams) error {
 
 	// create a zip out of the code dir
 	os.Chdir(appStagingDir)
-	src, err := zipUp(bParams, ".", whitelist, transformers)
+	src, err := b.zipUp(bParams, ".", whitelist, transformers)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -281,16 +319,20 @@ func buildRemote(bParams *build.BuildParams) error {
 		return errors.Trace(err)
 	}
 
-	if data, err := ioutil.ReadFile(moscommon.GetBuildCtxFilePath(buildDir)); err == nil {
-		// Successfully read build context name, transmit it to the remote builder
-		if err := mpw.WriteField(moscommon.FormBuildCtxName, string(data)); err != nil {
+	if b.p.Timeout > 0 {
+		if err := mpw.WriteField(moscommon.FormBuildTimeoutName, b.p.Timeout.String()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if len(buildCtxName) > 0 {
+		if err := mpw.WriteField(moscommon.FormBuildCtxName, string(buildCtxName)); err != nil {
 			return errors.Trace(err)
 		}
 	}
 
-	if data, err := ioutil.ReadFile(moscommon.GetBuildStatFilePath(buildDir)); err == nil {
-		// Successfully read build stat, transmit it to the remote builder
-		if err := mpw.WriteField(moscommon.FormBuildStatName, string(data)); err != nil {
+	if len(buildStat) > 0 {
+		if err := mpw.WriteField(moscommon.FormBuildStatName, string(buildStat)); err != nil {
 			return errors.Trace(err)
 		}
 	}
@@ -299,14 +341,14 @@ func buildRemote(bParams *build.BuildParams) error {
 		return errors.Trace(err)
 	}
 
-	server, err := serverURL()
+	server, err := b.serverURL()
 	if err != nil {
 		return errors.Trace(err)
 	}
 
 	buildUser := "test"
 	buildPass := "test"
-	freportf(logWriterStderr, "Connecting to %s, user %s", server, buildUser)
+	ourutil.Freportf(b.logWriterStderr, "Connecting to %s, user %s", server, buildUser)
 
 	// invoke the fwbuild API (replace "master" with "latest")
 	fwbuildVersion := version.GetMosVersion()
@@ -317,59 +359,48 @@ func buildRemote(bParams *build.BuildParams) error {
 
 	uri := fmt.Sprintf("%s/api/fwbuild/%s/build", server, fwbuildVersion)
 
-	freportf(logWriterStderr, "Uploading sources (%d bytes)", len(body.Bytes()))
-	req, err := http.NewRequest("POST", uri, body)
-	req.Header.Set("Content-Type", mpw.FormDataContentType())
-	req.Header.Add("User-Agent", version.GetUserAgent())
-	req.SetBasicAuth(buildUser, buildPass)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	ourutil.Freportf(b.logWriterStderr, "Uploading sources (%d bytes)", len(body.Bytes()))
+	// Every attempt sends the same build context name. It comes from the
+	// previous completed build, so a retry of a failed upload is not any more
+	// incremental than the first attempt.
+	status, respBody, err := postWithRetry(ctx, &http.Client{}, uri, body.Bytes(), func(req *http.Request) {
+		req.Header.Set("Content-Type", mpw.FormDataContentType())
+		req.Header.Add("User-Agent", version.GetUserAgent())
+		req.SetBasicAuth(buildUser, buildPass)
+	}, b.p.UploadRetries, uploadRetryDelay, b.logWriterStderr)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	// handle response
-	body.Reset()
-	body.ReadFrom(resp.Body)
-
-	switch resp.StatusCode {
+	switch status {
 	case http.StatusOK, http.StatusTeapot:
 		// Build either succeeded or failed
 
 		// unzip build results
-		r := bytes.NewReader(body.Bytes())
+		r := bytes.NewReader(respBody)
 		if err = archive.UnzipInto(r, r.Size(), buildDir, 1 /* skipLevels */); err != nil {
 			return errors.Annotatef(err, "failed to unzip build results")
 		}
 
 		// Save local log
-		ioutil.WriteFile(moscommon.GetBuildLogLocalFilePath(buildDir), logBuf.Bytes(), 0666)
-
-		// print log in verbose mode or when build fails
-		if bParams.Verbose || resp.StatusCode != http.StatusOK {
-			log, err := os.Open(moscommon.GetBuildLogFilePath(buildDir))
-			if err != nil {
-				return errors.Trace(err)
-			}
-			io.Copy(os.Stdout, log)
-		}
+		ioutil.WriteFile(moscommon.GetBuildLogLocalFilePath(buildDir), b.logBuf.Bytes(), 0666)
 
-		if resp.StatusCode != http.StatusOK {
-			return errors.Errorf("build failed")
+		if status != http.StatusOK {
+			return errcode.Errorf(errcode.BuildFailed, "build failed")
 		}
 		return nil
 
 	default:
 		// Unexpected response
-		return errors.Errorf("error response: %d: %s", resp.StatusCode, strings.TrimSpace(body.String()))
+		return errcode.Wrap(errors.Errorf("error response: %d: %s", status, strings.TrimSpace(string(respBody))),
+			errcode.BuildServerError, map[string]interface{}{"status": status})
 	}
 }
 
 // copyExternalCode checks whether given path p is outside of appDir, and if
 // so, copies its contents as a new directory under appStagingDir, and returns
 // its name. If nothing was copied, returns an empty string.
-func copyExternalCode(p, appDir, appStagingDir string) (string, error) {
+func (b *builder) copyExternalCode(p, appDir, appStagingDir string) (string, error) {
 	// Ensure we have relative path curPathRel which should start with ".." if
 	// it's outside of the appStagingDir
 	curPathAbs := p
@@ -411,7 +442,7 @@ func copyExternalCode(p, appDir, appStagingDir string) (string, error) {
 
 		// Copy source files to that new dir
 		// TODO(dfrank): ensure we don't copy too much
-		freportf(logWriter, "Copying %q as %q", actualPart, curTmpPathAbs)
+		ourutil.Freportf(b.logWriter, "Copying %q as %q", actualPart, curTmpPathAbs)
 		err = ourio.CopyDir(actualPart, curTmpPathAbs, nil)
 		if err != nil {
 			return "", errors.Trace(err)
@@ -425,15 +456,15 @@ func copyExternalCode(p, appDir, appStagingDir string) (string, error) {
 
 // copyExternalCodeAll calls copyExternalCode for each element of the paths
 // slice, and for each affected path updates the item in the slice.
-func copyExternalCodeAll(paths *[]string, appDir, appStagingDir string) error {
-	for i, curPath := range *paths {
-		newPath, err := copyExternalCode(curPath, appDir, appStagingDir)
+func (b *builder) copyExternalCodeAll(paths []string, appDir, appStagingDir string) error {
+	for i, curPath := range paths {
+		newPath, err := b.copyExternalCode(curPath, appDir, appStagingDir)
 		if err != nil {
 			return errors.Trace(err)
 		}
 
 		if newPath != "" {
-			(*paths)[i] = newPath
+			paths[i] = newPath
 		}
 	}
 
@@ -445,7 +476,7 @@ func copyExternalCodeAll(paths *[]string, appDir, appStagingDir string) error {
 // only. If some file needs to be transformed before placing into a zip
 // archive, the appropriate transformer function should be placed at the
 // transformers map.
-func zipUp(
+func (b *builder) zipUp(
 	bParams *build.BuildParams,
 	dir string,
 	whitelist map[string]bool,
@@ -475,7 +506,7 @@ func zipUp(
 		}
 
 		if bParams.Verbose {
-			ourutil.Reportf("Zipping %s", file)
+			ourutil.Freportf(b.logWriterStderr, "Zipping %s", file)
 		}
 
 		w, err := z.Create(fileForwardSlash)
@@ -515,6 +546,82 @@ func zipUp(
 	return data.Bytes(), nil
 }
 
+type fileTransformer func(r io.ReadCloser) (io.ReadCloser, error)
+
 func identityTransformer(r io.ReadCloser) (io.ReadCloser, error) {
 	return r, nil
 }
+
+func (b *builder) serverURL() (*url.URL, error) {
+	u, err := url.Parse(b.p.Server)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// If given URL does not contain scheme, assume http
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	return u, nil
+}
+
+// readManifestLocally resolves the final manifest of the app, fetching the
+// libs, without building it.
+func (b *builder) readManifestLocally(bParams *build.BuildParams) (*build.FWAppManifest, error) {
+	appDir, err := GetCodeDirAbs()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	compProvider := compProviderReal{
+		p:               b.p,
+		logWriter:       b.logWriter,
+		logWriterStderr: b.logWriterStderr,
+	}
+	interp := interpreter.NewInterpreter(NewMosVars())
+	manifest, _, err := manifest_parser.ReadManifestFinal(
+		appDir, &bParams.ManifestAdjustments, b.logWriter, interp,
+		&manifest_parser.ReadManifestCallbacks{ComponentProvider: &compProvider},
+		true /* requireArch */, bParams.PreferPrebuiltLibs, bParams.LibsUpdateInterval)
+	return manifest, errors.Trace(err)
+}
+
+// expandEnvVarsInYAML expands ${env.FOO} references in all string values of
+// the given YAML document.
+func expandEnvVarsInYAML(data []byte) ([]byte, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := expandEnvVarsInValue(&doc); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return yaml.Marshal(doc)
+}
+
+func expandEnvVarsInValue(v interface{}) error {
+	var err error
+	switch vv := v.(type) {
+	case *interface{}:
+		switch vvv := (*vv).(type) {
+		case string:
+			*vv, err = interpreter.ExpandEnvVars(vvv)
+		default:
+			err = expandEnvVarsInValue(vvv)
+		}
+	case *yaml.MapSlice:
+		for i := range *vv {
+			if err = expandEnvVarsInValue(&(*vv)[i].Value); err != nil {
+				break
+			}
+		}
+	case yaml.MapSlice:
+		err = expandEnvVarsInValue(&vv)
+	case []interface{}:
+		for i := range vv {
+			if err = expandEnvVarsInValue(&vv[i]); err != nil {
+				break
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,468 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package builder implements the mos build pipeline: resolving the manifest,
+// fetching libs and building the app locally (in Docker) or on the remote
+// build server. It is what "mos build" uses and can be used as a library.
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/juju/errors"
+	yaml "gopkg.in/yaml.v2"
+	glog "k8s.io/klog/v2"
+
+	"github.com/mongoose-os/mos/cli/build"
+	moscommon "github.com/mongoose-os/mos/cli/common"
+	"github.com/mongoose-os/mos/cli/errcode"
+	"github.com/mongoose-os/mos/cli/interpreter"
+	"github.com/mongoose-os/mos/cli/manifest_parser"
+	"github.com/mongoose-os/mos/cli/mosgit"
+	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/common/fwbundle"
+	"github.com/mongoose-os/mos/common/ourgit"
+	"github.com/mongoose-os/mos/version"
+)
+
+const (
+	projectDir = "."
+)
+
+// Logger receives the build output. Everything also goes to build.log.
+type Logger interface {
+	// Log receives the detailed log: lib fetching, make and Docker output.
+	Log() io.Writer
+	// Report receives the progress messages, normally shown to the user.
+	Report() io.Writer
+}
+
+// NewLogger returns a Logger which writes to the given writers.
+// Either of them can be nil.
+func NewLogger(log, report io.Writer) Logger {
+	return &logger{log: log, report: report}
+}
+
+type logger struct {
+	log, report io.Writer
+}
+
+func (l *logger) Log() io.Writer    { return l.log }
+func (l *logger) Report() io.Writer { return l.report }
+
+// BuildParams are the parameters of Build. The embedded build.BuildParams
+// are also sent to the remote build server, the rest are not.
+type BuildParams struct {
+	build.BuildParams
+
+	// Dir of the app to build, the current directory if empty.
+	AppDir string
+	// Build locally, in Docker (or with make, if already in the build
+	// container). Otherwise, the remote build server is used.
+	Local bool
+	// Remote build server URL and build timeout, 0 means server's default.
+	Server  string
+	Timeout time.Duration
+	// Remote build: how many times to retry the sources upload on network
+	// and server (5xx) errors and when the server is busy (429), with
+	// exponential backoff.
+	UploadRetries int
+	// Extra make arguments, added at the end of the make command line.
+	MakeArgsExtra []string
+	// Print the resolved make variables and the make command line.
+	DumpMakeVars bool
+	// If set, only build if any of the inputs changed since this git ref.
+	// Otherwise, an error with errcode.BuildSkipped is returned.
+	// Local builds only.
+	SinceGit string
+	// File the environment was loaded from (--env-file), only used as
+	// an input for SinceGit.
+	EnvFile string
+	// File with the deps versions (--deps-lock or --deps-versions), only used
+	// as an input for SinceGit.
+	DepsVersionsFile string
+	// Cache the resolved manifest across runs, see manifest_cache.go.
+	// Local builds only.
+	CacheManifest bool
+	// Keep the FS image in build/fs_cache and reuse it while the FS files,
+	// config schema and build vars are unchanged, see fs_cache.go.
+	// Local builds only.
+	FSCache bool
+	// Return the dependency graph in BuildResult.DepsGraph. For remote
+	// builds, the manifest is resolved locally as well for that.
+	DepsGraph bool
+
+	// Docker image to build with, by default the one the mos repo specifies
+	// for the platform. Local builds only.
+	BuildImage string
+	// Extra docker run arguments. Local builds only.
+	DockerExtra []string
+	// Do not mount any dirs into the build container, use the paths as they
+	// are. DockerExtra is expected to take care of that. Local builds only.
+	DockerNoMounts bool
+	// Build parallelism, 0 means the number of CPUs.
+	Parallelism int
+	// Dirs to look for libs in before fetching them.
+	LibsDir []string
+	// Where libs and modules are fetched to, by default "deps" and
+	// "deps/modules" in the app dir.
+	DepsDir    string
+	ModulesDir string
+	// Where the resolved manifests are cached, must be set if CacheManifest
+	// is.
+	ManifestCacheDir string
+	// Do not remove the temporary files, e.g. the staging dir of a remote
+	// build.
+	KeepTempFiles bool
+
+	// If nil, build output is only written to build.log.
+	Logger Logger
+}
+
+// BuildResult describes the build artifacts.
+type BuildResult struct {
+	// Firmware bundle, set if a firmware was built.
+	FirmwarePath string
+	Firmware     *fwbundle.FirmwareBundle
+	// Lib archive, set if a lib was built.
+	LibPath string
+	// Size of the firmware bundle or the lib archive, in bytes.
+	Size int64
+	// Linker map file of the firmware, build/objs/fw.map, if available.
+	MapFile string
+	// Libs and modules that went into the build, if available.
+	Deps *build.DepsManifest
+	// Resolved dependency graph, if requested.
+	DepsGraph *manifest_parser.DepsGraph
+
+	LogPath  string
+	Duration time.Duration
+}
+
+// builder holds the state of a single build.
+type builder struct {
+	p *BuildParams
+
+	// In-memory buffer containing all the log messages.  It has to be
+	// thread-safe, because it's used in compProviderReal, which is an
+	// implementation of the manifest_parser.ComponentProvider interface, whose
+	// methods are called concurrently.
+	logBuf threadSafeBuffer
+
+	// Log writer which always writes to the build.log file, logBuf and the
+	// Report writer of the logger.
+	logWriterStderr io.Writer
+
+	// The same as logWriterStderr, but writes to the Log writer of the logger.
+	logWriter io.Writer
+
+	makeArgsExtra []string
+
+	// Final manifest, once resolved.
+	manifest *build.FWAppManifest
+}
+
+// buildLock serializes builds: the build runs with the app dir as the
+// current directory.
+var buildLock sync.Mutex
+
+// Build builds the app in p.AppDir. On failure, the result contains the log
+// file path, if the log was created. Cancelling ctx aborts the build, killing
+// the build container if there is one. The current directory is changed to
+// the app dir for the duration of the build, so builds in one process do not
+// run concurrently.
+func Build(ctx context.Context, p BuildParams) (*BuildResult, error) {
+	res := &BuildResult{}
+
+	buildLock.Lock()
+	defer buildLock.Unlock()
+
+	if p.AppDir != "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return res, errors.Trace(err)
+		}
+		if err := os.Chdir(p.AppDir); err != nil {
+			return res, errors.Trace(err)
+		}
+		defer os.Chdir(wd)
+	}
+	buildDir := moscommon.GetBuildDir(projectDir)
+
+	if p.BuildTarget == "" {
+		p.BuildTarget = moscommon.BuildTargetDefault
+	}
+
+	if p.Env != "" {
+		envManifest := moscommon.GetManifestEnvFilePath(projectDir, p.Env)
+		if _, err := os.Stat(envManifest); err != nil {
+			return res, errors.Annotatef(err, "--env %s", p.Env)
+		}
+	}
+
+	start := time.Now()
+
+	if err := os.MkdirAll(buildDir, 0777); err != nil {
+		return res, errors.Trace(err)
+	}
+
+	blog := moscommon.GetBuildLogFilePath(buildDir)
+	logFile, err := os.Create(blog)
+	if err != nil {
+		return res, errors.Trace(err)
+	}
+	defer logFile.Close()
+	res.LogPath, _ = filepath.Abs(blog)
+
+	// Remove local log, ignore any errors
+	os.RemoveAll(moscommon.GetBuildLogLocalFilePath(buildDir))
+
+	b := &builder{p: &p, makeArgsExtra: append([]string{}, p.MakeArgsExtra...)}
+	var logw, reportw io.Writer = ioutil.Discard, ioutil.Discard
+	if p.Logger != nil {
+		if w := p.Logger.Log(); w != nil {
+			logw = w
+		}
+		if w := p.Logger.Report(); w != nil {
+			reportw = w
+		}
+	}
+	// Build logs are archived, make sure credentials don't end up there.
+	b.logWriterStderr = ourutil.NewRedactingWriter(io.MultiWriter(logFile, &b.logBuf, reportw))
+	b.logWriter = ourutil.NewRedactingWriter(io.MultiWriter(logFile, &b.logBuf, logw))
+
+	// Fail fast if there is no manifest
+	if _, err := os.Stat(moscommon.GetManifestFilePath(projectDir)); os.IsNotExist(err) {
+		return res, errcode.Errorf(errcode.NoManifest, "No mos.yml file")
+	}
+
+	if p.SinceGit != "" && !p.Local {
+		return res, errors.Errorf("--since-git is only supported for local builds")
+	}
+	if p.CacheManifest && !p.Local {
+		return res, errors.Errorf("--cache-libs-manifest is only supported for local builds")
+	}
+	if p.FSCache && !p.Local {
+		return res, errors.Errorf("--fs-cache is only supported for local builds")
+	}
+	if p.CacheManifest && p.ManifestCacheDir == "" {
+		return res, errors.Errorf("manifest cache dir is not set")
+	}
+
+	// Git info is collected here: on the remote build server the app is not
+	// in its repo. When building with --build-params, it is already there.
+	if p.IncludeBuildInfo && p.GitInfo == nil {
+		appDir, err := GetCodeDirAbs()
+		if err != nil {
+			return res, errors.Trace(err)
+		}
+		p.GitInfo = getGitInfo(mosgit.NewOurGit(nil), appDir)
+	}
+
+	if p.Local {
+		if isInDockerToolbox() {
+			ourutil.Freportf(b.logWriterStderr, "Docker Toolbox detected")
+		}
+		err = b.buildLocal(ctx, &p.BuildParams)
+	} else {
+		if p.DepsGraph {
+			// The manifest is resolved by the server, do it here as well.
+			// buildRemote modifies the params, so do it first.
+			ourutil.Freportf(b.logWriterStderr, "Resolving dependencies...")
+			if b.manifest, err = b.readManifestLocally(&p.BuildParams); err != nil {
+				return res, errors.Annotatef(err, "error parsing manifest")
+			}
+		}
+		err = b.buildRemote(ctx, &p.BuildParams)
+	}
+	res.Duration = time.Since(start)
+	if err != nil {
+		return res, errors.Trace(err)
+	}
+	if p.DryRun {
+		return res, nil
+	}
+
+	if p.DepsGraph && b.manifest != nil {
+		res.DepsGraph = manifest_parser.GetDepsGraph(b.manifest)
+	}
+
+	if data, err := ioutil.ReadFile(moscommon.GetDepsManifestFilePath(buildDir)); err == nil {
+		var dm build.DepsManifest
+		if err := yaml.Unmarshal(data, &dm); err == nil {
+			res.Deps = &dm
+		}
+	}
+
+	if p.BuildTarget == moscommon.BuildTargetDefault {
+		// We were building a firmware, so perform the required actions with moving
+		// firmware around, etc.
+		fwFilename := moscommon.GetFirmwareZipFilePath(buildDir)
+
+		fw, err := fwbundle.ReadZipFirmwareBundle(fwFilename)
+		if err != nil {
+			return res, errors.Trace(err)
+		}
+		res.Firmware = fw
+		res.FirmwarePath, _ = filepath.Abs(fwFilename)
+		if fi, err := os.Stat(fwFilename); err == nil {
+			res.Size = fi.Size()
+		}
+		if res.MapFile, err = preserveMapFile(buildDir); err != nil {
+			return res, errors.Trace(err)
+		}
+
+		if p.SaveBuildStat {
+			bstat := moscommon.BuildStat{
+				ArchOld:     fw.Platform,
+				Platform:    fw.Platform,
+				AppName:     fw.Name,
+				BuildTimeMS: int(res.Duration / time.Millisecond),
+			}
+
+			data, err := json.MarshalIndent(&bstat, "", "  ")
+			if err != nil {
+				return res, errors.Trace(err)
+			}
+
+			ioutil.WriteFile(moscommon.GetBuildStatFilePath(buildDir), data, 0666)
+		}
+
+		if p.Local || !p.Verbose {
+			ourutil.Freportf(b.logWriter, "Success, built %s/%s version %s (%s).", fw.Name, fw.Platform, fw.Version, fw.BuildID)
+			ourutil.Freportf(b.logWriterStderr, "Firmware saved to %s", res.FirmwarePath)
+		}
+	} else if lp := moscommon.GetOrigLibArchiveFilePath(buildDir, p.Platform); p.BuildTarget == lp {
+		libFilename := moscommon.GetLibArchiveFilePath(buildDir)
+		res.LibPath, _ = filepath.Abs(libFilename)
+		if fi, err := os.Stat(libFilename); err == nil {
+			res.Size = fi.Size()
+		}
+		ourutil.Freportf(b.logWriterStderr, "Lib saved to %s", libFilename)
+	} else {
+		// We were building some custom target, so just report that we succeeded.
+		ourutil.Freportf(b.logWriterStderr, "Target %s is built successfully", p.BuildTarget)
+	}
+
+	return res, nil
+}
+
+func fixupAppName(appName string) (string, error) {
+	if appName == "" {
+		wd, err := GetCodeDirAbs()
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		appName = filepath.Base(wd)
+	}
+
+	for _, c := range appName {
+		if unicode.IsSpace(c) {
+			return "", errors.Errorf("app name (%q) should not contain spaces", appName)
+		}
+	}
+
+	return appName, nil
+}
+
+func isURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme != ""
+}
+
+// GetCodeDirAbs returns the absolute path of the app being built.
+func GetCodeDirAbs() (string, error) {
+	absCodeDir, err := filepath.Abs(projectDir)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	absCodeDir, err = filepath.EvalSymlinks(absCodeDir)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	for _, c := range absCodeDir {
+		if unicode.IsSpace(c) {
+			return "", errors.Errorf("code dir (%q) should not contain spaces", absCodeDir)
+		}
+	}
+
+	return absCodeDir, nil
+}
+
+// NewMosVars returns the mos variables for manifest conditions.
+func NewMosVars() *interpreter.MosVars {
+	ret := interpreter.NewMosVars()
+	ret.SetVar(interpreter.GetMVarNameMosVersion(), version.GetMosVersion())
+	return ret
+}
+
+// getGitInfo returns the state of the git repo the app is in, nil if it is
+// not in a repo.
+func getGitInfo(gitinst ourgit.OurGit, appDir string) *build.GitInfo {
+	if gitToplevelDir, _ := gitinst.GetToplevelDir(appDir); gitToplevelDir == "" {
+		return nil
+	}
+	gi := &build.GitInfo{}
+	var err error
+	if gi.Hash, err = gitinst.GetCurrentHash(appDir); err != nil {
+		glog.Warningf("failed to get git hash: %s", err)
+		return nil
+	}
+	if gi.Describe, err = gitinst.Describe(appDir); err != nil {
+		glog.Warningf("failed to describe git HEAD: %s", err)
+		return nil
+	}
+	gi.Branch, _ = gitinst.GetCurrentBranch(appDir)
+	if isClean, err := mosgit.IsClean(gitinst, appDir, ""); err == nil {
+		gi.Dirty = !isClean
+	}
+	return gi
+}
+
+// Thread-safe bytes.Buffer {{{
+
+type threadSafeBuffer struct {
+	buf bytes.Buffer
+	mtx sync.Mutex
+}
+
+func (b *threadSafeBuffer) Write(p []byte) (n int, err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *threadSafeBuffer) Bytes() []byte {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.buf.Bytes()
+}
+
+// }}}
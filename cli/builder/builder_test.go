@@ -0,0 +1,103 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package builder
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mongoose-os/mos/cli/errcode"
+)
+
+func TestBuildNoManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builder_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+	wd, _ := os.Getwd()
+
+	var report bytes.Buffer
+	res, err := Build(context.Background(), BuildParams{AppDir: dir, Local: true, Logger: NewLogger(nil, &report)})
+	if c, _ := errcode.Get(err); c != errcode.NoManifest {
+		t.Fatalf("expected %s, got %v", errcode.NoManifest, err)
+	}
+	if res == nil || res.LogPath != filepath.Join(dir, "build", "build.log") {
+		t.Errorf("log path is not set: %+v", res)
+	}
+	if wd2, _ := os.Getwd(); wd2 != wd {
+		t.Errorf("current dir is not restored: %s", wd2)
+	}
+	if res.FirmwarePath != "" || res.LibPath != "" {
+		t.Errorf("unexpected artifacts: %+v", res)
+	}
+}
+
+func TestPreserveMapFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builder_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if mf, err := preserveMapFile(dir); err != nil || mf != "" {
+		t.Fatalf("expected no map file, got %q %v", mf, err)
+	}
+
+	objsDir := filepath.Join(dir, "objs")
+	os.MkdirAll(objsDir, 0755)
+	if err := ioutil.WriteFile(filepath.Join(objsDir, "app.map"), []byte("map1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mf, err := preserveMapFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(mf); filepath.Base(mf) != "fw.map" || string(data) != "map1" {
+		t.Errorf("unexpected map file %q: %q", mf, data)
+	}
+
+	// Newer map file from the next build replaces the copy.
+	newer := time.Now().Add(time.Hour)
+	ioutil.WriteFile(filepath.Join(objsDir, "app.map"), []byte("map2"), 0644)
+	os.Chtimes(filepath.Join(objsDir, "app.map"), newer, newer)
+	if mf, err = preserveMapFile(dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(mf); string(data) != "map2" {
+		t.Errorf("map file is not updated: %q", data)
+	}
+}
+
+func TestExpandEnvVarsInYAML(t *testing.T) {
+	os.Setenv("MOS_BUILDER_TEST_VAR", "env_val")
+	defer os.Unsetenv("MOS_BUILDER_TEST_VAR")
+	in := "name: app\nversion: ${env.MOS_BUILDER_TEST_VAR}\ncdefs:\n  FOO: ${env.MOS_BUILDER_TEST_VAR}\nsources:\n- src/${mos.platform}\n"
+	out, err := expandEnvVarsInYAML([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "name: app\nversion: env_val\ncdefs:\n  FOO: env_val\nsources:\n- src/${mos.platform}\n"; string(out) != exp {
+		t.Errorf("expected %q, got %q", exp, out)
+	}
+}
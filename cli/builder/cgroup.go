@@ -0,0 +1,75 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package builder
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupCPULimit returns the number of CPUs the processes in our cgroup are
+// allowed to use according to the CPU quota, or 0 if there is no quota.
+// cgroup v2 (cpu.max) is tried first, then v1 (cpu.cfs_quota_us and cpu.cfs_period_us).
+// cgroupRoot is normally /sys/fs/cgroup.
+func cgroupCPULimit(cgroupRoot string) int {
+	if data, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cpu.max")); err == nil {
+		return parseCgroupV2CPUMax(string(data))
+	}
+	for _, dir := range []string{"cpu", "cpu,cpuacct"} {
+		quota, err := ioutil.ReadFile(filepath.Join(cgroupRoot, dir, "cpu.cfs_quota_us"))
+		if err != nil {
+			continue
+		}
+		period, err := ioutil.ReadFile(filepath.Join(cgroupRoot, dir, "cpu.cfs_period_us"))
+		if err != nil {
+			continue
+		}
+		return parseCgroupV1CPUQuota(string(quota), string(period))
+	}
+	return 0
+}
+
+// parseCgroupV2CPUMax parses the contents of cpu.max: "$MAX $PERIOD", where $MAX may be "max".
+func parseCgroupV2CPUMax(s string) int {
+	parts := strings.Fields(s)
+	if len(parts) != 2 || parts[0] == "max" {
+		return 0
+	}
+	return cpusFromQuota(parts[0], parts[1])
+}
+
+// parseCgroupV1CPUQuota parses the contents of cpu.cfs_quota_us and cpu.cfs_period_us. Quota of -1 means no limit.
+func parseCgroupV1CPUQuota(quota, period string) int {
+	return cpusFromQuota(strings.TrimSpace(quota), strings.TrimSpace(period))
+}
+
+func cpusFromQuota(quotaStr, periodStr string) int {
+	quota, err := strconv.ParseInt(quotaStr, 10, 64)
+	if err != nil || quota <= 0 {
+		return 0
+	}
+	period, err := strconv.ParseInt(periodStr, 10, 64)
+	if err != nil || period <= 0 {
+		return 0
+	}
+	// Round up: a quota of 1.5 CPUs still allows 2 jobs to make progress.
+	return int((quota + period - 1) / period)
+}
@@ -0,0 +1,61 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package builder
+
+import (
+	"testing"
+)
+
+func TestCgroupCPULimit(t *testing.T) {
+	for _, c := range []struct {
+		root string
+		exp  int
+	}{
+		{"testdata/cgroup_v1", 2},
+		{"testdata/cgroup_v1_unlimited", 0},
+		{"testdata/cgroup_v2", 4},
+		{"testdata/cgroup_v2_unlimited", 0},
+		{"testdata/nonexistent", 0},
+	} {
+		if n := cgroupCPULimit(c.root); n != c.exp {
+			t.Errorf("%s: expected %d, got %d", c.root, c.exp, n)
+		}
+	}
+}
+
+func TestParseCgroupCPUQuota(t *testing.T) {
+	for _, c := range []struct {
+		s   string
+		exp int
+	}{
+		{"100000 100000", 1},
+		{"50000 100000", 1},
+		{"250000 100000\n", 3},
+		{"max 100000", 0},
+		{"garbage", 0},
+	} {
+		if n := parseCgroupV2CPUMax(c.s); n != c.exp {
+			t.Errorf("%q: expected %d, got %d", c.s, c.exp, n)
+		}
+	}
+	if n := parseCgroupV1CPUQuota("-1\n", "100000\n"); n != 0 {
+		t.Errorf("expected 0, got %d", n)
+	}
+	if n := parseCgroupV1CPUQuota("300000\n", "100000\n"); n != 3 {
+		t.Errorf("expected 3, got %d", n)
+	}
+}
@@ -0,0 +1,286 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package builder
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/errors"
+	glog "k8s.io/klog/v2"
+
+	"github.com/mongoose-os/mos/cli/build"
+	moscommon "github.com/mongoose-os/mos/cli/common"
+	"github.com/mongoose-os/mos/cli/errcode"
+	"github.com/mongoose-os/mos/cli/manifest_parser"
+	"github.com/mongoose-os/mos/cli/mosgit"
+	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/cli/trace"
+	"github.com/mongoose-os/mos/cli/update"
+	"github.com/mongoose-os/mos/version"
+)
+
+// manifest_parser.ComponentProvider implementation {{{
+type compProviderReal struct {
+	p               *BuildParams
+	logWriter       io.Writer
+	logWriterStderr io.Writer
+}
+
+// NewComponentProvider returns the manifest_parser.ComponentProvider which
+// fetches libs and modules the same way Build does. Detailed log goes to
+// logWriter, warnings to logWriterStderr.
+func NewComponentProvider(p *BuildParams, logWriter, logWriterStderr io.Writer) manifest_parser.ComponentProvider {
+	return &compProviderReal{p: p, logWriter: logWriter, logWriterStderr: logWriterStderr}
+}
+
+// getDepsDir returns the dir libs are fetched to.
+func (p *BuildParams) getDepsDir(appDir string) string {
+	if p.DepsDir != "" {
+		return p.DepsDir
+	}
+	return filepath.Join(appDir, "deps")
+}
+
+// getModulesDir returns the dir modules are fetched to.
+func (p *BuildParams) getModulesDir(appDir string) string {
+	if p.ModulesDir != "" {
+		return p.ModulesDir
+	}
+	return filepath.Join(p.getDepsDir(appDir), "modules")
+}
+
+func (lpr *compProviderReal) GetLibLocalPath(
+	m *build.SWModule, rootAppDir, libsDefVersion, platform string,
+) (string, error) {
+
+	name, err := m.GetName()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	creds := lpr.p.GetCredentialsForHost(m.GetHostName())
+	m.SetCredentials(creds)
+	m.SetGitHubAPIURL(lpr.p.GetGitHubAPIURLForHost(m.GetHostName()))
+	m.SetOffline(lpr.p.Offline)
+	if m.GetAppDir() == "" {
+		m.SetAppDir(rootAppDir)
+	}
+
+	gitinst := mosgit.NewOurGit(build.BuildCredsToGitCreds(creds))
+
+	appDir, err := GetCodeDirAbs()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	// --lib has the highest precedence.
+	customLoc, ok := lpr.p.CustomLibLocations[name]
+	if ok && !isURL(customLoc) {
+		ourutil.Freportf(lpr.logWriter, "%s: Using %q (--lib)", name, customLoc)
+		return customLoc, nil
+	}
+
+	// Check --libs-dir.
+	if !ok && len(lpr.p.LibsDir) > 0 {
+		name2, _ := m.GetName2()
+		for _, libsDir := range lpr.p.LibsDir {
+			libDir := filepath.Join(libsDir, name2)
+			glog.V(2).Infof("%s (%s): Trying %s...", name, name2, libDir)
+			if fi, err := os.Stat(libDir); err == nil && fi.IsDir() {
+				ourutil.Freportf(lpr.logWriter, "%s: Using %q (--libs-dir)", name, libDir)
+				return libDir, nil
+			}
+		}
+	}
+
+	// Check for version overrides.
+	if lpr.p.ManifestAdjustments.DepsVersions != nil {
+		dve := lpr.p.ManifestAdjustments.DepsVersions.FindLibEntry(name)
+		if dve == nil {
+			ourutil.Freportf(lpr.logWriterStderr, "%s: No deps manifest entry found [%s]", name, m.Location)
+			if lpr.p.StrictDepsVersions {
+				return "", fmt.Errorf("no dep manifest entry found for %q [%s] (strict mode)", name, m.Location)
+			}
+		} else {
+			if dve.RepoVersion != "" {
+				glog.V(1).Infof("%s: forcing version %s", name, dve.RepoVersion)
+				m.SetVersionOverride(dve.RepoVersion)
+			}
+		}
+	}
+
+	// Try to fetch into --deps-dir.
+	if ok {
+		m.Location = customLoc
+	}
+	libDirAbs := ""
+	depsDir := lpr.p.getDepsDir(appDir)
+	for {
+		localDir, err := m.GetLocalDir(depsDir, libsDefVersion)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+
+		updateIntvl := lpr.p.LibsUpdateInterval
+		if lpr.p.Offline {
+			updateIntvl = 0
+		}
+
+		// Try to get current hash, ignoring errors
+		curHash := ""
+		if m.GetType() == build.SWModuleTypeGit {
+			curHash, _ = gitinst.GetCurrentHash(localDir)
+		}
+
+		endFetch := trace.Span("fetch", name)
+		libDirAbs, err = m.PrepareLocalDir(depsDir, lpr.logWriter, true, libsDefVersion, updateIntvl, 0)
+		endFetch()
+		if err != nil {
+			if m.GetVersion("") == "" && libsDefVersion != "latest" && !lpr.p.Offline {
+				// We failed to fetch lib at the default version (mos.version),
+				// which is not "latest", and the lib in manifest does not have
+				// version specified explicitly. This might happen when some
+				// latest app is built with older mos tool.
+
+				serverVersion := libsDefVersion
+				v, err := update.GetServerMosVersion(string(update.GetUpdateChannel()))
+				if err == nil {
+					serverVersion = v.BuildVersion
+				}
+
+				ourutil.Freportf(lpr.logWriterStderr,
+					"WARNING: the lib %q does not have version %s. Resorting to latest, but the build might fail.\n"+
+						"It usually happens if you clone the latest version of some example app, and try to build it with the mos tool which is older than the lib (in this case, %q).", name, libsDefVersion, name,
+				)
+
+				if serverVersion != version.GetMosVersion() {
+					// There is a newer version of the mos tool available, so
+					// suggest upgrading.
+
+					ourutil.Freportf(lpr.logWriterStderr,
+						"There is a newer version of the mos tool available: %s, try to update mos tool (mos update), and build again. "+
+							"Alternatively, you can build the version %s of the app (git checkout %s).", serverVersion, libsDefVersion, libsDefVersion,
+					)
+				} else {
+					// Current mos is at the newest released version, so the only
+					// alternatives are: build older (released) version of the app,
+					// or use latest mos.
+
+					ourutil.Freportf(lpr.logWriterStderr,
+						"Consider using the version %s of the app (git checkout %s), or using latest mos tool (mos update latest).", libsDefVersion, libsDefVersion,
+					)
+				}
+
+				// In any case, retry with the latest lib version and cross fingers.
+
+				libsDefVersion = "latest"
+				continue
+			}
+			return "", errcode.Wrap(errors.Annotatef(err, "%s: preparing local copy", name),
+				errcode.LibFetchFailed, map[string]interface{}{"lib": name, "location": m.Location})
+		}
+
+		if m.GetType() == build.SWModuleTypeGit && updateIntvl != 0 {
+			if newHash, _, err := m.GetRepoVersion(); err == nil && newHash != curHash {
+				ourutil.Freportf(lpr.logWriter, "%s: Hash is updated: %s -> %s", name, curHash, newHash)
+				// The current repo hash has changed after the pull, so we need to
+				// vanish binary lib(s) we might have downloaded before
+				bLibs, _ := filepath.Glob(moscommon.GetBinaryLibFilePath(moscommon.GetBuildDir(appDir), name, "*", "*"))
+				for _, bl := range bLibs {
+					if os.Remove(bl) == nil {
+						ourutil.Freportf(lpr.logWriterStderr, "%s: Removed %s because the repo has been updated", name, bl)
+					}
+				}
+			} else {
+				ourutil.Freportf(lpr.logWriter, "%s: Hash unchanged at %s (dir %q)", name, curHash, libDirAbs)
+			}
+		}
+
+		break
+	}
+	ourutil.Freportf(lpr.logWriter, "%s: Prepared local dir: %q", name, libDirAbs)
+
+	return libDirAbs, nil
+}
+
+func (lpr *compProviderReal) GetModuleLocalPath(
+	m *build.SWModule, rootAppDir, modulesDefVersion, platform string,
+) (string, error) {
+	name, err := m.GetName()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	m.SetCredentials(lpr.p.GetCredentialsForHost(m.GetHostName()))
+	m.SetOffline(lpr.p.Offline)
+	if m.GetAppDir() == "" {
+		m.SetAppDir(rootAppDir)
+	}
+
+	customLoc, ok := lpr.p.CustomModuleLocations[name]
+	if ok && !isURL(customLoc) {
+		ourutil.Freportf(lpr.logWriter, "Using module %q located at %q", name, customLoc)
+	}
+
+	if ok {
+		m.Location = customLoc
+	}
+
+	// Check for version overrides.
+	if lpr.p.ManifestAdjustments.DepsVersions != nil {
+		dve := lpr.p.ManifestAdjustments.DepsVersions.FindModuleEntry(name)
+		if dve == nil {
+			ourutil.Freportf(lpr.logWriterStderr, "%s: No deps manifest entry found [%s]", name, m.Location)
+			if lpr.p.StrictDepsVersions {
+				return "", fmt.Errorf("no dep manifest entry found for %q [%s] (strict mode)", name, m.Location)
+			}
+		} else {
+			if dve.RepoVersion != "" {
+				glog.V(1).Infof("%s: forcing version %s", name, dve.RepoVersion)
+				m.SetVersionOverride(dve.RepoVersion)
+			}
+		}
+	}
+
+	// Custom module location wasn't provided on the command line, so, we'll
+	// use the module name and will clone/pull it if necessary
+	ourutil.Freportf(lpr.logWriter, "%s: Going to fetch module from %s", name, m.Location)
+
+	appDir, err := GetCodeDirAbs()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	updateIntvl := lpr.p.LibsUpdateInterval
+	if lpr.p.Offline {
+		updateIntvl = 0
+	}
+
+	endFetch := trace.Span("fetch", name)
+	targetDir, err := m.PrepareLocalDir(lpr.p.getModulesDir(appDir), lpr.logWriter, true, modulesDefVersion, updateIntvl, 0)
+	endFetch()
+	if err != nil {
+		return "", errors.Annotatef(err, "preparing local copy of the module %q", name)
+	}
+
+	return targetDir, nil
+}
+
+// }}}
@@ -0,0 +1,276 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	yaml "gopkg.in/yaml.v2"
+	glog "k8s.io/klog/v2"
+
+	moscommon "github.com/mongoose-os/mos/cli/common"
+	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/common/fwbundle"
+	"github.com/mongoose-os/mos/common/ourio"
+)
+
+// FS image cache (mos build --fs-cache).
+//
+// The filesystem image is generated by the platform makefile from the FS
+// files, the config schema and the build vars (build info is not included,
+// it changes with every build). The images of the last build are kept in
+// build/fs_cache together with the hash of these inputs. If the hash did not
+// change, the cached images are put back where the makefile expects them,
+// with a fresh mtime, so that make considers them up to date.
+
+const (
+	fsCacheIndexFile = "index.yml"
+	fsPartType       = "fs"
+)
+
+// Build vars which only affect the code, not the FS image.
+var fsCacheIgnoredVars = map[string]bool{
+	"APP_SOURCES":  true,
+	"APP_INCLUDES": true,
+	"APP_BIN_LIBS": true,
+	"APP_CFLAGS":   true,
+	"APP_CXXFLAGS": true,
+	"FFI_SYMBOLS":  true,
+}
+
+type fsCachePart struct {
+	Name string `yaml:"name"`
+	// File in the cache dir with the image data.
+	File string `yaml:"file"`
+	// Path of the image generated by make, relative to the build dir.
+	// Empty if it could not be found.
+	ImagePath string `yaml:"image_path,omitempty"`
+	SHA1      string `yaml:"cs_sha1"`
+}
+
+type fsCacheIndex struct {
+	Hash  string         `yaml:"hash"`
+	Parts []*fsCachePart `yaml:"parts"`
+}
+
+// fsInputsHash returns the hash of the FS image inputs: the expanded list of
+// FS files with their contents plus the given extra files and values.
+func fsInputsHash(fsFiles, extraFiles []string, vars map[string]string) (string, error) {
+	h := sha256.New()
+	var files []string
+	for _, f := range fsFiles {
+		matches, err := filepath.Glob(f)
+		if err != nil {
+			return "", errors.Annotatef(err, "invalid FS file pattern %q", f)
+		}
+		for _, m := range matches {
+			if err := filepath.Walk(m, func(path string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !fi.IsDir() {
+					files = append(files, path)
+				}
+				return nil
+			}); err != nil {
+				return "", errors.Trace(err)
+			}
+		}
+	}
+	sort.Strings(files)
+	for _, f := range append(files, extraFiles...) {
+		if err := hashFile(h, f); err != nil {
+			return "", errors.Trace(err)
+		}
+	}
+	var kk []string
+	for k := range vars {
+		kk = append(kk, k)
+	}
+	sort.Strings(kk)
+	for _, k := range kk {
+		fmt.Fprintf(h, "var %s=%s\n", k, vars[k])
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(w io.Writer, fname string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	fmt.Fprintf(w, "file %s\n", fname)
+	if _, err := io.Copy(w, f); err != nil {
+		return errors.Annotatef(err, "failed to read %s", fname)
+	}
+	fmt.Fprintf(w, "\n")
+	return nil
+}
+
+func readFSCacheIndex(buildDir string) (*fsCacheIndex, error) {
+	data, err := ioutil.ReadFile(filepath.Join(moscommon.GetFSImageCacheDir(buildDir), fsCacheIndexFile))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var idx fsCacheIndex
+	if err := yaml.Unmarshal(data, &idx); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &idx, nil
+}
+
+// restoreFSImages checks whether the FS images of the previous build can be
+// reused and, if so, puts them back into the build dir. Returns the cache
+// index on a hit, nil otherwise.
+func (b *builder) restoreFSImages(buildDir, hash string) *fsCacheIndex {
+	idx, err := readFSCacheIndex(buildDir)
+	if err != nil || idx.Hash != hash || len(idx.Parts) == 0 {
+		return nil
+	}
+	cacheDir := moscommon.GetFSImageCacheDir(buildDir)
+	for _, cp := range idx.Parts {
+		if cp.ImagePath == "" {
+			continue
+		}
+		// CopyFile gives the image a fresh mtime, newer than any of the inputs.
+		if err := ourio.CopyFile(filepath.Join(cacheDir, cp.File), filepath.Join(buildDir, cp.ImagePath)); err != nil {
+			glog.Warningf("failed to restore FS image %s: %s", cp.ImagePath, err)
+			return nil
+		}
+	}
+	ourutil.Freportf(b.logWriter, "FS is unchanged, using the cached FS image")
+	return idx
+}
+
+// updateFSImages is called after a successful build. On a cache miss (idx is
+// nil), the FS parts of the bundle are saved to the cache. On a hit, the FS
+// parts are expected to match the cached images. If the makefile generated
+// different ones anyway, they are kept and the cache is refreshed.
+func (b *builder) updateFSImages(buildDir, fwFilename, hash string, idx *fsCacheIndex) error {
+	fw, err := fwbundle.ReadZipFirmwareBundle(fwFilename)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer fw.Cleanup()
+	cacheDir := moscommon.GetFSImageCacheDir(buildDir)
+
+	if idx != nil {
+		changed := false
+		for _, cp := range idx.Parts {
+			p := fw.Parts[cp.Name]
+			if p == nil || p.Type != fsPartType {
+				return errors.Errorf("FS part %q is missing from the bundle", cp.Name)
+			}
+			data, err := fw.GetPartData(cp.Name)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if dataSHA1(data) != cp.SHA1 {
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		ourutil.Freportf(b.logWriterStderr, "WARNING: FS image differs from the cached one although its inputs did not change, updating the cache")
+	}
+
+	if err := os.RemoveAll(cacheDir); err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.MkdirAll(cacheDir, 0777); err != nil {
+		return errors.Trace(err)
+	}
+	newIdx := &fsCacheIndex{Hash: hash}
+	for _, name := range sortedPartNames(fw) {
+		p := fw.Parts[name]
+		if p.Type != fsPartType {
+			continue
+		}
+		data, err := fw.GetPartData(name)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		cp := &fsCachePart{
+			Name:      name,
+			File:      fmt.Sprintf("%s.bin", name),
+			ImagePath: findFSImage(buildDir, p.Src, data),
+			SHA1:      dataSHA1(data),
+		}
+		if err := ioutil.WriteFile(filepath.Join(cacheDir, cp.File), data, 0644); err != nil {
+			return errors.Trace(err)
+		}
+		newIdx.Parts = append(newIdx.Parts, cp)
+	}
+	if len(newIdx.Parts) == 0 {
+		return nil
+	}
+	data, err := yaml.Marshal(newIdx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(filepath.Join(cacheDir, fsCacheIndexFile), data, 0644))
+}
+
+func dataSHA1(data []byte) string {
+	cs := sha1.Sum(data)
+	return hex.EncodeToString(cs[:])
+}
+
+func sortedPartNames(fw *fwbundle.FirmwareBundle) []string {
+	var names []string
+	for name := range fw.Parts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// findFSImage looks for the image generated by make in the objects dir: a file
+// with the same name as the part source and the same contents. Returns its path
+// relative to the build dir, or an empty string.
+func findFSImage(buildDir, src string, data []byte) string {
+	if src == "" {
+		return ""
+	}
+	cs := sha1.Sum(data)
+	res := ""
+	filepath.Walk(moscommon.GetObjectDir(buildDir), func(path string, fi os.FileInfo, err error) error {
+		if err != nil || res != "" || fi.IsDir() || fi.Name() != filepath.Base(src) || fi.Size() != int64(len(data)) {
+			return nil
+		}
+		if fdata, err := ioutil.ReadFile(path); err == nil && sha1.Sum(fdata) == cs {
+			if rel, err := filepath.Rel(buildDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+				res = rel
+			}
+		}
+		return nil
+	})
+	return res
+}
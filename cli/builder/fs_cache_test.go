@@ -0,0 +1,149 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	moscommon "github.com/mongoose-os/mos/cli/common"
+	"github.com/mongoose-os/mos/common/fwbundle"
+)
+
+func writeFSTestBundle(t *testing.T, fname string, fsData []byte) {
+	fwb := fwbundle.NewBundle()
+	fwb.Name = "test"
+	fwb.Platform = "esp32"
+	app := &fwbundle.FirmwarePart{Name: "app", Src: "app.bin"}
+	app.SetData([]byte("code"))
+	fwb.AddPart(app)
+	fs := &fwbundle.FirmwarePart{Name: "fs", Type: "fs", Src: "fs.img"}
+	fs.SetData(fsData)
+	fwb.AddPart(fs)
+	if err := fwbundle.WriteZipFirmwareBundle(fwb, fname, true, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFSInputsHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs_cache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fsDir := filepath.Join(dir, "fs")
+	os.MkdirAll(filepath.Join(fsDir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(fsDir, "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(fsDir, "sub", "b.txt"), []byte("b"), 0644)
+	files := []string{filepath.Join(fsDir, "*")}
+	vars := map[string]string{"MGOS_ROOT_FS_SIZE": "65536"}
+
+	h1, err := fsInputsHash(files, nil, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2, _ := fsInputsHash(files, nil, vars); h2 != h1 {
+		t.Errorf("hash is not stable: %s vs %s", h1, h2)
+	}
+	ioutil.WriteFile(filepath.Join(fsDir, "sub", "b.txt"), []byte("bb"), 0644)
+	h3, _ := fsInputsHash(files, nil, vars)
+	if h3 == h1 {
+		t.Errorf("hash did not change with file contents")
+	}
+	if h4, _ := fsInputsHash(files, nil, map[string]string{"MGOS_ROOT_FS_SIZE": "131072"}); h4 == h3 {
+		t.Errorf("hash did not change with build vars")
+	}
+	if _, err := fsInputsHash(files, []string{filepath.Join(dir, "nonexistent.yml")}, vars); err == nil {
+		t.Errorf("expected an error for a missing extra file")
+	}
+}
+
+func TestFSImageCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs_cache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := &builder{logWriter: ioutil.Discard, logWriterStderr: ioutil.Discard}
+	objsDir := filepath.Join(dir, "objs", "fw_temp")
+	os.MkdirAll(objsDir, 0755)
+	fwFilename := filepath.Join(dir, "fw.zip")
+	fsImage := filepath.Join(objsDir, "fs.img")
+
+	// Nothing is cached yet.
+	if idx := b.restoreFSImages(dir, "hash1"); idx != nil {
+		t.Fatalf("unexpected cache hit: %+v", idx)
+	}
+
+	// First build saves the image.
+	ioutil.WriteFile(fsImage, []byte("fs1"), 0644)
+	writeFSTestBundle(t, fwFilename, []byte("fs1"))
+	if err := b.updateFSImages(dir, fwFilename, "hash1", nil); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := readFSCacheIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.Hash != "hash1" || len(idx.Parts) != 1 || idx.Parts[0].Name != "fs" ||
+		idx.Parts[0].ImagePath != filepath.Join("objs", "fw_temp", "fs.img") {
+		t.Fatalf("unexpected cache index: %+v %+v", idx, idx.Parts)
+	}
+
+	// Different inputs: a miss.
+	if idx := b.restoreFSImages(dir, "hash2"); idx != nil {
+		t.Errorf("unexpected cache hit with a different hash")
+	}
+
+	// Same inputs: the image is put back.
+	os.Remove(fsImage)
+	idx = b.restoreFSImages(dir, "hash1")
+	if idx == nil {
+		t.Fatalf("expected a cache hit")
+	}
+	if data, _ := ioutil.ReadFile(fsImage); string(data) != "fs1" {
+		t.Errorf("image is not restored: %q", data)
+	}
+
+	// Make regenerated the image anyway: its output is kept and the cache is
+	// refreshed.
+	writeFSTestBundle(t, fwFilename, []byte("fs1-regenerated"))
+	if err := b.updateFSImages(dir, fwFilename, "hash1", idx); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := fwbundle.ReadZipFirmwareBundle(fwFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Cleanup()
+	if data, err := fw.GetPartData("fs"); err != nil || !bytes.Equal(data, []byte("fs1-regenerated")) {
+		t.Errorf("FS part is changed: %q %v", data, err)
+	}
+	idx = b.restoreFSImages(dir, "hash1")
+	if idx == nil {
+		t.Fatalf("expected a cache hit")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(moscommon.GetFSImageCacheDir(dir), idx.Parts[0].File)); string(data) != "fs1-regenerated" {
+		t.Errorf("cache is not refreshed: %q", data)
+	}
+}
@@ -0,0 +1,416 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	yaml "gopkg.in/yaml.v2"
+	glog "k8s.io/klog/v2"
+
+	"github.com/mongoose-os/mos/cli/build"
+	moscommon "github.com/mongoose-os/mos/cli/common"
+	"github.com/mongoose-os/mos/cli/interpreter"
+	"github.com/mongoose-os/mos/cli/manifest_parser"
+	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/cli/trace"
+	"github.com/mongoose-os/mos/version"
+)
+
+// Manifest cache (mos build --cache-libs-manifest).
+//
+// Resolving the manifest, i.e. preparing all the libs and expanding conds,
+// dominates the latency of incremental builds of apps with many libs. The
+// result is saved in --manifest-cache-dir, one file per app and set of build
+// params, together with the files it was derived from, and reused while none
+// of them changed. Libs are not updated on a hit, so entries expire after
+// --libs-update-interval.
+
+const manifestCacheStatsFile = "stats.json"
+
+type manifestCacheFile struct {
+	Path string `yaml:"path"`
+	Size int64  `yaml:"size"`
+	// Modification time, in nanoseconds since epoch.
+	MTime int64 `yaml:"mtime"`
+}
+
+// manifestCacheModule is the local state of a module, which is not
+// serialized with the manifest.
+type manifestCacheModule struct {
+	Name        string `yaml:"name"`
+	Path        string `yaml:"path"`
+	RepoVersion string `yaml:"repo_version,omitempty"`
+	RepoDirty   bool   `yaml:"repo_dirty,omitempty"`
+}
+
+type manifestCacheEntry struct {
+	Created       time.Time     `yaml:"created"`
+	ParseDuration time.Duration `yaml:"parse_duration"`
+
+	// Files and dirs the manifest was derived from.
+	Inputs []manifestCacheFile `yaml:"inputs"`
+	// Environment variables referenced by the manifests, with their values.
+	Env map[string]string `yaml:"env,omitempty"`
+	// Files generated by the parser which the build needs.
+	Outputs []string `yaml:"outputs,omitempty"`
+
+	Manifest     *build.FWAppManifest           `yaml:"manifest"`
+	Deps         map[string][]string            `yaml:"deps,omitempty"`
+	InitDepsInfo map[string]*build.InitDepsInfo `yaml:"init_deps_info,omitempty"`
+	RMFOut       *manifest_parser.RMFOut        `yaml:"rmf_out"`
+	Modules      []manifestCacheModule          `yaml:"modules,omitempty"`
+}
+
+// ManifestCacheStats are the usage stats of the manifest cache, accumulated
+// across runs until the cache is cleared.
+type ManifestCacheStats struct {
+	Hits   int `json:"hits"`
+	Misses int `json:"misses"`
+	// Sum of the parse durations of the cached entries used, minus the time
+	// spent on their validation.
+	TimeSaved time.Duration `json:"time_saved"`
+
+	// Number and total size of the entries, not saved.
+	Entries int   `json:"-"`
+	Size    int64 `json:"-"`
+}
+
+var envRefRE = regexp.MustCompile(`\benv\.([A-Za-z_][A-Za-z0-9_]*)`)
+
+// readManifestFinal is manifest_parser.ReadManifestFinal, cached if
+// requested.
+func (b *builder) readManifestFinal(
+	appDir string, bParams *build.BuildParams, interp *interpreter.MosInterpreter,
+	cp manifest_parser.ComponentProvider,
+) (*build.FWAppManifest, *manifest_parser.RMFOut, error) {
+	if !b.p.CacheManifest {
+		return manifest_parser.ReadManifestFinal(
+			appDir, &bParams.ManifestAdjustments, b.logWriter, interp,
+			&manifest_parser.ReadManifestCallbacks{ComponentProvider: cp},
+			true /* requireArch */, bParams.PreferPrebuiltLibs, bParams.LibsUpdateInterval)
+	}
+
+	key, err := manifestCacheKey(appDir, b.p)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	fname := filepath.Join(b.p.ManifestCacheDir, key+".yml")
+
+	start := time.Now()
+	endLookup := trace.Span("parse", "Manifest cache lookup")
+	e, reason := loadManifestCacheEntry(fname, bParams)
+	endLookup()
+	if e != nil {
+		saved := e.ParseDuration - time.Since(start)
+		if saved < 0 {
+			saved = 0
+		}
+		ourutil.Freportf(b.logWriterStderr, "Using cached manifest (%s)", fname)
+		updateManifestCacheStats(b.p.ManifestCacheDir, func(s *ManifestCacheStats) {
+			s.Hits++
+			s.TimeSaved += saved
+		})
+		e.Manifest.Deps = e.Deps
+		e.Manifest.InitDepsInfo = e.InitDepsInfo
+		return e.Manifest, e.RMFOut, nil
+	}
+	ourutil.Freportf(b.logWriter, "Manifest cache miss: %s", reason)
+	updateManifestCacheStats(b.p.ManifestCacheDir, func(s *ManifestCacheStats) { s.Misses++ })
+
+	start = time.Now()
+	manifest, fp, err := manifest_parser.ReadManifestFinal(
+		appDir, &bParams.ManifestAdjustments, b.logWriter, interp,
+		&manifest_parser.ReadManifestCallbacks{ComponentProvider: cp},
+		true /* requireArch */, bParams.PreferPrebuiltLibs, bParams.LibsUpdateInterval)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	e = &manifestCacheEntry{
+		Created:       time.Now(),
+		ParseDuration: time.Since(start),
+		Manifest:      manifest,
+		Deps:          manifest.Deps,
+		InitDepsInfo:  manifest.InitDepsInfo,
+		RMFOut:        fp,
+		Modules:       getManifestCacheModules(manifest),
+	}
+	e.Inputs, e.Env = getManifestCacheInputs(appDir, bParams, manifest, fp)
+	e.Outputs = append(append([]string{}, manifest.Sources...), manifest.BinaryLibs...)
+	if manifest.Type == build.ManifestTypeApp {
+		if dmf, err := filepath.Abs(moscommon.GetDepsManifestFilePath(moscommon.GetBuildDir(appDir))); err == nil {
+			e.Outputs = append(e.Outputs, dmf)
+		}
+	}
+	// Not being able to save the entry does not fail the build.
+	if err := saveManifestCacheEntry(fname, e); err != nil {
+		glog.Warningf("failed to save manifest cache entry: %s", err)
+	}
+	return manifest, fp, nil
+}
+
+// manifestCacheKey returns the cache key for the app and the build params
+// which affect the resolved manifest.
+func manifestCacheKey(appDir string, p *BuildParams) (string, error) {
+	data, err := yaml.Marshal(struct {
+		AppDir                string
+		MosVersion            string
+		Adjustments           build.ManifestAdjustments
+		CustomLibLocations    map[string]string
+		CustomModuleLocations map[string]string
+		PreferPrebuiltLibs    bool
+		LibsDir               []string
+		DepsDir               string
+		ModulesDir            string
+	}{
+		AppDir:                appDir,
+		MosVersion:            version.GetMosVersion(),
+		Adjustments:           p.ManifestAdjustments,
+		CustomLibLocations:    p.CustomLibLocations,
+		CustomModuleLocations: p.CustomModuleLocations,
+		PreferPrebuiltLibs:    p.PreferPrebuiltLibs,
+		LibsDir:               p.LibsDir,
+		DepsDir:               p.DepsDir,
+		ModulesDir:            p.ModulesDir,
+	})
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))[:16], nil
+}
+
+// getManifestCacheInputs returns the files the manifest was derived from and
+// the environment variables referenced in the manifests: the manifest files
+// of the app, the libs and the mos module, the dirs containing them and the
+// ones the sources and filesystem files were picked from.
+func getManifestCacheInputs(appDir string, bParams *build.BuildParams, manifest *build.FWAppManifest, fp *manifest_parser.RMFOut) ([]manifestCacheFile, map[string]string) {
+	var paths, manifests []string
+	addDir := func(dir string) {
+		paths = append(paths, dir)
+		ymls, _ := filepath.Glob(filepath.Join(dir, "mos*.yml"))
+		manifests = append(manifests, ymls...)
+		// Catches checkouts and pulls.
+		paths = append(paths, filepath.Join(dir, ".git", "HEAD"), filepath.Join(dir, ".git", "index"))
+	}
+	addDir(appDir)
+	for _, lh := range manifest.LibsHandled {
+		if lh.Path != "" {
+			addDir(lh.Path)
+		}
+	}
+	if fp.MosDirEffective != "" {
+		addDir(fp.MosDirEffective)
+		sdkVersionFiles, _ := filepath.Glob(moscommon.GetSdkVersionFile(fp.MosDirEffective, "*"))
+		paths = append(paths, sdkVersionFiles...)
+	}
+	paths = append(paths, manifests...)
+	for _, l := range [][]string{fp.AppSourceDirs, fp.AppFSDirs, fp.AppBinLibDirs, bParams.ExtraSources} {
+		paths = append(paths, l...)
+	}
+
+	var inputs []manifestCacheFile
+	seen := map[string]bool{}
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(appDir, p)
+		}
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		fi, err := os.Stat(p)
+		if err != nil {
+			// Optional files, e.g. .git of a lib which is not a repo.
+			continue
+		}
+		inputs = append(inputs, manifestCacheFile{Path: p, Size: fi.Size(), MTime: fi.ModTime().UnixNano()})
+	}
+
+	env := map[string]string{}
+	for _, m := range manifests {
+		data, err := ioutil.ReadFile(m)
+		if err != nil {
+			continue
+		}
+		for _, match := range envRefRE.FindAllSubmatch(data, -1) {
+			env[string(match[1])] = os.Getenv(string(match[1]))
+		}
+	}
+	return inputs, env
+}
+
+// loadManifestCacheEntry returns the entry if it's still valid, otherwise
+// the reason why it's not.
+func loadManifestCacheEntry(fname string, bParams *build.BuildParams) (*manifestCacheEntry, string) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, "no entry"
+		}
+		return nil, err.Error()
+	}
+	var e manifestCacheEntry
+	if err := yaml.Unmarshal(data, &e); err != nil || e.Manifest == nil || e.RMFOut == nil {
+		return nil, "invalid entry"
+	}
+	if len(e.Modules) != len(e.Manifest.Modules) {
+		return nil, "invalid entry"
+	}
+	for i, ms := range e.Modules {
+		m := &e.Manifest.Modules[i]
+		if name, _ := m.GetName(); name != ms.Name {
+			return nil, "invalid entry"
+		}
+		m.SetLocalPathAndRepoVersion(ms.Path, ms.RepoVersion, ms.RepoDirty)
+	}
+	return &e, checkManifestCacheEntry(&e, bParams)
+}
+
+func getManifestCacheModules(manifest *build.FWAppManifest) []manifestCacheModule {
+	var res []manifestCacheModule
+	for i := range manifest.Modules {
+		m := &manifest.Modules[i]
+		name, _ := m.GetName()
+		rv, dirty, _ := m.GetRepoVersion()
+		res = append(res, manifestCacheModule{Name: name, Path: m.GetLocalPath(), RepoVersion: rv, RepoDirty: dirty})
+	}
+	return res
+}
+
+// checkManifestCacheEntry returns the reason why e is no longer valid,
+// or an empty string if it is.
+func checkManifestCacheEntry(e *manifestCacheEntry, bParams *build.BuildParams) string {
+	if bParams.LibsUpdateInterval > 0 && !bParams.Offline && time.Since(e.Created) > bParams.LibsUpdateInterval {
+		return "expired, libs may need updating"
+	}
+	for _, in := range e.Inputs {
+		fi, err := os.Stat(in.Path)
+		if err != nil || fi.Size() != in.Size || fi.ModTime().UnixNano() != in.MTime {
+			return fmt.Sprintf("%s changed", in.Path)
+		}
+	}
+	for k, v := range e.Env {
+		if os.Getenv(k) != v {
+			return fmt.Sprintf("env var %s changed", k)
+		}
+	}
+	for _, out := range e.Outputs {
+		if _, err := os.Stat(out); err != nil {
+			return fmt.Sprintf("%s is missing", out)
+		}
+	}
+	return ""
+}
+
+func saveManifestCacheEntry(fname string, e *manifestCacheEntry) error {
+	data, err := yaml.Marshal(e)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(writeFileAtomic(fname, data))
+}
+
+// writeFileAtomic writes the file via a temp file, so that concurrent builds
+// never see it half-written.
+func writeFileAtomic(fname string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return errors.Trace(err)
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", fname, os.Getpid())
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		os.Remove(tmp)
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func readManifestCacheStats(dir string) *ManifestCacheStats {
+	s := &ManifestCacheStats{}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, manifestCacheStatsFile)); err == nil {
+		json.Unmarshal(data, s)
+	}
+	return s
+}
+
+// updateManifestCacheStats applies f to the saved stats. Updates of
+// concurrent builds may get lost, which is fine for stats.
+func updateManifestCacheStats(dir string, f func(s *ManifestCacheStats)) {
+	s := readManifestCacheStats(dir)
+	f(s)
+	data, _ := json.Marshal(s)
+	if err := writeFileAtomic(filepath.Join(dir, manifestCacheStatsFile), data); err != nil {
+		glog.Warningf("failed to save manifest cache stats: %s", err)
+	}
+}
+
+func getManifestCacheEntryFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yml"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// GetManifestCacheStats returns the stats of the manifest cache in dir.
+func GetManifestCacheStats(dir string) (*ManifestCacheStats, error) {
+	s := readManifestCacheStats(dir)
+	files, err := getManifestCacheEntryFiles(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			s.Entries++
+			s.Size += fi.Size()
+		}
+	}
+	return s, nil
+}
+
+// ClearManifestCache removes all the entries from the manifest cache in dir
+// and resets the stats. Returns the number of entries removed.
+func ClearManifestCache(dir string) (int, error) {
+	files, err := getManifestCacheEntryFiles(dir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	n := 0
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return n, errors.Trace(err)
+		}
+		n++
+	}
+	if err := os.Remove(filepath.Join(dir, manifestCacheStatsFile)); err != nil && !os.IsNotExist(err) {
+		return n, errors.Trace(err)
+	}
+	return n, nil
+}
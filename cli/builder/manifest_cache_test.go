@@ -0,0 +1,156 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mongoose-os/mos/cli/build"
+	"github.com/mongoose-os/mos/cli/manifest_parser"
+)
+
+func TestManifestCacheEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest_cache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	appDir := filepath.Join(dir, "app")
+	libDir := filepath.Join(dir, "lib1")
+	genDir := filepath.Join(appDir, "build", "gen")
+	for _, d := range []string{filepath.Join(appDir, "src"), genDir, libDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile := func(fname, data string) {
+		if err := ioutil.WriteFile(fname, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(filepath.Join(appDir, "mos.yml"), "name: app\nbuild_vars:\n  FOO: ${env.MOS_CACHE_TEST_FOO}\n")
+	writeFile(filepath.Join(libDir, "mos.yml"), "name: lib1\n")
+	mainC := filepath.Join(appDir, "src", "main.c")
+	writeFile(mainC, "")
+	depsInitC := filepath.Join(genDir, "deps_init.c")
+	writeFile(depsInitC, "")
+	os.Setenv("MOS_CACHE_TEST_FOO", "foo")
+	defer os.Unsetenv("MOS_CACHE_TEST_FOO")
+
+	manifest := &build.FWAppManifest{
+		Sources:     []string{mainC, depsInitC},
+		LibsHandled: []build.FWAppManifestLibHandled{{Lib: build.SWModule{Name: "lib1"}, Path: libDir}},
+	}
+	manifest.Name = "app"
+	manifest.Modules = []build.SWModule{{Name: "mongoose-os", Location: "https://github.com/cesanta/mongoose-os"}}
+	manifest.Modules[0].SetLocalPathAndRepoVersion(filepath.Join(dir, "mongoose-os"), "abcdef", true)
+	fp := &manifest_parser.RMFOut{MTime: time.Unix(1234, 0), AppSourceDirs: []string{filepath.Join(appDir, "src")}}
+	bParams := &build.BuildParams{LibsUpdateInterval: time.Hour}
+
+	e := &manifestCacheEntry{
+		Created:       time.Now(),
+		ParseDuration: 5 * time.Second,
+		Manifest:      manifest,
+		Deps:          map[string][]string{"app": {"lib1"}},
+		RMFOut:        fp,
+		Outputs:       manifest.Sources,
+		Modules:       getManifestCacheModules(manifest),
+	}
+	e.Inputs, e.Env = getManifestCacheInputs(appDir, bParams, manifest, fp)
+	if e.Env["MOS_CACHE_TEST_FOO"] != "foo" {
+		t.Errorf("referenced env var not recorded: %v", e.Env)
+	}
+
+	fname := filepath.Join(dir, "cache", "entry.yml")
+	if err := saveManifestCacheEntry(fname, e); err != nil {
+		t.Fatal(err)
+	}
+	check := func(expReason string) {
+		t.Helper()
+		e2, reason := loadManifestCacheEntry(fname, bParams)
+		if !strings.Contains(reason, expReason) || (expReason == "") != (reason == "") {
+			t.Errorf("expected reason %q, got %q", expReason, reason)
+		}
+		if reason == "" {
+			if e2.Manifest.Name != "app" || e2.Deps["app"][0] != "lib1" || !e2.RMFOut.MTime.Equal(fp.MTime) {
+				t.Errorf("entry did not round-trip: %+v", e2)
+			}
+			// Local state of the modules is restored.
+			m := &e2.Manifest.Modules[0]
+			if rv, dirty, _ := m.GetRepoVersion(); m.GetLocalPath() != filepath.Join(dir, "mongoose-os") || rv != "abcdef" || !dirty {
+				t.Errorf("module state is not restored: %q %q %t", m.GetLocalPath(), rv, dirty)
+			}
+		}
+	}
+	check("")
+
+	os.Setenv("MOS_CACHE_TEST_FOO", "bar")
+	check("env var MOS_CACHE_TEST_FOO changed")
+	os.Setenv("MOS_CACHE_TEST_FOO", "foo")
+	check("")
+
+	// A new source file changes the dir.
+	time.Sleep(10 * time.Millisecond)
+	writeFile(filepath.Join(appDir, "src", "new.c"), "")
+	check("src changed")
+	e.Inputs, e.Env = getManifestCacheInputs(appDir, bParams, manifest, fp)
+	saveManifestCacheEntry(fname, e)
+	check("")
+
+	writeFile(filepath.Join(libDir, "mos.yml"), "name: lib1\nsources: [src]\n")
+	check(filepath.Join(libDir, "mos.yml") + " changed")
+	e.Inputs, e.Env = getManifestCacheInputs(appDir, bParams, manifest, fp)
+	saveManifestCacheEntry(fname, e)
+
+	// Generated files are gone after a clean build.
+	os.Remove(depsInitC)
+	check("deps_init.c is missing")
+	writeFile(depsInitC, "")
+	check("")
+
+	e.Created = time.Now().Add(-2 * time.Hour)
+	saveManifestCacheEntry(fname, e)
+	check("expired")
+	bParams.Offline = true
+	check("")
+}
+
+func TestManifestCacheKey(t *testing.T) {
+	bp1 := &BuildParams{}
+	bp1.Platform = "esp32"
+	bp2 := &BuildParams{}
+	bp2.Platform = "esp8266"
+	bp3 := &BuildParams{DepsDir: "/deps"}
+	bp3.Platform = "esp32"
+	k1, _ := manifestCacheKey("/app", bp1)
+	k1again, _ := manifestCacheKey("/app", bp1)
+	k2, _ := manifestCacheKey("/app", bp2)
+	k3, _ := manifestCacheKey("/app2", bp1)
+	k4, _ := manifestCacheKey("/app", bp3)
+	if k1 != k1again {
+		t.Errorf("key is not stable: %s vs %s", k1, k1again)
+	}
+	if k1 == k2 || k1 == k3 || k1 == k4 {
+		t.Errorf("keys must differ: %s %s %s %s", k1, k2, k3, k4)
+	}
+}
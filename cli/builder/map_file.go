@@ -0,0 +1,54 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package builder
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/juju/errors"
+
+	moscommon "github.com/mongoose-os/mos/cli/common"
+	"github.com/mongoose-os/mos/common/ourio"
+)
+
+// preserveMapFile copies the linker map file, named differently by different
+// platforms, to build/objs/fw.map. Returns the path of the map file or an
+// empty string if the build did not produce one.
+func preserveMapFile(buildDir string) (string, error) {
+	dst := moscommon.GetMapFilePath(buildDir)
+	matches, _ := filepath.Glob(filepath.Join(moscommon.GetObjectDir(buildDir), "*.map"))
+	var src string
+	var srcMTime int64
+	for _, m := range matches {
+		if m == dst {
+			continue
+		}
+		if fi, err := os.Stat(m); err == nil && fi.ModTime().UnixNano() > srcMTime {
+			src, srcMTime = m, fi.ModTime().UnixNano()
+		}
+	}
+	dfi, err := os.Stat(dst)
+	if src != "" && (err != nil || dfi.ModTime().UnixNano() < srcMTime) {
+		if err := ourio.CopyFile(src, dst); err != nil {
+			return "", errors.Annotatef(err, "failed to copy %s", src)
+		}
+	} else if err != nil {
+		return "", nil
+	}
+	return filepath.Abs(dst)
+}
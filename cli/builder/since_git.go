@@ -0,0 +1,184 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package builder
+
+import (
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+	yaml "gopkg.in/yaml.v2"
+	glog "k8s.io/klog/v2"
+
+	"github.com/mongoose-os/mos/cli/build"
+	moscommon "github.com/mongoose-os/mos/cli/common"
+	"github.com/mongoose-os/mos/cli/errcode"
+	"github.com/mongoose-os/mos/cli/manifest_parser"
+	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/common/ourgit"
+)
+
+// checkChangedSinceGit implements --since-git: returns an error with
+// errcode.BuildSkipped if none of the app's inputs changed since the given
+// git ref. Inputs are the app's manifest (including mos.<env>.yml and the
+// --env-file), resolved sources, includes, filesystem files and binary libs,
+// as well as the dirs they came from. Local libs are checked as part of the
+// app's repo. Libs which are git repos themselves are checked with
+// checkLibsChangedSinceGit.
+func (b *builder) checkChangedSinceGit(gitinst ourgit.OurGit, appDir string, manifest *build.FWAppManifest, fp *manifest_parser.RMFOut) error {
+	ref := b.p.SinceGit
+	topDir, err := gitinst.GetToplevelDir(appDir)
+	if err != nil {
+		return errors.Annotatef(err, "--since-git: app is not in a git repo")
+	} else if topDir == "" {
+		return errors.Errorf("--since-git: app is not in a git repo")
+	}
+	changedFiles, err := gitinst.GetChangedFiles(appDir, ref)
+	if err != nil {
+		return errors.Annotatef(err, "--since-git")
+	}
+	var changed []string
+	for _, f := range changedFiles {
+		changed = append(changed, normPath(filepath.Join(topDir, filepath.FromSlash(f))))
+	}
+
+	inputs := []string{moscommon.GetManifestFilePath(appDir)}
+	if b.p.Env != "" {
+		inputs = append(inputs, moscommon.GetManifestEnvFilePath(appDir, b.p.Env))
+	}
+	if b.p.EnvFile != "" {
+		inputs = append(inputs, b.p.EnvFile)
+	}
+	if b.p.DepsVersionsFile != "" {
+		inputs = append(inputs, b.p.DepsVersionsFile)
+	}
+	for _, l := range [][]string{
+		manifest.Sources, manifest.Includes, manifest.Filesystem, manifest.BinaryLibs,
+		fp.AppSourceDirs, fp.AppFSDirs, fp.AppBinLibDirs,
+	} {
+		inputs = append(inputs, l...)
+	}
+	for _, lh := range manifest.LibsHandled {
+		if lh.Path != "" && lh.RepoVersion == "" {
+			inputs = append(inputs, lh.Path)
+		}
+	}
+	if checkLibsChangedSinceGit(b.logWriter, appDir, manifest, b.p.DepsVersions) {
+		return nil
+	}
+	for i, p := range inputs {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(appDir, p)
+		}
+		inputs[i] = normPath(p)
+	}
+
+	for _, f := range changed {
+		for _, in := range inputs {
+			if f == in || isUnderDir(f, in) {
+				ourutil.Freportf(b.logWriter, "--since-git: %s changed since %s", f, ref)
+				return nil
+			}
+		}
+	}
+	return errcode.Errorf(errcode.BuildSkipped, "no inputs changed since %s, build skipped", ref)
+}
+
+// checkLibsChangedSinceGit returns true if any of the libs which are git
+// repos may have changed since the base ref. A lib is unchanged if its version
+// is pinned: by the deps versions (the file is an input, so the pin is the same
+// as at the base ref), or by a hash in the manifest. Otherwise it is compared
+// with the previous build, if there is one. If the version at the base ref
+// can't be determined, the lib is reported and considered unchanged.
+func checkLibsChangedSinceGit(logWriter io.Writer, appDir string, manifest *build.FWAppManifest, dv *build.DepsManifest) bool {
+	pinned := map[string]string{}
+	if dv != nil {
+		for _, e := range dv.Libs {
+			pinned[e.Name] = e.RepoVersion
+		}
+	}
+	prevLibVersions := readPrevLibVersions(appDir)
+	for _, lh := range manifest.LibsHandled {
+		if lh.Path == "" || lh.RepoVersion == "" {
+			continue
+		}
+		name := lh.Lib.Name
+		if lh.RepoDirty {
+			ourutil.Freportf(logWriter, "--since-git: lib %s has local changes", name)
+			return true
+		}
+		if pv, ok := pinned[name]; ok {
+			if !ourgit.HashesEqual(pv, lh.RepoVersion) {
+				ourutil.Freportf(logWriter, "--since-git: lib %s is at %s, pinned to %s", name, lh.RepoVersion, pv)
+				return true
+			}
+			continue
+		}
+		if ourgit.HashesEqual(lh.Version, lh.RepoVersion) {
+			continue
+		}
+		prev, ok := prevLibVersions[name]
+		if !ok {
+			ourutil.Freportf(logWriter, "--since-git: version of lib %s at the base ref is unknown (not pinned, no previous build), assuming unchanged", name)
+			continue
+		}
+		if !ourgit.HashesEqual(prev, lh.RepoVersion) {
+			ourutil.Freportf(logWriter, "--since-git: lib %s is at %s, was %q in the previous build", name, lh.RepoVersion, prev)
+			return true
+		}
+	}
+	return false
+}
+
+// readPrevLibVersions returns repo versions of the libs from the final
+// manifest of the previous build, if any.
+func readPrevLibVersions(appDir string) map[string]string {
+	res := map[string]string{}
+	data, err := ioutil.ReadFile(moscommon.GetMosFinalFilePath(moscommon.GetBuildDir(appDir)))
+	if err != nil {
+		return res
+	}
+	var m build.FWAppManifest
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		glog.Warningf("failed to parse the previous final manifest: %s", err)
+		return res
+	}
+	for _, lh := range m.LibsHandled {
+		if lh.RepoVersion != "" {
+			res[lh.Lib.Name] = lh.RepoVersion
+		}
+	}
+	return res
+}
+
+// normPath returns a clean path with symlinks resolved. Deleted files
+// only have their dir resolved.
+func normPath(p string) string {
+	if rp, err := filepath.EvalSymlinks(p); err == nil {
+		return rp
+	}
+	if rd, err := filepath.EvalSymlinks(filepath.Dir(p)); err == nil {
+		return filepath.Join(rd, filepath.Base(p))
+	}
+	return filepath.Clean(p)
+}
+
+func isUnderDir(p, dir string) bool {
+	return strings.HasPrefix(p, dir+string(filepath.Separator))
+}
@@ -0,0 +1,80 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package builder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/mongoose-os/mos/cli/build"
+	moscommon "github.com/mongoose-os/mos/cli/common"
+)
+
+func TestCheckLibsChangedSinceGit(t *testing.T) {
+	appDir, err := ioutil.TempDir("", "since_git_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(appDir)
+
+	const hash1, hash2 = "0123456789abcdef0123456789abcdef01234567", "89abcdef0123456789abcdef0123456789abcdef"
+	lib := func(version, repoVersion string, dirty bool) *build.FWAppManifest {
+		return &build.FWAppManifest{LibsHandled: []build.FWAppManifestLibHandled{{
+			Lib: build.SWModule{Name: "lib1"}, Path: "/libs/lib1",
+			Version: version, RepoVersion: repoVersion, RepoDirty: dirty,
+		}}}
+	}
+	check := func(m *build.FWAppManifest, dv *build.DepsManifest, exp bool, expMsg string) {
+		t.Helper()
+		var out bytes.Buffer
+		if res := checkLibsChangedSinceGit(&out, appDir, m, dv); res != exp {
+			t.Errorf("expected %t, got %t (%s)", exp, res, out.String())
+		}
+		if !strings.Contains(out.String(), expMsg) {
+			t.Errorf("expected %q in the output, got %q", expMsg, out.String())
+		}
+	}
+
+	// No previous build (e.g. a fresh CI checkout): the version at the base
+	// ref is unknown, which is reported but is not a change.
+	check(lib("master", hash1, false), nil, false, "lib1 at the base ref is unknown")
+	// Pinned in the manifest.
+	check(lib(hash1, hash1, false), nil, false, "")
+	// Pinned by the deps lock.
+	dv := &build.DepsManifest{Libs: []*build.DepsManifestEntry{{Name: "lib1", RepoVersion: hash1}}}
+	check(lib("master", hash1, false), dv, false, "")
+	dv.Libs[0].RepoVersion = hash2
+	check(lib("master", hash1, false), dv, true, "pinned to")
+	check(lib(hash1, hash1, true), nil, true, "local changes")
+
+	// Previous build at a different version.
+	prev := lib("master", hash2, false)
+	data, _ := yaml.Marshal(prev)
+	mf := moscommon.GetMosFinalFilePath(moscommon.GetBuildDir(appDir))
+	os.MkdirAll(filepath.Dir(mf), 0755)
+	if err := ioutil.WriteFile(mf, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	check(lib("master", hash1, false), nil, true, "in the previous build")
+	check(lib("master", hash2, false), nil, false, "")
+}
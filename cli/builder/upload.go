@@ -0,0 +1,111 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package builder
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/ourutil"
+)
+
+const (
+	uploadRetryDelay    = 2 * time.Second
+	uploadRetryMaxDelay = time.Minute
+)
+
+// postWithRetry POSTs body to uri and returns the response status and body.
+// Transport errors (including the ones while reading the response), 5xx and
+// 429 responses are retried up to retries times, doubling the delay between
+// attempts, but no more than uploadRetryMaxDelay. Retry-After of the response,
+// if any, overrides the delay. Other responses are returned to the caller as
+// is. setHeaders is invoked on the request of each attempt.
+func postWithRetry(
+	ctx context.Context, client *http.Client, uri string, body []byte,
+	setHeaders func(req *http.Request), retries int, delay time.Duration,
+	logWriter io.Writer,
+) (int, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		status, hdr, respBody, err := post(ctx, client, uri, body, setHeaders)
+		if err == nil && status < http.StatusInternalServerError && status != http.StatusTooManyRequests {
+			return status, respBody, nil
+		}
+		if err == nil {
+			err = errors.Errorf("error response: %d: %s", status, bytes.TrimSpace(respBody))
+		}
+		if attempt >= retries || ctx.Err() != nil {
+			if status != 0 {
+				// Let the caller handle the last server error response.
+				return status, respBody, nil
+			}
+			return 0, nil, errors.Trace(err)
+		}
+		wait := delay
+		if ra := getRetryAfter(hdr); ra > 0 {
+			wait = ra
+		}
+		ourutil.Freportf(logWriter, "Upload failed (attempt %d of %d): %s, retrying in %s",
+			attempt+1, retries+1, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return 0, nil, errors.Trace(ctx.Err())
+		}
+		delay *= 2
+		if delay > uploadRetryMaxDelay {
+			delay = uploadRetryMaxDelay
+		}
+	}
+}
+
+func post(ctx context.Context, client *http.Client, uri string, body []byte, setHeaders func(req *http.Request)) (int, http.Header, []byte, error) {
+	req, err := http.NewRequest("POST", uri, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, nil, errors.Trace(err)
+	}
+	req = req.WithContext(ctx)
+	setHeaders(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	var respBody bytes.Buffer
+	if _, err := respBody.ReadFrom(resp.Body); err != nil {
+		return 0, nil, nil, errors.Annotatef(err, "failed to read response (status %d)", resp.StatusCode)
+	}
+	return resp.StatusCode, resp.Header, respBody.Bytes(), nil
+}
+
+// getRetryAfter returns the delay from the Retry-After header (in seconds),
+// capped at uploadRetryMaxDelay, or 0 if there is none.
+func getRetryAfter(hdr http.Header) time.Duration {
+	secs, err := strconv.Atoi(hdr.Get("Retry-After"))
+	if err != nil || secs <= 0 {
+		return 0
+	}
+	if d := time.Duration(secs) * time.Second; d < uploadRetryMaxDelay {
+		return d
+	}
+	return uploadRetryMaxDelay
+}
@@ -0,0 +1,150 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFlakyServer returns a server which fails the first numFailures requests,
+// either with 503 or by dropping the connection, and then responds with 200
+// and the request body.
+func newFlakyServer(t *testing.T, numFailures int32, dropConn bool, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Test") != "1" {
+			t.Errorf("headers not set on attempt %d", atomic.LoadInt32(requests)+1)
+		}
+		if atomic.AddInt32(requests, 1) <= numFailures {
+			if dropConn {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+}
+
+func setTestHeaders(req *http.Request) {
+	req.Header.Set("X-Test", "1")
+}
+
+func TestPostWithRetry(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		numFailures int32
+		dropConn    bool
+		retries     int
+		expStatus   int
+		expErr      bool
+		expRequests int32
+	}{
+		{name: "no failures", numFailures: 0, retries: 3, expStatus: 200, expRequests: 1},
+		{name: "503 then ok", numFailures: 2, retries: 3, expStatus: 200, expRequests: 3},
+		{name: "dropped then ok", numFailures: 3, dropConn: true, retries: 3, expStatus: 200, expRequests: 4},
+		{name: "503 out of retries", numFailures: 5, retries: 2, expStatus: 503, expRequests: 3},
+		{name: "dropped out of retries", numFailures: 5, dropConn: true, retries: 1, expErr: true, expRequests: 2},
+		{name: "no retries", numFailures: 1, retries: 0, expStatus: 503, expRequests: 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var requests int32
+			srv := newFlakyServer(t, c.numFailures, c.dropConn, &requests)
+			defer srv.Close()
+
+			status, body, err := postWithRetry(context.Background(), srv.Client(), srv.URL, []byte("sources"),
+				setTestHeaders, c.retries, time.Millisecond, ioutil.Discard)
+			if c.expErr {
+				if err == nil {
+					t.Errorf("expected an error, got status %d", status)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			} else if status != c.expStatus {
+				t.Errorf("expected status %d, got %d", c.expStatus, status)
+			} else if status == 200 && string(body) != "sources" {
+				// The body must be sent in full on every attempt.
+				t.Errorf("unexpected body %q", body)
+			}
+			if requests != c.expRequests {
+				t.Errorf("expected %d requests, got %d", c.expRequests, requests)
+			}
+		})
+	}
+}
+
+func TestPostWithRetryNoRetryOnClientError(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	status, _, err := postWithRetry(context.Background(), srv.Client(), srv.URL, nil,
+		setTestHeaders, 3, time.Millisecond, ioutil.Discard)
+	if err != nil || status != http.StatusBadRequest || requests != 1 {
+		t.Errorf("expected a single request with status 400, got %d requests, status %d, err %v", requests, status, err)
+	}
+}
+
+func TestPostWithRetryCancel(t *testing.T) {
+	var requests int32
+	srv := newFlakyServer(t, 100, false, &requests)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := postWithRetry(ctx, srv.Client(), srv.URL, nil,
+		setTestHeaders, 100, time.Second, ioutil.Discard); err == nil {
+		t.Errorf("expected an error")
+	}
+	if requests != 1 {
+		t.Errorf("expected 1 request, got %d", requests)
+	}
+}
+
+func TestPostWithRetryTooManyRequests(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent builds", http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	status, _, err := postWithRetry(context.Background(), srv.Client(), srv.URL, nil,
+		setTestHeaders, 3, time.Millisecond, ioutil.Discard)
+	if err != nil || status != http.StatusOK || requests != 2 {
+		t.Errorf("expected a retry after 429, got %d requests, status %d, err %v", requests, status, err)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("Retry-After is not respected, retried after %s", d)
+	}
+}
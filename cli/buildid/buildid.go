@@ -0,0 +1,121 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package buildid extracts firmware build ids from ELF files and devices
+// and compares them, so that mismatched firmware and symbols are detected
+// early instead of producing confusing results.
+package buildid
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/dev"
+)
+
+// Name of the variable generated by fw_meta.py gen_build_info,
+// possibly with a prefix (e.g. mg_build_id).
+const symbolSuffix = "build_id"
+
+// FromELF returns the build id compiled into the firmware ELF file.
+func FromELF(fname string) (string, error) {
+	f, err := elf.Open(fname)
+	if err != nil {
+		return "", errors.Annotatef(err, "failed to open %s", fname)
+	}
+	defer f.Close()
+	syms, err := f.Symbols()
+	if err != nil {
+		return "", errors.Annotatef(err, "failed to read symbols from %s", fname)
+	}
+	for _, s := range syms {
+		if !strings.HasSuffix(s.Name, symbolSuffix) || elf.ST_TYPE(s.Info) != elf.STT_OBJECT {
+			continue
+		}
+		// const char *build_id = "..."; - read the pointer first, then the string.
+		ptr, err := readAt(f, s.Value, s.Size)
+		if err != nil {
+			return "", errors.Annotatef(err, "%s", s.Name)
+		}
+		var addr uint64
+		switch len(ptr) {
+		case 4:
+			addr = uint64(f.ByteOrder.Uint32(ptr))
+		case 8:
+			addr = f.ByteOrder.Uint64(ptr)
+		default:
+			continue
+		}
+		str, err := readAt(f, addr, 0)
+		if err != nil {
+			return "", errors.Annotatef(err, "%s", s.Name)
+		}
+		if i := bytes.IndexByte(str, 0); i >= 0 {
+			return string(str[:i]), nil
+		}
+		return "", errors.Errorf("%s: string is not terminated", s.Name)
+	}
+	return "", errors.NotFoundf("build id in %s", fname)
+}
+
+// readAt returns size bytes of data at the given address or, if size is 0,
+// all the data from address till the end of the section.
+func readAt(f *elf.File, addr, size uint64) ([]byte, error) {
+	for _, s := range f.Sections {
+		if s.Type == elf.SHT_NOBITS || s.Flags&elf.SHF_ALLOC == 0 ||
+			addr < s.Addr || addr >= s.Addr+s.Size {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		data = data[addr-s.Addr:]
+		if size > 0 {
+			if size > uint64(len(data)) {
+				return nil, errors.Errorf("0x%x: short read", addr)
+			}
+			data = data[:size]
+		}
+		return data, nil
+	}
+	return nil, errors.Errorf("0x%x: address not found", addr)
+}
+
+// FromDevice returns the build id of the firmware running on the device.
+func FromDevice(ctx context.Context, devConn dev.DevConn) (string, error) {
+	info, err := dev.GetInfo(ctx, devConn)
+	if err != nil {
+		return "", errors.Annotatef(err, "failed to get device info")
+	}
+	if info.Fw_id == nil || *info.Fw_id == "" {
+		return "", errors.NotFoundf("build id in device info")
+	}
+	return *info.Fw_id, nil
+}
+
+// Compare returns an error if the build ids are both known and differ.
+// what and against describe the sources of the ids, e.g. "firmware" and "device".
+func Compare(what, id, against, againstID string) error {
+	if id == "" || againstID == "" || id == againstID {
+		return nil
+	}
+	return errors.Errorf("build id mismatch: %s is %s but %s is %s", what, id, against, againstID)
+}
@@ -0,0 +1,68 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package buildid
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestFromELF(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+	dir, err := ioutil.TempDir("", "buildid_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "build_info.c")
+	if err := ioutil.WriteFile(src, []byte("const char *mg_build_id = \"20201014-100000/master@1234abcd\";\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	main := filepath.Join(dir, "main.c")
+	if err := ioutil.WriteFile(main, []byte("int main(void) { return 0; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	exe := filepath.Join(dir, "fw.elf")
+	if out, err := exec.Command(cc, "-o", exe, src, main).CombinedOutput(); err != nil {
+		t.Skipf("failed to compile: %s %s", err, out)
+	}
+	id, err := FromELF(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "20201014-100000/master@1234abcd"; id != exp {
+		t.Errorf("expected %q, got %q", exp, id)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	if err := Compare("firmware", "a", "device", "a"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := Compare("firmware", "", "device", "a"); err != nil {
+		t.Errorf("unknown id should not be an error: %s", err)
+	}
+	if err := Compare("firmware", "a", "device", "b"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
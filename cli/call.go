@@ -20,14 +20,23 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/errcode"
 	"github.com/mongoose-os/mos/cli/flags"
 
 	"github.com/juju/errors"
 	flag "github.com/spf13/pflag"
 )
 
+var (
+	callJSONPath = flag.String("jsonpath", "", `Print only the part of the response at this path, e.g. "$.sys.free_ram", "items[0].name" or "files.0.size"`)
+)
+
 func isJSONString(s string) bool {
 	var js string
 	return json.Unmarshal([]byte(s), &js) == nil
@@ -38,6 +47,43 @@ func isJSON(s string) bool {
 	return json.Unmarshal([]byte(s), &js) == nil
 }
 
+// parseCallArgs builds JSON args object from a list of key=value and
+// key:=json arguments. Values of the former are strings, values of the latter
+// are parsed as JSON, e.g. count:=5 or enable:=true. key:=@file.json reads
+// the value from a file.
+func parseCallArgs(args []string) (string, error) {
+	params := map[string]interface{}{}
+	for _, a := range args {
+		eqIdx := strings.Index(a, "=")
+		if eqIdx <= 0 {
+			return "", errors.Errorf("invalid argument %q, expected key=value or key:=json", a)
+		}
+		key, value := a[:eqIdx], a[eqIdx+1:]
+		if !strings.HasSuffix(key, ":") {
+			params[key] = value
+			continue
+		}
+		key = key[:len(key)-1]
+		data := []byte(value)
+		if strings.HasPrefix(value, "@") {
+			var err error
+			if data, err = ioutil.ReadFile(value[1:]); err != nil {
+				return "", errors.Annotatef(err, "%s", key)
+			}
+		}
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return "", errors.Annotatef(err, "%s: invalid JSON value", key)
+		}
+		params[key] = v
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return string(data), nil
+}
+
 func callDeviceService(
 	ctx context.Context, devConn dev.DevConn, method string, args string,
 ) (string, error) {
@@ -52,6 +98,68 @@ func callDeviceService(
 	return string(b), e
 }
 
+// callResult is what "mos call --json" prints.
+type callResult struct {
+	Request struct {
+		Method string          `json:"method"`
+		Args   json.RawMessage `json:"args,omitempty"`
+	} `json:"request"`
+	// Null if the call failed.
+	Response   json.RawMessage `json:"response"`
+	Error      *callError      `json:"error,omitempty"`
+	DurationMS int64           `json:"duration_ms"`
+}
+
+type callError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// newCallResult makes the --json output for a call. Only errors returned by
+// the device are included in the result, other errors are returned as is.
+func newCallResult(method, args string, resp json.RawMessage, err error, d time.Duration) (*callResult, error) {
+	res := &callResult{Response: resp, DurationMS: int64(d / time.Millisecond)}
+	res.Request.Method = method
+	if args != "" {
+		res.Request.Args = json.RawMessage(args)
+	}
+	if err != nil {
+		re, ok := errors.Cause(err).(*dev.RemoteError)
+		if !ok {
+			return nil, errors.Trace(err)
+		}
+		res.Response = nil
+		res.Error = &callError{Code: re.Status, Message: re.Message}
+	}
+	if len(res.Response) == 0 {
+		res.Response = json.RawMessage("null")
+	}
+	return res, nil
+}
+
+// callJSON performs the call and prints the result as a single JSON object.
+// Device errors are reported in the object, but still make the command fail.
+func callJSON(ctx context.Context, devConn dev.DevConn, method, args string) error {
+	start := time.Now()
+	resp, err := devConn.(*dev.MosDevConn).CallRaw(ctx, method, args)
+	if err == nil && method == "Sys.Reboot" {
+		waitForReboot()
+	}
+	res, err := newCallResult(method, args, resp, err, time.Since(start))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	data, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Println(string(data))
+	if res.Error != nil {
+		return errcode.Errorf(errcode.RPCFailed, "remote error %d: %s", res.Error.Code, res.Error.Message)
+	}
+	return nil
+}
+
 func call(ctx context.Context, devConn dev.DevConn) error {
 	args := flag.Args()[1:]
 	if len(args) < 1 {
@@ -59,21 +167,115 @@ func call(ctx context.Context, devConn dev.DevConn) error {
 	}
 
 	params := ""
-	if len(args) > 1 {
+	if len(args) == 2 && isJSON(args[1]) {
 		params = args[1]
+	} else if len(args) > 1 {
+		var err error
+		if params, err = parseCallArgs(args[1:]); err != nil {
+			return errors.Trace(err)
+		}
 	}
 
-	if *flags.Timeout > 0 {
+	// With --retry, the timeout applies to each attempt, see MosDevConn.
+	if *flags.Timeout > 0 && *flags.RPCRetry <= 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, *flags.Timeout)
 		defer cancel()
 	}
 
+	if *jsonOutput {
+		if *callJSONPath != "" {
+			return errors.Errorf("--jsonpath cannot be used with --json")
+		}
+		return errors.Trace(callJSON(ctx, devConn, args[0], params))
+	}
+
 	result, err := callDeviceService(ctx, devConn, args[0], params)
 	if err != nil {
 		return err
 	}
 
+	if *callJSONPath != "" {
+		v, err := extractJSONPath(result, *callJSONPath)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if s, ok := v.(string); ok && *flags.Raw {
+			fmt.Println(s)
+			return nil
+		}
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		result = string(data)
+	}
+
 	fmt.Println(result)
 	return nil
 }
+
+// parseJSONPath splits a path like "$.a.b[0]" or "a.b.0" into components.
+// Array indices are returned as numeric strings.
+func parseJSONPath(path string) ([]string, error) {
+	p := strings.TrimPrefix(path, "$")
+	var res []string
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+		case '[':
+			end := strings.Index(p, "]")
+			if end < 0 {
+				return nil, errors.Errorf("invalid path %q: unterminated [", path)
+			}
+			comp := strings.Trim(p[1:end], `'"`)
+			if comp == "" {
+				return nil, errors.Errorf("invalid path %q: empty []", path)
+			}
+			res = append(res, comp)
+			p = p[end+1:]
+		default:
+			end := strings.IndexAny(p, ".[")
+			if end < 0 {
+				end = len(p)
+			}
+			res = append(res, p[:end])
+			p = p[end:]
+		}
+	}
+	return res, nil
+}
+
+// extractJSONPath returns the value at the given path in the JSON document.
+func extractJSONPath(data, path string) (interface{}, error) {
+	comps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, errors.Annotatef(err, "response is not valid JSON")
+	}
+	for i, c := range comps {
+		cur := "$." + strings.Join(comps[:i+1], ".")
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = vv[c]; !ok {
+				return nil, errors.Errorf("%s: not found", cur)
+			}
+		case []interface{}:
+			idx, err := strconv.Atoi(c)
+			if err != nil || idx < 0 || idx >= len(vv) {
+				return nil, errors.Errorf("%s: invalid index (array length %d)", cur, len(vv))
+			}
+			v = vv[idx]
+		default:
+			return nil, errors.Errorf("%s: not found, parent is not an object or array", cur)
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,75 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/dev"
+)
+
+func TestNewCallResult(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		args string
+		resp json.RawMessage
+		err  error
+		exp  string
+	}{
+		{
+			name: "success",
+			args: `{"a":1}`,
+			resp: json.RawMessage(`{"free_ram":1234}`),
+			exp:  `{"request":{"method":"Sys.GetInfo","args":{"a":1}},"response":{"free_ram":1234},"duration_ms":150}`,
+		},
+		{
+			name: "no args, no response",
+			exp:  `{"request":{"method":"Sys.GetInfo"},"response":null,"duration_ms":150}`,
+		},
+		{
+			name: "remote error",
+			err:  errors.Trace(&dev.RemoteError{Status: 404, Message: "No handler for Sys.GetInfo"}),
+			exp:  `{"request":{"method":"Sys.GetInfo"},"response":null,"error":{"code":404,"message":"No handler for Sys.GetInfo"},"duration_ms":150}`,
+		},
+	} {
+		res, err := newCallResult("Sys.GetInfo", c.args, c.resp, c.err, 150*time.Millisecond)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+			continue
+		}
+		data, err := json.Marshal(res)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if string(data) != c.exp {
+			t.Errorf("%s: expected\n%s\ngot\n%s", c.name, c.exp, data)
+		}
+		if (res.Error != nil) != (c.err != nil) {
+			t.Errorf("%s: unexpected error in the result: %+v", c.name, res.Error)
+		}
+	}
+
+	// Transport errors are not RPC errors and are returned as is.
+	if _, err := newCallResult("Sys.GetInfo", "", nil, errors.New("timeout"), 0); err == nil {
+		t.Errorf("expected an error")
+	}
+}
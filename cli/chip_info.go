@@ -0,0 +1,100 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// +build !noflash
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/devutil"
+	"github.com/mongoose-os/mos/cli/flags"
+	"github.com/mongoose-os/mos/cli/flash/esp"
+	espFlasher "github.com/mongoose-os/mos/cli/flash/esp/flasher"
+)
+
+// chipInfo handles "mos chip-info": connects to the ROM loader and prints
+// what is known about the chip, without flashing anything.
+func chipInfo(ctx context.Context, devConn dev.DevConn) error {
+	var ct esp.ChipType
+	platform := strings.ToLower(flags.Platform())
+	switch platform {
+	case "esp32":
+		ct = esp.ChipESP32
+	case "esp32s3":
+		ct = esp.ChipESP32S3
+	case "esp32c3":
+		ct = esp.ChipESP32C3
+	case "esp8266":
+		ct = esp.ChipESP8266
+	default:
+		return errors.NotImplementedf("chip info for %q", platform)
+	}
+	port, err := devutil.GetPort()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	espFlashOpts.ControlPort = port
+	ci, err := espFlasher.GetChipInfo(ct, &espFlashOpts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	switch *flags.Format {
+	case "", "text":
+		printChipInfo(ci)
+	case "json":
+		data, err := json.MarshalIndent(ci, "", "  ")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Printf("%s\n", data)
+	default:
+		return errors.Errorf("invalid --format %q, must be text or json", *flags.Format)
+	}
+	return nil
+}
+
+func printChipInfo(ci *espFlasher.ChipInfo) {
+	fmt.Printf("Chip:      %s\n", ci.Descr)
+	if ci.Revision >= 0 {
+		fmt.Printf("Revision:  %d\n", ci.Revision)
+	}
+	if ci.XtalFreqMHz > 0 {
+		fmt.Printf("Crystal:   %d MHz\n", ci.XtalFreqMHz)
+	} else {
+		fmt.Printf("Crystal:   unknown\n")
+	}
+	if ci.MAC != "" {
+		fmt.Printf("MAC:       %s\n", ci.MAC)
+	}
+	if ci.FlashError == "" {
+		fmt.Printf("Flash:     %d bytes (chip ID 0x%06x, mfg 0x%02x)\n", ci.Flash.Size, ci.Flash.ChipID, ci.Flash.Mfg)
+	} else {
+		fmt.Printf("Flash:     %s\n", ci.FlashError)
+	}
+	fmt.Printf("Variant detection eFuses:\n")
+	for _, f := range ci.VariantFuses {
+		fmt.Printf("  %-26s 0x%08x\n", f.Name, f.Value)
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/juju/errors"
 	"github.com/mongoose-os/mos/cli/build"
 	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/flags"
 	"github.com/mongoose-os/mos/version"
 	flag "github.com/spf13/pflag"
 )
@@ -64,7 +65,7 @@ func Clone(ctx context.Context, devConn dev.DevConn) error {
 		// Proceed as usual
 	}
 
-	d, err := m.PrepareLocalDir(".", os.Stderr, false, /* deleteIfFailed */
+	d, err := m.PrepareLocalDir(".", os.Stderr, *flags.RepairDeps, /* deleteIfFailed */
 		version.GetMosVersion() /* defaultVersion */, 1 /* pullInterval */, 0 /* cloneDepth */)
 
 	// Chdir is needed for the Web UI mode: immediately go into the cloned repo.
@@ -24,4 +24,6 @@ const (
 	FormPreferPrebuildLibsName = "prefer_prebuilt_libs"
 	FormSourcesZipName         = "file"
 	FormBuildParamsName        = "build_params"
+	// Optional, Go duration. The server may cap it.
+	FormBuildTimeoutName = "build_timeout"
 )
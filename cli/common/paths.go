@@ -47,6 +47,10 @@ func GetManifestArchFilePath(projectDir, arch string) string {
 	return filepath.Join(projectDir, fmt.Sprintf("mos_%s.yml", arch))
 }
 
+func GetManifestEnvFilePath(projectDir, env string) string {
+	return filepath.Join(projectDir, fmt.Sprintf("mos.%s.yml", env))
+}
+
 func GetGeneratedFilesDir(buildDir string) string {
 	if *genDirFlag != "" {
 		if gdfa, err := filepath.Abs(*genDirFlag); err == nil {
@@ -60,6 +64,12 @@ func GetObjectDir(buildDir string) string {
 	return filepath.Join(buildDir, "objs")
 }
 
+// GetMapFilePath returns the path where the linker map file of the firmware
+// is kept after the build.
+func GetMapFilePath(buildDir string) string {
+	return filepath.Join(GetObjectDir(buildDir), "fw.map")
+}
+
 func GetFirmwareDir(buildDir string) string {
 	return filepath.Join(buildDir, "fw")
 }
@@ -68,6 +78,12 @@ func GetFilesystemStagingDir(buildDir string) string {
 	return filepath.Join(buildDir, "fs")
 }
 
+// GetFSImageCacheDir returns the dir where the filesystem images of the last
+// build are kept, see mos build --fs-cache.
+func GetFSImageCacheDir(buildDir string) string {
+	return filepath.Join(buildDir, "fs_cache")
+}
+
 func GetPlatformMakefilePath(mosDir, platform string) string {
 	// New repo layout introduced on 2019/04/29, current release is 2.13.1.
 	oldPath := filepath.Join(mosDir, "fw", "platforms", platform, "Makefile.build")
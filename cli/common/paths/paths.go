@@ -17,13 +17,13 @@
 package paths
 
 import (
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 
 	"github.com/juju/errors"
+	glog "k8s.io/klog/v2"
 
 	"github.com/mongoose-os/mos/cli/flags"
 	"github.com/mongoose-os/mos/version"
@@ -59,6 +59,11 @@ func Init() error {
 		return errors.Trace(err)
 	}
 
+	*flags.ManifestCacheDir, err = NormalizePath(*flags.ManifestCacheDir, version.GetMosVersion())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
 	*flags.AuthFile, err = NormalizePath(*flags.AuthFile, version.GetMosVersion())
 	if err != nil {
 		return errors.Trace(err)
@@ -105,6 +110,10 @@ func GetDepsDir(projectDir string) string {
 	}
 }
 
+// GetTempDir returns --temp-dir, creating it if needed. If subdir is not
+// empty, a new uniquely named subdirectory with the given prefix is created
+// and marked as in use; callers should either remove it or call
+// ReleaseTempDir when done.
 func GetTempDir(subdir string) (string, error) {
 	dir, err := NormalizePath(*flags.TempDir, version.GetMosVersion())
 	if err != nil {
@@ -114,7 +123,13 @@ func GetTempDir(subdir string) (string, error) {
 		return "", errors.Trace(err)
 	}
 	if subdir != "" {
-		dir, err = ioutil.TempDir(dir, subdir)
+		if *flags.TempMaxSize > 0 {
+			// Make room for the new dir, but don't fail because of that.
+			if _, _, err := CleanTempDir(*flags.TempMaxSize * 1024 * 1024); err != nil {
+				glog.Warningf("failed to clean up temp dir: %s", err)
+			}
+		}
+		dir, err = newLockedTempDir(dir, subdir)
 		if err != nil {
 			return "", errors.Trace(err)
 		}
@@ -0,0 +1,177 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package paths
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	glog "k8s.io/klog/v2"
+
+	"github.com/mongoose-os/mos/cli/flags"
+	"github.com/mongoose-os/mos/version"
+)
+
+const (
+	// Lock file placed into temp dirs which are in use by a running mos.
+	tempDirLockFileName = ".mos_in_use"
+	// Locks older than that are considered stale (left behind by a mos
+	// process which was killed, or by --keep-temp-files).
+	tempDirLockMaxAge = 24 * time.Hour
+	// New temp dirs are created and locked here and then moved to their
+	// place, so CleanTempDir never sees them unlocked. It skips this dir.
+	tempDirPendingName = ".pending"
+	// Max number of attempts to move a new temp dir into place.
+	tempDirCreateAttempts = 10
+)
+
+type tempDirEntry struct {
+	path  string
+	size  int64
+	mtime time.Time
+}
+
+// lockTempDir marks the temp dir as being in use, so that it's not removed
+// by CleanTempDir.
+func lockTempDir(dir string) error {
+	data := []byte(fmt.Sprintf("%d\n", os.Getpid()))
+	return errors.Trace(ioutil.WriteFile(filepath.Join(dir, tempDirLockFileName), data, 0644))
+}
+
+// newLockedTempDir creates a new uniquely named subdirectory of dir, with the
+// given prefix, which is already locked when it appears in dir.
+func newLockedTempDir(dir, prefix string) (string, error) {
+	pendingDir := filepath.Join(dir, tempDirPendingName)
+	if err := os.MkdirAll(pendingDir, 0777); err != nil {
+		return "", errors.Trace(err)
+	}
+	for i := 1; ; i++ {
+		pdir, err := ioutil.TempDir(pendingDir, prefix)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		if err = lockTempDir(pdir); err != nil {
+			os.RemoveAll(pdir)
+			return "", errors.Trace(err)
+		}
+		res := filepath.Join(dir, filepath.Base(pdir))
+		// The name is only unique within pendingDir, make sure we don't
+		// step on an existing dir.
+		if _, err = os.Lstat(res); os.IsNotExist(err) {
+			if err = os.Rename(pdir, res); err == nil {
+				return res, nil
+			}
+		} else if err == nil {
+			err = os.ErrExist
+		}
+		os.RemoveAll(pdir)
+		if i >= tempDirCreateAttempts {
+			return "", errors.Annotatef(err, "failed to create temp dir in %s", dir)
+		}
+	}
+}
+
+// ReleaseTempDir removes the in-use mark from the temp dir created by
+// GetTempDir, it's the counterpart of GetTempDir for the case when the temp
+// dir is not removed (--keep-temp-files).
+func ReleaseTempDir(dir string) {
+	os.Remove(filepath.Join(dir, tempDirLockFileName))
+}
+
+func isTempDirLocked(dir string) bool {
+	st, err := os.Stat(filepath.Join(dir, tempDirLockFileName))
+	if err != nil {
+		return false
+	}
+	return time.Since(st.ModTime()) < tempDirLockMaxAge
+}
+
+func getTempDirEntries(dir string) ([]*tempDirEntry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	var res []*tempDirEntry
+	for _, f := range files {
+		if f.Name() == tempDirPendingName {
+			continue
+		}
+		e := &tempDirEntry{
+			path:  filepath.Join(dir, f.Name()),
+			size:  f.Size(),
+			mtime: f.ModTime(),
+		}
+		if f.IsDir() {
+			e.size = 0
+			filepath.Walk(e.path, func(p string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					e.size += info.Size()
+				}
+				return nil
+			})
+		}
+		res = append(res, e)
+	}
+	// Oldest first.
+	sort.Slice(res, func(i, j int) bool { return res[i].mtime.Before(res[j].mtime) })
+	return res, nil
+}
+
+// CleanTempDir removes the oldest entries from --temp-dir until its total size
+// does not exceed maxSize bytes. If maxSize is 0, all entries are removed.
+// Temp dirs which are in use by some mos process are never removed. Returns
+// the number of entries removed and bytes freed.
+func CleanTempDir(maxSize int64) (int, int64, error) {
+	dir, err := NormalizePath(*flags.TempDir, version.GetMosVersion())
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	entries, err := getTempDirEntries(dir)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	numRemoved, freed := 0, int64(0)
+	for _, e := range entries {
+		if total <= maxSize && maxSize > 0 {
+			break
+		}
+		if isTempDirLocked(e.path) {
+			glog.V(1).Infof("%s is in use, not removing", e.path)
+			continue
+		}
+		glog.V(1).Infof("Removing %s (%d bytes)", e.path, e.size)
+		if err := os.RemoveAll(e.path); err != nil {
+			return numRemoved, freed, errors.Annotatef(err, "failed to remove %s", e.path)
+		}
+		total -= e.size
+		freed += e.size
+		numRemoved++
+	}
+	return numRemoved, freed, nil
+}
@@ -0,0 +1,180 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/cli/dev"
+)
+
+// Global flags offered for every command, in addition to its own ones.
+var completionGlobalFlags = []string{"port", "verbose", "logtostderr"}
+
+func completion(ctx context.Context, devConn dev.DevConn) error {
+	args := flag.Args()[1:]
+	if len(args) != 1 {
+		return errors.Errorf("shell is required: bash, zsh or fish")
+	}
+	switch args[0] {
+	case "bash":
+		genBashCompletion(os.Stdout)
+	case "zsh":
+		genZshCompletion(os.Stdout)
+	case "fish":
+		genFishCompletion(os.Stdout)
+	default:
+		return errors.Errorf("unsupported shell %q, must be bash, zsh or fish", args[0])
+	}
+	return nil
+}
+
+// completionFlags returns sorted names of the flags applicable to the command.
+func completionFlags(c *command) []string {
+	m := map[string]bool{}
+	for _, lists := range [][]string{c.required, c.optional, completionGlobalFlags} {
+		for _, name := range lists {
+			if flag.Lookup(name) != nil {
+				m[name] = true
+			}
+		}
+	}
+	var res []string
+	for name := range m {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// completionDescr returns the first line of the command description, escaped
+// to be used within single quotes.
+func completionDescr(c *command, escapeColon bool) string {
+	d := strings.SplitN(c.short, "\n", 2)[0]
+	d = strings.Replace(d, `'`, `'\''`, -1)
+	if escapeColon {
+		d = strings.Replace(d, ":", `\:`, -1)
+	}
+	return d
+}
+
+func prefixAll(prefix string, ss []string) []string {
+	res := make([]string, len(ss))
+	for i, s := range ss {
+		res[i] = prefix + s
+	}
+	return res
+}
+
+func genBashCompletion(w io.Writer) {
+	var names []string
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	fmt.Fprintf(w, `# bash completion for mos, generated by "mos completion bash"
+_mos() {
+	local cur prev cmd w flags
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	prev="${COMP_WORDS[COMP_CWORD-1]}"
+	if [[ "$prev" == "--port" ]]; then
+		COMPREPLY=($(compgen -W "$(mos ports 2>/dev/null)" -- "$cur"))
+		return
+	fi
+	for w in "${COMP_WORDS[@]:1:COMP_CWORD-1}"; do
+		case "$w" in
+			-*) ;;
+			*) cmd="$w"; break ;;
+		esac
+	done
+	if [[ -z "$cmd" && "$cur" != -* ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return
+	fi
+	case "$cmd" in
+`, strings.Join(names, " "))
+	for i := range commands {
+		c := &commands[i]
+		fmt.Fprintf(w, "\t\t%s) flags=\"%s\" ;;\n", c.name, strings.Join(prefixAll("--", completionFlags(c)), " "))
+	}
+	fmt.Fprintf(w, `		*) flags="%s" ;;
+	esac
+	COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+}
+complete -o default -F _mos mos
+`, strings.Join(prefixAll("--", completionGlobalFlags), " "))
+}
+
+func genZshCompletion(w io.Writer) {
+	fmt.Fprintf(w, `#compdef mos
+# zsh completion for mos, generated by "mos completion zsh"
+_mos() {
+	local -a commands
+	commands=(
+`)
+	for i := range commands {
+		c := &commands[i]
+		fmt.Fprintf(w, "\t\t'%s:%s'\n", c.name, completionDescr(c, true))
+	}
+	fmt.Fprintf(w, `	)
+	if [[ ${words[CURRENT-1]} == --port ]]; then
+		compadd -- ${(f)"$(mos ports 2>/dev/null)"}
+		return
+	fi
+	if (( CURRENT == 2 )); then
+		_describe 'command' commands
+		return
+	fi
+	case ${words[2]} in
+`)
+	for i := range commands {
+		c := &commands[i]
+		fmt.Fprintf(w, "\t\t%s) compadd -- %s ;;\n", c.name, strings.Join(prefixAll("--", completionFlags(c)), " "))
+	}
+	fmt.Fprintf(w, `		*) compadd -- %s ;;
+	esac
+}
+compdef _mos mos
+`, strings.Join(prefixAll("--", completionGlobalFlags), " "))
+}
+
+func genFishCompletion(w io.Writer) {
+	fmt.Fprintf(w, "# fish completion for mos, generated by \"mos completion fish\"\n")
+	fmt.Fprintf(w, "complete -c mos -f\n")
+	for i := range commands {
+		c := &commands[i]
+		fmt.Fprintf(w, "complete -c mos -n __fish_use_subcommand -a %s -d '%s'\n",
+			c.name, strings.Replace(completionDescr(c, false), `'\''`, `\'`, -1))
+	}
+	for i := range commands {
+		c := &commands[i]
+		for _, name := range completionFlags(c) {
+			if name == "port" {
+				continue
+			}
+			fmt.Fprintf(w, "complete -c mos -n '__fish_seen_subcommand_from %s' -l %s\n", c.name, name)
+		}
+	}
+	fmt.Fprintf(w, "complete -c mos -l port -x -a '(mos ports 2>/dev/null)'\n")
+}
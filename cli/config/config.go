@@ -19,6 +19,7 @@ package config
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"sort"
 	"time"
 
@@ -28,12 +29,18 @@ import (
 	"github.com/mongoose-os/mos/cli/flags"
 	"github.com/mongoose-os/mos/cli/ourutil"
 	flag "github.com/spf13/pflag"
+	yaml "gopkg.in/yaml.v2"
 	glog "k8s.io/klog/v2"
 )
 
 var (
 	saveTimeout  = 10 * time.Second
 	saveAttempts = 3
+
+	watch         = flag.Bool("watch", false, "config-get: poll the value and print it whenever it changes")
+	watchInterval = flag.Duration("interval", 1*time.Second, "config-get --watch: polling interval")
+	validate      = flag.Bool("validate", true, "config-set: check keys and values against the config schema before sending them, if the device provides the schema")
+	noValidate    = flag.Bool("no-validate", false, "config-set: do not check keys and values against the config schema")
 )
 
 func Get(ctx context.Context, devConn dev.DevConn) error {
@@ -51,21 +58,60 @@ func Get(ctx context.Context, devConn dev.DevConn) error {
 		path = args[0]
 	}
 
+	if *watch {
+		return errors.Trace(watchValue(ctx, devConn, path))
+	}
+
+	val, err := getValue(ctx, devConn, path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	fmt.Println(val)
+
+	return nil
+}
+
+func getValue(ctx context.Context, devConn dev.DevConn, path string) (string, error) {
 	// Get all config from the attached device
 	devConf, err := dev.GetConfigLevel(ctx, devConn, *flags.Level)
 	if err != nil {
-		return errors.Trace(err)
+		return "", errors.Trace(err)
 	}
 
 	// Try to get requested value
 	val, err := devConf.Get(path)
 	if err != nil {
-		return errors.Trace(err)
+		return "", errors.Trace(err)
 	}
 
-	fmt.Println(val)
+	return val, nil
+}
 
-	return nil
+// watchValue polls the value every --interval and prints it, prefixed with
+// the current time, when it changes.
+func watchValue(ctx context.Context, devConn dev.DevConn, path string) error {
+	numPrinted := 0
+	lastVal := ""
+	for {
+		val, err := getValue(ctx, devConn, path)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if numPrinted == 0 || val != lastVal {
+			fmt.Printf("%s %s\n", time.Now().Format("15:04:05.000"), val)
+			lastVal = val
+			numPrinted++
+			if *flags.Count > 0 && numPrinted >= *flags.Count {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*watchInterval):
+		}
+	}
 }
 
 func Set(ctx context.Context, devConn dev.DevConn) error {
@@ -91,6 +137,24 @@ func SetWithArgs(
 		return errors.Trace(err)
 	}
 
+	if *validate && !*noValidate {
+		schema, err := GetSchema(ctx, devConn)
+		if err != nil {
+			if flag.CommandLine.Changed("validate") {
+				return errors.Trace(err)
+			}
+			ourutil.Reportf("Warning: failed to parse config schema, not validating: %s", err)
+			schema = nil
+		}
+		if schema != nil {
+			if err := schema.Validate(paramValues); err != nil {
+				return errors.Trace(err)
+			}
+		} else if flag.CommandLine.Changed("validate") {
+			return errors.Errorf("device does not provide config schema, cannot --validate")
+		}
+	}
+
 	// Try to set all provided values
 	for path, val := range paramValues {
 		err := devConf.Set(path, val)
@@ -183,3 +247,118 @@ func ApplyDiff(devConf *dev.DevConf, newConf map[string]string) error {
 	}
 	return nil
 }
+
+// ReadFile reads a YAML (or JSON) config file and returns it as a flat map
+// of "path.to.value" -> value, suitable for ApplyDiff.
+func ReadFile(fname string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var conf map[string]interface{}
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, errors.Annotatef(err, "failed to parse %s", fname)
+	}
+	res := map[string]string{}
+	if err := flattenConf("", conf, res); err != nil {
+		return nil, errors.Annotatef(err, "%s", fname)
+	}
+	return res, nil
+}
+
+func flattenConf(prefix string, v interface{}, res map[string]string) error {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		for k, v := range vv {
+			if err := flattenConf(prefix+k+".", v, res); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for k, v := range vv {
+			if err := flattenConf(fmt.Sprintf("%s%v.", prefix, k), v, res); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		return errors.Errorf("%s: arrays are not supported", prefix[:len(prefix)-1])
+	case nil:
+		res[prefix[:len(prefix)-1]] = ""
+	default:
+		res[prefix[:len(prefix)-1]] = fmt.Sprintf("%v", vv)
+	}
+	return nil
+}
+
+// Backup handles "mos config-backup --out cfg.json": the whole device config
+// is saved as JSON, with values of their schema types.
+func Backup(ctx context.Context, devConn dev.DevConn) error {
+	if *flags.Output == "" {
+		return errors.Errorf("--out is required")
+	}
+	ourutil.Reportf("Getting configuration...")
+	devConf, err := dev.GetConfigLevel(ctx, devConn, *flags.Level)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	data, err := devConf.Get("")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := ioutil.WriteFile(*flags.Output, []byte(data+"\n"), 0600); err != nil {
+		return errors.Trace(err)
+	}
+	ourutil.Reportf("Saved configuration to %s", *flags.Output)
+	return nil
+}
+
+// Restore handles "mos config-restore cfg.json". Only the values that differ
+// from the current ones are sent, all in one Config.Set call, so the device
+// either gets all of them or none. With dryRun, the changes are only printed.
+func Restore(ctx context.Context, devConn dev.DevConn, dryRun bool) error {
+	args := flag.Args()[1:]
+	if len(args) != 1 {
+		return errors.Errorf("config file is required")
+	}
+	newConf, err := ReadFile(args[0])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ourutil.Reportf("Getting configuration...")
+	devConf, err := dev.GetConfigLevel(ctx, devConn, *flags.Level)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	keys := []string{}
+	for k, _ := range newConf {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	numChanged := 0
+	for _, k := range keys {
+		cur, err := devConf.Get(k)
+		if err != nil {
+			return errors.Annotatef(err, "%s", args[0])
+		}
+		if cur == newConf[k] {
+			continue
+		}
+		if numChanged == 0 {
+			ourutil.Reportf("\nChanges:")
+		}
+		if err := devConf.Set(k, newConf[k]); err != nil {
+			return errors.Annotatef(err, "failed to set %s", k)
+		}
+		ourutil.Reportf("  %s: %q -> %q", k, cur, newConf[k])
+		numChanged++
+	}
+	if numChanged == 0 {
+		ourutil.Reportf("Configuration is the same as in %s, nothing to do", args[0])
+		return nil
+	}
+	if dryRun {
+		ourutil.Reportf("Dry run, not applying %d changes", numChanged)
+		return nil
+	}
+	return SetAndSave(ctx, devConn, devConf)
+}
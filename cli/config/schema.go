@@ -0,0 +1,196 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	glog "k8s.io/klog/v2"
+
+	"github.com/mongoose-os/mos/cli/dev"
+)
+
+// Schema maps config paths ("wifi.sta.ssid") to their types, as declared
+// in the config schema: "o" (object), "s" (string), "i" (int),
+// "ui" (unsigned int), "b" (bool), "d" (double) or "f" (float).
+type Schema map[string]string
+
+var schemaTypes = map[string]bool{
+	"o": true, "s": true, "i": true, "ui": true, "b": true, "d": true, "f": true,
+}
+
+// ParseSchema parses the config schema in the same format as in the
+// manifests, i.e. a list of ["path", "type", {params}] and
+// ["path", "type", default, {params}] entries. Two-element entries are
+// value overrides, e.g. ["debug.level", 3], and are ignored.
+func ParseSchema(data []byte) (Schema, error) {
+	var items [][]interface{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, errors.Annotatef(err, "invalid config schema")
+	}
+	s := Schema{}
+	for _, item := range items {
+		if len(item) < 2 {
+			continue
+		}
+		path, ok := item[0].(string)
+		if !ok {
+			return nil, errors.Errorf("invalid config schema entry %v", item)
+		}
+		if len(item) == 2 {
+			continue
+		}
+		typ, ok := item[1].(string)
+		if !ok || !schemaTypes[typ] {
+			return nil, errors.Errorf("invalid config schema entry %v", item)
+		}
+		s[path] = typ
+	}
+	return s, nil
+}
+
+// GetSchema fetches the config schema from the device. Returns nil if the
+// device does not provide it (firmware without Config.GetSchema).
+func GetSchema(ctx context.Context, devConn dev.DevConn) (Schema, error) {
+	ctx2, cancel := context.WithTimeout(ctx, devConn.GetTimeout())
+	defer cancel()
+	var resp json.RawMessage
+	if err := devConn.Call(ctx2, "Config.GetSchema", nil, &resp); err != nil {
+		glog.Infof("Config.GetSchema failed: %s", err)
+		return nil, nil
+	}
+	return ParseSchema(resp)
+}
+
+// CheckValue checks that the path exists and that the value can be
+// converted to its type.
+func (s Schema) CheckValue(path, value string) error {
+	typ, ok := s[path]
+	if !ok {
+		if sugg := s.suggest(path); sugg != "" {
+			return errors.Errorf("%s: no such config key, did you mean %s?", path, sugg)
+		}
+		return errors.Errorf("%s: no such config key", path)
+	}
+	var err error
+	switch typ {
+	case "o":
+		return errors.Errorf("%s: is an object, only its fields can be set", path)
+	case "i":
+		_, err = strconv.ParseInt(value, 0, 64)
+	case "ui":
+		_, err = strconv.ParseUint(value, 0, 64)
+	case "b":
+		if value != "true" && value != "false" {
+			err = errors.Errorf("must be true or false")
+		}
+	case "d", "f":
+		_, err = strconv.ParseFloat(value, 64)
+	}
+	if err != nil {
+		return errors.Errorf("%s: invalid value %q for type %s", path, value, schemaTypeName(typ))
+	}
+	return nil
+}
+
+// Validate checks all the values and returns an error listing all the
+// problems found.
+func (s Schema) Validate(values map[string]string) error {
+	var paths, msgs []string
+	for path := range values {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := s.CheckValue(path, values[path]); err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return errors.Errorf("invalid config:\n  %s", strings.Join(msgs, "\n  "))
+	}
+	return nil
+}
+
+// suggest returns the leaf key which is closest to the path, if it is close
+// enough to be a typo.
+func (s Schema) suggest(path string) string {
+	best, bestDist := "", len(path)/3+1
+	for p, typ := range s {
+		if typ == "o" {
+			continue
+		}
+		if d := editDistance(path, p); d < bestDist || (d == bestDist && best != "" && p < best) {
+			best, bestDist = p, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+func schemaTypeName(typ string) string {
+	switch typ {
+	case "s":
+		return "string"
+	case "i":
+		return "int"
+	case "ui":
+		return "unsigned int"
+	case "b":
+		return "bool"
+	case "d":
+		return "double"
+	case "f":
+		return "float"
+	}
+	return fmt.Sprintf("%q", typ)
+}
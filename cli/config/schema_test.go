@@ -0,0 +1,119 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+const testSchema = `[
+  ["debug", "o", {"title": "Debug settings"}],
+  ["debug.level", "i", {"title": "Level"}],
+  ["debug.udp_log_addr", "s", {"title": "UDP log address"}],
+  ["wifi", "o", {"title": "WiFi"}],
+  ["wifi.sta", "o", {"title": "Station"}],
+  ["wifi.sta.enable", "b", {"title": "Enable"}],
+  ["wifi.sta.ssid", "s", {"title": "SSID"}],
+  ["wifi.sta.pass", "s", {"title": "Password"}],
+  ["sys.tz_offset", "d", {"title": "Time zone offset"}],
+  ["sys.wdt_timeout", "ui", {"title": "Watchdog timeout"}]
+]`
+
+func TestSchemaCheckValue(t *testing.T) {
+	s, err := ParseSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		path, value string
+		expErr      string
+	}{
+		{"debug.level", "3", ""},
+		{"debug.level", "-1", ""},
+		{"debug.level", "high", `debug.level: invalid value "high" for type int`},
+		{"debug.udp_log_addr", "1.2.3.4:1993", ""},
+		{"wifi.sta.enable", "true", ""},
+		{"wifi.sta.enable", "1", `wifi.sta.enable: invalid value "1" for type bool`},
+		{"wifi.sta.ssid", "", ""},
+		{"wifi.sta.sssid", "foo", "wifi.sta.sssid: no such config key, did you mean wifi.sta.ssid?"},
+		{"wifi.sta", "foo", "wifi.sta: is an object, only its fields can be set"},
+		{"sys.tz_offset", "-3.5", ""},
+		{"sys.wdt_timeout", "30", ""},
+		{"sys.wdt_timeout", "-30", `sys.wdt_timeout: invalid value "-30" for type unsigned int`},
+		{"foo.bar", "1", "foo.bar: no such config key"},
+	} {
+		err := s.CheckValue(c.path, c.value)
+		errStr := ""
+		if err != nil {
+			errStr = err.Error()
+		}
+		if errStr != c.expErr {
+			t.Errorf("%s=%q: expected error %q, got %q", c.path, c.value, c.expErr, errStr)
+		}
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	s, err := ParseSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate(map[string]string{"wifi.sta.ssid": "foo", "wifi.sta.pass": "bar"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = s.Validate(map[string]string{"wifi.sta.sssid": "foo", "debug.level": "x", "wifi.sta.pass": "bar"})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	// All the problems are reported, in order.
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "  debug.level:") || !strings.HasPrefix(lines[2], "  wifi.sta.sssid:") {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestParseSchemaInvalid(t *testing.T) {
+	if _, err := ParseSchema([]byte(`{"foo": 1}`)); err == nil {
+		t.Errorf("expected an error")
+	}
+	if _, err := ParseSchema([]byte(`[[1, "s"]]`)); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestParseSchemaOverrides(t *testing.T) {
+	s, err := ParseSchema([]byte(`[
+  ["debug", "o", {"title": "Debug settings"}],
+  ["debug.level", "i", 2, {"title": "Level"}],
+  ["debug.level", 3],
+  ["wifi.ap.ssid", "Mongoose_??????"],
+  ["wifi.ap.enable", "b", false, {"title": "Enable"}]
+]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 3 || s["debug.level"] != "i" || s["wifi.ap.enable"] != "b" {
+		t.Errorf("unexpected schema %v", s)
+	}
+	if _, ok := s["wifi.ap.ssid"]; ok {
+		t.Errorf("value override is parsed as a type: %v", s)
+	}
+	if _, err := ParseSchema([]byte(`[["debug.level", "int", {"title": "Level"}]]`)); err == nil {
+		t.Errorf("expected an error for an unknown type")
+	}
+}
@@ -23,7 +23,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math"
 	"net"
 	"net/url"
 	"os"
@@ -53,7 +52,10 @@ var (
 	noInputFlag        bool
 	tsfSpecFlag        string
 	catchCoreDumpsFlag bool
+	saveCoreDumpsDir   string
+	analyzeCoreDumps   bool
 	hexdumpFlag        int
+	filterNonTextFlag  bool
 )
 
 var (
@@ -64,6 +66,10 @@ func init() {
 	flag.BoolVar(&noInputFlag, "no-input", false,
 		"Do not read from stdin, only print device's output to stdout")
 	flag.BoolVar(&catchCoreDumpsFlag, "catch-core-dumps", true, "Catch and save core dumps")
+	flag.StringVar(&saveCoreDumpsDir, "save-coredumps", "",
+		"Directory to save caught core dumps to. Default is the current directory")
+	flag.BoolVar(&analyzeCoreDumps, "analyze-core-dumps", true,
+		"Run debug-core-dump on each caught core dump, using --fw-elf-file or the ELF file found in the build dir")
 
 	flag.StringVar(&tsfSpecFlag, "timestamp", "StampMilli",
 		"Prepend each line with a timestamp in the specified format. A number of specifications are supported:"+
@@ -73,8 +79,10 @@ func init() {
 			"(see http://strftime.org/)")
 	flag.Lookup("timestamp").NoOptDefVal = "true" // support just passing --timestamp
 
-	flag.IntVar(&hexdumpFlag, "hexdump", 0, "Output console as hexdump")
+	flag.IntVar(&hexdumpFlag, "hexdump", 0, "Output console as a hex+ASCII dump with this many bytes per line (16 if just --hexdump is given)")
 	flag.Lookup("hexdump").NoOptDefVal = "16" // --hexdump -> --hexdump=16
+	flag.BoolVar(&filterNonTextFlag, "filter-non-text", false,
+		"Replace control characters and bytes outside of ASCII with spaces. By default, output is passed through as is")
 
 	for _, f := range []string{"no-input", "timestamp"} {
 		hiddenFlags = append(hiddenFlags, f)
@@ -99,14 +107,21 @@ func printConsoleLine(out io.Writer, ts time.Time, line []byte) {
 	if tsfSpecFlag != "" && !ts.IsZero() {
 		fmt.Printf("%s", FormatTimestamp(ts))
 	}
-	removeNonText(line, ' ')
+	if filterNonTextFlag {
+		removeNonText(line, ' ')
+	}
 	out.Write(line)
 }
 
 func analyzeCoreDump(out io.Writer, cd []byte) error {
-	info, err := debug_core_dump.GetInfoFromCoreDump(cd)
-	cwd, _ := os.Getwd() // Mac docker cannot mount dirs from /tmp. Thus, create core in the CWD
-	tf, err := ioutil.TempFile(cwd, fmt.Sprintf("core-%s-%s-%s", info.App, info.Platform, time.Now().Format("20060102-150405.")))
+	info, _ := debug_core_dump.GetInfoFromCoreDump(cd)
+	dir := saveCoreDumpsDir
+	if dir == "" {
+		dir, _ = os.Getwd() // Mac docker cannot mount dirs from /tmp. Thus, create core in the CWD
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Annotatef(err, "failed to create core dump dir")
+	}
+	tf, err := ioutil.TempFile(dir, fmt.Sprintf("core-%s-%s-%s", info.App, info.Platform, time.Now().Format("20060102-150405.")))
 	if err != nil {
 		return errors.Annotatef(err, "failed open core dump file")
 	}
@@ -122,6 +137,9 @@ func analyzeCoreDump(out io.Writer, cd []byte) error {
 	tf.Write([]byte("\r\n"))
 	tf.Write([]byte(debug_core_dump.CoreDumpEnd))
 	tf.Close()
+	if !analyzeCoreDumps {
+		return nil
+	}
 	printConsoleLine(out, now, []byte("mos: analyzing core dump\n"))
 	return debug_core_dump.DebugCoreDumpF(tfn, "", true)
 }
@@ -164,6 +182,9 @@ func (chr *chanReader) Close() error {
 }
 
 func console(ctx context.Context, devConn dev.DevConn) error {
+	if *flags.Raw && hexdumpFlag > 0 {
+		return errors.Errorf("--raw and --hexdump are mutually exclusive")
+	}
 
 	var r io.Reader
 	var w io.Writer
@@ -301,9 +322,10 @@ func consoleReadWrite(ctx context.Context, r io.Reader, w io.Writer) error {
 	go func() { // Serial -> Stdout
 		var curLine []byte
 		var coreDump []byte
-		coreDumping := false
+		var cdt debug_core_dump.CoreDumpTracker
 		lastCDProgress := 0
 		cont := false
+		hexOff := 0 // Total number of bytes received, for hexdump offsets.
 
 		for {
 			buf := make([]byte, 1500)
@@ -318,35 +340,15 @@ func consoleReadWrite(ctx context.Context, r io.Reader, w io.Writer) error {
 			}
 			now := time.Now()
 			buf = buf[:n]
+			if *flags.Raw {
+				out.Write(buf)
+				continue
+			}
 			if hexdumpFlag > 0 {
-				for off := 0; off < n; {
-					left := n - off
-					chunkSize := int(math.Min(float64(left), float64(hexdumpFlag)))
-					chunk := buf[off : off+chunkSize]
-					hexLine := fmt.Sprintf("%08x  ", off)
-					for i := 0; i < hexdumpFlag; i++ {
-						if i < chunkSize {
-							hexLine += fmt.Sprintf("%02x ", chunk[i])
-						} else {
-							hexLine += "   "
-						}
-						if i%8 == 7 {
-							hexLine += " "
-						}
-					}
-					hexLine += " |"
-					for i := 0; i < chunkSize; i++ {
-						c := chunk[i]
-						if !isNonText(c) && c != 0x0a && c != 0x0d && c != 0x1b {
-							hexLine += string(c)
-						} else {
-							hexLine += "."
-						}
-					}
-					hexLine += "|\n"
-					printConsoleLine(out, now, []byte(hexLine))
-					off += chunkSize
+				for _, l := range hexdumpLines(hexOff, buf, hexdumpFlag) {
+					printConsoleLine(out, now, []byte(l))
 				}
+				hexOff += n
 				continue
 			}
 			for {
@@ -357,51 +359,43 @@ func consoleReadWrite(ctx context.Context, r io.Reader, w io.Writer) error {
 				chunk := buf[:lf+1]
 				curLine = append(curLine, chunk...)
 				if catchCoreDumpsFlag {
-					tsl := bytes.TrimSpace(curLine)
-					if !coreDumping && bytes.Compare(tsl, []byte(debug_core_dump.CoreDumpStart)) == 0 {
+					switch cdt.Feed(bytes.TrimSpace(curLine)) {
+					case debug_core_dump.CoreDumpBegin:
 						var addTS time.Time
 						if !cont {
 							addTS = now
 						}
 						printConsoleLine(out, addTS, chunk)
 						printConsoleLine(out, now, []byte("mos: catching core dump\n"))
-						coreDumping = true
 						coreDump = nil
-					} else if coreDumping {
-						if bytes.Compare(tsl, []byte(debug_core_dump.CoreDumpEnd)) == 0 {
-							if lastCDProgress > 0 {
-								printConsoleLine(out, time.Time{}, []byte("\n"))
-							}
-							printConsoleLine(out, now, curLine)
-							coreDumping = false
-							lastCDProgress = 0
-							curLine = nil
-							if err := analyzeCoreDump(out, coreDump); err != nil {
-								printConsoleLine(out, now, []byte(fmt.Sprintf("mos: %s\n", err)))
-							}
-						} else {
-							// There should be no empty lines in the CD body.
-							// If we encounter an empty line, this means device rebooted without finishing the CD.
-							if len(tsl) == 0 {
-								printConsoleLine(out, now, []byte("mos: core dump aborted\n"))
-								coreDumping = false
-								lastCDProgress = 0
-								coreDump = nil
-							} else {
-								coreDump = append(coreDump, curLine...)
-								var addTS time.Time
-								if lastCDProgress == 0 {
-									addTS = now
-								}
-								if len(coreDump) > lastCDProgress+32*1024 {
-									printConsoleLine(out, addTS, []byte("."))
-									lastCDProgress = len(coreDump)
-								}
-							}
+						lastCDProgress = 0
+					case debug_core_dump.CoreDumpComplete:
+						if lastCDProgress > 0 {
+							printConsoleLine(out, time.Time{}, []byte("\n"))
+						}
+						printConsoleLine(out, now, curLine)
+						lastCDProgress = 0
+						curLine = nil
+						if err := analyzeCoreDump(out, coreDump); err != nil {
+							printConsoleLine(out, now, []byte(fmt.Sprintf("mos: %s\n", err)))
+						}
+					case debug_core_dump.CoreDumpAborted:
+						printConsoleLine(out, now, []byte("mos: core dump aborted\n"))
+						lastCDProgress = 0
+						coreDump = nil
+					case debug_core_dump.CoreDumpData:
+						coreDump = append(coreDump, curLine...)
+						var addTS time.Time
+						if lastCDProgress == 0 {
+							addTS = now
+						}
+						if len(coreDump) > lastCDProgress+32*1024 {
+							printConsoleLine(out, addTS, []byte("."))
+							lastCDProgress = len(coreDump)
 						}
 					}
 				}
-				if !coreDumping && curLine != nil {
+				if !cdt.InDump() && curLine != nil {
 					var addTS time.Time
 					if !cont {
 						addTS = now
@@ -412,7 +406,7 @@ func consoleReadWrite(ctx context.Context, r io.Reader, w io.Writer) error {
 				buf = buf[lf+1:]
 				cont = false
 			}
-			if !coreDumping && len(buf) > 0 {
+			if !cdt.InDump() && len(buf) > 0 {
 				var addTS time.Time
 				if !cont {
 					addTS = now
@@ -442,14 +436,51 @@ func consoleReadWrite(ctx context.Context, r io.Reader, w io.Writer) error {
 	return nil
 }
 
+// hexdumpLines formats data as a canonical hex+ASCII dump, width bytes per line.
+// off is the offset of the data in the stream.
+func hexdumpLines(off int, data []byte, width int) []string {
+	var lines []string
+	for len(data) > 0 {
+		chunkSize := width
+		if chunkSize > len(data) {
+			chunkSize = len(data)
+		}
+		chunk := data[:chunkSize]
+		hexLine := fmt.Sprintf("%08x  ", off)
+		for i := 0; i < width; i++ {
+			if i < chunkSize {
+				hexLine += fmt.Sprintf("%02x ", chunk[i])
+			} else {
+				hexLine += "   "
+			}
+			if i%8 == 7 {
+				hexLine += " "
+			}
+		}
+		hexLine += " |"
+		for _, c := range chunk {
+			if !isNonText(c) && c != 0x0a && c != 0x0d && c != 0x1b {
+				hexLine += string(c)
+			} else {
+				hexLine += "."
+			}
+		}
+		hexLine += "|\n"
+		lines = append(lines, hexLine)
+		data = data[chunkSize:]
+		off += chunkSize
+	}
+	return lines
+}
+
 func isNonText(c byte) bool {
 	return ((c < 0x20 && c != 0x0a && c != 0x0d && c != 0x1b /* Esc */) || c >= 0x7f)
 }
 
-func removeNonText(data []byte, c byte) {
+func removeNonText(data []byte, repl byte) {
 	for i, c := range data {
 		if isNonText(c) {
-			data[i] = c
+			data[i] = repl
 		}
 	}
 }
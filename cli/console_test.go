@@ -0,0 +1,40 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPrintConsoleLineNonText(t *testing.T) {
+	line := "Привет, \x1b[1mworld\x1b[0m\x01\r\n"
+	var out bytes.Buffer
+	printConsoleLine(&out, time.Time{}, []byte(line))
+	if out.String() != line {
+		t.Errorf("output is modified by default: %q", out.String())
+	}
+
+	filterNonTextFlag = true
+	defer func() { filterNonTextFlag = false }()
+	out.Reset()
+	printConsoleLine(&out, time.Time{}, []byte("ab\x01\xffc\x1b\r\n"))
+	if exp := "ab  c\x1b\r\n"; out.String() != exp {
+		t.Errorf("expected %q, got %q", exp, out.String())
+	}
+}
@@ -24,9 +24,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/mongoose-os/mos/cli/buildid"
 	"github.com/mongoose-os/mos/cli/dev"
 	"github.com/mongoose-os/mos/cli/flags"
 
@@ -90,13 +93,18 @@ var (
 		},
 	}
 
-	mosSrcPath = ""
-	fwELFFile  = ""
+	mosSrcPath     = ""
+	fwELFFile      = ""
+	fromConsoleLog = ""
+
+	// Console log lines may be prefixed with a timestamp, e.g. by mos console.
+	consoleTimestampRE = regexp.MustCompile(`^\[[^\]]*\] ?`)
 )
 
 func init() {
 	flag.StringVar(&mosSrcPath, "mos-src-path", "", "Path to mos fw sources")
 	flag.StringVar(&fwELFFile, "fw-elf-file", "", "Path to teh firmware ELF file")
+	flag.StringVar(&fromConsoleLog, "from-console-log", "", "Extract the core dump from this console log instead of using a core dump file. If there are several, the last one is used")
 }
 
 func getMosSrcPath() string {
@@ -229,6 +237,15 @@ func DebugCoreDumpF(cdFile, elfFile string, traceOnly bool) error {
 		return errors.Annotatef(err, "invalid file %s", elfFile)
 	}
 	ourutil.Reportf("Using ELF file at: %s", elfFile)
+	if info.BuildID != "" {
+		if elfBuildID, err := buildid.FromELF(elfFile); err == nil {
+			if err := buildid.Compare("core dump", info.BuildID, "ELF file", elfBuildID); err != nil {
+				ourutil.Reportf("WARNING: %s, the backtrace is likely to be wrong", err)
+			}
+		} else {
+			glog.Warningf("%s", err)
+		}
+	}
 	dockerImage := info.BuildImage
 	if dockerImage == "" {
 		dockerImage = dp.image
@@ -310,9 +327,105 @@ func findLatestCoreFile() string {
 	return cfi[0].Name()
 }
 
+// CoreDumpEvent is the result of feeding a console line to CoreDumpTracker.
+type CoreDumpEvent int
+
+const (
+	// The line is not part of a core dump.
+	CoreDumpNone CoreDumpEvent = iota
+	CoreDumpBegin
+	CoreDumpData
+	// An empty line inside a dump means that the device rebooted before
+	// finishing it.
+	CoreDumpAborted
+	CoreDumpComplete
+)
+
+// CoreDumpTracker finds core dumps in console output, line by line.
+type CoreDumpTracker struct {
+	inDump bool
+}
+
+// Feed processes the next line, with surrounding whitespace removed.
+func (t *CoreDumpTracker) Feed(line []byte) CoreDumpEvent {
+	switch {
+	case bytes.HasSuffix(line, []byte(CoreDumpStart)):
+		t.inDump = true
+		return CoreDumpBegin
+	case !t.inDump:
+		return CoreDumpNone
+	case bytes.HasSuffix(line, []byte(CoreDumpEnd)):
+		t.inDump = false
+		return CoreDumpComplete
+	case len(line) == 0:
+		t.inDump = false
+		return CoreDumpAborted
+	}
+	return CoreDumpData
+}
+
+// InDump returns true if a core dump has started and has not ended yet.
+func (t *CoreDumpTracker) InDump() bool {
+	return t.inDump
+}
+
+// ExtractCoreDumps returns bodies of all the complete core dumps found in
+// a console log. Timestamps added by the console are stripped. Aborted dumps
+// are skipped.
+func ExtractCoreDumps(log []byte) [][]byte {
+	var res [][]byte
+	var cd []byte
+	var t CoreDumpTracker
+	for _, line := range bytes.Split(log, []byte("\n")) {
+		line = bytes.TrimSpace(consoleTimestampRE.ReplaceAll(bytes.TrimSpace(line), nil))
+		switch t.Feed(line) {
+		case CoreDumpBegin:
+			cd = nil
+		case CoreDumpComplete:
+			res = append(res, cd)
+		case CoreDumpData:
+			cd = append(append(cd, line...), '\r', '\n')
+		}
+	}
+	return res
+}
+
+// coreFileFromConsoleLog extracts the last core dump from a console log
+// and saves it to a core file in the current directory.
+func coreFileFromConsoleLog(logFile string) (string, error) {
+	log, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	cds := ExtractCoreDumps(log)
+	if len(cds) == 0 {
+		return "", errors.Errorf("no core dumps found in %s", logFile)
+	}
+	ourutil.Reportf("Found %d core dump(s) in %s, using the last one", len(cds), logFile)
+	cd := cds[len(cds)-1]
+	info, _ := GetInfoFromCoreDump(cd)
+	cwd, _ := os.Getwd() // Mac docker cannot mount dirs from /tmp.
+	tf, err := ioutil.TempFile(cwd, fmt.Sprintf("core-%s-%s-%s", info.App, info.Platform, time.Now().Format("20060102-150405.")))
+	if err != nil {
+		return "", errors.Annotatef(err, "failed open core dump file")
+	}
+	defer tf.Close()
+	fmt.Fprintf(tf, "%s\r\n%s%s", CoreDumpStart, cd, CoreDumpEnd)
+	ourutil.Reportf("Wrote %s", tf.Name())
+	return tf.Name(), nil
+}
+
 func DebugCoreDump(ctx context.Context, _ dev.DevConn) error {
 	args := flag.Args()
 	var coreFile, elfFile string
+	if fromConsoleLog != "" {
+		var err error
+		if coreFile, err = coreFileFromConsoleLog(fromConsoleLog); err != nil {
+			return errors.Trace(err)
+		}
+		// The ELF file may still be given as a positional arg.
+		args = append([]string{args[0], coreFile}, args[1:]...)
+	}
 	if len(args) >= 2 {
 		coreFile = args[1]
 	} else {
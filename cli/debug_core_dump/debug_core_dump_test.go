@@ -0,0 +1,45 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package debug_core_dump
+
+import (
+	"testing"
+)
+
+func TestExtractCoreDumps(t *testing.T) {
+	log := "[Oct 14 10:00:00.001] boot\n" +
+		"[Oct 14 10:00:01.002] --- BEGIN CORE DUMP ---\n" +
+		"[Oct 14 10:00:01.003] incomplete\n" +
+		"\n" +
+		"[Oct 14 10:00:02.001] --- BEGIN CORE DUMP ---\r\n" +
+		"[Oct 14 10:00:02.002] {\"arch\": \"ESP32\",\r\n" +
+		"[Oct 14 10:00:02.003] \"REGS\": {}}\r\n" +
+		"[Oct 14 10:00:02.004] ---- END CORE DUMP ----\r\n" +
+		"--- BEGIN CORE DUMP ---\n" +
+		"second\n" +
+		"---- END CORE DUMP ----\n"
+	cds := ExtractCoreDumps([]byte(log))
+	if len(cds) != 2 {
+		t.Fatalf("expected 2 core dumps, got %d", len(cds))
+	}
+	if exp := "{\"arch\": \"ESP32\",\r\n\"REGS\": {}}\r\n"; string(cds[0]) != exp {
+		t.Errorf("unexpected core dump %q, expected %q", cds[0], exp)
+	}
+	if exp := "second\r\n"; string(cds[1]) != exp {
+		t.Errorf("unexpected core dump %q, expected %q", cds[1], exp)
+	}
+}
@@ -0,0 +1,69 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/cli/build"
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/ourutil"
+)
+
+const depsLockDefaultFile = "deps.lock"
+
+var depsLockWrite = flag.Bool("write", false, "deps-lock: write the lock to the --deps-lock file ("+depsLockDefaultFile+" by default) instead of printing it")
+
+// depsLockHandler handles "mos deps-lock": resolves the app manifest and
+// prints the current repo versions of the libs and modules, in the format
+// accepted by mos build --deps-lock.
+func depsLockHandler(ctx context.Context, devConn dev.DevConn) error {
+	manifest, _, _, err := readFinalManifestFromFlags()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	dl, unpinned, dirty := build.DepsLockFromManifest(manifest)
+	if len(unpinned) > 0 {
+		ourutil.Reportf("Warning: no repo version, not pinned: %s", strings.Join(unpinned, ", "))
+	}
+	if len(dirty) > 0 {
+		ourutil.Reportf("Warning: local changes are not captured by the lock: %s", strings.Join(dirty, ", "))
+	}
+	data, err := dl.Marshal()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !*depsLockWrite {
+		_, err := os.Stdout.Write(data)
+		return errors.Trace(err)
+	}
+	fname := *depsLock
+	if fname == "" {
+		fname = depsLockDefaultFile
+	}
+	if err := ioutil.WriteFile(fname, data, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	ourutil.Reportf("Wrote %d entries to %s", len(dl), fname)
+	return nil
+}
@@ -0,0 +1,94 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/build"
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/manifest_parser"
+)
+
+// depsTree prints the tree of libs, starting from the app, with versions.
+// Libs which were already printed are marked with (*) and not expanded again.
+func depsTree(ctx context.Context, devConn dev.DevConn) error {
+	manifest, _, _, err := readFinalManifestFromFlags()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	writeDepsTree(os.Stdout, manifest)
+	return nil
+}
+
+func writeDepsTree(w io.Writer, manifest *build.FWAppManifest) {
+	libs := map[string]*build.FWAppManifestLibHandled{}
+	for i, lh := range manifest.LibsHandled {
+		libs[lh.Lib.Name] = &manifest.LibsHandled[i]
+	}
+
+	fmt.Fprintf(w, "%s %s\n", manifest.Name, manifest.Version)
+	seen := map[string]bool{}
+	var walk func(node string, level int)
+	walk = func(node string, level int) {
+		for _, dep := range manifest.Deps[node] {
+			lh := libs[dep]
+			if lh == nil {
+				// Optional dep which is not present.
+				continue
+			}
+			line := fmt.Sprintf("%s%s %s", strings.Repeat("  ", level), dep, lh.Version)
+			if lh.RepoVersion != "" {
+				line += fmt.Sprintf(" (%s", lh.RepoVersion)
+				if lh.RepoDirty {
+					line += ", dirty"
+				}
+				line += ")"
+			}
+			if seen[dep] {
+				fmt.Fprintf(w, "%s (*)\n", line)
+				continue
+			}
+			fmt.Fprintln(w, line)
+			seen[dep] = true
+			walk(dep, level+1)
+		}
+	}
+	walk(manifest_parser.DepsApp, 1)
+
+	if len(manifest.Modules) > 0 {
+		fmt.Fprintf(w, "\nModules:\n")
+		for _, m := range manifest.Modules {
+			name, _ := m.GetName()
+			line := fmt.Sprintf("  %s %s", name, m.GetVersion(manifest.ModulesVersion))
+			if rv, dirty, err := m.GetRepoVersion(); err == nil && rv != "" {
+				line += fmt.Sprintf(" (%s", rv)
+				if dirty {
+					line += ", dirty"
+				}
+				line += ")"
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+}
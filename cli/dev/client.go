@@ -28,6 +28,10 @@ type Client struct {
 	Port      string
 	Reconnect bool
 	Timeout   time.Duration
+	// Number of times to retry idempotent calls that failed with a transport
+	// error or timed out, and the initial delay between attempts.
+	Retries    int
+	RetryDelay time.Duration
 }
 
 func (c *Client) RegisterFlags(fs *flag.FlagSet) {
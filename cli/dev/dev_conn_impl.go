@@ -20,6 +20,8 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/juju/errors"
@@ -140,6 +142,16 @@ func isJSON(s string) bool {
 	return json.Unmarshal([]byte(s), &js) == nil
 }
 
+// RemoteError is returned when the device responds to an RPC with an error.
+type RemoteError struct {
+	Status  int
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error %d: %s", e.Status, e.Message)
+}
+
 func (dc *MosDevConn) CallRaw(ctx context.Context, method string, args interface{}) (json.RawMessage, error) {
 	argsJSON, ok := args.(string)
 	if !ok {
@@ -163,18 +175,66 @@ func (dc *MosDevConn) CallRaw(ctx context.Context, method string, args interface
 		cmd.Args.UnmarshalJSON([]byte(argsJSON))
 	}
 
-	resp, err := dc.RPC.Call(ctx, dc.Dest, cmd, rpccreds.GetRPCCreds)
+	resp, err := dc.callWithRetry(ctx, cmd)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
 	if resp.Status != 0 {
-		return nil, errors.Errorf("remote error %d: %s", resp.Status, resp.StatusMsg)
+		return nil, errors.Trace(&RemoteError{Status: resp.Status, Message: resp.StatusMsg})
 	}
 
 	return resp.Response, nil
 }
 
+// isIdempotent returns true for the methods that only read device state
+// and can be safely sent again, e.g. Sys.GetInfo, Config.Get, FS.List,
+// OTA.Status. A timed out call may still have been executed by the device,
+// so calls like OTA.Begin, Config.Save or Sys.Reboot are never retried.
+func isIdempotent(method string) bool {
+	name := method[strings.LastIndex(method, ".")+1:]
+	for _, p := range []string{"Get", "List", "Describe"} {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return name == "Status" || name == "Ping"
+}
+
+// callWithRetry sends the command, retrying idempotent calls on transport
+// errors and timeouts as configured by the client. Application-level errors
+// (non-zero status in the response) are returned to the caller as is and are
+// never retried. When retries are enabled, each attempt gets its own timeout.
+func (dc *MosDevConn) callWithRetry(ctx context.Context, cmd *frame.Command) (*frame.Response, error) {
+	if dc.c.Retries <= 0 {
+		return dc.RPC.Call(ctx, dc.Dest, cmd, rpccreds.GetRPCCreds)
+	}
+	retries := dc.c.Retries
+	if !isIdempotent(cmd.Cmd) {
+		retries = 0
+	}
+	delay := dc.c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if dc.c.Timeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, dc.c.Timeout)
+		}
+		resp, err := dc.RPC.Call(actx, dc.Dest, cmd, rpccreds.GetRPCCreds)
+		cancel()
+		if err == nil || attempt >= retries || ctx.Err() != nil {
+			return resp, err
+		}
+		glog.Warningf("%s failed (attempt %d of %d): %s, retrying in %s",
+			cmd.Cmd, attempt+1, retries+1, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, errors.Trace(ctx.Err())
+		}
+		delay *= 2
+	}
+}
+
 func (dc *MosDevConn) CallB(ctx context.Context, method string, args interface{}) ([]byte, error) {
 	respRaw, err := dc.CallRaw(ctx, method, args)
 	if err != nil {
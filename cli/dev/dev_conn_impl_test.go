@@ -0,0 +1,76 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package dev
+
+import (
+	"context"
+	"testing"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/common/mgrpc"
+	"github.com/mongoose-os/mos/common/mgrpc/codec"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+// fakeRPC returns the given response and error, counting the calls.
+type fakeRPC struct {
+	resp     *frame.Response
+	err      error
+	numCalls int
+}
+
+func (r *fakeRPC) Call(ctx context.Context, dst string, cmd *frame.Command, getCreds mgrpc.GetCredsCallback) (*frame.Response, error) {
+	r.numCalls++
+	return r.resp, r.err
+}
+
+func (r *fakeRPC) AddHandler(method string, handler mgrpc.Handler) {}
+func (r *fakeRPC) Disconnect(ctx context.Context) error            { return nil }
+func (r *fakeRPC) IsConnected() bool                               { return true }
+func (r *fakeRPC) SetCodecOptions(opts *codec.Options) error       { return nil }
+
+func TestCallRetry(t *testing.T) {
+	for _, c := range []struct {
+		method    string
+		resp      *frame.Response
+		err       error
+		wantCalls int
+	}{
+		{"Sys.GetInfo", nil, errors.New("timeout"), 3},
+		{"FS.List", nil, errors.New("timeout"), 3},
+		{"OTA.Status", nil, errors.New("timeout"), 3},
+		{"Sys.GetInfo", &frame.Response{}, nil, 1},
+		// Errors reported by the device are never retried.
+		{"Sys.GetInfo", &frame.Response{Status: 500, StatusMsg: "busy"}, nil, 1},
+		{"Config.Get", &frame.Response{Status: 404, StatusMsg: "not found"}, nil, 1},
+		// Calls with side effects are not retried on transport errors either.
+		{"OTA.Begin", nil, errors.New("timeout"), 1},
+		{"Config.Save", nil, errors.New("timeout"), 1},
+		{"Sys.Reboot", nil, errors.New("timeout"), 1},
+	} {
+		r := &fakeRPC{resp: c.resp, err: c.err}
+		dc := &MosDevConn{c: &Client{Retries: 2}, RPC: r}
+		_, err := dc.CallRaw(context.Background(), c.method, nil)
+		if (err != nil) != (c.err != nil || c.resp.Status != 0) {
+			t.Errorf("%s: unexpected error %v", c.method, err)
+		}
+		if r.numCalls != c.wantCalls {
+			t.Errorf("%s: expected %d calls, got %d", c.method, c.wantCalls, r.numCalls)
+		}
+	}
+}
@@ -38,7 +38,22 @@ func createDevConnWithJunkHandler(ctx context.Context, junkHandler func(junk []b
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	c := dev.Client{Port: port, Timeout: *flags.Timeout, Reconnect: *flags.Reconnect}
+	return createDevConnForPort(ctx, port, junkHandler)
+}
+
+func createDevConnForPort(ctx context.Context, port string, junkHandler func(junk []byte)) (dev.DevConn, error) {
+	return createDevConnForPortBaud(ctx, port, *flags.BaudRate, junkHandler)
+}
+
+func createDevConnForPortBaud(ctx context.Context, port string, baudRate int, junkHandler func(junk []byte)) (dev.DevConn, error) {
+	var err error
+	c := dev.Client{
+		Port:       port,
+		Timeout:    *flags.Timeout,
+		Reconnect:  *flags.Reconnect,
+		Retries:    *flags.RPCRetry,
+		RetryDelay: *flags.RPCRetryDelay,
+	}
 	prefix := "serial://"
 	if strings.Index(port, "://") > 0 {
 		prefix = ""
@@ -70,7 +85,7 @@ func createDevConnWithJunkHandler(ctx context.Context, junkHandler func(junk []b
 		},
 		MQTT: codec.MQTTCodecOptions{},
 		Serial: codec.SerialCodecOptions{
-			BaudRate:             uint(*flags.BaudRate),
+			BaudRate:             uint(baudRate),
 			HardwareFlowControl:  *flags.HWFC,
 			JunkHandler:          junkHandler,
 			SetControlLines:      *flags.SetControlLines,
@@ -104,3 +119,9 @@ func createDevConnWithJunkHandler(ctx context.Context, junkHandler func(junk []b
 func CreateDevConnFromFlags(ctx context.Context) (dev.DevConn, error) {
 	return createDevConnWithJunkHandler(ctx, func(junk []byte) {})
 }
+
+// CreateDevConnForPort is like CreateDevConnFromFlags, but connects to the
+// given port (or address) instead of --port.
+func CreateDevConnForPort(ctx context.Context, port string) (dev.DevConn, error) {
+	return createDevConnForPort(ctx, port, func(junk []byte) {})
+}
@@ -0,0 +1,150 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package devutil
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	glog "k8s.io/klog/v2"
+
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/flags"
+	"github.com/mongoose-os/mos/cli/ourutil"
+)
+
+const (
+	probeTimeout  = 2 * time.Second
+	rebootTimeout = 20 * time.Second
+)
+
+// Baud rates --enable-rpc tries if the device does not respond at --baud-rate.
+var probeBaudRates = []int{115200, 230400, 460800, 921600, 74880, 57600, 38400, 9600}
+
+// IsNoResponse returns true if err is the device not responding in time.
+func IsNoResponse(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err) == context.DeadlineExceeded || strings.Contains(err.Error(), context.DeadlineExceeded.Error())
+}
+
+func isSerialPort(port string) bool {
+	return strings.HasPrefix(port, "serial://") || !strings.Contains(port, "://")
+}
+
+// NoRPCHint explains the usual reasons for the device not responding to RPC
+// on the port, and what to do about them.
+func NoRPCHint(port string) string {
+	if !isSerialPort(port) {
+		return fmt.Sprintf(`Device does not respond to RPC at %s.
+  - Check that the device is online and the address is right.
+  - Check that the firmware includes the RPC lib for this transport (e.g. rpc-ws for ws://, rpc-mqtt for mqtt://).`, port)
+	}
+	return fmt.Sprintf(`Device does not respond to RPC on %s.
+  - Check that it is the right port: "mos ports" lists them.
+  - The firmware must include the rpc-uart lib, and rpc.uart.uart_no must be the UART connected to this port.
+  - rpc.uart.baud_rate must match --baud-rate (%d). --enable-rpc looks for the device at other baud rates and fixes the config.
+  - If the board uses DTR/RTS for reset, try --set-control-lines=false or --inverted-control-lines.
+  - If the device is stuck in the bootloader (e.g. after "mos flash --esp-boot-after-flashing=false"), reset it.
+  - "mos console" shows what the device prints, a boot loop prevents RPC from working.`, port, *flags.BaudRate)
+}
+
+func pingDevice(ctx context.Context, devConn dev.DevConn) error {
+	ctx2, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	return devConn.Call(ctx2, "Sys.GetInfo", nil, nil)
+}
+
+// CreateDevConnEnableRPC is like CreateDevConnFromFlags, but if the device
+// does not respond on the serial port at --baud-rate, other baud rates are
+// tried. If the device is found, rpc.uart.baud_rate is set to --baud-rate
+// and the device is rebooted to apply it.
+func CreateDevConnEnableRPC(ctx context.Context) (dev.DevConn, error) {
+	port, err := GetPort()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !isSerialPort(port) {
+		return CreateDevConnFromFlags(ctx)
+	}
+	devConn, err := createDevConnForPort(ctx, port, func(junk []byte) {})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = pingDevice(ctx, devConn); err == nil {
+		return devConn, nil
+	}
+	devConn.Disconnect(ctx)
+	glog.Infof("no response at %d: %s", *flags.BaudRate, err)
+	for _, br := range probeBaudRates {
+		if br == *flags.BaudRate {
+			continue
+		}
+		ourutil.Reportf("No response at %d, trying %d...", *flags.BaudRate, br)
+		devConn, err = createDevConnForPortBaud(ctx, port, br, func(junk []byte) {})
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = pingDevice(ctx, devConn); err != nil {
+			devConn.Disconnect(ctx)
+			continue
+		}
+		ourutil.Reportf("Device responds at %d, setting rpc.uart.baud_rate to %d and rebooting...", br, *flags.BaudRate)
+		err = setRPCBaudRate(ctx, devConn, *flags.BaudRate)
+		devConn.Disconnect(ctx)
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to set rpc.uart.baud_rate")
+		}
+		return waitForDevice(ctx, port)
+	}
+	return nil, errors.New(NoRPCHint(port))
+}
+
+func setRPCBaudRate(ctx context.Context, devConn dev.DevConn, baudRate int) error {
+	devConf, err := dev.GetConfig(ctx, devConn)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := devConf.Set("rpc.uart.baud_rate", fmt.Sprintf("%d", baudRate)); err != nil {
+		return errors.Trace(err)
+	}
+	_, err = dev.SetConfig(ctx, devConn, devConf, &dev.ConfigSetArg{Save: true, Reboot: true})
+	return errors.Trace(err)
+}
+
+// waitForDevice reconnects at --baud-rate until the device comes up.
+func waitForDevice(ctx context.Context, port string) (dev.DevConn, error) {
+	deadline := time.Now().Add(rebootTimeout)
+	for {
+		devConn, err := createDevConnForPort(ctx, port, func(junk []byte) {})
+		if err == nil {
+			if err = pingDevice(ctx, devConn); err == nil {
+				return devConn, nil
+			}
+			devConn.Disconnect(ctx)
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.Annotatef(err, "device did not come up at %d after reboot", *flags.BaudRate)
+		}
+		glog.V(1).Infof("device is not ready yet: %s", err)
+		time.Sleep(1 * time.Second)
+	}
+}
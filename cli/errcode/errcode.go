@@ -0,0 +1,102 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package errcode attaches stable, machine-readable codes to errors,
+// so that tools can classify failures (see mos --error-json).
+package errcode
+
+import (
+	"github.com/juju/errors"
+)
+
+type Code string
+
+const (
+	Unknown Code = "UNKNOWN"
+
+	// Build
+	NoManifest        Code = "NO_MANIFEST"
+	DockerUnavailable Code = "DOCKER_UNAVAILABLE"
+	LibFetchFailed    Code = "LIB_FETCH_FAILED"
+	BuildFailed       Code = "BUILD_FAILED"
+	BuildServerError  Code = "BUILD_SERVER_ERROR"
+	// Not really an error: nothing to build, see mos build --since-git.
+	BuildSkipped Code = "BUILD_SKIPPED"
+
+	// Flash
+	NoFirmware        Code = "NO_FIRMWARE"
+	FlashNoResponse   Code = "FLASH_NO_RESPONSE"
+	FlashWriteFailed  Code = "FLASH_WRITE_FAILED"
+	FlashVerifyFailed Code = "FLASH_VERIFY_FAILED"
+
+	// Device
+	DeviceConnectFailed Code = "DEVICE_CONNECT_FAILED"
+	RPCFailed           Code = "RPC_FAILED"
+	// The device did not respond, most likely RPC is not set up on its side.
+	RPCNoResponse Code = "RPC_NO_RESPONSE"
+)
+
+// Error is an error with a code and optional details. It is transparent:
+// the message and the cause are those of the wrapped error.
+type Error struct {
+	errors.Err
+	Code    Code
+	Details map[string]interface{}
+}
+
+// Wrap attaches code and details to err. Returns nil if err is nil.
+func Wrap(err error, code Code, details map[string]interface{}) error {
+	if err == nil {
+		return nil
+	}
+	e := &Error{Err: errors.NewErrWithCause(err, ""), Code: code, Details: details}
+	e.SetLocation(1)
+	return e
+}
+
+// Errorf creates a new error with the given code.
+func Errorf(code Code, format string, args ...interface{}) error {
+	e := &Error{Err: errors.NewErr(format, args...), Code: code}
+	e.SetLocation(1)
+	return e
+}
+
+// Get returns the code and details of the innermost coded error in the chain,
+// which is the most specific one, or Unknown if there are none.
+func Get(err error) (Code, map[string]interface{}) {
+	code, details := Unknown, map[string]interface{}(nil)
+	for err != nil {
+		if e, ok := err.(*Error); ok {
+			code, details = e.Code, e.Details
+		}
+		u, ok := err.(interface{ Underlying() error })
+		if !ok {
+			break
+		}
+		err = u.Underlying()
+	}
+	return code, details
+}
+
+// ExitCode returns the process exit code for the error code. Most codes map
+// to 1, the ones callers need to tell apart have their own.
+func ExitCode(code Code) int {
+	switch code {
+	case BuildSkipped:
+		return 3
+	}
+	return 1
+}
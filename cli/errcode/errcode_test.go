@@ -0,0 +1,59 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package errcode
+
+import (
+	"io"
+	"testing"
+
+	"github.com/juju/errors"
+)
+
+func TestGet(t *testing.T) {
+	if c, _ := Get(errors.New("foo")); c != Unknown {
+		t.Errorf("expected %s, got %s", Unknown, c)
+	}
+
+	err := Wrap(io.EOF, LibFetchFailed, map[string]interface{}{"lib": "foo"})
+	err = errors.Annotatef(errors.Trace(err), "while building")
+	err = Wrap(err, BuildFailed, nil)
+	err = errors.Trace(err)
+	c, d := Get(err)
+	if c != LibFetchFailed || d["lib"] != "foo" {
+		t.Errorf("unexpected code %s, details %v", c, d)
+	}
+	if errors.Cause(err) != io.EOF {
+		t.Errorf("cause is not preserved: %v", errors.Cause(err))
+	}
+	if err.Error() != "while building: EOF" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+
+	err = errors.Trace(Errorf(NoManifest, "no %s", "mos.yml"))
+	if c, _ := Get(err); c != NoManifest || err.Error() != "no mos.yml" {
+		t.Errorf("unexpected code %s, message %q", c, err.Error())
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	if c := ExitCode(BuildFailed); c != 1 {
+		t.Errorf("expected 1, got %d", c)
+	}
+	if c, _ := Get(errors.Trace(Errorf(BuildSkipped, "skipped"))); ExitCode(c) != 3 {
+		t.Errorf("expected 3, got %d", ExitCode(c))
+	}
+}
@@ -17,15 +17,19 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 
 	"context"
 
 	"github.com/juju/errors"
 	"github.com/mongoose-os/mos/cli/build"
+	"github.com/mongoose-os/mos/cli/builder"
 	"github.com/mongoose-os/mos/cli/dev"
 	"github.com/mongoose-os/mos/cli/flags"
 	"github.com/mongoose-os/mos/cli/interpreter"
@@ -33,93 +37,149 @@ import (
 	flag "github.com/spf13/pflag"
 )
 
+var (
+	evalExprStdin = flag.Bool("stdin", false, "eval-manifest-expr: read newline-separated expressions from stdin")
+)
+
 func evalManifestExpr(ctx context.Context, devConn dev.DevConn) error {
-	cll, err := getCustomLocations(*flags.Libs)
-	if err != nil {
-		return errors.Trace(err)
+	exprs := flag.Args()[1:]
+
+	if *evalExprStdin {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if expr := strings.TrimSpace(scanner.Text()); expr != "" {
+				exprs = append(exprs, expr)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return errors.Annotatef(err, "failed to read expressions from stdin")
+		}
 	}
-	cml, err := getCustomLocations(*flags.Modules)
+
+	if len(exprs) == 0 {
+		return errors.Errorf("expression is required")
+	}
+
+	// Reading the manifest is the expensive part, so it's done once for all
+	// the expressions.
+	_, _, interp, err := readFinalManifestFromFlags()
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	args := flag.Args()[1:]
+	// A single expression given as an argument is printed as is, for
+	// compatibility; otherwise each result is printed on its own line,
+	// prefixed with the expression.
+	batch := len(exprs) > 1 || *evalExprStdin
+
+	for _, expr := range exprs {
+		res, err := interp.EvaluateExpr(expr)
+		if err != nil {
+			return errors.Annotatef(err, "%s", expr)
+		}
+
+		var data []byte
+		if batch {
+			data, err = json.Marshal(res)
+		} else {
+			data, err = json.MarshalIndent(res, "", "  ")
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// TODO(dfrank): probably add a flag whether to expand vars (the default
+		// being to expand)
+		sdata, err := interpreter.ExpandVars(interp, string(data), false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if batch {
+			fmt.Printf("%s: %s\n", expr, sdata)
+		} else {
+			fmt.Println(sdata)
+		}
+	}
+
+	return nil
+}
 
-	if len(args) == 0 {
-		return errors.Errorf("expression is required")
+// readFinalManifestFromFlags reads the final manifest of the app in the
+// current directory, using the platform, build vars, extra libs and lib /
+// module locations given on the command line. Libs are never updated. The
+// returned interpreter has manifest vars already set.
+func readFinalManifestFromFlags() (*build.FWAppManifest, *manifest_parser.RMFOut, *interpreter.MosInterpreter, error) {
+	if err := loadEnvFile(*flags.EnvFile); err != nil {
+		return nil, nil, nil, errors.Annotatef(err, "--env-file")
 	}
 
-	expr := args[0]
+	cll, err := getCustomLocations(*flags.Libs)
+	if err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	cml, err := getCustomLocations(*flags.Modules)
+	if err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
 
-	bParams := &build.BuildParams{
-		ManifestAdjustments: build.ManifestAdjustments{
-			Platform: flags.Platform(),
+	bParams := &builder.BuildParams{
+		BuildParams: build.BuildParams{
+			ManifestAdjustments: build.ManifestAdjustments{
+				Platform:   flags.Platform(),
+				MosRepoURL: *flags.MosRepoURL,
+			},
+			CustomLibLocations:    cll,
+			CustomModuleLocations: cml,
+			// Never update libs on that command
+			LibsUpdateInterval: 0,
 		},
-		CustomLibLocations:    cll,
-		CustomModuleLocations: cml,
-		// Never update libs on that command
-		LibsUpdateInterval: 0,
+		LibsDir:    *flags.LibsDir,
+		DepsDir:    *flags.DepsDir,
+		ModulesDir: *flags.ModulesDir,
 	}
 
-	interp := interpreter.NewInterpreter(newMosVars())
+	interp := interpreter.NewInterpreter(builder.NewMosVars())
 
-	appDir, err := getCodeDirAbs()
+	appDir, err := builder.GetCodeDirAbs()
 	if err != nil {
-		return errors.Trace(err)
+		return nil, nil, nil, errors.Trace(err)
 	}
 
-	logWriterStderr = os.Stderr
-
+	var logWriterStderr, logWriter io.Writer = os.Stderr, &bytes.Buffer{}
 	if *flags.Verbose {
 		logWriter = logWriterStderr
-	} else {
-		logWriter = &bytes.Buffer{}
 	}
 
-	compProvider := compProviderReal{
-		bParams:   bParams,
-		logWriter: logWriter,
-	}
+	compProvider := builder.NewComponentProvider(bParams, logWriter, logWriterStderr)
 
 	buildVarsCli, err := getBuildVarsFromCLI()
 	if err != nil {
-		return errors.Trace(err)
+		return nil, nil, nil, errors.Trace(err)
+	}
+
+	libsFromCLI, err := getLibsFromCLI()
+	if err != nil {
+		return nil, nil, nil, errors.Trace(err)
 	}
 
-	manifest, _, err := manifest_parser.ReadManifestFinal(
+	manifest, fp, err := manifest_parser.ReadManifestFinal(
 		appDir, &build.ManifestAdjustments{
 			Platform:  bParams.Platform,
+			Env:       *flags.Env,
 			BuildVars: buildVarsCli,
+			ExtraLibs: libsFromCLI,
 		}, logWriter, interp,
-		&manifest_parser.ReadManifestCallbacks{ComponentProvider: &compProvider},
+		&manifest_parser.ReadManifestCallbacks{ComponentProvider: compProvider},
 		false /* requireArch */, *flags.PreferPrebuiltLibs, 0, /* binaryLibsUpdateInterval */
 	)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, nil, nil, errors.Trace(err)
 	}
 
 	if err := interpreter.SetManifestVars(interp.MVars, manifest); err != nil {
-		return errors.Trace(err)
-	}
-
-	res, err := interp.EvaluateExpr(expr)
-	if err != nil {
-		return errors.Trace(err)
-	}
-
-	data, err := json.MarshalIndent(res, "", "  ")
-	if err != nil {
-		return errors.Trace(err)
+		return nil, nil, nil, errors.Trace(err)
 	}
 
-	// TODO(dfrank): probably add a flag whether to expand vars (the default
-	// being to expand)
-	sdata, err := interpreter.ExpandVars(interp, string(data), false)
-	if err != nil {
-		return errors.Trace(err)
-	}
-
-	fmt.Println(sdata)
-
-	return nil
+	return manifest, fp, interp, nil
 }
@@ -42,13 +42,17 @@ var (
 	Input       = flag.StringP("input", "i", "", "")
 	Manifest    = flag.String("manifest", "", "")
 	Name        = flag.String("name", "", "")
-	Output      = flag.StringP("output", "o", "", "")
+	Output      = flag.StringP("output", "o", "", "Output file. For mos build, the firmware bundle is also copied there")
 	platform    = flag.String("platform", "", "Hardware platform")
 	SrcDir      = flag.String("src-dir", "", "")
 	Compress    = flag.Bool("compress", false, "")
 
 	Credentials = flag.String("credentials", "", "Credentials to use when accessing protected resources such as Git repos and their assets. "+
-		"Can be comma-separated list of host:token entries or refer to a file @/path/to/credentials (one entry per line).")
+		"Can be comma-separated list of host:token entries or refer to a file @/path/to/credentials (one entry per line). "+
+		"Per-host credentials are also taken from MOS_CREDENTIALS_<HOST> env vars, e.g. MOS_CREDENTIALS_GITHUB_COM=token; command line entries take precedence over env vars, which take precedence over the file.")
+	GitHubAPIURL = flag.String("github-api-url", "", "GitHub API base URL to use when fetching assets from GitHub Enterprise hosts. "+
+		"Can be comma-separated list of host=url entries, an entry without host applies to all hosts except github.com. "+
+		"Default is https://<host>/api/v3.")
 	GHToken = flag.String("gh-token", "", "Deprecated, please use --credentials") // Deprecated: 2020-08-06
 
 	ChunkSize      = flag.Int("chunk-size", 512, "Chunk size for operations")
@@ -62,6 +66,9 @@ var (
 	RPCUARTNoDelay = flag.Bool("rpc-uart-no-delay", false, "Do not introduce delay into UART over RPC")
 	Timeout        = flag.Duration("timeout", 20*time.Second, "Timeout for the device connection and call operation")
 	Reconnect      = flag.Bool("reconnect", false, "Enable reconnection")
+	RPCRetry       = flag.Int("retry", 0, "Number of times to retry a read-only device RPC call (e.g. Sys.GetInfo, Config.Get) that failed due to a transport error or timeout")
+	RPCRetryDelay  = flag.Duration("retry-delay", time.Second, "Delay before the first RPC retry, doubled after each subsequent attempt")
+	EnableRPC      = flag.Bool("enable-rpc", false, "If the device does not respond to RPC over the serial port, look for it at other baud rates and set rpc.uart.baud_rate to --baud-rate")
 	HWFC           = flag.Bool("hw-flow-control", false, "Enable hardware flow control (CTS/RTS)")
 
 	LicenseServer    = flag.String("license-server", "https://license.mongoose-os.com", "License server address")
@@ -80,17 +87,21 @@ var (
 	GCPRPCCreateTopic = flag.Bool("gcp-rpc-create-topic", false, "Create RPC topic plumbing if needed")
 
 	Level    = flag.Int("level", -1, "Config level; default - runtime")
-	NoReboot = flag.Bool("no-reboot", false, "Save config but don't reboot the device.")
+	NoReboot = flag.Bool("no-reboot", false, "Save config but don't reboot the device. For ota: write and verify the update but don't activate it, see ota-activate")
 	NoSave   = flag.Bool("no-save", false, "Don't save config and don't reboot the device")
 	TryOnce  = flag.Bool("try-once", false, "When saving the config, do it in such a way that it's only applied on the next boot")
 
-	Format       = flag.String("format", "", "Config format, hex or json")
+	Format       = flag.String("format", "", "Config format, hex or json. For flash-read: bin (default), ihex (Intel HEX) or srec (Motorola S-record). For mac and chip-info: text (default) or json. For build --deps-manifest-out: yaml (default) or json")
+	KeyFormat    = flag.String("key-format", "", "Public key format: pem, der or raw (uncompressed EC point). If not specified, derived from the output file extension; default is pem")
 	WriteKey     = flag.String("write-key", "", "Write key file")
 	CSRTemplate  = flag.String("csr-template", "", "CSR template to use")
 	CertTemplate = flag.String("cert-template", "", "cert template to use")
 	CertDays     = flag.Int("cert-days", 0, "new cert validity, days")
 	Subject      = flag.String("subject", "", "Subject for CSR or certificate")
 
+	Count = flag.Int("count", 0, "config-get --watch: exit after printing this many values, 0 means no limit. For mac: number of MACs to print, derived from the base one (WiFi STA, AP, BT, Ethernet)")
+	Raw   = flag.Bool("raw", false, "For call: with --jsonpath, print strings without quotes. For console: output data as is, no filtering of non-text bytes, no timestamps and no core dump catching")
+
 	GDBServerCmd = flag.String("gdb-server-cmd", "/usr/local/bin/serve_core.py", "")
 
 	KeepTempFiles = flag.Bool("keep-temp-files", false, "keep temp files after the build is done (by default they are in ~/.mos/tmp)")
@@ -105,21 +116,35 @@ var (
 	AuthFile  = flag.String("auth-file", "~/.mos/auth.json", "Where to store license server auth key")
 
 	// Build flags.
-	BuildParams = flag.String("build-params", "", "build params file")
+	BuildParams = flag.String("build-params", "", "build params file, YAML or JSON")
 	TempDir     = flag.String("temp-dir", "~/.mos/tmp", "Directory to store temporary files")
+	TempMaxSize = flag.Int64("tmp-max-size", 2048, "Max size of --temp-dir, in megabytes. When exceeded, oldest temp dirs which are not in use are removed. 0 means no limit")
 	DepsDir     = flag.String("deps-dir", "", "Directory to fetch libs, modules into")
 	LibsDir     = flag.StringSlice("libs-dir", []string{}, "Directory to find libs in. Can be used multiple times.")
 	ModulesDir  = flag.String("modules-dir", "", "Directory to store modules into")
 
+	ManifestCacheDir = flag.String("manifest-cache-dir", "~/.mos/manifest_cache", "Directory to store the manifest cache in, see build --cache-libs-manifest")
+
+	FailOnManifestWarning = flag.Bool("fail-on-manifest-warning", false, "Treat warnings in app and lib manifests as errors")
+
 	Local              = flag.Bool("local", false, "Local build.")
 	Clean              = flag.Bool("clean", false, "Perform a clean build, wipe the previous build state")
 	MosRepo            = flag.String("repo", "", "Path to the mongoose-os repository; if omitted, the mongoose-os repository will be cloned as ./mongoose-os")
+	MosRepoURL         = flag.String("mos-repo-url", "", "URL of the mongoose-os repository to clone instead of the default one, e.g. an internal mirror. Use --credentials for private repos")
 	Verbose            = flag.Bool("verbose", false, "Verbose output")
+	ErrorJSON          = flag.Bool("error-json", false, "On failure, print the error to stderr as JSON: {code, message, details, stack}")
 	Modules            = flag.StringArray("module", []string{}, "location of the module from mos.yaml, in the format: \"module_name:/path/to/location\". Can be used multiple times.")
 	Libs               = flag.StringArray("lib", []string{}, "location of the lib from mos.yaml, in the format: \"lib_name:/path/to/location\". Can be used multiple times.")
+	DepOverrides       = flag.StringArray("dep-override", []string{}, "Replace location and version of a lib, including the ones pulled in by other libs, in the format: \"lib_name=location[@version]\". Can be used multiple times.")
 	NoLibsUpdate       = flag.Bool("no-libs-update", false, "if true, never try to pull existing libs (treat existing default locations as if they were given in --lib)")
+	Offline            = flag.Bool("offline", false, "Do not access the network: use only the libs and modules already present locally, fail if any of them is missing")
+	RepairDeps         = flag.Bool("repair-deps", false, "if a local copy of a repo is a broken git repository (e.g. after an interrupted clone), remove and clone it again. mos build always does that")
 	LibsUpdateInterval = flag.Duration("libs-update-interval", time.Hour*1, "how often to update already fetched libs")
 	BuildVars          = flag.StringSlice("build-var", []string{}, `Build variable in the format "NAME=VALUE". Can be used multiple times.`)
+	Env                = flag.String("env", "", `Environment name; if set, mos.<env>.yml is applied on top of mos.yml, e.g. "mos.prod.yml" for --env prod`)
+	SinceGit           = flag.String("since-git", "", "Only build if any of the app's inputs (manifest, sources, filesystem, libs) changed since this git ref. Otherwise exit with code 3. Local builds only")
+	SourcesFile        = flag.String("sources-file", "", "File with the list of extra source files to build, one per line, used as is without globbing. Lines starting with -I are include dirs. Relative paths are relative to the file")
+	EnvFile            = flag.String("env-file", "", "File with KEY=VALUE lines to add to the environment before reading the manifest, available as ${env.KEY}. Variables already set in the environment take precedence")
 	CDefs              = flag.StringSlice("cdef", []string{}, `C/C++ define in the format "NAME=VALUE". Can be used multiple times.`)
 	BuildDryRun        = flag.Bool("build-dry-run", false, "do not actually run the build, only prepare")
 	BuildTarget        = flag.String("build-target", moscommon.BuildTargetDefault, "target to build with make")
@@ -127,8 +152,12 @@ var (
 	CFlagsExtra        = flag.StringArray("cflags-extra", []string{}, "extra C flag, appended to the \"cflags\" in the manifest. Can be used multiple times.")
 	CXXFlagsExtra      = flag.StringArray("cxxflags-extra", []string{}, "extra C++ flag, appended to the \"cxxflags\" in the manifest. Can be used multiple times.")
 	LibsExtra          = flag.StringArray("lib-extra", []string{}, "Extra libs to add to the app being built. Value should be a YAML string. Can be used multiple times.")
+	LibsExtraDir       = flag.StringArray("lib-extra-dir", []string{}, "Directory with extra libs to add to the app being built: each subdirectory with a mos.yml is added as a lib. Can be used multiple times.")
 	SaveBuildStat      = flag.Bool("save-build-stat", true, "save build statistics")
 	PreferPrebuiltLibs = flag.Bool("prefer-prebuilt-libs", false, "if both sources and prebuilt binary of a lib exists, use the binary")
+	IncludeBuildInfo   = flag.Bool("include-build-info", false, "Generate build_info.json with app and lib versions, build id and git hash, and put it on the device filesystem")
+	ForbidLib          = flag.StringArray("forbid-lib", []string{}, "Fail the build if a lib with this name is present anywhere in the dependency tree. Can be used multiple times")
+	ForbidLibFile      = flag.String("forbid-lib-file", "", "YAML file with the dependency policy: a \"forbid\" list of rules with \"name\", \"location\" (a regex) and \"reason\". Libs matching any rule fail the build")
 
 	DepsVersions       = flag.String("deps-versions", "", "If specified, this file will be consulted for all libs and modules versions")
 	StrictDepsVersions = flag.Bool("strict-deps-versions", true, "If set, then --deps-versions will be in strict mode: missing deps will be disallowed")
@@ -146,10 +175,11 @@ var (
 			"e.g. --build-docker-extra=--volumes-from=outer",
 	)
 	BuildImage       = flag.String("build-image", "", "Override the Docker image used for build.")
-	BuildParalellism = flag.Int("build-parallelism", 0, "build parallelism. default is to use number of CPUs.")
+	BuildParalellism = flag.Int("build-parallelism", 0, "build parallelism. default is to use number of CPUs, limited by the CPU quota when building inside the container")
 
 	// Flashing flags
-	NoVerify = flag.Bool("no-verify", false, "Do not verify flashed image")
+	Verify   = flag.String("verify", "always", "Verification of the flashed image: always (after writing everything), after-each-block (write in 64K blocks, verify each one right after writing it) or none")
+	NoVerify = flag.Bool("no-verify", false, "Same as --verify=none")
 )
 
 func Platform() string {
@@ -28,6 +28,8 @@ import (
 	flag "github.com/spf13/pflag"
 	glog "k8s.io/klog/v2"
 
+	"github.com/mongoose-os/mos/cli/flags"
+	"github.com/mongoose-os/mos/cli/ourutil"
 	"github.com/mongoose-os/mos/cli/update"
 	"github.com/mongoose-os/mos/common/multierror"
 	"github.com/mongoose-os/mos/version"
@@ -51,9 +53,21 @@ func initFlags() {
 	flag.CommandLine.AddGoFlagSet(goflag.CommandLine)
 	hideFlags()
 	flag.Usage = usage
+	if isPluginCommandLine() {
+		flag.CommandLine.ParseErrorsWhitelist.UnknownFlags = true
+	}
 	flag.Parse()
 }
 
+// registerSecretFlags makes sure that values of the sensitive flags don't
+// end up in the output and logs. Credentials which need parsing are
+// registered where they are parsed.
+func registerSecretFlags() {
+	for _, s := range []string{*pass, *devicePass, *flags.GHToken} {
+		ourutil.RegisterSecret(s)
+	}
+}
+
 func hideFlags() {
 	for _, f := range hiddenFlags {
 		flag.CommandLine.MarkHidden(f)
@@ -82,6 +96,10 @@ func checkFlags(fs []string) error {
 
 func printFlag(w io.Writer, opt string, name string) {
 	f := flag.Lookup(name)
+	if f == nil {
+		// Flag is not available in this build (e.g. built with noflash).
+		return
+	}
 	arg := "<string>"
 	if f.Value.Type() == "bool" {
 		arg = ""
@@ -111,7 +129,7 @@ func usage() {
 
 	fmt.Fprintf(w, "The Mongoose OS command line tool %s.\n", version.Version)
 
-	if !version.LooksLikeDistrBuildId(version.BuildId) {
+	if !version.LooksLikeDistrBuildId(version.BuildId) && !*flags.Offline {
 		fmt.Fprintf(w, "Update channel: %q. Checking updates... ", update.GetUpdateChannel())
 		w.Flush()
 
@@ -140,6 +158,7 @@ func usage() {
 		}
 		fmt.Fprintf(w, "  %s\t\t%s\n", c.name, c.short)
 	}
+	fmt.Fprintf(w, "\nOther commands are looked up as %s<command> executables on PATH.\n", pluginPrefix)
 
 	fmt.Fprintf(w, "\nGlobal Flags:\n")
 	if *helpFull {
@@ -147,6 +166,7 @@ func usage() {
 	} else {
 		printFlag(w, "Optional", "verbose")
 		printFlag(w, "Optional", "logtostderr")
+		printFlag(w, "Optional", "offline")
 	}
 
 	w.Flush()
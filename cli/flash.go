@@ -21,6 +21,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"runtime"
 	"strings"
@@ -28,17 +29,22 @@ import (
 
 	"context"
 
+	"github.com/cesanta/go-serial/serial"
 	"github.com/juju/errors"
 	flag "github.com/spf13/pflag"
 	glog "k8s.io/klog/v2"
 
+	"github.com/mongoose-os/mos/cli/buildid"
+	"github.com/mongoose-os/mos/cli/config"
 	"github.com/mongoose-os/mos/cli/dev"
 	"github.com/mongoose-os/mos/cli/devutil"
+	"github.com/mongoose-os/mos/cli/errcode"
 	"github.com/mongoose-os/mos/cli/flags"
 	"github.com/mongoose-os/mos/cli/flash/cc3200"
 	"github.com/mongoose-os/mos/cli/flash/cc3220"
 	"github.com/mongoose-os/mos/cli/flash/esp"
 	espFlasher "github.com/mongoose-os/mos/cli/flash/esp/flasher"
+	"github.com/mongoose-os/mos/cli/flash/esp32"
 	"github.com/mongoose-os/mos/cli/flash/rs14100"
 	"github.com/mongoose-os/mos/cli/flash/stm32"
 	"github.com/mongoose-os/mos/cli/ourutil"
@@ -47,6 +53,17 @@ import (
 )
 
 var (
+	afterFlashConfig        = flag.String("after-flash-config", "", "Config file (YAML or JSON) to apply to the device after successful flashing")
+	afterFlashConfigTimeout = flag.Duration("after-flash-config-timeout", 30*time.Second, "How long to wait for the device to come up after flashing before applying --after-flash-config, --config-preserve-keys or --verify-build-id")
+	baudAfter               = flag.Int("baud-after", 0, "Serial port speed to use after flashing. If set, the device is reset once flashing completes and --baud-rate is changed to this value")
+	configPreserveKeys      = flag.StringSlice("config-preserve-keys", nil, "Comma-separated list of config keys (e.g. device.id,wifi.sta.ssid) to read from the device before flashing and set again after it boots")
+	consoleAfterFlash       = flag.Bool("console", false, "Open console after successful flashing")
+	imageOnly               = flag.String("image-only", "", "Write this raw image file (e.g. a full flash dump made with flash-read) instead of a firmware bundle. Requires --platform")
+	imageOffset             = flag.Uint32("offset", 0, "Flash address to write --image-only at")
+	partitionTable          = flag.String("partition-table", "", "ESP32: Partition table CSV file (ESP-IDF format) to use instead of the one in the firmware bundle")
+	verifyOnly              = flag.Bool("verify-only", false, "ESP: do not write anything, only compare flash contents with the firmware and report the sections that differ")
+	verifyBuildID           = flag.Bool("verify-build-id", false, "After flashing, wait for the device to boot and check that it runs the firmware that was flashed")
+
 	cc3200FlashOpts  cc3200.FlashOpts
 	cc3220FlashOpts  cc3220.FlashOpts
 	espFlashOpts     esp.FlashOpts
@@ -80,18 +97,26 @@ func init() {
 	flag.BoolVar(&espFlashOpts.EraseChip, "esp-erase-chip", false,
 		"Erase entire chip before flashing")
 	flag.BoolVar(&espFlashOpts.EnableCompression, "esp-enable-compression", true,
-		"Compress data while writing to flash. Usually makes flashing faster.")
+		"Same as --flash-compress")
 	flag.BoolVar(&espFlashOpts.MinimizeWrites, "esp-minimize-writes", true,
 		"Minimize the number of blocks to write by comparing current contents "+
 			"with the images being written")
 	flag.BoolVar(&espFlashOpts.BootFirmware, "esp-boot-after-flashing", true,
 		"Boot the firmware after flashing")
+	flag.StringVar(&espFlashOpts.Chip, "esp-chip", "",
+		"Chip to talk to regardless of the platform: esp32, esp32c3, esp32s3 or esp8266")
 	flag.StringVar(&espFlashOpts.ESP32EncryptionKeyFile, "esp32-encryption-key-file", "",
 		"If specified, this file will be used to encrypt data before flashing. "+
 			"Encryption is only applied to parts with encrypt=true.")
 	flag.Uint32Var(&espFlashOpts.ESP32FlashCryptConf, "esp32-flash-crypt-conf", 0xf,
 		"Value of the FLASH_CRYPT_CONF eFuse setting, affecting how key is tweaked.")
 
+	flag.BoolVar(&espFlashOpts.EnableCompression, "flash-compress", true,
+		"Compress data while writing to flash, where supported (ESP8266, ESP32). Usually makes flashing faster")
+
+	flag.StringVar(&espFlashOpts.FlasherStub, "flasher-stub", "",
+		"ESP: Flasher stub JSON file to use instead of the built-in one, e.g. a newer build. Only the chips mos knows about are supported")
+
 	// RS14100
 	flag.BoolVar(&rs14100FlashOpts.EraseChip, "rs-erase-chip", false, "Erase chip when flashing")
 
@@ -123,6 +148,25 @@ func getFirmwareURL(appName, platformWithVariation string) string {
 	)
 }
 
+func readPartitionTable(fname, platform string) ([]byte, error) {
+	switch strings.ToLower(platform) {
+	case "esp32", "esp32c3", "esp32s3":
+	default:
+		return nil, errors.Errorf("custom partition table is not supported on %s", platform)
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	ptes, err := esp32.ParsePartitionTableCSV(f)
+	if err != nil {
+		return nil, errors.Annotatef(err, "%s", fname)
+	}
+	ourutil.Reportf("Using partition table from %s (%d partitions)", fname, len(ptes))
+	return esp32.MakePartitionTable(ptes)
+}
+
 func getDemoAppName(platformWithVariation string) string {
 	appName := "demo-js"
 	if strings.HasPrefix(platformWithVariation, "cc3200") {
@@ -132,6 +176,10 @@ func getDemoAppName(platformWithVariation string) string {
 }
 
 func flash(ctx context.Context, devConn dev.DevConn) error {
+	if *imageOnly != "" {
+		return errors.Trace(flashImageOnly(ctx, devConn))
+	}
+
 	fwname := *firmware
 	args := flag.Args()
 	if len(args) == 2 {
@@ -147,9 +195,25 @@ func flash(ctx context.Context, devConn dev.DevConn) error {
 		fwname = getFirmwareURL(appName, platforWithVariation)
 	}
 
-	fw, err := fwbundle.ReadZipFirmwareBundle(fwname)
+	// Parse the config file upfront so that we don't flash the device only to
+	// fail afterwards.
+	var afterFlashConf map[string]string
+	if *afterFlashConfig != "" {
+		if afterFlashConf, err = config.ReadFile(*afterFlashConfig); err != nil {
+			return errors.Annotatef(err, "invalid --after-flash-config")
+		}
+	}
+
+	// The data is kept for flashing multiple devices, each one needs its own
+	// copy of the bundle.
+	var fw *fwbundle.FirmwareBundle
+	fwData, err := ourutil.ReadOrFetchFile(fwname)
+	if err == nil {
+		fw, err = fwbundle.ReadZipFirmwareBundleData(fwname, fwData)
+	}
 	if err != nil {
-		return errors.Annotatef(err, "failed to load %s", fwname)
+		return errcode.Wrap(errors.Annotatef(err, "failed to load %s", fwname),
+			errcode.NoFirmware, map[string]interface{}{"firmware": fwname})
 	}
 	if !*flags.KeepTempFiles {
 		defer fw.Cleanup()
@@ -157,6 +221,39 @@ func flash(ctx context.Context, devConn dev.DevConn) error {
 
 	ourutil.Reportf("Loaded %s/%s version %s (%s)", fw.Name, fw.Platform, fw.Version, fw.BuildID)
 
+	if *verifyOnly {
+		if !strings.HasPrefix(strings.ToLower(fw.Platform), "esp") {
+			return errors.Errorf("--verify-only is not supported on %s", fw.Platform)
+		}
+		if *afterFlashConfig != "" {
+			return errors.Errorf("--verify-only and --after-flash-config are incompatible")
+		}
+		if len(*configPreserveKeys) > 0 {
+			return errors.Errorf("--verify-only and --config-preserve-keys are incompatible")
+		}
+		espFlashOpts.VerifyOnly = true
+	}
+
+	if *partitionTable != "" {
+		if espFlashOpts.ESP32PartitionTable, err = readPartitionTable(*partitionTable, fw.Platform); err != nil {
+			return errors.Annotatef(err, "invalid --partition-table")
+		}
+	}
+
+	if len(*configPreserveKeys) > 0 && len(*flashPorts) == 0 && !*flashAllPorts {
+		// Preserved values are applied on top of --after-flash-config.
+		preserved, err := readPreservedConfig(ctx, devConn, *configPreserveKeys)
+		if err != nil {
+			return errors.Annotatef(err, "failed to read --config-preserve-keys from the device")
+		}
+		if afterFlashConf == nil {
+			afterFlashConf = map[string]string{}
+		}
+		for k, v := range preserved {
+			afterFlashConf[k] = v
+		}
+	}
+
 	// if given devConn is not nill, we should disconnect it while flashing is
 	// in progress
 	if devConn != nil {
@@ -164,6 +261,10 @@ func flash(ctx context.Context, devConn dev.DevConn) error {
 		defer devConn.Connect(ctx, true)
 	}
 
+	if len(*flashPorts) > 0 || *flashAllPorts {
+		return errors.Trace(flashMultiPort(ctx, fwname, fwData, fw.Platform))
+	}
+
 	port := ""
 	if fw.Platform != "stm32" && fw.Platform != "rs14100" {
 		port, err = devutil.GetPort()
@@ -173,7 +274,9 @@ func flash(ctx context.Context, devConn dev.DevConn) error {
 	}
 
 	espFlashOpts.InvertedControlLines = *flags.InvertedControlLines
-	espFlashOpts.NoVerify = *flags.NoVerify
+	if espFlashOpts.Verify, err = getVerifyMode(); err != nil {
+		return errors.Trace(err)
+	}
 
 	switch strings.ToLower(fw.Platform) {
 	case "cc3200":
@@ -192,6 +295,10 @@ func flash(ctx context.Context, devConn dev.DevConn) error {
 		espFlashOpts.ControlPort = port
 		espFlashOpts.KeepFS = *flags.KeepFS
 		err = espFlasher.Flash(esp.ChipESP32C3, fw, &espFlashOpts)
+	case "esp32s3":
+		espFlashOpts.ControlPort = port
+		espFlashOpts.KeepFS = *flags.KeepFS
+		err = espFlasher.Flash(esp.ChipESP32S3, fw, &espFlashOpts)
 	case "esp8266":
 		espFlashOpts.ControlPort = port
 		espFlashOpts.KeepFS = *flags.KeepFS
@@ -230,9 +337,225 @@ func flash(ctx context.Context, devConn dev.DevConn) error {
 		err = errors.Errorf("%s: unsupported platform '%s'", *firmware, fw.Platform)
 	}
 
-	if err == nil {
-		ourutil.Reportf("All done!")
+	if err == nil && *baudAfter > 0 {
+		*flags.BaudRate = *baudAfter
+		if port != "" {
+			err = resetDevice(port)
+		}
+	}
+
+	if err == nil && len(afterFlashConf) > 0 {
+		err = applyConfigAfterFlash(ctx, afterFlashConf)
+	}
+
+	if err == nil && *verifyBuildID {
+		err = verifyBuildIDAfterFlash(ctx, fw.BuildID)
+	}
+
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	ourutil.Reportf("All done!")
+
+	if *consoleAfterFlash {
+		return errors.Trace(console(ctx, nil))
+	}
+
+	return nil
+}
+
+func getVerifyMode() (esp.VerifyMode, error) {
+	if *flags.NoVerify {
+		return esp.VerifyNone, nil
+	}
+	vm, err := esp.ParseVerifyMode(*flags.Verify)
+	return vm, errors.Annotatef(err, "--verify")
+}
+
+// getESPChipType returns the chip to talk to for the given platform, taking
+// --esp-chip into account. With --esp-chip, the platform may be empty.
+func getESPChipType(platform string) (esp.ChipType, error) {
+	if platform == "" && espFlashOpts.Chip != "" {
+		platform = espFlashOpts.Chip
+	}
+	ct, err := esp.ParseChipType(platform)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return espFlashOpts.GetChipType(ct)
+}
+
+// flashImageOnly handles "mos flash --image-only": the image is written to
+// flash as is, bypassing bundle parsing.
+func flashImageOnly(ctx context.Context, devConn dev.DevConn) error {
+	platform := flags.Platform()
+	if platform == "" && espFlashOpts.Chip == "" {
+		return errors.Errorf("--platform is required with --image-only")
+	}
+	ct, err := getESPChipType(platform)
+	if err != nil {
+		return errors.Annotatef(err, "--image-only")
+	}
+
+	data, err := ioutil.ReadFile(*imageOnly)
+	if err != nil {
+		return errors.Annotatef(err, "failed to read %s", *imageOnly)
+	}
+
+	if devConn != nil {
+		devConn.Disconnect(ctx)
+		defer devConn.Connect(ctx, true)
+	}
+
+	port, err := devutil.GetPort()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	espFlashOpts.ControlPort = port
+	espFlashOpts.InvertedControlLines = *flags.InvertedControlLines
+	if espFlashOpts.Verify, err = getVerifyMode(); err != nil {
+		return errors.Trace(err)
+	}
+
+	ourutil.Reportf("Writing %s (%d bytes) @ 0x%x...", *imageOnly, len(data), *imageOffset)
+	if err := espFlasher.WriteFlashImage(ct, *imageOffset, data, &espFlashOpts); err != nil {
+		return errors.Trace(err)
+	}
+
+	ourutil.Reportf("All done!")
+
+	if *consoleAfterFlash {
+		return errors.Trace(console(ctx, nil))
+	}
+
+	return nil
+}
+
+// resetDevice resets the device connected to the given serial port by
+// toggling RTS, with DTR de-asserted so that the device boots the firmware.
+func resetDevice(port string) error {
+	ourutil.Reportf("Resetting the device, new baud rate is %d...", *flags.BaudRate)
+	sp, err := serial.Open(serial.OpenOptions{
+		PortName:        port,
+		BaudRate:        uint(*flags.BaudRate),
+		DataBits:        8,
+		ParityMode:      serial.PARITY_NONE,
+		StopBits:        1,
+		MinimumReadSize: 1,
+	})
+	if err != nil {
+		return errors.Annotatef(err, "failed to open %s", port)
+	}
+	defer sp.Close()
+	mFalse := *flags.InvertedControlLines
+	mTrue := !*flags.InvertedControlLines
+	sp.SetDTR(mFalse)
+	sp.SetRTS(mTrue)
+	time.Sleep(50 * time.Millisecond)
+	sp.SetRTS(mFalse)
+	return nil
+}
+
+// readPreservedConfig reads the values of the given config keys from the
+// device, before it is flashed. If devConn is nil, a connection is created
+// from flags and closed before returning, so that the port is free for the
+// flasher.
+func readPreservedConfig(ctx context.Context, devConn dev.DevConn, keys []string) (map[string]string, error) {
+	if devConn == nil {
+		var err error
+		devConn, err = devutil.CreateDevConnFromFlags(ctx)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer devConn.Disconnect(ctx)
+	}
+	ourutil.Reportf("Reading config keys to preserve...")
+	devConf, err := dev.GetConfigLevel(ctx, devConn, *flags.Level)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	res := map[string]string{}
+	for _, k := range keys {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		v, err := devConf.Get(k)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		// Make sure the value can be set back, e.g. it's not an object,
+		// before the device is wiped.
+		if err := devConf.Set(k, v); err != nil {
+			return nil, errors.Trace(err)
+		}
+		ourutil.Reportf("  %s = %s", k, v)
+		res[k] = v
+	}
+	return res, nil
+}
+
+// applyConfigAfterFlash waits for the freshly flashed device to boot and
+// applies the given config values to it.
+func applyConfigAfterFlash(ctx context.Context, newConf map[string]string) error {
+	devConn, err := waitForDeviceAfterFlash(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer devConn.Disconnect(ctx)
+	devConf, err := dev.GetConfigLevel(ctx, devConn, *flags.Level)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := config.ApplyDiff(devConf, newConf); err != nil {
+		return errors.Trace(err)
 	}
+	return errors.Trace(config.SetAndSave(ctx, devConn, devConf))
+}
 
-	return errors.Trace(err)
+func verifyBuildIDAfterFlash(ctx context.Context, fwBuildID string) error {
+	if fwBuildID == "" {
+		return errors.Errorf("firmware bundle has no build id, cannot verify")
+	}
+	devConn, err := waitForDeviceAfterFlash(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer devConn.Disconnect(ctx)
+	devBuildID, err := buildid.FromDevice(ctx, devConn)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := buildid.Compare("flashed firmware", fwBuildID, "device firmware", devBuildID); err != nil {
+		return errors.Trace(err)
+	}
+	ourutil.Reportf("Device is running %s", devBuildID)
+	return nil
+}
+
+func waitForDeviceAfterFlash(ctx context.Context) (dev.DevConn, error) {
+	ourutil.Reportf("Waiting for the device to boot...")
+	deadline := time.Now().Add(*afterFlashConfigTimeout)
+	var devConn dev.DevConn
+	for {
+		var err error
+		devConn, err = devutil.CreateDevConnFromFlags(ctx)
+		if err == nil {
+			ctx2, cancel := context.WithTimeout(ctx, 3*time.Second)
+			_, err = dev.GetConfigLevel(ctx2, devConn, *flags.Level)
+			cancel()
+			if err == nil {
+				break
+			}
+			devConn.Disconnect(ctx)
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.Annotatef(err, "device did not come up after flashing")
+		}
+		glog.V(1).Infof("device is not ready yet: %s", err)
+		time.Sleep(1 * time.Second)
+	}
+	return devConn, nil
 }
@@ -0,0 +1,112 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/juju/errors"
+)
+
+const hexRecordLen = 16
+
+// WriteIntelHex writes data located at addr in the Intel HEX format, using
+// extended linear address records for addresses above 64K.
+func WriteIntelHex(w io.Writer, addr uint32, data []byte) error {
+	if uint64(addr)+uint64(len(data)) > 1<<32 {
+		return errors.Errorf("data does not fit into 32-bit address space")
+	}
+	bw := bufio.NewWriter(w)
+	writeRecord := func(recAddr uint16, recType byte, recData []byte) {
+		rec := []byte{byte(len(recData)), byte(recAddr >> 8), byte(recAddr), recType}
+		rec = append(rec, recData...)
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		fmt.Fprintf(bw, ":%X%02X\n", rec, -sum)
+	}
+	upper := -1
+	for off := 0; off < len(data); {
+		a := addr + uint32(off)
+		if int(a>>16) != upper {
+			upper = int(a >> 16)
+			writeRecord(0, 0x04, []byte{byte(upper >> 8), byte(upper)})
+		}
+		n := hexRecordLen
+		if n > len(data)-off {
+			n = len(data) - off
+		}
+		// Records must not cross 64K boundary.
+		if rem := 0x10000 - int(a&0xffff); n > rem {
+			n = rem
+		}
+		writeRecord(uint16(a), 0x00, data[off:off+n])
+		off += n
+	}
+	writeRecord(0, 0x01, nil)
+	return errors.Trace(bw.Flush())
+}
+
+// WriteSRec writes data located at addr in the Motorola S-record format.
+// The smallest address size which fits the whole range is used (S1, S2 or S3
+// data records).
+func WriteSRec(w io.Writer, addr uint32, data []byte) error {
+	end := uint64(addr) + uint64(len(data))
+	if end > 1<<32 {
+		return errors.Errorf("data does not fit into 32-bit address space")
+	}
+	addrLen, dataType, termType := 4, '3', '7'
+	switch {
+	case end <= 1<<16:
+		addrLen, dataType, termType = 2, '1', '9'
+	case end <= 1<<24:
+		addrLen, dataType, termType = 3, '2', '8'
+	}
+	bw := bufio.NewWriter(w)
+	writeRecord := func(recType rune, recAddr uint32, recAddrLen int, recData []byte) {
+		rec := []byte{byte(recAddrLen + len(recData) + 1)}
+		for i := recAddrLen - 1; i >= 0; i-- {
+			rec = append(rec, byte(recAddr>>(uint(i)*8)))
+		}
+		rec = append(rec, recData...)
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		fmt.Fprintf(bw, "S%c%X%02X\n", recType, rec, ^sum)
+	}
+	writeRecord('0', 0, 2, []byte("mos"))
+	numRecords := 0
+	for off := 0; off < len(data); off += hexRecordLen {
+		n := hexRecordLen
+		if n > len(data)-off {
+			n = len(data) - off
+		}
+		writeRecord(dataType, addr+uint32(off), addrLen, data[off:off+n])
+		numRecords++
+	}
+	if numRecords <= 0xffff {
+		writeRecord('5', uint32(numRecords), 2, nil)
+	} else if numRecords <= 0xffffff {
+		writeRecord('6', uint32(numRecords), 3, nil)
+	}
+	writeRecord(termType, addr, addrLen, nil)
+	return errors.Trace(bw.Flush())
+}
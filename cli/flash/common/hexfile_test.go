@@ -0,0 +1,64 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteIntelHex(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteIntelHex(&buf, 0x100, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	exp := ":020000040000FA\n:020100000102FA\n:00000001FF\n"
+	if buf.String() != exp {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), exp)
+	}
+
+	// Records must not cross 64K boundary, extended address record is emitted.
+	buf.Reset()
+	if err := WriteIntelHex(&buf, 0xffff, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	exp = ":020000040000FA\n:01FFFF000100\n:020000040001F9\n:0100000002FD\n:00000001FF\n"
+	if buf.String() != exp {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), exp)
+	}
+}
+
+func TestWriteSRec(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteSRec(&buf, 0x100, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	exp := "S00600006D6F73AA\nS10501000102F6\nS5030001FB\nS9030100FB\n"
+	if buf.String() != exp {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), exp)
+	}
+
+	// 32-bit addresses use S3 / S7 records.
+	buf.Reset()
+	if err := WriteSRec(&buf, 0x3f400000, []byte{0xaa}); err != nil {
+		t.Fatal(err)
+	}
+	exp = "S00600006D6F73AA\nS3063F400000AAD0\nS5030001FB\nS7053F4000007B\n"
+	if buf.String() != exp {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), exp)
+	}
+}
@@ -16,7 +16,14 @@
 //
 package esp
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/flash/common"
+)
 
 type ChipType int
 
@@ -41,7 +48,76 @@ type FlashOpts struct {
 	ESP32EncryptionKeyFile string
 	ESP32FlashCryptConf    uint32
 	KeepFS                 bool
-	NoVerify               bool
+	Verify                 VerifyMode
+	// If set, replaces the partition table in the bundle (ESP32 only).
+	ESP32PartitionTable []byte
+	// Only compare flash contents with the images, do not write anything.
+	VerifyOnly bool
+	// Chip type to use regardless of the platform: esp32, esp32c3, esp32s3
+	// or esp8266, see ParseChipType.
+	Chip string
+	// Flasher stub JSON file to use instead of the built-in one. Only replaces
+	// the stub, the chip must still be one of the supported ones.
+	FlasherStub string
+	// Prepended to progress messages, e.g. to tell devices apart when
+	// flashing several of them at once.
+	ReportPrefix string
+}
+
+// GetChipType returns the chip type to talk to: the one set by Chip, if any,
+// otherwise ct.
+func (opts *FlashOpts) GetChipType(ct ChipType) (ChipType, error) {
+	if opts.Chip == "" {
+		return ct, nil
+	}
+	forced, err := ParseChipType(opts.Chip)
+	if err != nil {
+		return ct, errors.Trace(err)
+	}
+	if forced != ct {
+		opts.Reportf("Using %s instead of %s as requested", forced, ct)
+	}
+	return forced, nil
+}
+
+func (opts *FlashOpts) Reportf(f string, args ...interface{}) {
+	common.Reportf("%s%s", opts.ReportPrefix, fmt.Sprintf(f, args...))
+}
+
+// VerifyMode controls verification of the written data.
+type VerifyMode string
+
+const (
+	// Verify all the images once everything is written. This is the default.
+	VerifyAlways VerifyMode = "always"
+	// Write in 64K blocks and verify each one right after it is written.
+	VerifyAfterEachBlock VerifyMode = "after-each-block"
+	VerifyNone           VerifyMode = "none"
+)
+
+func ParseVerifyMode(s string) (VerifyMode, error) {
+	switch vm := VerifyMode(s); vm {
+	case VerifyAlways, VerifyAfterEachBlock, VerifyNone:
+		return vm, nil
+	case "":
+		return VerifyAlways, nil
+	}
+	return "", errors.Errorf("invalid verify mode %q, expected %s, %s or %s", s, VerifyAlways, VerifyAfterEachBlock, VerifyNone)
+}
+
+// ChipInfo describes the chip, as detected from its eFuses.
+type ChipInfo struct {
+	Descr string `json:"descr"`
+	// -1 if the chip has no notion of revision.
+	Revision int    `json:"revision"`
+	MAC      string `json:"mac"`
+	// Raw values the variant detection is based on.
+	VariantFuses []FuseValue `json:"variant_fuses"`
+}
+
+type FuseValue struct {
+	Name  string `json:"name"`
+	Value uint64 `json:"value"`
 }
 
 type RegReader interface {
@@ -54,6 +130,24 @@ type RegReaderWriter interface {
 	Disconnect()
 }
 
+// ParseChipType parses the chip name, which is the same as the platform
+// name: esp32, esp32c3, esp32s3 or esp8266.
+func ParseChipType(name string) (ChipType, error) {
+	switch strings.ToLower(name) {
+	case "esp32":
+		return ChipESP32, nil
+	case "esp32c3":
+		return ChipESP32C3, nil
+	case "esp32s3":
+		return ChipESP32S3, nil
+	case "esp8266":
+		return ChipESP8266, nil
+	case "esp32s2":
+		return 0, errors.NotSupportedf("ESP32-S2")
+	}
+	return 0, errors.Errorf("unknown chip %q, expected esp32, esp32c3, esp32s3 or esp8266", name)
+}
+
 func (ct ChipType) String() string {
 	switch ct {
 	case ChipESP32:
@@ -0,0 +1,55 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package esp
+
+import (
+	"testing"
+)
+
+func TestGetChipType(t *testing.T) {
+	for _, c := range []struct {
+		chip   string
+		ct     ChipType
+		exp    ChipType
+		expErr bool
+	}{
+		// No override, the chip type derived from the platform is used.
+		{"", ChipESP32, ChipESP32, false},
+		{"", ChipESP8266, ChipESP8266, false},
+		// Override takes precedence.
+		{"esp32c3", ChipESP32, ChipESP32C3, false},
+		{"ESP32S3", ChipESP8266, ChipESP32S3, false},
+		{"esp8266", ChipESP32, ChipESP8266, false},
+		{"esp32", ChipESP32, ChipESP32, false},
+		{"esp32s2", ChipESP32, ChipESP32, true},
+		{"esp31", ChipESP32, ChipESP32, true},
+	} {
+		opts := &FlashOpts{Chip: c.chip}
+		res, err := opts.GetChipType(c.ct)
+		if c.expErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", c.chip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", c.chip, err)
+		} else if res != c.exp {
+			t.Errorf("%q: expected %s, got %s", c.chip, c.exp, res)
+		}
+	}
+}
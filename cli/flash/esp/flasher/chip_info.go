@@ -0,0 +1,104 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package flasher
+
+import (
+	"github.com/juju/errors"
+	"github.com/mongoose-os/mos/cli/flash/esp"
+	"github.com/mongoose-os/mos/cli/flash/esp32"
+	"github.com/mongoose-os/mos/cli/flash/esp32c3"
+	"github.com/mongoose-os/mos/cli/flash/esp32s3"
+	"github.com/mongoose-os/mos/cli/flash/esp8266"
+)
+
+// ChipInfo is what GetChipInfo reports about the chip.
+type ChipInfo struct {
+	Chip string `json:"chip"`
+	esp.ChipInfo
+	// Crystal frequency, 0 if could not be determined.
+	XtalFreqMHz int           `json:"xtal_freq_mhz"`
+	Flash       FlashChipInfo `json:"flash"`
+	// Set if the flash chip could not be detected, Flash is empty then.
+	FlashError string `json:"flash_error,omitempty"`
+}
+
+// GetChipInfo connects to the ROM loader and collects the details about
+// the chip, without writing anything.
+func GetChipInfo(ct esp.ChipType, opts *esp.FlashOpts) (*ChipInfo, error) {
+	ct, err := opts.GetChipType(ct)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rc, fc, err := connectToFlasher(ct, opts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rc.Disconnect()
+
+	var eci *esp.ChipInfo
+	switch ct {
+	case esp.ChipESP32:
+		eci, err = esp32.GetChipInfo(fc)
+	case esp.ChipESP32C3:
+		eci, err = esp32c3.GetChipInfo(fc)
+	case esp.ChipESP32S3:
+		eci, err = esp32s3.GetChipInfo(fc)
+	case esp.ChipESP8266:
+		eci, err = esp8266.GetChipInfo(fc)
+	default:
+		return nil, errors.Errorf("unsupported chip %s", ct)
+	}
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to read chip info")
+	}
+	ci := &ChipInfo{
+		Chip:        ct.String(),
+		ChipInfo:    *eci,
+		XtalFreqMHz: estimateXtalFreq(ct, fc.romUARTClk),
+	}
+
+	chipID, err := fc.GetFlashChipID()
+	if err == nil {
+		ci.Flash.ChipID = chipID
+		ci.Flash.Mfg, ci.Flash.Size, err = detectFlashSize(fc)
+	}
+	if err != nil {
+		ci.FlashError = err.Error()
+	}
+	return ci, nil
+}
+
+// estimateXtalFreq returns crystal frequency in MHz based on the UART clock
+// used by the ROM loader, which runs straight from the crystal.
+// Same as esptool, the value is rounded to either 26 or 40 MHz.
+func estimateXtalFreq(ct esp.ChipType, romUARTClk uint32) int {
+	switch ct {
+	case esp.ChipESP32C3, esp.ChipESP32S3:
+		// Only 40 MHz crystals are supported.
+		return 40
+	case esp.ChipESP8266:
+		romUARTClk /= 2
+	}
+	switch {
+	case romUARTClk == 0:
+		return 0
+	case romUARTClk > 33000000:
+		return 40
+	default:
+		return 26
+	}
+}
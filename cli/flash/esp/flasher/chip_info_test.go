@@ -0,0 +1,44 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package flasher
+
+import (
+	"testing"
+
+	"github.com/mongoose-os/mos/cli/flash/esp"
+)
+
+func TestEstimateXtalFreq(t *testing.T) {
+	for _, c := range []struct {
+		ct  esp.ChipType
+		clk uint32
+		exp int
+	}{
+		{esp.ChipESP32, 40000000, 40},
+		{esp.ChipESP32, 39800000, 40},
+		{esp.ChipESP32, 26000000, 26},
+		{esp.ChipESP32, 0, 0},
+		{esp.ChipESP8266, 52000000, 26},
+		{esp.ChipESP8266, 80000000, 40},
+		{esp.ChipESP32C3, 0, 40},
+		{esp.ChipESP32S3, 0, 40},
+	} {
+		if res := estimateXtalFreq(c.ct, c.clk); res != c.exp {
+			t.Errorf("%s %d: expected %d, got %d", c.ct, c.clk, c.exp, res)
+		}
+	}
+}
@@ -17,6 +17,8 @@
 package flasher
 
 import (
+	"io/ioutil"
+
 	"github.com/juju/errors"
 	"github.com/mongoose-os/mos/cli/flash/esp"
 	"github.com/mongoose-os/mos/cli/flash/esp/rom_client"
@@ -29,14 +31,21 @@ const (
 )
 
 type cfResult struct {
+	// Chip type, as overridden by opts.Chip.
+	ct          esp.ChipType
 	rc          *rom_client.ROMClient
 	fc          *FlasherClient
 	flashParams flashParams
+	// Size of the flash chip as reported by its JEDEC ID, 0 if not known.
+	chipSize int
 }
 
 func ConnectToFlasherClient(ct esp.ChipType, opts *esp.FlashOpts) (*cfResult, error) {
-	var err error
-	r := &cfResult{}
+	ct, err := opts.GetChipType(ct)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	r := &cfResult{ct: ct}
 
 	if opts.FlasherBaudRate < 0 || opts.FlasherBaudRate > 4000000 {
 		return nil, errors.Errorf("invalid flashing baud rate (%d)", opts.FlasherBaudRate)
@@ -46,42 +55,25 @@ func ConnectToFlasherClient(ct esp.ChipType, opts *esp.FlashOpts) (*cfResult, er
 		return nil, errors.Annotatef(err, "invalid flash params (%q)", opts.FlashParams)
 	}
 
-	ownROMClient := false
+	r.rc, r.fc, err = connectToFlasher(ct, opts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ownROMClient := true
 	defer func() {
 		if ownROMClient {
 			r.rc.Disconnect()
 		}
 	}()
-	flasherBaudRate := opts.FlasherBaudRate
-	for {
-		r.rc, err = rom_client.ConnectToROM(ct, opts)
-		if err != nil {
-			return nil, errors.Annotatef(
-				err,
-				"Failed to talk to bootloader.\nSee "+
-					"https://github.com/espressif/esptool/wiki/ESP8266-Boot-Mode-Selection\n"+
-					"for wiring instructions or pull GPIO0 low and reset.",
-			)
-		}
-		ownROMClient = true
-
-		r.fc, err = NewFlasherClient(ct, r.rc, opts.ROMBaudRate, flasherBaudRate)
-		if err == nil {
-			break
-		}
-		if flasherBaudRate != 0 {
-			glog.Errorf("failed to run flasher @ %d, falling back to ROM baud rate...", flasherBaudRate)
-			r.rc.Disconnect()
-			ownROMClient = false
-			flasherBaudRate = 0
-		} else {
-			return nil, errors.Annotatef(err, "failed to run flasher")
-		}
+	mfg, flashSize, detectErr := detectFlashSize(r.fc)
+	if detectErr == nil {
+		r.chipSize = flashSize
+	} else {
+		glog.Warningf("failed to detect flash size: %s", detectErr)
 	}
 	if r.flashParams.Size() <= 0 || r.flashParams.Mode() == "" {
-		mfg, flashSize, err := detectFlashSize(r.fc)
-		if err != nil {
-			return nil, errors.Annotatef(err, "flash size is not specified and could not be detected")
+		if detectErr != nil {
+			return nil, errors.Annotatef(detectErr, "flash size is not specified and could not be detected")
 		}
 		if err = r.flashParams.SetSize(flashSize); err != nil {
 			return nil, errors.Annotatef(err, "invalid flash size detected")
@@ -102,6 +94,54 @@ func ConnectToFlasherClient(ct esp.ChipType, opts *esp.FlashOpts) (*cfResult, er
 	return r, nil
 }
 
+// connectToFlasher connects to the ROM loader and runs the flasher stub,
+// falling back to the ROM baud rate if the stub fails to run at the
+// requested one.
+func connectToFlasher(ct esp.ChipType, opts *esp.FlashOpts) (*rom_client.ROMClient, *FlasherClient, error) {
+	stubJSON, err := readFlasherStub(opts)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	flasherBaudRate := opts.FlasherBaudRate
+	for {
+		rc, err := rom_client.ConnectToROM(ct, opts)
+		if err != nil {
+			return nil, nil, errors.Annotatef(
+				err,
+				"Failed to talk to bootloader.\nSee "+
+					"https://github.com/espressif/esptool/wiki/ESP8266-Boot-Mode-Selection\n"+
+					"for wiring instructions or pull GPIO0 low and reset.",
+			)
+		}
+
+		fc, err := NewFlasherClient(ct, rc, stubJSON, opts.ROMBaudRate, flasherBaudRate)
+		if err == nil {
+			return rc, fc, nil
+		}
+		rc.Disconnect()
+		if flasherBaudRate != 0 {
+			glog.Errorf("failed to run flasher @ %d, falling back to ROM baud rate...", flasherBaudRate)
+			flasherBaudRate = 0
+		} else {
+			return nil, nil, errors.Annotatef(err, "failed to run flasher")
+		}
+	}
+}
+
+// readFlasherStub returns the contents of opts.FlasherStub, nil if it is not
+// set and the built-in stub should be used.
+func readFlasherStub(opts *esp.FlashOpts) ([]byte, error) {
+	if opts.FlasherStub == "" {
+		return nil, nil
+	}
+	stubJSON, err := ioutil.ReadFile(opts.FlasherStub)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to read flasher stub")
+	}
+	opts.Reportf("Using flasher stub from %s", opts.FlasherStub)
+	return stubJSON, nil
+}
+
 func detectFlashSize(fc *FlasherClient) (int, int, error) {
 	chipID, err := fc.GetFlashChipID()
 	if err != nil {
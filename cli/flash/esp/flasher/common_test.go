@@ -0,0 +1,61 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package flasher
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mongoose-os/mos/cli/flash/esp"
+)
+
+func TestFlasherStub(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flasher_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stubFile := filepath.Join(dir, "stub.json")
+	stubData := []byte(`{"entry": 1}`)
+	if err := ioutil.WriteFile(stubFile, stubData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// No stub file - the built-in stub is used.
+	stubJSON, err := readFlasherStub(&esp.FlashOpts{})
+	if err != nil || stubJSON != nil {
+		t.Fatalf("unexpected stub %q %v", stubJSON, err)
+	}
+	if builtin, err := getStubJSON(esp.ChipESP32, stubJSON); err != nil || len(builtin) == 0 {
+		t.Errorf("expected the built-in stub, got %d bytes %v", len(builtin), err)
+	}
+
+	stubJSON, err = readFlasherStub(&esp.FlashOpts{FlasherStub: stubFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := getStubJSON(esp.ChipESP32, stubJSON); err != nil || !bytes.Equal(res, stubData) {
+		t.Errorf("stub from the file is not used: %q %v", res, err)
+	}
+
+	if _, err := readFlasherStub(&esp.FlashOpts{FlasherStub: filepath.Join(dir, "nope.json")}); err == nil {
+		t.Errorf("expected an error for a missing stub file")
+	}
+}
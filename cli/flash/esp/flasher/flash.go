@@ -27,7 +27,7 @@ import (
 
 	"github.com/juju/errors"
 	moscommon "github.com/mongoose-os/mos/cli/common"
-	"github.com/mongoose-os/mos/cli/flash/common"
+	"github.com/mongoose-os/mos/cli/errcode"
 	"github.com/mongoose-os/mos/cli/flash/esp"
 	"github.com/mongoose-os/mos/cli/flash/esp32"
 	"github.com/mongoose-os/mos/common/fwbundle"
@@ -52,6 +52,8 @@ type image struct {
 	Addr         uint32
 	Data         []byte
 	ESP32Encrypt bool
+	// Raw images are written as is, flash params are not patched.
+	Raw bool
 }
 
 type imagesByAddr []*image
@@ -74,18 +76,28 @@ func Flash(ct esp.ChipType, fw *fwbundle.FirmwareBundle, opts *esp.FlashOpts) er
 	if opts.KeepFS && opts.EraseChip {
 		return errors.Errorf("--keep-fs and --esp-erase-chip are incompatible")
 	}
+	if opts.VerifyOnly && opts.EraseChip {
+		return errors.Errorf("--verify-only and --esp-erase-chip are incompatible")
+	}
 
 	cfr, err := ConnectToFlasherClient(ct, opts)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	defer cfr.rc.Disconnect()
+	ct = cfr.ct
 
 	if ct == esp.ChipESP8266 {
 		// Based on our knowledge of flash size, adjust type=sys_params image.
 		adjustSysParamsLocation(fw, cfr.flashParams.Size())
 	}
 
+	if opts.ESP32PartitionTable != nil {
+		if err := esp32.SetPartitionTable(fw, opts.ESP32PartitionTable); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
 	// Sort images by address
 	var images []*image
 	for _, p := range fw.Parts {
@@ -119,6 +131,11 @@ func Flash(ct esp.ChipType, fw *fwbundle.FirmwareBundle, opts *esp.FlashOpts) er
 		if err != nil {
 			return errors.Annotatef(err, "%s: failed to get data", p.Name)
 		}
+		if p.ESP32PartitionName != "" {
+			if err := checkFitsPartition(fw, p, len(data)); err != nil {
+				return errors.Trace(err)
+			}
+		}
 		im := &image{
 			Name:         p.Name,
 			Type:         p.Type,
@@ -132,10 +149,24 @@ func Flash(ct esp.ChipType, fw *fwbundle.FirmwareBundle, opts *esp.FlashOpts) er
 	return errors.Trace(writeImages(ct, cfr, images, opts, true))
 }
 
+// checkFitsPartition checks that the part's data does not extend beyond its partition.
+func checkFitsPartition(fw *fwbundle.FirmwareBundle, p *fwbundle.FirmwarePart, dataLen int) error {
+	pti, err := esp32.GetPartitionInfo(fw, p.ESP32PartitionName)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	start, end := pti.Pos.Offset, pti.Pos.Offset+pti.Pos.Size
+	if p.Addr < start || uint64(p.Addr)+uint64(dataLen) > uint64(end) {
+		return errors.Errorf("%s: %d bytes @ 0x%x do not fit in partition %q (%d bytes @ 0x%x)",
+			p.Name, dataLen, p.Addr, p.ESP32PartitionName, pti.Pos.Size, pti.Pos.Offset)
+	}
+	return nil
+}
+
 func writeImages(ct esp.ChipType, cfr *cfResult, images []*image, opts *esp.FlashOpts, sanityCheck bool) error {
 	var err error
 
-	common.Reportf("Flash size: %d, params: %s", cfr.flashParams.Size(), cfr.flashParams)
+	opts.Reportf("Flash size: %d, params: %s", cfr.flashParams.Size(), cfr.flashParams)
 
 	encryptionEnabled := false
 	secureBootEnabled := false
@@ -148,20 +179,23 @@ func writeImages(ct esp.ChipType, cfr *cfResult, images []*image, opts *esp.Flas
 			if fcnt, err := fusesByName[esp32.FlashCryptCntFuseName].Value(true /* withDiffs */); err == nil {
 				encryptionEnabled = (bits.OnesCount64(fcnt.Uint64())%2 != 0)
 				kcs = esp32.GetKeyEncodingScheme(fusesByName)
-				common.Reportf("Flash encryption: %s, scheme: %s", enDis(encryptionEnabled), kcs)
+				opts.Reportf("Flash encryption: %s, scheme: %s", enDis(encryptionEnabled), kcs)
 			}
 			if abs0, err := fusesByName[esp32.AbstractDone0FuseName].Value(true /* withDiffs */); err == nil {
 				secureBootEnabled = (abs0.Int64() != 0)
-				common.Reportf("Secure boot: %s", enDis(secureBootEnabled))
+				opts.Reportf("Secure boot: %s", enDis(secureBootEnabled))
 			}
 		} else {
 			// Some boards (ARDUINO NANO 33 IOT) do not support memory reading commands to read efuses.
 			// Allow to proceed anyway.
-			common.Reportf("Failed to read eFuses, assuming no flash encryption")
+			opts.Reportf("Failed to read eFuses, assuming no flash encryption")
 		}
 	}
 
 	for _, im := range images {
+		if im.Raw {
+			continue
+		}
 		if im.Addr == 0 || im.Addr == 0x1000 && len(im.Data) >= 4 && im.Data[0] == 0xe9 {
 			im.Data[2], im.Data[3] = cfr.flashParams.Bytes()
 		}
@@ -170,7 +204,7 @@ func writeImages(ct esp.ChipType, cfr *cfResult, images []*image, opts *esp.Flas
 				if opts.ESP32EncryptionKeyFile != "" {
 					mac := strings.ToUpper(strings.Replace(fusesByName[esp32.MACAddressFuseName].MACAddressString(), ":", "", -1))
 					ekf := moscommon.ExpandPlaceholders(opts.ESP32EncryptionKeyFile, "?", mac)
-					common.Reportf("Flash encryption key: %s", ekf)
+					opts.Reportf("Flash encryption key: %s", ekf)
 					esp32EncryptionKey, err = ioutil.ReadFile(ekf)
 					if err != nil {
 						return errors.Annotatef(err, "failed to read encryption key")
@@ -203,20 +237,29 @@ func writeImages(ct esp.ChipType, cfr *cfResult, images []*image, opts *esp.Flas
 	sort.Sort(imagesByAddr(images))
 
 	if sanityCheck {
-		err = sanityCheckImages(ct, images, cfr.flashParams.Size(), flashSectorSize)
+		flashSize := cfr.flashParams.Size()
+		if cfr.chipSize > 0 && cfr.chipSize < flashSize {
+			opts.Reportf("Warning: flash params specify %d bytes but the chip is only %d bytes", flashSize, cfr.chipSize)
+			flashSize = cfr.chipSize
+		}
+		err = sanityCheckImages(ct, images, flashSize, flashSectorSize)
 		if err != nil {
 			return errors.Trace(err)
 		}
 	}
 
+	if opts.VerifyOnly {
+		return errors.Trace(compareImages(cfr.fc, images, opts))
+	}
+
 	imagesToWrite := images
 	if opts.EraseChip {
-		common.Reportf("Erasing chip...")
+		opts.Reportf("Erasing chip...")
 		if err = cfr.fc.EraseChip(); err != nil {
 			return errors.Annotatef(err, "failed to erase chip")
 		}
 	} else if opts.MinimizeWrites {
-		common.Reportf("Deduping...")
+		opts.Reportf("Deduping...")
 		imagesToWrite, err = dedupImages(cfr.fc, images)
 		if err != nil {
 			return errors.Annotatef(err, "failed to dedup images")
@@ -224,9 +267,11 @@ func writeImages(ct esp.ChipType, cfr *cfResult, images []*image, opts *esp.Flas
 	}
 
 	if len(imagesToWrite) > 0 {
-		common.Reportf("Writing...")
+		opts.Reportf("Writing...")
 		start := time.Now()
-		totalBytesWritten := 0
+		totalBytesWritten, numBytesVerified := 0, 0
+		var verifyTime time.Duration
+		_, wireBytesBefore := cfr.fc.TransferStats()
 		for _, im := range imagesToWrite {
 			data := im.Data
 			numAttempts := 3
@@ -242,16 +287,25 @@ func writeImages(ct esp.ChipType, cfr *cfResult, images []*image, opts *esp.Flas
 				data = newData
 			}
 			for i := 1; imageBytesWritten < len(im.Data); i++ {
-				common.Reportf("  %7d @ 0x%x", len(data), addr)
-				bytesWritten, err := cfr.fc.Write(addr, data, true /* erase */, opts.EnableCompression)
-				if err != nil {
+				block := data
+				// To verify each block it has to be written separately.
+				if opts.Verify == esp.VerifyAfterEachBlock && len(block) > flashBlockSize {
+					block = block[:flashBlockSize]
+				}
+				opts.Reportf("  %7d @ 0x%x", len(block), addr)
+				bytesWritten, err := cfr.fc.Write(addr, block, true /* erase */, opts.EnableCompression)
+				if err == nil {
+					// Success, reset the retry counter for the next block.
+					i = 0
+				} else {
 					if bytesWritten >= flashSectorSize {
 						// We made progress, restart the retry counter.
 						i = 1
 					}
 					err = errors.Annotatef(err, "write error (attempt %d/%d)", i, numAttempts)
 					if i >= numAttempts {
-						return errors.Annotatef(err, "%s: failed to write", im.Name)
+						return errcode.Wrap(errors.Annotatef(err, "%s: failed to write", im.Name),
+							errcode.FlashWriteFailed, map[string]interface{}{"part": im.Name, "addr": addr})
 					}
 					glog.Warningf("%s", err)
 					if err := cfr.fc.Sync(); err != nil {
@@ -259,55 +313,50 @@ func writeImages(ct esp.ChipType, cfr *cfResult, images []*image, opts *esp.Flas
 					}
 					// Round down to sector boundary
 					bytesWritten = bytesWritten - (bytesWritten % flashSectorSize)
-					data = data[bytesWritten:]
+				}
+				data = data[bytesWritten:]
+				if opts.Verify == esp.VerifyAfterEachBlock && bytesWritten > 0 {
+					vStart := time.Now()
+					if err := verifyData(cfr.fc, im.Name, addr, block[:bytesWritten]); err != nil {
+						return errors.Trace(err)
+					}
+					verifyTime += time.Since(vStart)
+					numBytesVerified += bytesWritten
 				}
 				imageBytesWritten += bytesWritten
 				addr += uint32(bytesWritten)
 			}
 			totalBytesWritten += len(im.Data)
 		}
-		seconds := time.Since(start).Seconds()
+		seconds := (time.Since(start) - verifyTime).Seconds()
 		bytesPerSecond := float64(totalBytesWritten) / seconds
-		common.Reportf("Wrote %d bytes in %.2f seconds (%.2f KBit/sec)", totalBytesWritten, seconds, bytesPerSecond*8/1024)
+		opts.Reportf("Wrote %d bytes in %.2f seconds (%.2f KBit/sec)", totalBytesWritten, seconds, bytesPerSecond*8/1024)
+		if _, wireBytes := cfr.fc.TransferStats(); opts.EnableCompression && totalBytesWritten > 0 {
+			wireBytes -= wireBytesBefore
+			opts.Reportf("Sent %d bytes, %.1f%% less than uncompressed",
+				wireBytes, 100-float64(wireBytes)*100/float64(totalBytesWritten))
+		}
+		if numBytesVerified > 0 {
+			reportVerifyStats(opts, numBytesVerified, verifyTime)
+		}
 	}
 
-	if !opts.NoVerify {
-		common.Reportf("Verifying...")
+	if opts.Verify == esp.VerifyAlways || opts.Verify == "" {
+		opts.Reportf("Verifying...")
 		numBytes := 0
 		start := time.Now()
 		for _, im := range images {
 			numBytes += len(im.Data)
-			common.Reportf("  %7d @ 0x%x", len(im.Data), im.Addr)
-			addr, done := im.Addr, 0
-			for done < len(im.Data) {
-				size := len(im.Data) - done
-				if size > 0x100000 {
-					size = 0x100000
-				}
-				data := im.Data[done : done+size]
-				digest, err := cfr.fc.Digest(addr, uint32(size), 0 /* blockSize */)
-				if err != nil {
-					return errors.Annotatef(err, "%s: failed to compute digest %d @ 0x%x", im.Name, size, addr)
-				}
-				if len(digest) != 1 || len(digest[0]) != 16 {
-					return errors.Errorf("unexpected digest packetresult %+v", digest)
-				}
-				digestHex := strings.ToLower(hex.EncodeToString(digest[0]))
-				expectedDigest := md5.Sum(data)
-				expectedDigestHex := strings.ToLower(hex.EncodeToString(expectedDigest[:]))
-				if digestHex != expectedDigestHex {
-					return errors.Errorf("%d @ 0x%x: digest mismatch: expected %s, got %s", size, addr, expectedDigestHex, digestHex)
-				}
-				addr += uint32(size)
-				done += size
+			opts.Reportf("  %7d @ 0x%x", len(im.Data), im.Addr)
+			if err := verifyData(cfr.fc, im.Name, im.Addr, im.Data); err != nil {
+				return errors.Trace(err)
 			}
 		}
-		elapsed := time.Since(start)
-		glog.Infof("Verified %d bytes in %s, %.2f Kbit/sec", numBytes, elapsed, float64(numBytes*8)/elapsed.Seconds()/1000)
+		reportVerifyStats(opts, numBytes, time.Since(start))
 	}
 
 	if opts.BootFirmware {
-		common.Reportf("Booting firmware...")
+		opts.Reportf("Booting firmware...")
 		if err = cfr.fc.BootFirmware(); err != nil {
 			return errors.Annotatef(err, "failed to reboot into firmware")
 		}
@@ -315,6 +364,74 @@ func writeImages(ct esp.ChipType, cfr *cfResult, images []*image, opts *esp.Flas
 	return nil
 }
 
+// verifyData checks that flash contents at addr match data.
+func verifyData(fc *FlasherClient, name string, addr uint32, data []byte) error {
+	for done := 0; done < len(data); {
+		size := len(data) - done
+		if size > 0x100000 {
+			size = 0x100000
+		}
+		digest, err := fc.Digest(addr, uint32(size), 0 /* blockSize */)
+		if err != nil {
+			return errors.Annotatef(err, "%s: failed to compute digest %d @ 0x%x", name, size, addr)
+		}
+		if len(digest) != 1 || len(digest[0]) != 16 {
+			return errors.Errorf("unexpected digest packetresult %+v", digest)
+		}
+		digestHex := strings.ToLower(hex.EncodeToString(digest[0]))
+		expectedDigest := md5.Sum(data[done : done+size])
+		expectedDigestHex := strings.ToLower(hex.EncodeToString(expectedDigest[:]))
+		if digestHex != expectedDigestHex {
+			return errcode.Errorf(errcode.FlashVerifyFailed, "%d @ 0x%x: digest mismatch: expected %s, got %s", size, addr, expectedDigestHex, digestHex)
+		}
+		addr += uint32(size)
+		done += size
+	}
+	return nil
+}
+
+// compareImages compares flash contents with the images, printing a table of
+// expected and actual digests. Nothing is written.
+func compareImages(fc *FlasherClient, images []*image, opts *esp.FlashOpts) error {
+	opts.Reportf("Comparing flash contents with the firmware...")
+	opts.Reportf("  %-16s %-10s %8s  %-32s  %-32s", "Name", "Address", "Size", "Expected MD5", "Actual MD5")
+	numDiffer := 0
+	for _, im := range images {
+		expectedDigest := md5.Sum(im.Data)
+		expectedDigestHex := hex.EncodeToString(expectedDigest[:])
+		digest, err := fc.Digest(im.Addr, uint32(len(im.Data)), 0 /* blockSize */)
+		if err != nil {
+			return errors.Annotatef(err, "%s: failed to compute digest %d @ 0x%x", im.Name, len(im.Data), im.Addr)
+		}
+		if len(digest) != 1 || len(digest[0]) != 16 {
+			return errors.Errorf("unexpected digest packetresult %+v", digest)
+		}
+		digestHex := strings.ToLower(hex.EncodeToString(digest[0]))
+		status := "ok"
+		if digestHex != expectedDigestHex {
+			status = "DIFFERENT"
+			numDiffer++
+		}
+		opts.Reportf("  %-16s 0x%08x %8d  %s  %s  %s", im.Name, im.Addr, len(im.Data), expectedDigestHex, digestHex, status)
+	}
+	if numDiffer > 0 {
+		return errcode.Errorf(errcode.FlashVerifyFailed, "%d of %d sections differ", numDiffer, len(images))
+	}
+	opts.Reportf("Flash contents match the firmware")
+	if opts.BootFirmware {
+		opts.Reportf("Booting firmware...")
+		if err := fc.BootFirmware(); err != nil {
+			return errors.Annotatef(err, "failed to reboot into firmware")
+		}
+	}
+	return nil
+}
+
+func reportVerifyStats(opts *esp.FlashOpts, numBytes int, elapsed time.Duration) {
+	opts.Reportf("Verified %d bytes in %.2f seconds (%.2f KBit/sec)",
+		numBytes, elapsed.Seconds(), float64(numBytes*8)/elapsed.Seconds()/1024)
+}
+
 func adjustSysParamsLocation(fw *fwbundle.FirmwareBundle, flashSize int) {
 	sysParamsAddr := uint32(flashSize - sysParamsAreaSize)
 	for _, p := range fw.Parts {
@@ -343,7 +460,7 @@ func sanityCheckImages(ct esp.ChipType, images []*image, flashSize, flashSectorS
 		imageEnd := imageBegin + len(im.Data)
 		if imageBegin >= flashSize || imageEnd > flashSize {
 			return errors.Errorf(
-				"Image %d @ 0x%x will not fit in flash (size %d)", len(im.Data), imageBegin, flashSize)
+				"%s: image %d @ 0x%x will not fit in flash (size %d)", im.Name, len(im.Data), imageBegin, flashSize)
 		}
 		if imageBegin%flashSectorSize != 0 {
 			return errors.Errorf("Image starting address (0x%x) is not on flash sector boundary (sector size %d)",
@@ -369,7 +486,8 @@ func sanityCheckImages(ct esp.ChipType, images []*image, flashSize, flashSectorS
 			prevImageEnd := prevImageBegin + len(images[i-1].Data)
 			// We traverse the list in order, so a simple check will suffice.
 			if prevImageEnd > imageBegin {
-				return errors.Errorf("Images 0x%x and 0x%x overlap", prevImageBegin, imageBegin)
+				return errors.Errorf("Images %s (0x%x-0x%x) and %s (0x%x-0x%x) overlap",
+					images[i-1].Name, prevImageBegin, prevImageEnd, im.Name, imageBegin, imageEnd)
 			}
 		}
 	}
@@ -441,7 +559,7 @@ func dedupImages(fc *FlasherClient, images []*image) ([]*image, error) {
 		// is substantial, don't bother.
 		if newTotalLen < len(im.Data) && (newTotalLen < flashBlockSize || len(im.Data)-newTotalLen >= flashBlockSize) {
 			dedupedImages = append(dedupedImages, newImages...)
-			common.Reportf("  %7d @ 0x%x -> %d", len(im.Data), im.Addr, newTotalLen)
+			fc.rom.Reportf("  %7d @ 0x%x -> %d", len(im.Data), im.Addr, newTotalLen)
 		} else {
 			dedupedImages = append(dedupedImages, im)
 		}
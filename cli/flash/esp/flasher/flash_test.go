@@ -0,0 +1,45 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package flasher
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mongoose-os/mos/cli/flash/esp"
+)
+
+func TestSanityCheckImages(t *testing.T) {
+	boot := &image{Name: "boot", Addr: 0x1000, Data: make([]byte, 0x4000)}
+	app := &image{Name: "app", Addr: 0x10000, Data: make([]byte, 0x300000)}
+
+	// 4MB image fits on a 4MB chip...
+	if err := sanityCheckImages(esp.ChipESP32, []*image{app, boot}, 0x400000, flashSectorSize); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	// ...but not on a 2MB one.
+	err := sanityCheckImages(esp.ChipESP32, []*image{app, boot}, 0x200000, flashSectorSize)
+	if err == nil || !strings.Contains(err.Error(), "app: ") {
+		t.Errorf("expected an error about app, got %v", err)
+	}
+
+	fs := &image{Name: "fs", Addr: 0x200000, Data: make([]byte, 0x10000)}
+	err = sanityCheckImages(esp.ChipESP32, []*image{boot, app, fs}, 0x400000, flashSectorSize)
+	if err == nil || !strings.Contains(err.Error(), "overlap") {
+		t.Errorf("expected an overlap error, got %v", err)
+	}
+}
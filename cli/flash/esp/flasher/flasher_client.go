@@ -32,6 +32,7 @@ import (
 	"github.com/juju/errors"
 	glog "k8s.io/klog/v2"
 
+	"github.com/mongoose-os/mos/cli/errcode"
 	"github.com/mongoose-os/mos/cli/flash/common"
 	"github.com/mongoose-os/mos/cli/flash/esp"
 	"github.com/mongoose-os/mos/cli/flash/esp/rom_client"
@@ -57,6 +58,11 @@ const (
 	// This is made small to workaround slow Mac driver
 	flashReadSize     = 1024
 	flashReadAttempts = 5
+
+	// Status code returned by the stub when it fails to inflate a block,
+	// i.e. the data got corrupted on the way. The stub is always built
+	// with compression support.
+	stubErrDecompress = 0x39
 )
 
 /* Decls from stub_flasher.h */
@@ -80,36 +86,54 @@ type FlasherClient struct {
 	srw       *common.SLIPReaderWriter
 	rom       *rom_client.ROMClient
 	connected bool
+	// UART clock used by the ROM loader, as reported by the stub, 0 if not known.
+	romUARTClk uint32
+
+	// Total number of bytes written and sent over the wire by Write.
+	numBytesWritten   int
+	numBytesOnTheWire int
 }
 
-func NewFlasherClient(ct esp.ChipType, rc *rom_client.ROMClient, romBaudRate uint, baudRate uint) (*FlasherClient, error) {
+// NewFlasherClient runs the flasher stub and connects to it. If stubJSON is
+// nil, the built-in stub for the chip is used.
+func NewFlasherClient(ct esp.ChipType, rc *rom_client.ROMClient, stubJSON []byte, romBaudRate uint, baudRate uint) (*FlasherClient, error) {
 	if baudRate < 0 || baudRate > 4000000 {
 		return nil, errors.Errorf("invalid flashing baud rate (%d)", baudRate)
 	}
 	fc := &FlasherClient{ct: ct, s: rc.DataPort(), srw: common.NewSLIPReaderWriter(rc.DataPort()), rom: rc}
-	if err := fc.connect(romBaudRate, baudRate); err != nil {
+	if err := fc.connect(stubJSON, romBaudRate, baudRate); err != nil {
 		return nil, errors.Trace(err)
 	}
 	return fc, nil
 }
 
-func (fc *FlasherClient) connect(romBaudRate, baudRate uint) error {
-	var stubJSON []byte
-	switch fc.ct {
+// getStubJSON returns stubJSON if it is set, the built-in stub for the chip
+// otherwise.
+func getStubJSON(ct esp.ChipType, stubJSON []byte) ([]byte, error) {
+	if stubJSON != nil {
+		return stubJSON, nil
+	}
+	switch ct {
 	case esp.ChipESP32:
-		stubJSON = esp32.MustAsset("stub/stub.json")
+		return esp32.MustAsset("stub/stub.json"), nil
 	case esp.ChipESP32S3:
-		stubJSON = esp32s3.MustAsset("stub/stub.json")
+		return esp32s3.MustAsset("stub/stub.json"), nil
 	case esp.ChipESP32C3:
-		stubJSON = esp32c3.MustAsset("stub/stub.json")
+		return esp32c3.MustAsset("stub/stub.json"), nil
 	case esp.ChipESP8266:
-		stubJSON = esp8266.MustAsset("stub/stub.json")
-	default:
-		return errors.Errorf("unknown chip type %d", fc.ct)
+		return esp8266.MustAsset("stub/stub.json"), nil
+	}
+	return nil, errors.Errorf("unknown chip type %d", ct)
+}
+
+func (fc *FlasherClient) connect(stubJSON []byte, romBaudRate, baudRate uint) error {
+	stubJSON, err := getStubJSON(fc.ct, stubJSON)
+	if err != nil {
+		return errors.Trace(err)
 	}
 
-	common.Reportf("Running flasher @ %d...", baudRate)
-	err := fc.rom.RunStub(stubJSON, []uint32{uint32(romBaudRate), uint32(baudRate)})
+	fc.rom.Reportf("Running flasher @ %d...", baudRate)
+	err = fc.rom.RunStub(stubJSON, []uint32{uint32(romBaudRate), uint32(baudRate)})
 	if err != nil {
 		return errors.Annotatef(err, "failed to run flasher stub")
 	}
@@ -130,12 +154,13 @@ func (fc *FlasherClient) connect(romBaudRate, baudRate uint) error {
 			}
 			masterCLK := uint32(romBaudRate) * uint32(oldUARTdivF)
 			glog.V(1).Infof("Previous UART divider: %.3f (0x%x), master clk: %d", oldUARTdivF, oldUARTDiv, masterCLK)
+			fc.romUARTClk = masterCLK
 		}
 	}
 	if err = fc.Sync(); err != nil {
 		return errors.Annotatef(err, "failed to talk to flasher")
 	}
-	common.Reportf("  Flasher is running")
+	fc.rom.Reportf("  Flasher is running")
 	fc.connected = true
 	return nil
 }
@@ -271,7 +296,7 @@ sync:
 			}
 		}
 	}
-	return errors.Errorf("flasher did not respond")
+	return errcode.Errorf(errcode.FlashNoResponse, "flasher did not respond")
 }
 
 func (fc *FlasherClient) Write(addr uint32, data []byte, erase bool, compress bool) (int, error) {
@@ -296,6 +321,9 @@ func (fc *FlasherClient) Write(addr uint32, data []byte, erase bool, compress bo
 		if err != nil {
 			return numWritten, errors.Annotatef(err, "flash write failed @ %d/%d", numWritten, numSent)
 		}
+		if n == 1 && buf[0] == stubErrDecompress {
+			return numWritten, errors.Errorf("flasher failed to decompress data @ %d/%d", numWritten, numSent)
+		}
 		if n < len(buf) {
 			return numWritten, errors.Errorf("invalid write progress packet %q", hex.EncodeToString(buf[:n]))
 		}
@@ -368,6 +396,7 @@ func (fc *FlasherClient) Write(addr uint32, data []byte, erase bool, compress bo
 			numSent += numToSend
 			canSend -= numToSend
 			numBytesOnTheWire += ns
+			fc.numBytesOnTheWire += ns
 			glog.V(3).Infof("=> %d; %d/%d/%d", ns, numWritten, numSent, len(data))
 		}
 	}
@@ -402,9 +431,16 @@ func (fc *FlasherClient) Write(addr uint32, data []byte, erase bool, compress bo
 		result.totalTime,
 		float64(numBytesOnTheWire)/float64(numWritten),
 	)
+	fc.numBytesWritten += numWritten
 	return numWritten, nil
 }
 
+// TransferStats returns the total number of bytes successfully written
+// and the number of bytes sent to the stub to do so.
+func (fc *FlasherClient) TransferStats() (int, int) {
+	return fc.numBytesWritten, fc.numBytesOnTheWire
+}
+
 func (fc *FlasherClient) Read(addr uint32, data []byte) error {
 	if !fc.connected {
 		return errors.New("not connected")
@@ -25,11 +25,27 @@ import (
 )
 
 func ReadFlash(ct esp.ChipType, addr uint32, length int, opts *esp.FlashOpts) ([]byte, error) {
-	if addr < 0 {
-		return nil, errors.Errorf("invalid addr: %d", addr)
+	res, err := ReadFlashRegions(ct, []FlashRegion{{Addr: addr, Length: length}}, opts)
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
-	if length < 0 {
-		return nil, errors.Errorf("invalid addr: %d", length)
+	return res[0], nil
+}
+
+// FlashRegion is a region of flash to read. Zero address and length mean the
+// entire flash, according to the flash params.
+type FlashRegion struct {
+	Addr   uint32
+	Length int
+}
+
+// ReadFlashRegions reads the given regions over a single flasher connection.
+// Returns the data of each region, in order.
+func ReadFlashRegions(ct esp.ChipType, regions []FlashRegion, opts *esp.FlashOpts) ([][]byte, error) {
+	for _, r := range regions {
+		if r.Length < 0 {
+			return nil, errors.Errorf("invalid length: %d", r.Length)
+		}
 	}
 
 	cfr, err := ConnectToFlasherClient(ct, opts)
@@ -39,20 +55,74 @@ func ReadFlash(ct esp.ChipType, addr uint32, length int, opts *esp.FlashOpts) ([
 	defer cfr.rc.Disconnect()
 
 	flashSize := cfr.flashParams.Size()
-	if addr == 0 && length == 0 {
-		length = flashSize
-	} else if int(addr)+length > flashSize {
-		return nil, errors.Errorf("0x%x + %d exceeds flash size (%d)", addr, length, flashSize)
+	var res [][]byte
+	for _, r := range regions {
+		addr, length := r.Addr, r.Length
+		if addr == 0 && length == 0 {
+			length = flashSize
+		} else if int(addr)+length > flashSize {
+			return nil, errors.Errorf("0x%x + %d exceeds flash size (%d)", addr, length, flashSize)
+		}
+
+		common.Reportf("Reading %d @ 0x%x...", length, addr)
+		data := make([]byte, length)
+		start := time.Now()
+		if err := cfr.fc.Read(addr, data); err != nil {
+			return nil, errors.Annotatef(err, "failed to read %d @ 0x%x", length, addr)
+		}
+		seconds := time.Since(start).Seconds()
+		bytesPerSecond := float64(len(data)) / seconds
+		common.Reportf("Read %d bytes in %.2f seconds (%.2f KBit/sec)", length, seconds, bytesPerSecond*8/1024)
+		res = append(res, data)
+	}
+	return res, nil
+}
+
+// FlashChipInfo describes the flash chip, as detected by ReadWholeFlash.
+type FlashChipInfo struct {
+	ChipID uint32 `json:"chip_id"`
+	Mfg    int    `json:"mfg"`
+	Size   int    `json:"size"`
+}
+
+// ReadWholeFlash detects the size of the flash chip and reads all of it,
+// reporting progress along the way.
+func ReadWholeFlash(ct esp.ChipType, opts *esp.FlashOpts) ([]byte, *FlashChipInfo, error) {
+	cfr, err := ConnectToFlasherClient(ct, opts)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	defer cfr.rc.Disconnect()
+
+	chipID, err := cfr.fc.GetFlashChipID()
+	if err != nil {
+		return nil, nil, errors.Annotatef(err, "failed to get flash chip id")
+	}
+	mfg, flashSize, err := detectFlashSize(cfr.fc)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if ps := cfr.flashParams.Size(); ps != flashSize {
+		common.Reportf("Note: flash params size (%d) differs from the detected chip size (%d), reading %d", ps, flashSize, flashSize)
 	}
+	info := &FlashChipInfo{ChipID: chipID, Mfg: mfg, Size: flashSize}
+	common.Reportf("Flash chip ID: 0x%08x, size: %d", chipID, flashSize)
 
-	common.Reportf("Reading %d @ 0x%x...", length, addr)
-	data := make([]byte, length)
+	const chunkSize = 0x40000
+	data := make([]byte, flashSize)
 	start := time.Now()
-	if err := cfr.fc.Read(uint32(addr), data); err != nil {
-		return nil, errors.Annotatef(err, "failed to read %d @ 0x%x", length, addr)
+	for addr := 0; addr < flashSize; addr += chunkSize {
+		n := chunkSize
+		if addr+n > flashSize {
+			n = flashSize - addr
+		}
+		if err := cfr.fc.Read(uint32(addr), data[addr:addr+n]); err != nil {
+			return nil, nil, errors.Annotatef(err, "failed to read %d @ 0x%x", n, addr)
+		}
+		common.Reportf("  %7d / %d (%d%%)", addr+n, flashSize, (addr+n)*100/flashSize)
 	}
 	seconds := time.Since(start).Seconds()
 	bytesPerSecond := float64(len(data)) / seconds
-	common.Reportf("Read %d bytes in %.2f seconds (%.2f KBit/sec)", length, seconds, bytesPerSecond*8/1024)
-	return data, nil
+	common.Reportf("Read %d bytes in %.2f seconds (%.2f KBit/sec)", len(data), seconds, bytesPerSecond*8/1024)
+	return data, info, nil
 }
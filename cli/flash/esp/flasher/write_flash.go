@@ -36,5 +36,28 @@ func WriteFlash(ct esp.ChipType, addr uint32, data []byte, opts *esp.FlashOpts)
 		Data:         data,
 		ESP32Encrypt: (opts.ESP32EncryptionKeyFile != ""),
 	}
-	return errors.Trace(writeImages(ct, cfr, []*image{im}, opts, false))
+	return errors.Trace(writeImages(cfr.ct, cfr, []*image{im}, opts, false))
+}
+
+// WriteFlashImage writes a raw image, such as a full flash dump obtained with
+// ReadFlash, at the given address. Unlike WriteFlash, the data is not
+// modified in any way: flash params are not patched and no encryption is
+// applied. Written data is verified as requested by opts.Verify.
+func WriteFlashImage(ct esp.ChipType, addr uint32, data []byte, opts *esp.FlashOpts) error {
+	cfr, err := ConnectToFlasherClient(ct, opts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer cfr.rc.Disconnect()
+	if flashSize := cfr.flashParams.Size(); int(addr)+len(data) > flashSize {
+		return errors.Errorf("0x%x + %d exceeds flash size (%d)", addr, len(data), flashSize)
+	}
+	im := &image{
+		Name: "image",
+		Type: "raw",
+		Addr: addr,
+		Data: data,
+		Raw:  true,
+	}
+	return errors.Trace(writeImages(cfr.ct, cfr, []*image{im}, opts, false))
 }
@@ -28,6 +28,7 @@ import (
 
 	"github.com/cesanta/go-serial/serial"
 	"github.com/juju/errors"
+	"github.com/mongoose-os/mos/cli/errcode"
 	"github.com/mongoose-os/mos/cli/flash/common"
 	"github.com/mongoose-os/mos/cli/flash/esp"
 	"github.com/mongoose-os/mos/cli/flash/esp32"
@@ -69,6 +70,7 @@ type ROMClient struct {
 	srw       *common.SLIPReaderWriter
 	connected bool
 	inverted  bool
+	reportf   func(f string, args ...interface{})
 }
 
 type romResponse struct {
@@ -89,7 +91,7 @@ func ConnectToROM(ct esp.ChipType, opts *esp.FlashOpts) (*ROMClient, error) {
 	}
 	scOpts := commonOpts
 	scOpts.PortName = opts.ControlPort
-	common.Reportf("Opening %s @ %d...", scOpts.PortName, opts.ROMBaudRate)
+	opts.Reportf("Opening %s @ %d...", scOpts.PortName, opts.ROMBaudRate)
 	sc, err := serial.Open(scOpts)
 	if err != nil {
 		return nil, errors.Annotate(err, "failed to open control port")
@@ -98,14 +100,14 @@ func ConnectToROM(ct esp.ChipType, opts *esp.FlashOpts) (*ROMClient, error) {
 	if opts.DataPort != "" {
 		sdOpts := commonOpts
 		sdOpts.PortName = opts.DataPort
-		common.Reportf("Opening %s...", sdOpts.PortName)
+		opts.Reportf("Opening %s...", sdOpts.PortName)
 		sd, err = serial.Open(sdOpts)
 		if err != nil {
 			sc.Close()
 			return nil, errors.Annotate(err, "failed to open data port")
 		}
 	}
-	rc, err := NewROMClient(ct, sc, sd, opts.InvertedControlLines)
+	rc, err := newROMClient(ct, sc, sd, opts.InvertedControlLines, opts.Reportf)
 	if err != nil {
 		sc.Close()
 		sd.Close()
@@ -115,12 +117,17 @@ func ConnectToROM(ct esp.ChipType, opts *esp.FlashOpts) (*ROMClient, error) {
 }
 
 func NewROMClient(chipType esp.ChipType, sc, sd serial.Serial, inverted bool) (*ROMClient, error) {
+	return newROMClient(chipType, sc, sd, inverted, common.Reportf)
+}
+
+func newROMClient(chipType esp.ChipType, sc, sd serial.Serial, inverted bool, reportf func(f string, args ...interface{})) (*ROMClient, error) {
 	rc := &ROMClient{
 		ct:       chipType,
 		sc:       sc,
 		sd:       sd,
 		srw:      common.NewSLIPReaderWriter(sd),
 		inverted: inverted,
+		reportf:  reportf,
 	}
 	if err := rc.connect(); err != nil {
 		return nil, errors.Annotatef(err, "failed to connect to ROM")
@@ -132,6 +139,11 @@ func (rc *ROMClient) DataPort() serial.Serial {
 	return rc.sd
 }
 
+// Reportf reports progress of the operations on this device.
+func (rc *ROMClient) Reportf(f string, args ...interface{}) {
+	rc.reportf(f, args...)
+}
+
 func (rc *ROMClient) connect() error {
 	rc.connected = false
 	rc.sd.SetReadTimeout(200 * time.Millisecond)
@@ -140,7 +152,7 @@ func (rc *ROMClient) connect() error {
 		if rc.inverted {
 			is = " (inverted)"
 		}
-		common.Reportf("Connecting to %s ROM, attempt %d of %d%s...", rc.ct, i, numConnectAttempts, is)
+		rc.Reportf("Connecting to %s ROM, attempt %d of %d%s...", rc.ct, i, numConnectAttempts, is)
 		mFalse := rc.inverted
 		mTrue := !rc.inverted
 		rc.sc.SetRTSDTR(mTrue, mFalse)
@@ -165,13 +177,13 @@ func (rc *ROMClient) connect() error {
 			if err != nil {
 				return errors.Annotatef(err, "failed to read chip type")
 			}
-			common.Reportf("  Connected, chip: %s", cd)
+			rc.Reportf("  Connected, chip: %s", cd)
 			return nil
 		} else {
 			glog.V(1).Infof("Sync #%d failed: %s", i, err)
 		}
 	}
-	return errors.Errorf("failed to connect to %s ROM", rc.ct)
+	return errcode.Errorf(errcode.FlashNoResponse, "failed to connect to %s ROM", rc.ct)
 }
 
 func (rc *ROMClient) Disconnect() {
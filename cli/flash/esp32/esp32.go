@@ -45,36 +45,45 @@ var (
 )
 
 func GetChipDescr(rrw esp.RegReaderWriter) (string, error) {
+	ci, err := GetChipInfo(rrw)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return fmt.Sprintf("%s R%d", ci.Descr, ci.Revision), nil
+}
+
+// GetChipInfo detects the chip package and revision and reads the base MAC address.
+func GetChipInfo(rrw esp.RegReaderWriter) (*esp.ChipInfo, error) {
 	_, _, fusesByName, err := ReadFuses(rrw)
 	if err != nil {
-		return "", errors.Annotatef(err, "failed to read eFuses")
+		return nil, errors.Annotatef(err, "failed to read eFuses")
 	}
 	cpkg02, err := fusesByName["chip_pkg02"].Value(false)
 	if err != nil {
-		return "", errors.Annotatef(err, "failed to get chip_pkg02")
+		return nil, errors.Annotatef(err, "failed to get chip_pkg02")
 	}
 	cpkg3, err := fusesByName["chip_pkg3"].Value(false)
 	if err != nil {
-		return "", errors.Annotatef(err, "failed to get chip_pkg3")
+		return nil, errors.Annotatef(err, "failed to get chip_pkg3")
 	}
 	disable_app_cpu, err := fusesByName["disable_app_cpu"].Value(false)
 	if err != nil {
-		return "", errors.Annotatef(err, "failed to get disable_app_cpu")
+		return nil, errors.Annotatef(err, "failed to get disable_app_cpu")
 	}
 	cpkg := (cpkg3.Uint64() << 3) | cpkg02.Uint64()
 	single_core := (disable_app_cpu.Uint64() == 1)
 
 	crev1, err := fusesByName["chip_rev1"].Value(false)
 	if err != nil {
-		return "", errors.Annotatef(err, "failed to get chip_rev0")
+		return nil, errors.Annotatef(err, "failed to get chip_rev0")
 	}
 	crev2, err := fusesByName["chip_rev2"].Value(false)
 	if err != nil {
-		return "", errors.Annotatef(err, "failed to get chip_rev1")
+		return nil, errors.Annotatef(err, "failed to get chip_rev1")
 	}
 	apb_ctl_date, err := rrw.ReadReg(0x3ff6607c)
 	if err != nil {
-		return "", errors.Annotatef(err, "failed to read apb_ctl_date")
+		return nil, errors.Annotatef(err, "failed to read apb_ctl_date")
 	}
 	chip_rev := 0
 	if crev1.Uint64() != 0 {
@@ -117,5 +126,17 @@ func GetChipDescr(rrw esp.RegReaderWriter) (string, error) {
 		chip_pkg = fmt.Sprintf("ESP32?%d", cpkg)
 	}
 
-	return fmt.Sprintf("%s R%d", chip_pkg, chip_rev), nil
+	return &esp.ChipInfo{
+		Descr:    chip_pkg,
+		Revision: chip_rev,
+		MAC:      fusesByName[MACAddressFuseName].MACAddressString(),
+		VariantFuses: []esp.FuseValue{
+			{Name: "chip_pkg02", Value: cpkg02.Uint64()},
+			{Name: "chip_pkg3", Value: cpkg3.Uint64()},
+			{Name: "disable_app_cpu", Value: disable_app_cpu.Uint64()},
+			{Name: "chip_rev1", Value: crev1.Uint64()},
+			{Name: "chip_rev2", Value: crev2.Uint64()},
+			{Name: "apb_ctl_date", Value: uint64(apb_ctl_date)},
+		},
+	}, nil
 }
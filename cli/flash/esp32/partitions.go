@@ -50,11 +50,15 @@ type ESPPartitionInfo struct {
 	Flags   uint32
 }
 
-func GetPartitionInfo(fw *fwbundle.FirmwareBundle, name string) (*ESPPartitionInfo, error) {
-	data, err := fw.GetPartData(espPartitionTablePartName)
-	if err != nil {
-		return nil, errors.Errorf("no partition table in the fw bundle")
-	}
+// Name returns the partition label as a string.
+func (pte *ESPPartitionInfo) Name() string {
+	return strings.TrimRight(string(pte.Label[:]), "\x00")
+}
+
+// ParsePartitionTable parses binary partition table data.
+// Parsing stops at the first entry without the partition magic (the MD5 entry or padding).
+func ParsePartitionTable(data []byte) []*ESPPartitionInfo {
+	var res []*ESPPartitionInfo
 	ptb := bytes.NewBuffer(data)
 	for {
 		var pte ESPPartitionInfo
@@ -68,10 +72,31 @@ func GetPartitionInfo(fw *fwbundle.FirmwareBundle, name string) (*ESPPartitionIn
 		binary.Read(ptb, binary.LittleEndian, &pte.Pos.Size)
 		ptb.Read(pte.Label[:])
 		binary.Read(ptb, binary.LittleEndian, &pte.Flags)
-		ptn := strings.TrimRight(string(pte.Label[:]), "\x00")
-		glog.V(2).Infof("pt %q - %d @ 0x%x", ptn, pte.Pos.Size, pte.Pos.Offset)
-		if ptn == name {
-			return &pte, nil
+		glog.V(2).Infof("pt %q - %d @ 0x%x", pte.Name(), pte.Pos.Size, pte.Pos.Offset)
+		res = append(res, &pte)
+	}
+	return res
+}
+
+// SetPartitionTable replaces the partition table of the fw bundle.
+// Parts that specify partition names will be resolved against the new table.
+func SetPartitionTable(fw *fwbundle.FirmwareBundle, data []byte) error {
+	p := fw.Parts[espPartitionTablePartName]
+	if p == nil {
+		return errors.Errorf("no partition table in the fw bundle")
+	}
+	p.SetData(data)
+	return nil
+}
+
+func GetPartitionInfo(fw *fwbundle.FirmwareBundle, name string) (*ESPPartitionInfo, error) {
+	data, err := fw.GetPartData(espPartitionTablePartName)
+	if err != nil {
+		return nil, errors.Errorf("no partition table in the fw bundle")
+	}
+	for _, pte := range ParsePartitionTable(data) {
+		if pte.Name() == name {
+			return pte, nil
 		}
 	}
 	return nil, errors.Errorf("partition %q not found", name)
@@ -0,0 +1,232 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// +build !noflash
+
+package esp32
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Partition table CSV format is the same as used by ESP-IDF:
+// https://docs.espressif.com/projects/esp-idf/en/latest/esp32/api-guides/partition-tables.html
+
+const (
+	espPartitionTableMaxLen             = 0xc00
+	espPartitionTableEntryLen           = 32
+	espPartitionTableFirstOffset        = 0x9000
+	espPartitionMD5Magic         uint16 = 0xebeb
+
+	espPartitionTypeApp  uint8 = 0x00
+	espPartitionTypeData uint8 = 0x01
+
+	espPartitionFlagEncrypted uint32 = 0x1
+
+	espPartitionAlignData = 0x1000
+	espPartitionAlignApp  = 0x10000
+)
+
+var espPartitionTypes = map[string]uint8{
+	"app":  espPartitionTypeApp,
+	"data": espPartitionTypeData,
+}
+
+var espPartitionSubtypes = map[uint8]map[string]uint8{
+	espPartitionTypeApp: {
+		"factory": 0x00,
+		"test":    0x20,
+	},
+	espPartitionTypeData: {
+		"ota":      0x00,
+		"phy":      0x01,
+		"nvs":      0x02,
+		"coredump": 0x03,
+		"nvs_keys": 0x04,
+		"efuse":    0x05,
+		"esphttpd": 0x80,
+		"fat":      0x81,
+		"spiffs":   0x82,
+	},
+}
+
+func init() {
+	for i := 0; i < 16; i++ {
+		espPartitionSubtypes[espPartitionTypeApp][fmt.Sprintf("ota_%d", i)] = uint8(0x10 + i)
+	}
+}
+
+// parsePartitionNumber parses a number in decimal or hex, with optional K or M suffix.
+func parsePartitionNumber(s string) (uint32, error) {
+	mult := uint64(1)
+	switch {
+	case strings.HasSuffix(s, "K") || strings.HasSuffix(s, "k"):
+		mult, s = 1024, s[:len(s)-1]
+	case strings.HasSuffix(s, "M") || strings.HasSuffix(s, "m"):
+		mult, s = 1024*1024, s[:len(s)-1]
+	}
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, errors.Errorf("invalid number %q", s)
+	}
+	v *= mult
+	if v > 0xffffffff {
+		return 0, errors.Errorf("%q is too large", s)
+	}
+	return uint32(v), nil
+}
+
+func parsePartitionType(s string) (uint8, error) {
+	if t, ok := espPartitionTypes[s]; ok {
+		return t, nil
+	}
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, errors.Errorf("invalid partition type %q", s)
+	}
+	return uint8(v), nil
+}
+
+func parsePartitionSubtype(t uint8, s string) (uint8, error) {
+	if st, ok := espPartitionSubtypes[t][s]; ok {
+		return st, nil
+	}
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, errors.Errorf("invalid partition subtype %q", s)
+	}
+	return uint8(v), nil
+}
+
+// ParsePartitionTableCSV parses partition table in the ESP-IDF CSV format.
+// Offset may be omitted, in which case the partition is placed right after the previous one.
+func ParsePartitionTableCSV(r io.Reader) ([]*ESPPartitionInfo, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var res []*ESPPartitionInfo
+	names := map[string]bool{}
+	nextOffset := uint32(espPartitionTableFirstOffset)
+	for i, rec := range records {
+		for j := range rec {
+			rec[j] = strings.TrimSpace(rec[j])
+		}
+		if len(rec) < 5 {
+			return nil, errors.Errorf("line %d: expected at least 5 fields, got %d", i+1, len(rec))
+		}
+		pte := &ESPPartitionInfo{Magic: ESPPartitionMagic}
+		name := rec[0]
+		if name == "" || len(name) > len(pte.Label) {
+			return nil, errors.Errorf("line %d: invalid partition name %q", i+1, name)
+		}
+		if names[name] {
+			return nil, errors.Errorf("line %d: duplicate partition name %q", i+1, name)
+		}
+		names[name] = true
+		copy(pte.Label[:], name)
+		if pte.Type, err = parsePartitionType(rec[1]); err != nil {
+			return nil, errors.Annotatef(err, "line %d", i+1)
+		}
+		if pte.Subtype, err = parsePartitionSubtype(pte.Type, rec[2]); err != nil {
+			return nil, errors.Annotatef(err, "line %d", i+1)
+		}
+		align := uint32(espPartitionAlignData)
+		if pte.Type == espPartitionTypeApp {
+			align = espPartitionAlignApp
+		}
+		if rec[3] != "" {
+			if pte.Pos.Offset, err = parsePartitionNumber(rec[3]); err != nil {
+				return nil, errors.Annotatef(err, "line %d: offset", i+1)
+			}
+		} else {
+			pte.Pos.Offset = (nextOffset + align - 1) / align * align
+		}
+		if pte.Pos.Offset%align != 0 {
+			return nil, errors.Errorf("line %d: offset 0x%x is not aligned to 0x%x", i+1, pte.Pos.Offset, align)
+		}
+		if pte.Pos.Size, err = parsePartitionNumber(rec[4]); err != nil {
+			return nil, errors.Annotatef(err, "line %d: size", i+1)
+		}
+		if pte.Pos.Size == 0 {
+			return nil, errors.Errorf("line %d: partition size must not be 0", i+1)
+		}
+		if len(rec) > 5 {
+			for _, f := range strings.Fields(strings.Replace(rec[5], ":", " ", -1)) {
+				switch f {
+				case "encrypted":
+					pte.Flags |= espPartitionFlagEncrypted
+				default:
+					return nil, errors.Errorf("line %d: unknown flag %q", i+1, f)
+				}
+			}
+		}
+		nextOffset = pte.Pos.Offset + pte.Pos.Size
+		res = append(res, pte)
+	}
+	if len(res) == 0 {
+		return nil, errors.Errorf("partition table is empty")
+	}
+	if err := checkPartitionOverlaps(res); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return res, nil
+}
+
+func checkPartitionOverlaps(ptes []*ESPPartitionInfo) error {
+	sorted := append([]*ESPPartitionInfo{}, ptes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Pos.Offset < sorted[j].Pos.Offset })
+	for i := 1; i < len(sorted); i++ {
+		prev, cur := sorted[i-1], sorted[i]
+		if prev.Pos.Offset+prev.Pos.Size > cur.Pos.Offset {
+			return errors.Errorf("partitions %q (0x%x-0x%x) and %q (0x%x-0x%x) overlap",
+				prev.Name(), prev.Pos.Offset, prev.Pos.Offset+prev.Pos.Size,
+				cur.Name(), cur.Pos.Offset, cur.Pos.Offset+cur.Pos.Size)
+		}
+	}
+	return nil
+}
+
+// MakePartitionTable generates binary partition table data, including the MD5 checksum entry.
+func MakePartitionTable(ptes []*ESPPartitionInfo) ([]byte, error) {
+	if (len(ptes)+1)*espPartitionTableEntryLen > espPartitionTableMaxLen {
+		return nil, errors.Errorf("too many partitions (%d)", len(ptes))
+	}
+	buf := bytes.NewBuffer(nil)
+	for _, pte := range ptes {
+		binary.Write(buf, binary.LittleEndian, pte)
+	}
+	csum := md5.Sum(buf.Bytes())
+	binary.Write(buf, binary.LittleEndian, espPartitionMD5Magic)
+	buf.Write(bytes.Repeat([]byte{0xff}, 14))
+	buf.Write(csum[:])
+	buf.Write(bytes.Repeat([]byte{0xff}, espPartitionTableMaxLen-buf.Len()))
+	return buf.Bytes(), nil
+}
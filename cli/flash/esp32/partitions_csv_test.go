@@ -0,0 +1,94 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package esp32
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePartitionTableCSV(t *testing.T) {
+	csv := `# Name,   Type, SubType, Offset,  Size, Flags
+nvs,      data, nvs,     0x9000,  0x4000,
+otadata,  data, ota,     ,        0x2000,
+app_0,    app,  ota_0,   ,        1M, encrypted
+fs_0,     data, 0x82,    ,        256K,
+`
+	ptes, err := ParsePartitionTableCSV(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []struct {
+		name         string
+		typ, subtype uint8
+		offset, size uint32
+		flags        uint32
+	}{
+		{"nvs", 1, 0x02, 0x9000, 0x4000, 0},
+		{"otadata", 1, 0x00, 0xd000, 0x2000, 0},
+		{"app_0", 0, 0x10, 0x10000, 0x100000, 1},
+		{"fs_0", 1, 0x82, 0x110000, 0x40000, 0},
+	}
+	if len(ptes) != len(exp) {
+		t.Fatalf("expected %d partitions, got %d", len(exp), len(ptes))
+	}
+	for i, e := range exp {
+		p := ptes[i]
+		if p.Name() != e.name || p.Type != e.typ || p.Subtype != e.subtype ||
+			p.Pos.Offset != e.offset || p.Pos.Size != e.size || p.Flags != e.flags {
+			t.Errorf("%d: expected %+v, got %q %+v", i, e, p.Name(), p)
+		}
+	}
+
+	data, err := MakePartitionTable(ptes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != espPartitionTableMaxLen {
+		t.Errorf("expected %d bytes, got %d", espPartitionTableMaxLen, len(data))
+	}
+	if data[4*espPartitionTableEntryLen] != 0xeb || data[4*espPartitionTableEntryLen+1] != 0xeb {
+		t.Errorf("no MD5 entry after the partitions")
+	}
+	ptes2 := ParsePartitionTable(data)
+	if len(ptes2) != len(ptes) {
+		t.Fatalf("expected %d partitions after round trip, got %d", len(ptes), len(ptes2))
+	}
+	for i := range ptes {
+		if *ptes2[i] != *ptes[i] {
+			t.Errorf("%d: expected %+v, got %+v", i, ptes[i], ptes2[i])
+		}
+	}
+}
+
+func TestParsePartitionTableCSVErrors(t *testing.T) {
+	for _, csv := range []string{
+		"",
+		"nvs, data, nvs, 0x9000\n",
+		"nvs, data, nvs, 0x9000, 0x4000\nnvs, data, nvs, 0xd000, 0x4000\n",
+		"nvs, data, nvs, 0x9000, 0x4000\nfs, data, spiffs, 0xc000, 0x4000\n",
+		"app, app, factory, 0x9000, 1M\n",
+		"nvs, data, foo, 0x9000, 0x4000\n",
+		"nvs, data, nvs, 0x9000, 0\n",
+		"nvs, data, nvs, 0x9000, 0x4000, readonly\n",
+		"a_very_long_partition_name, data, nvs, 0x9000, 0x4000\n",
+	} {
+		if _, err := ParsePartitionTableCSV(strings.NewReader(csv)); err == nil {
+			t.Errorf("%q: expected an error", csv)
+		}
+	}
+}
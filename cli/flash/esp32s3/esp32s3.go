@@ -30,9 +30,18 @@ const (
 )
 
 func GetChipDescr(rr esp.RegReader) (string, error) {
+	ci, err := GetChipInfo(rr)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return fmt.Sprintf("%s R%d", ci.Descr, ci.Revision), nil
+}
+
+// GetChipInfo detects the chip package and revision and reads the base MAC address.
+func GetChipInfo(rr esp.RegReader) (*esp.ChipInfo, error) {
 	efuse_rd_mac_spi_sys_3_reg, err := rr.ReadReg(EFUSE_BASE + 0x50)
 	if err != nil {
-		return "", errors.Annotatef(err, "failed to read eFuse reg")
+		return nil, errors.Annotatef(err, "failed to read eFuse reg")
 	}
 	chip_pkg := (efuse_rd_mac_spi_sys_3_reg >> 21) & 0x7
 	var chip_pkg_str string
@@ -43,5 +52,21 @@ func GetChipDescr(rr esp.RegReader) (string, error) {
 		chip_pkg_str = fmt.Sprintf("?(%d", chip_pkg)
 	}
 	chip_rev := (efuse_rd_mac_spi_sys_3_reg >> 18) & 0x7
-	return fmt.Sprintf("%s R%d", chip_pkg_str, chip_rev), nil
+	mac0, err := rr.ReadReg(EFUSE_BASE + 0x44)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to read eFuse reg")
+	}
+	mac1, err := rr.ReadReg(EFUSE_BASE + 0x44 + 4)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to read eFuse reg")
+	}
+	return &esp.ChipInfo{
+		Descr:    chip_pkg_str,
+		Revision: int(chip_rev),
+		MAC: fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x",
+			byte(mac1>>8), byte(mac1), byte(mac0>>24), byte(mac0>>16), byte(mac0>>8), byte(mac0)),
+		VariantFuses: []esp.FuseValue{
+			{Name: "efuse_rd_mac_spi_sys_3_reg", Value: uint64(efuse_rd_mac_spi_sys_3_reg)},
+		},
+	}, nil
 }
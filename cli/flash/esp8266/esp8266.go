@@ -19,6 +19,8 @@
 package esp8266
 
 import (
+	"fmt"
+
 	"github.com/juju/errors"
 	"github.com/mongoose-os/mos/cli/flash/esp"
 )
@@ -47,16 +49,47 @@ var (
 )
 
 func GetChipDescr(rrw esp.RegReader) (string, error) {
-	efuse0, err := rrw.ReadReg(0x3ff00050)
+	ci, err := GetChipInfo(rrw)
 	if err != nil {
-		return "", errors.Annotatef(err, "failed to read eFuse")
+		return "", errors.Trace(err)
 	}
-	efuse2, err := rrw.ReadReg(0x3ff00058)
-	if err != nil {
-		return "", errors.Annotatef(err, "failed to read eFuse")
+	return ci.Descr, nil
+}
+
+// GetChipInfo detects the chip variant and reads the MAC address.
+// The MAC is computed the same way esptool does it.
+func GetChipInfo(rrw esp.RegReader) (*esp.ChipInfo, error) {
+	var efuses [4]uint32
+	for i := range efuses {
+		v, err := rrw.ReadReg(0x3ff00050 + uint32(i)*4)
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to read eFuse")
+		}
+		efuses[i] = v
+	}
+	ci := &esp.ChipInfo{
+		Descr:    "ESP8266EX",
+		Revision: -1,
+		VariantFuses: []esp.FuseValue{
+			{Name: "efuse0", Value: uint64(efuses[0])},
+			{Name: "efuse2", Value: uint64(efuses[2])},
+		},
+	}
+	if efuses[0]&(1<<4) != 0 || efuses[2]&(1<<16) != 0 {
+		ci.Descr = "ESP8285"
+	}
+	var oui [3]byte
+	switch {
+	case efuses[3] != 0:
+		oui = [3]byte{byte(efuses[3] >> 16), byte(efuses[3] >> 8), byte(efuses[3])}
+	case (efuses[1]>>16)&0xff == 0:
+		oui = [3]byte{0x18, 0xfe, 0x34}
+	case (efuses[1]>>16)&0xff == 1:
+		oui = [3]byte{0xac, 0xd0, 0x74}
 	}
-	if efuse0&(1<<4) != 0 || efuse2&(1<<16) != 0 {
-		return "ESP8285", nil
+	if oui != [3]byte{} {
+		ci.MAC = fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x",
+			oui[0], oui[1], oui[2], byte(efuses[1]>>8), byte(efuses[1]), byte(efuses[0]>>24))
 	}
-	return "ESP8266EX", nil
+	return ci, nil
 }
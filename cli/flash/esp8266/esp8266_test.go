@@ -0,0 +1,56 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package esp8266
+
+import (
+	"fmt"
+	"testing"
+)
+
+type fakeRegReader map[uint32]uint32
+
+func (rr fakeRegReader) ReadReg(reg uint32) (uint32, error) {
+	v, ok := rr[reg]
+	if !ok {
+		return 0, fmt.Errorf("unexpected reg 0x%x", reg)
+	}
+	return v, nil
+}
+
+func TestGetChipInfo(t *testing.T) {
+	for _, c := range []struct {
+		efuses           [4]uint32
+		expDescr, expMAC string
+	}{
+		{[4]uint32{0x9a000000, 0x0000c4d2, 0x00000000, 0x00000000}, "ESP8266EX", "18:fe:34:c4:d2:9a"},
+		{[4]uint32{0x12000010, 0x00013456, 0x00000000, 0x00000000}, "ESP8285", "ac:d0:74:34:56:12"},
+		{[4]uint32{0x78000000, 0x00000102, 0x00010000, 0x005ccf7f}, "ESP8285", "5c:cf:7f:01:02:78"},
+		{[4]uint32{0x78000000, 0x00020102, 0x00000000, 0x00000000}, "ESP8266EX", ""},
+	} {
+		rr := fakeRegReader{}
+		for i, v := range c.efuses {
+			rr[0x3ff00050+uint32(i)*4] = v
+		}
+		ci, err := GetChipInfo(rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ci.Descr != c.expDescr || ci.MAC != c.expMAC || ci.Revision != -1 {
+			t.Errorf("%08x: unexpected chip info %+v", c.efuses, ci)
+		}
+	}
+}
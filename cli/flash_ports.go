@@ -0,0 +1,146 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+//go:build !noflash
+// +build !noflash
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/cli/devutil"
+	"github.com/mongoose-os/mos/cli/flags"
+	"github.com/mongoose-os/mos/cli/flash/esp"
+	espFlasher "github.com/mongoose-os/mos/cli/flash/esp/flasher"
+	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/common/fwbundle"
+)
+
+var (
+	flashPorts       = flag.StringSlice("ports", nil, "Flash the same firmware to devices on all of these serial ports at once")
+	flashAllPorts    = flag.Bool("all-ports", false, "Flash the same firmware to devices on all the serial ports at once")
+	flashParallelism = flag.Int("flash-parallelism", 4, "With --ports or --all-ports, max number of devices to flash at the same time")
+)
+
+type flashPortResult struct {
+	port     string
+	err      error
+	duration time.Duration
+}
+
+// flashMultiPort flashes firmware to several ESP devices concurrently.
+// fwData is the bundle read from fwname, it is only fetched once.
+// Each device gets its own copy of the bundle and of the flash options,
+// so a failure on one port does not affect the others.
+func flashMultiPort(ctx context.Context, fwname string, fwData []byte, platform string) error {
+	var ct esp.ChipType
+	switch strings.ToLower(platform) {
+	case "esp32":
+		ct = esp.ChipESP32
+	case "esp32c3":
+		ct = esp.ChipESP32C3
+	case "esp8266":
+		ct = esp.ChipESP8266
+	default:
+		return errors.NotImplementedf("flashing multiple %s devices", platform)
+	}
+	for _, f := range []string{"after-flash-config", "config-preserve-keys", "baud-after", "console", "verify-build-id", "esp-data-port"} {
+		if flag.Lookup(f).Changed {
+			return errors.Errorf("--%s is not supported when flashing multiple devices", f)
+		}
+	}
+	ports := *flashPorts
+	if *flashAllPorts {
+		ports = devutil.EnumerateSerialPorts()
+	}
+	if len(ports) == 0 {
+		return errors.Errorf("no ports to flash")
+	}
+	verify, err := getVerifyMode()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	n := *flashParallelism
+	if n < 1 {
+		n = 1
+	}
+	ourutil.Reportf("Flashing %d devices (%s), %d at a time...", len(ports), strings.Join(ports, ", "), n)
+
+	results := make([]*flashPortResult, len(ports))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, n)
+	for i, port := range ports {
+		wg.Add(1)
+		go func(i int, port string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			res := &flashPortResult{port: port}
+			results[i] = res
+			start := time.Now()
+			opts := espFlashOpts
+			opts.ControlPort = port
+			opts.InvertedControlLines = *flags.InvertedControlLines
+			opts.KeepFS = *flags.KeepFS
+			opts.Verify = verify
+			opts.ReportPrefix = fmt.Sprintf("[%s] ", port)
+			res.err = flashPort(ct, fwname, fwData, &opts)
+			res.duration = time.Since(start)
+			if res.err != nil {
+				opts.Reportf("Flashing failed: %s", res.err)
+			} else {
+				opts.Reportf("Flashing finished")
+			}
+		}(i, port)
+	}
+	wg.Wait()
+
+	ourutil.Reportf("\nSummary:")
+	numFailed := 0
+	for _, r := range results {
+		if r.err != nil {
+			numFailed++
+			ourutil.Reportf("  %s: FAILED (%s): %s", r.port, r.duration.Round(time.Second), r.err)
+		} else {
+			ourutil.Reportf("  %s: ok (%s)", r.port, r.duration.Round(time.Second))
+		}
+	}
+	ourutil.Reportf("%d succeeded, %d failed", len(ports)-numFailed, numFailed)
+	if numFailed > 0 {
+		return errors.Errorf("%d of %d devices were not flashed", numFailed, len(ports))
+	}
+	return nil
+}
+
+func flashPort(ct esp.ChipType, fwname string, fwData []byte, opts *esp.FlashOpts) error {
+	// Flashing adjusts parts of the bundle, so each device needs its own.
+	fw, err := fwbundle.ReadZipFirmwareBundleData(fwname, fwData)
+	if err != nil {
+		return errors.Annotatef(err, "failed to load %s", fwname)
+	}
+	if !*flags.KeepTempFiles {
+		defer fw.Cleanup()
+	}
+	return errors.Trace(espFlasher.Flash(ct, fw, opts))
+}
@@ -20,9 +20,17 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"context"
 
@@ -30,11 +38,24 @@ import (
 	"github.com/mongoose-os/mos/cli/dev"
 	"github.com/mongoose-os/mos/cli/devutil"
 	"github.com/mongoose-os/mos/cli/flags"
+	flashCommon "github.com/mongoose-os/mos/cli/flash/common"
 	"github.com/mongoose-os/mos/cli/flash/esp"
 	espFlasher "github.com/mongoose-os/mos/cli/flash/esp/flasher"
 	flag "github.com/spf13/pflag"
 )
 
+var (
+	flashReadWholeChip = flag.Bool("whole-chip", false, "Detect flash chip size and read the entire chip. Chip info is written next to the output file, with .json suffix")
+)
+
+// flashReadMeta is written next to the image read with --whole-chip.
+type flashReadMeta struct {
+	Platform string `json:"platform"`
+	espFlasher.FlashChipInfo
+	MD5       string    `json:"md5"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
 func flashRead(ctx context.Context, devConn dev.DevConn) error {
 	// if given devConn is not nil, we should disconnect it while flash reading is in progress
 	if devConn != nil {
@@ -42,62 +63,199 @@ func flashRead(ctx context.Context, devConn dev.DevConn) error {
 		defer devConn.Connect(ctx, true)
 	}
 
-	var err error
-	var addr, length int64
-	outFile := ""
 	args := flag.Args()
+	if *flashReadWholeChip && len(args) != 2 {
+		return errors.Errorf("only output file is expected with --whole-chip")
+	}
+	fra, err := parseFlashReadArgs(args[1:])
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	port, err := devutil.GetPort()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	switch *flags.Format {
+	case "", "bin", "ihex", "srec":
+	default:
+		return errors.Errorf("invalid --format %q", *flags.Format)
+	}
+
+	platform := flags.Platform()
+	ct, err := getESPChipType(platform)
+	if err != nil {
+		return errors.Annotatef(err, "flash reading")
+	}
+	if *flashReadWholeChip {
+		return errors.Trace(flashReadWholeChipToFile(platform, ct, port, fra.outFile))
+	}
+	espFlashOpts.ControlPort = port
+	data, err := espFlasher.ReadFlashRegions(ct, fra.regions, &espFlashOpts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if fra.outDir == "" {
+		return errors.Trace(writeFlashData(fra.outFile, fra.regions[0].Addr, data[0]))
+	}
+	if err := os.MkdirAll(fra.outDir, 0755); err != nil {
+		return errors.Trace(err)
+	}
+	for i, r := range fra.regions {
+		if err := writeFlashData(filepath.Join(fra.outDir, flashRegionFileName(r, *flags.Format)), r.Addr, data[i]); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+type flashReadArgs struct {
+	regions []espFlasher.FlashRegion
+	// Single region: the output file, "-" for stdout.
+	outFile string
+	// Multiple regions: the dir to write them to, one file per region.
+	outDir string
+}
+
+// parseFlashReadArgs parses flash-read arguments (without the command name):
+//
+//	<out file>                       - entire flash
+//	<addr> <length> <out file>       - single region
+//	<addr:length>... <out dir>       - one or more regions, one file each
+func parseFlashReadArgs(args []string) (*flashReadArgs, error) {
+	res := &flashReadArgs{}
+	if len(args) > 0 && isFlashRegionSpec(args[0]) {
+		if len(args) == 1 {
+			return nil, errors.Errorf("output dir is expected after the regions")
+		}
+		for _, spec := range args[:len(args)-1] {
+			parts := strings.Split(spec, ":")
+			if len(parts) != 2 {
+				return nil, errors.Errorf("invalid region %q, expected addr:length", spec)
+			}
+			r, err := parseFlashRegion(parts[0], parts[1])
+			if err != nil {
+				return nil, errors.Annotatef(err, "invalid region %q", spec)
+			}
+			res.regions = append(res.regions, r)
+		}
+		res.outDir = args[len(args)-1]
+		if res.outDir == "-" || isFlashRegionSpec(res.outDir) {
+			return nil, errors.Errorf("output dir is expected after the regions")
+		}
+		return res, nil
+	}
 	switch len(args) {
-	case 2:
+	case 1:
 		// Nothing, will auto-detect the size and read entire flash.
-		outFile = args[1]
-	case 4:
-		addr, err = strconv.ParseInt(args[1], 0, 64)
-		if err != nil {
-			return errors.Annotatef(err, "invalid address")
-		}
-		length, err = strconv.ParseInt(args[2], 0, 64)
+		res.regions = []espFlasher.FlashRegion{{}}
+		res.outFile = args[0]
+	case 3:
+		r, err := parseFlashRegion(args[0], args[1])
 		if err != nil {
-			return errors.Annotatef(err, "invalid length")
+			return nil, errors.Trace(err)
 		}
-		outFile = args[3]
+		res.regions = []espFlasher.FlashRegion{r}
+		res.outFile = args[2]
 	default:
-		return errors.Errorf("invalid arguments")
+		return nil, errors.Errorf("invalid arguments")
 	}
+	return res, nil
+}
 
-	port, err := devutil.GetPort()
+// isFlashRegionSpec returns true if s looks like addr:length. Only the address
+// is checked, so that Windows paths (C:\out) are not mistaken for regions.
+func isFlashRegionSpec(s string) bool {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	_, err := strconv.ParseUint(parts[0], 0, 32)
+	return err == nil
+}
+
+func parseFlashRegion(addrStr, lengthStr string) (espFlasher.FlashRegion, error) {
+	addr, err := strconv.ParseUint(addrStr, 0, 32)
 	if err != nil {
-		return errors.Trace(err)
+		return espFlasher.FlashRegion{}, errors.Annotatef(err, "invalid address")
+	}
+	length, err := strconv.ParseUint(lengthStr, 0, 32)
+	if err != nil {
+		return espFlasher.FlashRegion{}, errors.Annotatef(err, "invalid length")
 	}
+	return espFlasher.FlashRegion{Addr: uint32(addr), Length: int(length)}, nil
+}
 
-	var data []byte
-	platform := flags.Platform()
-	switch platform {
-	case "esp32":
-		espFlashOpts.ControlPort = port
-		data, err = espFlasher.ReadFlash(esp.ChipESP32, uint32(addr), int(length), &espFlashOpts)
-	case "esp32s3":
-		espFlashOpts.ControlPort = port
-		data, err = espFlasher.ReadFlash(esp.ChipESP32S3, uint32(addr), int(length), &espFlashOpts)
-	case "esp32c3":
-		espFlashOpts.ControlPort = port
-		data, err = espFlasher.ReadFlash(esp.ChipESP32C3, uint32(addr), int(length), &espFlashOpts)
-	case "esp8266":
-		espFlashOpts.ControlPort = port
-		data, err = espFlasher.ReadFlash(esp.ChipESP8266, uint32(addr), int(length), &espFlashOpts)
-	default:
-		err = errors.NotImplementedf("flash reading for %s", platform)
+// flashRegionFileName returns the name of the file for the region read in
+// the multi-region form, e.g. 0x9000-0x6000.bin.
+func flashRegionFileName(r espFlasher.FlashRegion, format string) string {
+	ext := "bin"
+	switch format {
+	case "ihex":
+		ext = "hex"
+	case "srec":
+		ext = "srec"
 	}
+	return fmt.Sprintf("0x%x-0x%x.%s", r.Addr, r.Length, ext)
+}
 
-	if err == nil {
-		if outFile == "-" {
-			_, err = os.Stdout.Write(data)
-		} else {
-			err = ioutil.WriteFile(outFile, data, 0644)
-			if err == nil {
-				reportf("Wrote %s", outFile)
-			}
+// writeFlashData writes data read from addr to outFile ("-" for stdout) in
+// the format specified by --format.
+func writeFlashData(outFile string, addr uint32, data []byte) error {
+	var out bytes.Buffer
+	switch *flags.Format {
+	case "ihex":
+		if err := flashCommon.WriteIntelHex(&out, addr, data); err != nil {
+			return errors.Trace(err)
+		}
+	case "srec":
+		if err := flashCommon.WriteSRec(&out, addr, data); err != nil {
+			return errors.Trace(err)
 		}
+	default:
+		out.Write(data)
+	}
+	if outFile == "-" {
+		_, err := os.Stdout.Write(out.Bytes())
+		return errors.Trace(err)
+	}
+	if err := ioutil.WriteFile(outFile, out.Bytes(), 0644); err != nil {
+		return errors.Trace(err)
 	}
+	reportf("Wrote %s", outFile)
+	return nil
+}
 
-	return errors.Trace(err)
+func flashReadWholeChipToFile(platform string, ct esp.ChipType, port, outFile string) error {
+	espFlashOpts.ControlPort = port
+	data, info, err := espFlasher.ReadWholeFlash(ct, &espFlashOpts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := writeFlashData(outFile, 0, data); err != nil {
+		return errors.Trace(err)
+	}
+	if outFile == "-" {
+		return nil
+	}
+
+	digest := md5.Sum(data)
+	meta := &flashReadMeta{
+		Platform:      platform,
+		FlashChipInfo: *info,
+		MD5:           hex.EncodeToString(digest[:]),
+		Timestamp:     time.Now().UTC(),
+	}
+	metaData, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	metaFile := outFile + ".json"
+	if err := ioutil.WriteFile(metaFile, append(metaData, '\n'), 0644); err != nil {
+		return errors.Trace(err)
+	}
+	reportf("Wrote %s", metaFile)
+	return nil
 }
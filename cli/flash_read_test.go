@@ -0,0 +1,95 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+//go:build !noflash
+// +build !noflash
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	espFlasher "github.com/mongoose-os/mos/cli/flash/esp/flasher"
+)
+
+func TestParseFlashReadArgs(t *testing.T) {
+	for _, c := range []struct {
+		args   []string
+		res    *flashReadArgs
+		errStr string
+	}{
+		{
+			args: []string{"out.bin"},
+			res:  &flashReadArgs{regions: []espFlasher.FlashRegion{{}}, outFile: "out.bin"},
+		},
+		{
+			args: []string{"0x9000", "0x6000", "-"},
+			res:  &flashReadArgs{regions: []espFlasher.FlashRegion{{Addr: 0x9000, Length: 0x6000}}, outFile: "-"},
+		},
+		{
+			args: []string{"0x9000:0x6000", "0xd000:8192", "out-dir/"},
+			res: &flashReadArgs{regions: []espFlasher.FlashRegion{
+				{Addr: 0x9000, Length: 0x6000},
+				{Addr: 0xd000, Length: 8192},
+			}, outDir: "out-dir/"},
+		},
+		{
+			args: []string{"0x1000:0x100", "out"},
+			res:  &flashReadArgs{regions: []espFlasher.FlashRegion{{Addr: 0x1000, Length: 0x100}}, outDir: "out"},
+		},
+		{args: []string{}, errStr: "invalid arguments"},
+		{args: []string{"0x9000", "out.bin"}, errStr: "invalid arguments"},
+		{args: []string{"0x9000:0x6000"}, errStr: "output dir is expected after the regions"},
+		{args: []string{`C:\out.bin`}, res: &flashReadArgs{regions: []espFlasher.FlashRegion{{}}, outFile: `C:\out.bin`}},
+		{args: []string{"0x1000:0x100", `C:\out`}, res: &flashReadArgs{regions: []espFlasher.FlashRegion{{Addr: 0x1000, Length: 0x100}}, outDir: `C:\out`}},
+		{args: []string{"0x9000:0x6000", "0xd000:0x2000"}, errStr: "output dir is expected after the regions"},
+		{args: []string{"0x9000:0x6000", "-"}, errStr: "output dir is expected after the regions"},
+		{args: []string{"0x9000:0x6000", "0xd000", "out"}, errStr: `invalid region "0xd000", expected addr:length`},
+		{args: []string{"0x9000:0x6000:1", "out"}, errStr: `invalid region "0x9000:0x6000:1", expected addr:length`},
+		{args: []string{"0x9000:zz", "out"}, errStr: `invalid region "0x9000:zz": invalid length: strconv.ParseUint: parsing "zz": invalid syntax`},
+		{args: []string{"foo", "0x10", "out"}, errStr: `invalid address: strconv.ParseUint: parsing "foo": invalid syntax`},
+	} {
+		res, err := parseFlashReadArgs(c.args)
+		if c.errStr != "" {
+			if err == nil || err.Error() != c.errStr {
+				t.Errorf("%q: expected error %q, got %v", c.args, c.errStr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", c.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, c.res) {
+			t.Errorf("%q: expected %+v, got %+v", c.args, c.res, res)
+		}
+	}
+}
+
+func TestFlashRegionFileName(t *testing.T) {
+	r := espFlasher.FlashRegion{Addr: 0x9000, Length: 0x6000}
+	for format, exp := range map[string]string{
+		"":     "0x9000-0x6000.bin",
+		"bin":  "0x9000-0x6000.bin",
+		"ihex": "0x9000-0x6000.hex",
+		"srec": "0x9000-0x6000.srec",
+	} {
+		if fn := flashRegionFileName(r, format); fn != exp {
+			t.Errorf("%q: expected %q, got %q", format, exp, fn)
+		}
+	}
+}
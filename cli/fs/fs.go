@@ -37,6 +37,7 @@ import (
 
 var (
 	longFormat = flag.BoolP("long", "l", false, "Long output format.")
+	atomicPut  = flag.Bool("atomic", true, "put: upload to a temporary file and rename it when done, so that an interrupted transfer does not leave a partially written file. Requires FS.Rename support on the device")
 )
 
 type ListArgs struct {
@@ -194,9 +195,65 @@ func Put(ctx context.Context, devConn dev.DevConn) error {
 		devFilename = args[2]
 	}
 
+	if *atomicPut {
+		return errors.Trace(PutFileAtomic(ctx, devConn, hostFilename, devFilename))
+	}
 	return PutFile(ctx, devConn, hostFilename, devFilename)
 }
 
+// PutFileAtomic uploads the file to a temporary name and renames it to
+// devFilename once the transfer is complete. Devices that do not support
+// FS.Rename get the file written in place, as with PutFile.
+// Some filesystems (SPIFFS) cannot rename over an existing file, there the
+// temporary file is read back and verified, and only then the old file is
+// removed and the new one renamed. This is not atomic: if interrupted in
+// between, devFilename is missing and the new data is left in devFilename.tmp.
+func PutFileAtomic(ctx context.Context, devConn dev.DevConn, hostFilename, devFilename string) error {
+	fileData, err := ourutil.ReadOrFetchFile(hostFilename)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var methods []string
+	ctx2, cancel := context.WithTimeout(ctx, devConn.GetTimeout())
+	defer cancel()
+	if err := devConn.Call(ctx2, "RPC.List", nil, &methods); err != nil {
+		return errors.Annotatef(err, "RPC.List")
+	}
+	hasRename := false
+	for _, m := range methods {
+		if m == "FS.Rename" {
+			hasRename = true
+		}
+	}
+	if !hasRename {
+		ourutil.Reportf("Warning: device does not support FS.Rename, writing %s in place", devFilename)
+		return errors.Trace(PutData(ctx, devConn, bytes.NewBuffer(fileData), devFilename))
+	}
+	tmpFilename := devFilename + ".tmp"
+	if err := PutData(ctx, devConn, bytes.NewBuffer(fileData), tmpFilename); err != nil {
+		fsRemoveFile(ctx, devConn, tmpFilename)
+		return errors.Trace(err)
+	}
+	if err := fsRename(ctx, devConn, tmpFilename, devFilename); err != nil {
+		glog.Infof("Rename failed (%s), removing %s and retrying", err, devFilename)
+		tmpData, err := GetFile(ctx, devConn, tmpFilename)
+		if err != nil {
+			return errors.Annotatef(err, "failed to read back %s", tmpFilename)
+		}
+		if tmpData != string(fileData) {
+			fsRemoveFile(ctx, devConn, tmpFilename)
+			return errors.Errorf("%s does not match the uploaded data, %s is left intact", tmpFilename, devFilename)
+		}
+		if err := fsRemoveFile(ctx, devConn, devFilename); err != nil {
+			return errors.Annotatef(err, "failed to replace %s, new data is in %s", devFilename, tmpFilename)
+		}
+		if err := fsRename(ctx, devConn, tmpFilename, devFilename); err != nil {
+			return errors.Annotatef(err, "failed to rename %s to %s", tmpFilename, devFilename)
+		}
+	}
+	return nil
+}
+
 func PutFile(ctx context.Context, devConn dev.DevConn, hostFilename, devFilename string) error {
 	fileData, err := ourutil.ReadOrFetchFile(hostFilename)
 	if err != nil {
@@ -271,6 +328,13 @@ func fsRemoveFile(ctx context.Context, devConn dev.DevConn, devFilename string)
 	}, nil))
 }
 
+func fsRename(ctx context.Context, devConn dev.DevConn, src, dst string) error {
+	return errors.Trace(devConn.Call(ctx, "FS.Rename", &struct {
+		Src string `json:"src"`
+		Dst string `json:"dst"`
+	}{Src: src, Dst: dst}, nil))
+}
+
 func Rm(ctx context.Context, devConn dev.DevConn) error {
 	args := flag.Args()
 	if len(args) < 2 {
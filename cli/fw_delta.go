@@ -0,0 +1,65 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"sort"
+
+	"github.com/juju/errors"
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/flags"
+	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/common/fwbundle"
+)
+
+func init() {
+	flag.StringVar(flags.Output, "out", "", "Alias for --output")
+}
+
+// fwDelta handles "mos fw-delta old.zip new.zip --out delta.bin".
+func fwDelta(ctx context.Context, devConn dev.DevConn) error {
+	args := flag.Args()[1:]
+	if len(args) != 2 {
+		return errors.Errorf("base and new firmware files are required")
+	}
+	if *flags.Output == "" {
+		return errors.Errorf("--out is required")
+	}
+
+	delta, di, err := fwbundle.MakeDelta(args[0], args[1])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := ioutil.WriteFile(*flags.Output, delta, 0644); err != nil {
+		return errors.Trace(err)
+	}
+
+	var names []string
+	for name := range di.Parts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ourutil.Reportf("  %s: %s", name, di.Parts[name].Op)
+	}
+	ourutil.Reportf("Wrote %s (%d bytes)", *flags.Output, len(delta))
+	return nil
+}
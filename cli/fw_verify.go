@@ -0,0 +1,117 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+
+	"github.com/juju/errors"
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/common/fwbundle"
+)
+
+var verifyKeys = flag.StringArray("verify-key", nil, "Public key (PEM) to verify the firmware bundle signature with. Can be used multiple times, each key must have a valid signature")
+
+// fwVerify handles "mos fw-verify firmware.zip --verify-key pub.pem".
+func fwVerify(ctx context.Context, devConn dev.DevConn) error {
+	args := flag.Args()[1:]
+	if len(args) != 1 {
+		return errors.Errorf("firmware file is required")
+	}
+	if len(*verifyKeys) == 0 {
+		return errors.Errorf("--verify-key is required")
+	}
+	var keys []*ecdsa.PublicKey
+	for _, kf := range *verifyKeys {
+		key, err := readECPublicKey(kf)
+		if err != nil {
+			return errors.Annotatef(err, "failed to read %s", kf)
+		}
+		keys = append(keys, key)
+	}
+
+	zipData, err := ourutil.ReadOrFetchFile(args[0])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	res, verr := fwbundle.VerifyZipFirmwareBundle(zipData, keys)
+	if res == nil {
+		return errors.Annotatef(verr, "%s", args[0])
+	}
+
+	ourutil.Reportf("Signatures: %d", res.NumSignatures)
+	valid := map[int]bool{}
+	for _, ki := range res.ValidKeys {
+		valid[ki] = true
+	}
+	for ki, kf := range *verifyKeys {
+		status := "ok"
+		if !valid[ki] {
+			status = "NO VALID SIGNATURE"
+		}
+		ourutil.Reportf("  %s: %s", kf, status)
+	}
+	ourutil.Reportf("Parts:")
+	for _, pr := range res.Parts {
+		status := "ok"
+		if pr.Err != nil {
+			status = pr.Err.Error()
+		}
+		ourutil.Reportf("  %-12s %-24s %s", pr.Name, pr.Src, status)
+	}
+	for _, name := range res.Unreferenced {
+		ourutil.Reportf("Warning: %s is not referenced by the manifest and is not covered by the signature", name)
+	}
+	if verr != nil {
+		return errors.Annotatef(verr, "%s", args[0])
+	}
+	ourutil.Reportf("%s: OK", args[0])
+	return nil
+}
+
+func readECPublicKey(fname string) (*ecdsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for {
+		var p *pem.Block
+		p, data = pem.Decode(data)
+		if p == nil {
+			return nil, errors.Errorf("no PUBLIC KEY block found")
+		}
+		if p.Type != "PUBLIC KEY" {
+			continue
+		}
+		pk, err := x509.ParsePKIXPublicKey(p.Bytes)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		ecpk, ok := pk.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, errors.Errorf("not an EC public key")
+		}
+		return ecpk, nil
+	}
+}
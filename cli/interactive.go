@@ -0,0 +1,190 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	shellwords "github.com/mattn/go-shellwords"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/mongoose-os/mos/cli/config"
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/flags"
+)
+
+const interactiveHelp = `Commands:
+  Method.Name [json | key=value | key:=json ...]  Call an RPC method
+  list                                            List RPC methods
+  get [path.to.value]                             Get config value
+  set path.to.value=value ...                     Set config values
+  help                                            Show this help
+  exit                                            Exit (Ctrl+D works too)`
+
+var interactiveCommands = []string{"exit", "get", "help", "list", "set"}
+
+// interactive handles "mos interactive": RPC shell that keeps the connection
+// to the device open between commands.
+func interactive(ctx context.Context, devConn dev.DevConn) error {
+	var methods []string
+	if err := devConn.Call(ctx, "RPC.List", nil, &methods); err != nil {
+		return errors.Annotatef(err, "RPC.List")
+	}
+	sort.Strings(methods)
+	fmt.Printf("Connected, %d methods available. Type \"help\" for help.\n", len(methods))
+
+	readLine := readLineFunc(append(methods, interactiveCommands...))
+	for {
+		line, err := readLine()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		args, err := shellwords.Parse(line)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			return nil
+		}
+		if err := interactiveCommand(ctx, devConn, args, methods); err != nil {
+			fmt.Printf("Error: %s\n", err)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// readLineFunc returns the function that reads commands, with history and
+// completion if stdin is a terminal.
+func readLineFunc(completions []string) func() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		scanner := bufio.NewScanner(os.Stdin)
+		return func() (string, error) {
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return "", err
+				}
+				return "", io.EOF
+			}
+			return scanner.Text(), nil
+		}
+	}
+	t := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "mos> ")
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return completeWord(completions, line, pos)
+	}
+	return func() (string, error) {
+		// Only keep the terminal in raw mode while reading, so that the output
+		// of commands is not garbled.
+		st, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		defer terminal.Restore(fd, st)
+		return t.ReadLine()
+	}
+}
+
+// completeWord completes the first word of the line to the longest common
+// prefix of the matching completions.
+func completeWord(completions []string, line string, pos int) (string, int, bool) {
+	if pos != len(line) || strings.Contains(line, " ") {
+		return "", 0, false
+	}
+	common := ""
+	for _, c := range completions {
+		if !strings.HasPrefix(c, line) {
+			continue
+		}
+		if common == "" {
+			common = c
+			continue
+		}
+		for !strings.HasPrefix(c, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(common) <= len(line) {
+		return "", 0, false
+	}
+	return common, len(common), true
+}
+
+func interactiveCommand(ctx context.Context, devConn dev.DevConn, args, methods []string) error {
+	switch args[0] {
+	case "help":
+		fmt.Println(interactiveHelp)
+	case "list":
+		fmt.Println(strings.Join(methods, "\n"))
+	case "get":
+		if len(args) > 2 {
+			return errors.Errorf("only one path to value is allowed")
+		}
+		devConf, err := dev.GetConfigLevel(ctx, devConn, *flags.Level)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		path := ""
+		if len(args) == 2 {
+			path = args[1]
+		}
+		val, err := devConf.Get(path)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Println(val)
+	case "set":
+		return errors.Trace(config.SetWithArgs(ctx, devConn, args[1:]))
+	default:
+		params := ""
+		if len(args) == 2 && isJSON(args[1]) {
+			params = args[1]
+		} else if len(args) > 1 {
+			var err error
+			if params, err = parseCallArgs(args[1:]); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		result, err := callDeviceService(ctx, devConn, args[0], params)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Println(result)
+	}
+	return nil
+}
@@ -3,7 +3,10 @@
 
 package interpreter
 
-import "testing"
+import (
+	"os"
+	"testing"
+)
 
 type interpExpectString struct {
 	expr   string
@@ -21,6 +24,8 @@ func TestInterpreterBasic(t *testing.T) {
 	mVars := NewMosVars()
 	mVars.SetVar("foo", "foo_val")
 	mVars.SetVar("bar.baz.boo", "boo_val")
+	os.Setenv("MOS_INTERPRETER_TEST_VAR", "env_val")
+	defer os.Unsetenv("MOS_INTERPRETER_TEST_VAR")
 
 	mi := NewInterpreter(mVars)
 
@@ -37,6 +42,7 @@ func TestInterpreterBasic(t *testing.T) {
 		interpExpectString{`foo == "foo_val"`, "true", ""},
 		interpExpectString{`bar.baz.boo`, "boo_val", ""},
 		interpExpectString{`bar.baz.booo`, "", "failed to evaluate bar.baz.booo"},
+		interpExpectString{`env.MOS_INTERPRETER_TEST_VAR`, "env_val", ""},
 	}
 
 	for _, v := range es {
@@ -90,3 +96,28 @@ func TestInterpreterBasic(t *testing.T) {
 	}
 
 }
+
+func TestExpandEnvVars(t *testing.T) {
+	os.Setenv("MOS_INTERPRETER_TEST_VAR", "env_val")
+	defer os.Unsetenv("MOS_INTERPRETER_TEST_VAR")
+	os.Unsetenv("MOS_INTERPRETER_TEST_UNSET")
+
+	es := []interpExpectString{
+		interpExpectString{`a-${env.MOS_INTERPRETER_TEST_VAR}-${foo}`, "a-env_val-${foo}", ""},
+		interpExpectString{`${env.MOS_INTERPRETER_TEST_UNSET}`, "", `expanding expressions in "${env.MOS_INTERPRETER_TEST_UNSET}": MOS_INTERPRETER_TEST_UNSET is not set`},
+		interpExpectString{`${env.MOS_INTERPRETER_TEST_VAR == "x"}`, "${env.MOS_INTERPRETER_TEST_VAR == \"x\"}", `expanding expressions in "${env.MOS_INTERPRETER_TEST_VAR == \"x\"}": only plain ${env.NAME} references can be expanded locally`},
+	}
+	for _, v := range es {
+		res, err := ExpandEnvVars(v.expr)
+		errMsg := ""
+		if err != nil {
+			errMsg = err.Error()
+		}
+		if errMsg != v.err {
+			t.Fatalf("expr %q: want error %q, got %q", v.expr, v.err, errMsg)
+		}
+		if res != v.result {
+			t.Fatalf("expr %q: want result %q, got %q", v.expr, v.result, res)
+		}
+	}
+}
@@ -6,6 +6,7 @@ package interpreter
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/mongoose-os/mos/cli/build"
@@ -18,13 +19,16 @@ import (
 const (
 	mVarOldMosVersion = "mos_version"
 	mVarOldPathSuffix = "_path"
+
+	mVarEnvPrefix = "env."
 )
 
 // MosVars is a wrapper around datamap.DataMap with get-fail-handler which
 // provides some shortcut phantom values, e.g. it makes everything under
 // "manifest" available at the top level, and also provides backward
 // compatibility: maps "foo_bar_path" to "mos.modules.foo_bar.path" (and
-// prints a warning if such old name is used).
+// prints a warning if such old name is used). Environment variables are
+// available under "env".
 //
 // There are also a couple of helper functions to set mos-specific variables:
 // SetModuleVars() and SetManifestVars.
@@ -110,6 +114,11 @@ func getFailHandler(dm *datamap.DataMap, name string) (interface{}, bool) {
 		return dm.Get(GetMVarNameMosPlatform())
 	}
 
+	// Environment variables: "env.FOO"
+	if strings.HasPrefix(name, mVarEnvPrefix) {
+		return os.LookupEnv(name[len(mVarEnvPrefix):])
+	}
+
 	// Make everything under "manifest" also available at the top level
 	if !strings.HasPrefix(name, fmt.Sprint(GetMVarNameManifest(), ".")) {
 		if val, ok := dm.Get(GetMVarName(GetMVarNameManifest(), name)); ok {
@@ -18,6 +18,7 @@ package interpreter
 
 import (
 	"fmt"
+	"os"
 	"regexp"
 
 	"github.com/juju/errors"
@@ -27,6 +28,9 @@ var (
 	// Note: we opted to use ${foo} instead of {{foo}}, because {{foo}} needs to
 	// be quoted in yaml, whereas ${foo} does not.
 	varRegexp = regexp.MustCompile(`\$\{[^}]+\}`)
+
+	envVarRegexp = regexp.MustCompile(`^\s*env\.(\w+)\s*$`)
+	envRefRegexp = regexp.MustCompile(`\benv\.`)
 )
 
 func ExpandVars(interp *MosInterpreter, s string, skipFailed bool) (string, error) {
@@ -57,6 +61,28 @@ func ExpandVarsSlice(interp *MosInterpreter, slice []string, skipFailed bool) ([
 	return ret, nil
 }
 
+// ExpandEnvVars expands only ${env.FOO} references in s, using the local
+// environment. Other expressions are left intact, but an expression which
+// refers to env and is not a plain reference is an error.
+func ExpandEnvVars(s string) (string, error) {
+	var errRet error
+	result := varRegexp.ReplaceAllStringFunc(s, func(v string) string {
+		expr := v[2 : len(v)-1]
+		if m := envVarRegexp.FindStringSubmatch(expr); m != nil {
+			val, ok := os.LookupEnv(m[1])
+			if !ok {
+				errRet = errors.Errorf("expanding expressions in %q: %s is not set", s, m[1])
+			}
+			return val
+		}
+		if envRefRegexp.MatchString(expr) {
+			errRet = errors.Errorf("expanding expressions in %q: only plain ${env.NAME} references can be expanded locally", s)
+		}
+		return v
+	})
+	return result, errRet
+}
+
 func WrapMosExpr(s string) string {
 	return fmt.Sprintf("${%s}", s)
 }
@@ -0,0 +1,248 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package lib_update
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+	flag "github.com/spf13/pflag"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/mongoose-os/mos/cli/build"
+	moscommon "github.com/mongoose-os/mos/cli/common"
+	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/common/ourgit"
+)
+
+var (
+	only = flag.StringSlice("only", nil, "lib-update: only update the libs with these names")
+)
+
+var (
+	libsKeyRegexp = regexp.MustCompile(`^libs:\s*(#.*)?$`)
+	// Indentation, optional list item marker, key, value and optional comment.
+	keyValueRegexp = regexp.MustCompile(`^(\s*)(-\s+)?([a-z_]+):(\s*)([^#]*?)(\s*#.*)?$`)
+)
+
+// libEntry is a lib from the libs section of the manifest, along with the
+// places in the file where its keys are.
+type libEntry struct {
+	lib build.SWModule
+	// Index of the line which the location (or origin) key is on.
+	locationLine int
+	// Index of the line with the version key, -1 if there is none.
+	versionLine int
+	// Indentation of the keys of the item.
+	indent string
+}
+
+// LibUpdate handles "mos lib-update": for each lib of the app with a Git
+// location, resolves the latest version (highest version tag or the hash of
+// master) and rewrites the version of the lib in mos.yml. Only the lines with
+// versions are touched, comments and formatting are preserved.
+// If dryRun is set, the diff is printed and the file is not changed.
+func LibUpdate(ctx context.Context, appDir string, creds map[string]build.Credentials, dryRun bool) error {
+	manifestFullName := moscommon.GetManifestFilePath(appDir)
+	data, err := ioutil.ReadFile(manifestFullName)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	newData, err := updateLibVersions(data, *only, func(m *build.SWModule) (string, error) {
+		m.SetCredentials(build.GetCredentialsForHost(creds, m.GetHostName()))
+		return m.GetLatestVersion()
+	})
+	if err != nil {
+		return errors.Annotatef(err, "%s", manifestFullName)
+	}
+	if string(newData) == string(data) {
+		ourutil.Reportf("%s: all libs are up to date", manifestFullName)
+		return nil
+	}
+	if dryRun {
+		writeDiff(os.Stdout, manifestFullName, data, newData)
+		return nil
+	}
+	if err := ioutil.WriteFile(manifestFullName, newData, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	ourutil.Reportf("Updated %s", manifestFullName)
+	return nil
+}
+
+// updateLibVersions returns the manifest data with the versions of Git libs
+// set to the ones returned by getLatest. If names is not empty, only libs
+// with these names are updated.
+func updateLibVersions(
+	data []byte, names []string, getLatest func(m *build.SWModule) (string, error),
+) ([]byte, error) {
+	var m struct {
+		Libs []build.SWModule `yaml:"libs"`
+	}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, errors.Annotatef(err, "failed to parse manifest")
+	}
+	lines := strings.Split(string(data), "\n")
+	entries := findLibs(lines)
+	if len(entries) != len(m.Libs) {
+		return nil, errors.Errorf("found %d libs, expected %d; only block style libs are supported", len(entries), len(m.Libs))
+	}
+
+	wanted := map[string]bool{}
+	for _, n := range names {
+		wanted[n] = true
+	}
+	insertAfter := map[int]string{}
+	for _, e := range entries {
+		name, err := e.lib.GetName2()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(wanted) > 0 && !wanted[name] {
+			continue
+		}
+		delete(wanted, name)
+		if e.lib.GetType() != build.SWModuleTypeGit {
+			ourutil.Reportf("%s: not a Git lib, skipping", name)
+			continue
+		}
+		if strings.HasPrefix(e.lib.Version, "@") {
+			ourutil.Reportf("%s: version is read from %s, skipping", name, e.lib.Version[1:])
+			continue
+		}
+		latest, err := getLatest(&e.lib)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s", name)
+		}
+		cur := e.lib.GetVersion("")
+		if cur == latest || ourgit.HashesEqual(cur, latest) {
+			ourutil.Reportf("%s: %s is the latest", name, latest)
+			continue
+		}
+		if cur == "" {
+			cur = "default"
+		}
+		ourutil.Reportf("%s: %s -> %s", name, cur, latest)
+		if e.versionLine >= 0 {
+			lines[e.versionLine] = setValue(lines[e.versionLine], latest)
+		} else {
+			insertAfter[e.locationLine] = fmt.Sprintf("%sversion: %s", e.indent, latest)
+		}
+	}
+	for n := range wanted {
+		return nil, errors.Errorf("no lib named %q", n)
+	}
+
+	var res []string
+	for i, l := range lines {
+		res = append(res, l)
+		if nl, ok := insertAfter[i]; ok {
+			res = append(res, nl)
+		}
+	}
+	return []byte(strings.Join(res, "\n")), nil
+}
+
+// findLibs scans the top level libs section of the manifest and returns the
+// libs in order.
+func findLibs(lines []string) []*libEntry {
+	var res []*libEntry
+	var cur *libEntry
+	inLibs := false
+	for i, l := range lines {
+		trimmed := strings.TrimSpace(l)
+		if !inLibs {
+			inLibs = libsKeyRegexp.MatchString(l)
+			continue
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if l[0] != ' ' && l[0] != '\t' && l[0] != '-' {
+			// Next top level key.
+			break
+		}
+		sm := keyValueRegexp.FindStringSubmatch(l)
+		if sm == nil {
+			continue
+		}
+		if sm[2] != "" {
+			cur = &libEntry{versionLine: -1, indent: sm[1] + strings.Repeat(" ", len(sm[2]))}
+			res = append(res, cur)
+		} else if cur == nil || sm[1] != cur.indent {
+			// Not a key of the item itself.
+			continue
+		}
+		value := unquote(sm[5])
+		switch sm[3] {
+		case "location", "origin":
+			cur.lib.Location = value
+			cur.locationLine = i
+		case "name":
+			cur.lib.Name = value
+		case "type":
+			cur.lib.Type = value
+		case "version":
+			cur.lib.Version = value
+			cur.versionLine = i
+		}
+	}
+	return res
+}
+
+// setValue replaces the value in a "key: value # comment" line.
+func setValue(line, value string) string {
+	sm := keyValueRegexp.FindStringSubmatchIndex(line)
+	if sm[8] == sm[9] {
+		value = " " + value
+	}
+	return line[:sm[10]] + value + line[sm[11]:]
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// writeDiff writes the changed lines of the manifest. Lines are only ever
+// replaced or inserted, never removed, so a simple walk is sufficient.
+func writeDiff(w io.Writer, fname string, oldData, newData []byte) {
+	oldLines := strings.Split(string(oldData), "\n")
+	newLines := strings.Split(string(newData), "\n")
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", fname, fname)
+	i, j := 0, 0
+	for j < len(newLines) {
+		switch {
+		case i < len(oldLines) && oldLines[i] == newLines[j]:
+			i++
+		case len(newLines)-j > len(oldLines)-i && (i >= len(oldLines) || oldLines[i] == newLines[j+1]):
+			fmt.Fprintf(w, "@@ %d @@\n+%s\n", j+1, newLines[j])
+		default:
+			fmt.Fprintf(w, "@@ %d @@\n-%s\n+%s\n", j+1, oldLines[i], newLines[j])
+			i++
+		}
+		j++
+	}
+}
@@ -0,0 +1,134 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package lib_update
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mongoose-os/mos/cli/build"
+)
+
+func gitCmd(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// makeRepo creates a repo with a commit and the given tags, returns its URL.
+func makeRepo(t *testing.T, dir, name string, tags ...string) string {
+	repoDir := filepath.Join(dir, name+".git")
+	if err := os.MkdirAll(repoDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	gitCmd(t, repoDir, "init", "-q")
+	gitCmd(t, repoDir, "checkout", "-q", "-b", "master")
+	if err := ioutil.WriteFile(filepath.Join(repoDir, "mos.yml"), []byte("type: lib\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitCmd(t, repoDir, "add", "mos.yml")
+	gitCmd(t, repoDir, "commit", "-q", "-m", "init")
+	for _, tag := range tags {
+		gitCmd(t, repoDir, "tag", "-a", "-m", tag, tag)
+	}
+	return "file://" + repoDir
+}
+
+func TestUpdateLibVersions(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	dir, err := ioutil.TempDir("", "lib_update_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fooURL := makeRepo(t, dir, "foo", "1.2", "1.10", "release")
+	barURL := makeRepo(t, dir, "bar")
+	barHash := gitCmd(t, filepath.Join(dir, "bar.git"), "rev-parse", "HEAD")
+
+	manifest := `author: mongoose-os
+# Libs used by the app.
+libs:
+  # Foo lib.
+  - location: ` + fooURL + `
+    type: git
+    version: 1.2  # pinned
+  - type: git
+    origin: ` + barURL + `
+  - location: /src/local_lib
+tags:
+  - c
+`
+	getLatest := func(m *build.SWModule) (string, error) {
+		return m.GetLatestVersion()
+	}
+
+	res, err := updateLibVersions([]byte(manifest), nil, getLatest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := strings.Replace(manifest, "version: 1.2  # pinned", "version: 1.10  # pinned", 1)
+	exp = strings.Replace(exp, "origin: "+barURL+"\n", "origin: "+barURL+"\n    version: "+barHash+"\n", 1)
+	if string(res) != exp {
+		t.Errorf("unexpected result:\n%s\nexpected:\n%s", res, exp)
+	}
+
+	// Updating again makes no changes.
+	res2, err := updateLibVersions(res, nil, getLatest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res2) != string(res) {
+		t.Errorf("unexpected changes:\n%s", res2)
+	}
+
+	// --only limits the scope.
+	res, err = updateLibVersions([]byte(manifest), []string{"bar"}, getLatest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(res), "version: 1.2  # pinned") || !strings.Contains(string(res), barHash) {
+		t.Errorf("unexpected result:\n%s", res)
+	}
+	if _, err := updateLibVersions([]byte(manifest), []string{"baz"}, getLatest); err == nil {
+		t.Errorf("expected an error for a non-existent lib")
+	}
+
+	// Diff shows the changed and inserted lines.
+	var diff bytes.Buffer
+	writeDiff(&diff, "mos.yml", []byte(manifest), []byte(exp))
+	expDiff := "--- mos.yml\n+++ mos.yml\n" +
+		"@@ 7 @@\n-    version: 1.2  # pinned\n+    version: 1.10  # pinned\n" +
+		"@@ 10 @@\n+    version: " + barHash + "\n"
+	if diff.String() != expDiff {
+		t.Errorf("unexpected diff:\n%s\nexpected:\n%s", diff.String(), expDiff)
+	}
+}
@@ -0,0 +1,153 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/build"
+	"github.com/mongoose-os/mos/cli/builder"
+	moscommon "github.com/mongoose-os/mos/cli/common"
+	"github.com/mongoose-os/mos/cli/common/paths"
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/manifest_parser"
+	"github.com/mongoose-os/mos/cli/ourutil"
+)
+
+// libsAudit looks for libs that are required only by the app itself (not by
+// other libs) but whose MGOS_HAVE_* macro is not referenced anywhere in the
+// app sources. Such libs may be unused and good candidates for removal.
+// Findings are reported as warnings, the command does not fail because of
+// them: a lib can be used without referencing its macro at all.
+func libsAudit(ctx context.Context, devConn dev.DevConn) error {
+	manifest, fp, _, err := readFinalManifestFromFlags()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	appDir, err := builder.GetCodeDirAbs()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	appSources, err := readAppSources(appDir, fp.AppSourceDirs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	extraLibs := map[string]bool{}
+	libsFromCLI, err := getLibsFromCLI()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, l := range libsFromCLI {
+		l.Normalize()
+		extraLibs[l.Name] = true
+	}
+
+	numWarnings := 0
+	for _, name := range getAppOnlyLibs(manifest) {
+		haveName := fmt.Sprintf("MGOS_HAVE_%s", strings.ToUpper(ourutil.IdentifierFromString(name)))
+		if strings.Contains(appSources, haveName) {
+			continue
+		}
+		via := "app manifest"
+		if extraLibs[name] {
+			via = "--lib-extra"
+		}
+		ourutil.Reportf("Warning: %s (via %s): %s is not referenced in app sources, the lib may be unused", name, via, haveName)
+		numWarnings++
+	}
+
+	if numWarnings == 0 {
+		ourutil.Reportf("No unused libs found")
+	}
+	return nil
+}
+
+// getAppOnlyLibs returns sorted names of the libs that the app depends on
+// directly and which are not required by any other lib. Core is never
+// returned, since it's always needed.
+func getAppOnlyLibs(manifest *build.FWAppManifest) []string {
+	requiredByLibs := map[string]bool{}
+	for node, deps := range manifest.Deps {
+		if node == manifest_parser.DepsApp {
+			continue
+		}
+		for _, d := range deps {
+			requiredByLibs[d] = true
+		}
+	}
+	handled := map[string]bool{}
+	for _, lh := range manifest.LibsHandled {
+		handled[lh.Lib.Name] = true
+	}
+	var res []string
+	for _, d := range manifest.Deps[manifest_parser.DepsApp] {
+		// Optional deps which are not present are skipped.
+		if d == "core" || requiredByLibs[d] || !handled[d] {
+			continue
+		}
+		res = append(res, d)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// readAppSources returns concatenated contents of all the files in the source
+// dirs which belong to the app (and not to libs or the build dir).
+func readAppSources(appDir string, sourceDirs []string) (string, error) {
+	buildDir := moscommon.GetBuildDir(appDir)
+	libsDir := paths.GetDepsDir(appDir)
+	var sb strings.Builder
+	for _, dir := range sourceDirs {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		if !isSubdir(dir, appDir) || isSubdir(dir, buildDir) || isSubdir(dir, libsDir) {
+			continue
+		}
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+			if err != nil {
+				return "", errors.Trace(err)
+			}
+			sb.Write(data)
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String(), nil
+}
+
+func isSubdir(dir, parent string) bool {
+	rel, err := filepath.Rel(parent, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,165 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// +build !noflash
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/devutil"
+	"github.com/mongoose-os/mos/cli/flags"
+	"github.com/mongoose-os/mos/cli/flash/esp32"
+)
+
+// Interfaces that get MACs derived from the base one, in the order of offsets.
+// See https://docs.espressif.com/projects/esp-idf/en/latest/esp32/api-reference/system/misc_system_api.html#mac-address
+var espDerivedMACNames = []string{"wifi_sta", "wifi_ap", "bt", "eth"}
+
+type macInfo struct {
+	Iface string `json:"iface"`
+	MAC   string `json:"mac"`
+}
+
+// macHandler prints the device MAC address: for ESP32, read from eFuses via
+// the ROM loader (no firmware needed), otherwise obtained via Sys.GetInfo.
+func macHandler(ctx context.Context, devConn dev.DevConn) error {
+	count := *flags.Count
+	if count <= 0 {
+		count = 1
+	}
+
+	var base net.HardwareAddr
+	var err error
+	platform := strings.ToLower(flags.Platform())
+	switch platform {
+	case "esp32":
+		base, err = readESP32MAC()
+	case "":
+		base, platform, err = readMACFromDevice(ctx)
+	default:
+		return errors.Errorf("reading MAC without firmware is not supported on %s, omit --platform to get it from the device", platform)
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	macs := []macInfo{{Iface: "base", MAC: base.String()}}
+	if count > 1 {
+		macs = nil
+		if platform != "esp32" && platform != "esp32c3" {
+			return errors.Errorf("derived MACs are only supported on ESP32")
+		}
+		if count > len(espDerivedMACNames) {
+			return errors.Errorf("--count can be at most %d", len(espDerivedMACNames))
+		}
+		for i := 0; i < count; i++ {
+			macs = append(macs, macInfo{Iface: espDerivedMACNames[i], MAC: deriveMAC(base, i).String()})
+		}
+	}
+
+	switch *flags.Format {
+	case "", "text":
+		for _, m := range macs {
+			fmt.Printf("%-8s %s\n", m.Iface, m.MAC)
+		}
+	case "json":
+		data, err := json.MarshalIndent(macs, "", "  ")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Printf("%s\n", data)
+	default:
+		return errors.Errorf("invalid --format %q, must be text or json", *flags.Format)
+	}
+	return nil
+}
+
+func readESP32MAC() (net.HardwareAddr, error) {
+	rrw, err := getRRW()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rrw.Disconnect()
+
+	_, _, fusesByName, err := esp32.ReadFuses(rrw)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to read eFuses")
+	}
+	mac, err := net.ParseMAC(fusesByName[esp32.MACAddressFuseName].MACAddressString())
+	return mac, errors.Trace(err)
+}
+
+func readMACFromDevice(ctx context.Context) (net.HardwareAddr, string, error) {
+	devConn, err := devutil.CreateDevConnFromFlags(ctx)
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	defer devConn.Disconnect(ctx)
+
+	info, err := dev.GetInfo(ctx, devConn)
+	if err != nil {
+		return nil, "", errors.Annotatef(err, "failed to get device info")
+	}
+	if info.Mac == nil {
+		return nil, "", errors.Errorf("device did not report its MAC address")
+	}
+	platform := ""
+	if info.Arch != nil {
+		platform = strings.ToLower(*info.Arch)
+	}
+	mac, err := parseMAC(*info.Mac)
+	return mac, platform, errors.Trace(err)
+}
+
+// parseMAC parses MAC address, either with separators or without
+// (as reported by Sys.GetInfo, e.g. 240AC405DD9C).
+func parseMAC(s string) (net.HardwareAddr, error) {
+	if len(s) == 12 {
+		if b, err := hex.DecodeString(s); err == nil {
+			return net.HardwareAddr(b), nil
+		}
+	}
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, errors.Errorf("invalid MAC address %q", s)
+	}
+	return mac, nil
+}
+
+// deriveMAC returns base MAC plus offset, treating the address as a 48-bit number.
+func deriveMAC(base net.HardwareAddr, offset int) net.HardwareAddr {
+	var v uint64
+	for _, b := range base {
+		v = v<<8 | uint64(b)
+	}
+	v += uint64(offset)
+	res := make(net.HardwareAddr, len(base))
+	for i := len(res) - 1; i >= 0; i-- {
+		res[i] = byte(v)
+		v >>= 8
+	}
+	return res
+}
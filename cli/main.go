@@ -21,12 +21,14 @@ package main
 import (
 	"context"
 	cRand "crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/big"
 	mRand "math/rand"
 	"os"
+	"os/exec"
 	"strings"
 	"time"
 
@@ -36,6 +38,7 @@ import (
 
 	"github.com/mongoose-os/mos/cli/aws"
 	"github.com/mongoose-os/mos/cli/azure"
+	"github.com/mongoose-os/mos/cli/builder"
 	"github.com/mongoose-os/mos/cli/clone"
 	moscommon "github.com/mongoose-os/mos/cli/common"
 	"github.com/mongoose-os/mos/cli/common/paths"
@@ -45,11 +48,16 @@ import (
 	"github.com/mongoose-os/mos/cli/debug_core_dump"
 	"github.com/mongoose-os/mos/cli/dev"
 	"github.com/mongoose-os/mos/cli/devutil"
+	"github.com/mongoose-os/mos/cli/errcode"
+	"github.com/mongoose-os/mos/cli/flags"
 	"github.com/mongoose-os/mos/cli/fs"
 	"github.com/mongoose-os/mos/cli/gcp"
+	"github.com/mongoose-os/mos/cli/lib_update"
 	license "github.com/mongoose-os/mos/cli/license_cmd"
 	"github.com/mongoose-os/mos/cli/mdash"
 	"github.com/mongoose-os/mos/cli/ota"
+	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/cli/provision"
 	"github.com/mongoose-os/mos/cli/update"
 	"github.com/mongoose-os/mos/cli/watson"
 	"github.com/mongoose-os/mos/common/pflagenv"
@@ -75,7 +83,8 @@ var (
 	chdir      = flag.StringP("chdir", "C", "", "Change into this directory first")
 	xFlag      = flag.BoolP("enable-extended", "X", false, "Deprecated. Enable extended commands")
 
-	helpFull = flag.Bool("full", false, "Show full help, including advanced flags")
+	helpFull   = flag.Bool("full", false, "Show full help, including advanced flags")
+	jsonOutput = flag.Bool("json", false, "Output in JSON format")
 
 	isUI = false
 )
@@ -116,48 +125,69 @@ func unimplemented() error {
 func init() {
 	commands = []command{
 		{"ui", startUI, `Start GUI`, nil, nil, No, false},
-		{"build", buildHandler, `Build a firmware from the sources located in the current directory`, nil, []string{"arch", "platform", "local", "repo", "clean", "server"}, No, false},
-		{"clone", clone.Clone, `Clone a repo`, nil, []string{}, No, false},
-		{"flash", flash, `Flash firmware to the device`, nil, []string{"port", "firmware"}, Maybe, false},
-		{"flash-read", flashRead, `Read a region of flash`, []string{"platform"}, []string{"port"}, No, false},
-		{"flash-write", flashWrite, `Write a region of flash`, []string{"platform"}, []string{"port"}, No, false},
-		{"console", console, `Simple serial port console`, nil, []string{"port"}, No, false}, //TODO: needDevConn
+		{"build", buildHandler, `Build a firmware from the sources located in the current directory`, nil, []string{"arch", "platform", "env", "env-file", "sources-file", "fail-on-manifest-warning", "include-build-info", "forbid-lib", "forbid-lib-file", "print-build-params", "list-boards", "lib-extra-dir", "since-git", "deps-lock", "strict-deps-lock", "local", "repo", "mos-repo-url", "dep-override", "clean", "server", "build-timeout", "build-upload-retries", "summary-only", "output", "lib-output", "deps-manifest-out", "format", "trace-profile", "cache-libs-manifest", "manifest-cache-dir", "deps-json", "symbol-sizes", "fs-cache"}, No, false},
+		{"clone", clone.Clone, `Clone a repo`, nil, []string{"repair-deps"}, No, false},
+		{"flash", flash, `Flash firmware to the device`, nil, []string{"port", "ports", "all-ports", "flash-parallelism", "firmware", "baud-after", "console", "image-only", "offset", "platform", "flash-compress", "verify", "verify-build-id", "after-flash-config", "config-preserve-keys", "partition-table", "verify-only", "flasher-stub", "esp-chip"}, Maybe, false},
+		{"flash-read", flashRead, `Read a region of flash, or several regions into a dir: flash-read addr:len... out-dir`, []string{"platform"}, []string{"port", "whole-chip", "format", "flasher-stub", "esp-chip"}, No, false},
+		{"flash-write", flashWrite, `Write a region of flash`, []string{"platform"}, []string{"port", "flasher-stub", "esp-chip"}, No, false},
+		{"chip-info", chipInfo, `Connect to the ROM loader and print the detected chip details, without flashing`, []string{"platform"}, []string{"port", "format", "flasher-stub", "esp-chip"}, No, false},
+		{"console", console, `Simple serial port console`, nil, []string{"port", "catch-core-dumps", "save-coredumps", "analyze-core-dumps", "fw-elf-file", "hexdump", "raw", "filter-non-text"}, No, false}, //TODO: needDevConn
 		{"ls", fs.Ls, `List files at the local device's filesystem`, nil, []string{"port"}, Yes, false},
 		{"get", fs.Get, `Read file from the local device's filesystem and print to stdout`, nil, []string{"port"}, Yes, false},
-		{"put", fs.Put, `Put file from the host machine to the local device's filesystem`, nil, []string{"port"}, Yes, false},
+		{"put", fs.Put, `Put file from the host machine to the local device's filesystem`, nil, []string{"port", "atomic"}, Yes, false},
 		{"rm", fs.Rm, `Delete a file from the device's filesystem`, nil, []string{"port"}, Yes, false},
-		{"ota", ota.OTA, `Perform an OTA update on a device`, nil, []string{"port"}, Yes, false},
-		{"config-get", config.Get, `Get config value from the locally attached device`, nil, []string{"port"}, Yes, false},
-		{"config-set", config.Set, `Set config value at the locally attached device`, nil, []string{"port"}, Yes, false},
-		{"call", call, `Perform a device API call. "mos call RPC.List" shows available methods`, nil, []string{"port"}, Yes, false},
+		{"ota", ota.OTA, `Perform an OTA update on a device`, nil, []string{"port", "devices", "parallelism", "max-failures", "delta", "base", "no-reboot", "retry", "retry-delay", "progress"}, Maybe, false},
+		{"ota-activate", ota.Activate, `Activate the update written with "mos ota --no-reboot" and reboot the device`, nil, []string{"port", "devices", "parallelism", "max-failures"}, Maybe, false},
+		{"config-get", config.Get, `Get config value from the locally attached device`, nil, []string{"port", "enable-rpc", "watch", "interval", "count", "retry", "retry-delay"}, Yes, false},
+		{"config-set", config.Set, `Set config value at the locally attached device`, nil, []string{"port", "enable-rpc", "validate", "no-validate", "retry", "retry-delay"}, Yes, false},
+		{"config-backup", config.Backup, `Save the whole device config to a file`, nil, []string{"out", "port", "level"}, Yes, false},
+		{"config-restore", configRestore, `Restore device config saved by config-backup, showing the changes`, nil, []string{"port", "level", "no-reboot", "no-save", "dry-run"}, Yes, false},
+		{"interactive", interactive, `Interactive RPC shell, the connection to the device is kept open between commands`, nil, []string{"port", "level", "no-reboot", "no-save"}, Yes, false},
+		{"call", call, `Perform a device API call. "mos call RPC.List" shows available methods. Args are either JSON or a list of key=value (string) and key:=json entries`, nil, []string{"port", "enable-rpc", "jsonpath", "raw", "json", "retry", "retry-delay"}, Yes, false},
+		{"rpc-list", rpcList, `List RPC methods of the device with their arguments`, nil, []string{"port", "json"}, Yes, false},
 		{"create-fw-bundle", create_fw_bundle.CreateFWBundle, `Create or modify a firmware ZIP bundle from disparate parts.`, nil, nil, No, false},
-		{"debug-core-dump", debug_core_dump.DebugCoreDump, `Debug a core dump`, nil, nil, No, false},
+		{"fw-delta", fwDelta, `Create a delta between two firmware bundles, for use with "mos ota --delta"`, nil, []string{"out"}, No, false},
+		{"fw-verify", fwVerify, `Verify firmware bundle signature and checksums of its parts`, nil, []string{"verify-key"}, No, false},
+		{"debug-core-dump", debug_core_dump.DebugCoreDump, `Debug a core dump`, nil, []string{"from-console-log", "fw-elf-file"}, No, false},
 		{"aws-iot-setup", aws.AWSIoTSetup, `Provision the device for AWS IoT cloud`, nil, []string{"atca-slot", "aws-region", "port", "use-atca"}, Yes, false},
 		{"azure-iot-setup", azure.AzureIoTSetup, `Provision the device for Azure IoT Hub`, nil, []string{"atca-slot", "azure-auth-file", "port", "use-atca"}, Yes, false},
 		{"gcp-iot-setup", gcp.GCPIoTSetup, `Provision the device for Google IoT Core`, nil, []string{"atca-slot", "gcp-region", "port", "use-atca", "registry"}, Yes, false},
 		{"watson-iot-setup", watson.WatsonIoTSetup, `Provision the device for IBM Watson IoT Platform`, nil, []string{}, Yes, false},
 		{"mdash-setup", mdash.MdashSetup, `Provision the device for mDash`, nil, []string{"port"}, Yes, false},
+		{"provision", provision.Provision, `Provision a batch of devices listed in a CSV file`, []string{"batch"}, []string{"provision-steps", "provision-parallel", "provision-results"}, No, false},
 		{"update", update.Update, `Self-update mos tool; optionally update channel can be given (e.g. "latest", "release", or some exact version)`, nil, nil, No, false},
 		{"license", license.License, `License device`, nil, nil, Maybe, false},
 		{"license-save-key", license.SaveKey, `Save license server key`, nil, nil, No, false},
 		{"wifi", wifi, `Setup WiFi - shortcut to config-set wifi...`, nil, nil, Yes, false},
 		{"help", showHelp, `Show help. Add --full to show advanced commands`, nil, nil, No, false},
-		{"version", showVersion, `Show version`, nil, nil, No, false},
+		{"tmp-clean", tmpClean, `Remove temporary files which are not in use`, nil, []string{"temp-dir"}, No, false},
+		{"cache-stats", cacheStats, `Show manifest cache stats: entries, hits, misses and time saved, see build --cache-libs-manifest`, nil, []string{"manifest-cache-dir", "json"}, No, false},
+		{"cache-clear", cacheClear, `Remove all entries from the manifest cache and reset its stats`, nil, []string{"manifest-cache-dir"}, No, false},
+		{"version", showVersion, `Show version`, nil, []string{"json"}, No, false},
+		{"completion", completion, `Generate shell completion script: mos completion bash|zsh|fish`, nil, nil, No, false},
 
 		// extended commands
 		{"atca-get-config", atcaGetConfig, `Get ATCA chip config`, nil, []string{"format", "port"}, Yes, true},
 		{"atca-set-config", atcaSetConfig, `Set ATCA chip config`, nil, []string{"format", "dry-run", "port"}, Yes, true},
 		{"atca-lock-zone", atcaLockZone, `Lock config or data zone`, nil, []string{"dry-run", "port"}, Yes, true},
 		{"atca-set-key", atcaSetKey, `Set key in a given slot`, nil, []string{"dry-run", "port", "write-key"}, Yes, true},
-		{"atca-gen-key", atcaGenKey, `Generate a random key in a given slot`, nil, []string{"dry-run", "port"}, Yes, true},
-		{"atca-get-pub-key", atcaGetPubKey, `Retrieve public ECC key from a given slot`, nil, []string{"port"}, Yes, true},
+		{"atca-gen-key", atcaGenKey, `Generate a random key in a given slot`, nil, []string{"dry-run", "port", "key-format"}, Yes, true},
+		{"atca-get-pub-key", atcaGetPubKey, `Retrieve public ECC key from a given slot`, nil, []string{"port", "key-format"}, Yes, true},
 		{"atca-gen-csr", atcaGenCSR, `Generate a random key in a given slot and generate a certificate request file`, nil, []string{"port"}, Yes, true},
 		{"atca-gen-cert", atcaGenCert, `Generate a random key in a given slot and issue a certificate`, nil, []string{"port"}, Yes, true},
+		{"mac", macHandler, `Print device MAC address(es), read from eFuses (ESP32) or obtained from the firmware`, nil, []string{"port", "platform", "format", "count"}, Maybe, false},
 		{"esp32-efuse-get", esp32EFuseGet, `Get ESP32 eFuses`, nil, nil, No, true},
 		{"esp32-efuse-set", esp32EFuseSet, `Set ESP32 eFuses`, nil, nil, No, true},
 		{"esp32-encrypt-image", esp32EncryptImage, `Encrypt a ESP32 firmware image`, []string{"esp32-encryption-key-file", "esp32-flash-address"}, nil, No, true},
 		{"esp32-gen-key", esp32GenKey, `Generate and program an encryption key`, nil, nil, No, true},
-		{"eval-manifest-expr", evalManifestExpr, `Evaluate the expression against the final manifest`, nil, nil, No, true},
+		{"deps-lock", depsLockHandler, `Print the git hashes of the libs and modules the app uses, in the format of build --deps-lock`, nil, []string{"platform", "env", "deps-lock", "write"}, No, false},
+		{"deps-tree", depsTree, `Print the tree of libs the app depends on, with versions`, nil, []string{"platform", "env"}, No, false},
+		{"libs-audit", libsAudit, `Report libs that may be unused by the app`, nil, []string{"platform", "env", "lib-extra", "lib-extra-dir"}, No, false},
+		{"test", testHandler, `Build the app or lib and run the tests listed in the manifest`, nil, []string{"platform", "env", "local", "repo", "clean", "server", "build-image"}, No, false},
+		{"run", runHandler, `Run the host executable built with "mos build --platform ubuntu", passing it the remaining args`, nil, []string{"run-native", "build-image"}, No, false},
+		{"lib-update", libUpdate, `Update versions of the app's Git libs in mos.yml to the latest tags (or master hashes)`, nil, []string{"only", "dry-run"}, No, false},
+		{"manifest-upgrade", manifestUpgrade, `Upgrade manifest_version in mos.yml to the latest supported`, nil, nil, No, false},
+		{"eval-manifest-expr", evalManifestExpr, `Evaluate expressions against the final manifest`, nil, []string{"stdin"}, No, true},
 		{"git-credentials", gitCredentials, `Git credentials helper mode`, nil, nil, No, true},
 		{"ports", showPorts, `Show serial ports`, nil, nil, No, true},
 	}
@@ -169,7 +199,41 @@ func showHelp(ctx context.Context, devConn dev.DevConn) error {
 	return nil
 }
 
+func libUpdate(ctx context.Context, devConn dev.DevConn) error {
+	appDir, err := builder.GetCodeDirAbs()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	creds, err := getCredentialsFromCLI()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// --dry-run defaults to true for the ATCA commands, here it is opt-in.
+	return lib_update.LibUpdate(ctx, appDir, creds, *dryRun && flag.CommandLine.Changed("dry-run"))
+}
+
+func configRestore(ctx context.Context, devConn dev.DevConn) error {
+	// As with lib-update, --dry-run is opt-in.
+	return config.Restore(ctx, devConn, *dryRun && flag.CommandLine.Changed("dry-run"))
+}
+
 func showVersion(ctx context.Context, devConn dev.DevConn) error {
+	if *jsonOutput {
+		data, err := json.MarshalIndent(struct {
+			Version       string `json:"version"`
+			BuildID       string `json:"build_id"`
+			UpdateChannel string `json:"update_channel"`
+		}{
+			Version:       version.Version,
+			BuildID:       version.BuildId,
+			UpdateChannel: string(update.GetUpdateChannel()),
+		}, "", "  ")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Println(string(data))
+		return nil
+	}
 	fmt.Printf(
 		"%s\nVersion: %s\nBuild ID: %s\nUpdate channel: %s\n",
 		"The Mongoose OS command line tool", version.Version, version.BuildId, update.GetUpdateChannel(),
@@ -213,7 +277,9 @@ func getCommand(str string) *command {
 }
 
 func consoleJunkHandler(data []byte) {
-	removeNonText(data, ' ')
+	if filterNonTextFlag {
+		removeNonText(data, ' ')
+	}
 	select {
 	case consoleMsgs <- data:
 	default:
@@ -254,6 +320,9 @@ func main() {
 
 	pflagenv.Parse(envPrefix)
 
+	registerSecretFlags()
+	glog.SetLogFilter(ourutil.RedactingLogFilter{})
+
 	glog.Infof("Version: %s", version.Version)
 	glog.Infof("Build ID: %s", version.BuildId)
 	glog.Infof("Update channel: %s", update.GetUpdateChannel())
@@ -286,14 +355,33 @@ func main() {
 	}
 	if cmd != nil && cmd.needDevConn == Yes {
 		var err error
-		devConn, err = devutil.CreateDevConnFromFlags(ctx)
+		if *flags.EnableRPC {
+			devConn, err = devutil.CreateDevConnEnableRPC(ctx)
+		} else {
+			devConn, err = devutil.CreateDevConnFromFlags(ctx)
+		}
 		if err != nil {
-			fmt.Println(errors.Trace(err))
+			err = errcode.Wrap(errors.Trace(err), errcode.DeviceConnectFailed, nil)
+			if *flags.ErrorJSON {
+				reportErrorJSON(err)
+			} else {
+				fmt.Println(err)
+			}
 			os.Exit(1)
 		}
 	}
 
 	if cmd == nil {
+		if pluginPath := findPlugin(flag.Arg(0)); pluginPath != "" {
+			if err := runPlugin(ctx, pluginPath); err != nil {
+				if ee, ok := err.(*exec.ExitError); ok {
+					os.Exit(ee.ExitCode())
+				}
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				os.Exit(1)
+			}
+			return
+		}
 		fmt.Fprintf(os.Stderr, "Unknown command: %s. Run \"mos help\"\n", flag.Arg(0))
 		os.Exit(1)
 	}
@@ -301,11 +389,41 @@ func main() {
 	err := run(cmd, ctx, devConn)
 	if devConn != nil {
 		devConn.Disconnect(context.Background())
+		if devutil.IsNoResponse(err) {
+			port, _ := devutil.GetPort()
+			hint := devutil.NoRPCHint(port)
+			err = errcode.Wrap(err, errcode.RPCNoResponse, map[string]interface{}{"hint": hint})
+			if !*flags.ErrorJSON {
+				fmt.Fprintf(os.Stderr, "%s\n", hint)
+			}
+		}
 	}
 	if err != nil {
 		glog.Infof("Error: %+v", errors.ErrorStack(err))
-		fmt.Fprintf(os.Stderr, "Error: %s\n", errors.ErrorStack(err))
+		if *flags.ErrorJSON {
+			reportErrorJSON(err)
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", errors.ErrorStack(err))
+		}
 		glog.Flush()
-		os.Exit(1)
+		code, _ := errcode.Get(err)
+		os.Exit(errcode.ExitCode(code))
 	}
 }
+
+// reportErrorJSON prints err to stderr in the --error-json format.
+func reportErrorJSON(err error) {
+	code, details := errcode.Get(err)
+	data, _ := json.Marshal(struct {
+		Code    errcode.Code           `json:"code"`
+		Message string                 `json:"message"`
+		Details map[string]interface{} `json:"details,omitempty"`
+		Stack   []string               `json:"stack"`
+	}{
+		Code:    code,
+		Message: err.Error(),
+		Details: details,
+		Stack:   strings.Split(errors.ErrorStack(err), "\n"),
+	})
+	fmt.Fprintln(os.Stderr, string(data))
+}
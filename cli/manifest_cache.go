@@ -0,0 +1,82 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/builder"
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/flags"
+	"github.com/mongoose-os/mos/cli/ourutil"
+)
+
+// cacheStats prints the usage stats of the manifest cache, see
+// mos build --cache-libs-manifest.
+func cacheStats(ctx context.Context, devConn dev.DevConn) error {
+	s, err := builder.GetManifestCacheStats(*flags.ManifestCacheDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if *jsonOutput {
+		data, err := json.MarshalIndent(struct {
+			Dir         string `json:"dir"`
+			Entries     int    `json:"entries"`
+			Size        int64  `json:"size"`
+			Hits        int    `json:"hits"`
+			Misses      int    `json:"misses"`
+			TimeSavedMS int64  `json:"time_saved_ms"`
+		}{
+			Dir:         *flags.ManifestCacheDir,
+			Entries:     s.Entries,
+			Size:        s.Size,
+			Hits:        s.Hits,
+			Misses:      s.Misses,
+			TimeSavedMS: int64(s.TimeSaved / time.Millisecond),
+		}, "", "  ")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	hitRate := 0
+	if s.Hits+s.Misses > 0 {
+		hitRate = s.Hits * 100 / (s.Hits + s.Misses)
+	}
+	fmt.Printf("Manifest cache: %s\n", *flags.ManifestCacheDir)
+	fmt.Printf("Entries: %d (%d KB)\n", s.Entries, s.Size/1024)
+	fmt.Printf("Hits: %d, misses: %d (%d%% hit rate)\n", s.Hits, s.Misses, hitRate)
+	fmt.Printf("Time saved: %s\n", s.TimeSaved.Round(time.Millisecond))
+	return nil
+}
+
+// cacheClear removes all the entries from the manifest cache and resets
+// the stats.
+func cacheClear(ctx context.Context, devConn dev.DevConn) error {
+	n, err := builder.ClearManifestCache(*flags.ManifestCacheDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ourutil.Reportf("Removed %d entries from %s", n, *flags.ManifestCacheDir)
+	return nil
+}
@@ -0,0 +1,146 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package manifest_parser
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/build"
+	moscommon "github.com/mongoose-os/mos/cli/common"
+	"github.com/mongoose-os/mos/cli/interpreter"
+)
+
+const boardsLibName = "boards"
+
+var (
+	boardCondRegex    = regexp.MustCompile(`build_vars\.BOARD\s*==\s*["']([^"']+)["']`)
+	platformCondRegex = regexp.MustCompile(`mos\.platform\s*==\s*["']([^"']+)["']`)
+)
+
+// ListBoards returns sorted BOARD values that the manifest (normally the one
+// of the boards lib) has conds for, on the given platform.
+// Conds that only apply to other platforms, along with the conds nested
+// in them, are skipped.
+func ListBoards(manifest *build.FWAppManifest, platform string) []string {
+	boards := map[string]bool{}
+	listBoards(manifest.Conds, platform, boards)
+	var res []string
+	for b := range boards {
+		res = append(res, b)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func listBoards(conds []build.ManifestCond, platform string, boards map[string]bool) {
+	for _, c := range conds {
+		if pm := platformCondRegex.FindAllStringSubmatch(c.When, -1); pm != nil {
+			matches := false
+			for _, m := range pm {
+				if m[1] == platform {
+					matches = true
+				}
+			}
+			if !matches {
+				continue
+			}
+		}
+		for _, m := range boardCondRegex.FindAllStringSubmatch(c.When, -1) {
+			boards[m[1]] = true
+		}
+		if c.Apply != nil {
+			listBoards(c.Apply.Conds, platform, boards)
+		}
+	}
+}
+
+// GetBoards returns the boards defined by the boards lib used by the final
+// manifest, on the manifest's platform. If the boards lib is not used, ok is false.
+func GetBoards(manifest *build.FWAppManifest, interp *interpreter.MosInterpreter) (boards []string, ok bool, err error) {
+	for _, lh := range manifest.LibsHandled {
+		name, err := lh.Lib.GetName2()
+		if err != nil {
+			return nil, false, errors.Trace(err)
+		}
+		if name != boardsLibName {
+			continue
+		}
+		bm, _, err := ReadManifestFile(moscommon.GetManifestFilePath(lh.Path), interp, false)
+		if err != nil {
+			return nil, false, errors.Annotatef(err, "failed to read boards lib manifest")
+		}
+		return ListBoards(bm, manifest.Platform), true, nil
+	}
+	return nil, false, nil
+}
+
+// CheckBoard returns an error if board is not one of boards, suggesting
+// the closest matches.
+func CheckBoard(board string, boards []string) error {
+	var suggestions []string
+	lb := strings.ToLower(board)
+	for _, b := range boards {
+		if b == board {
+			return nil
+		}
+		lcb := strings.ToLower(b)
+		maxDist := len(lcb) / 3
+		if maxDist < 2 {
+			maxDist = 2
+		}
+		if lcb == lb || strings.Contains(lcb, lb) || strings.Contains(lb, lcb) || editDistance(lb, lcb) <= maxDist {
+			suggestions = append(suggestions, b)
+		}
+	}
+	msg := fmt.Sprintf("unknown board %q.", board)
+	if len(suggestions) > 0 {
+		msg = fmt.Sprintf("unknown board %q, did you mean %s?", board, strings.Join(suggestions, " or "))
+	}
+	return errors.Errorf(`%s Run "mos build --list-boards" to see all the boards`, msg)
+}
+
+// editDistance returns Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = cur[j-1] + 1
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,80 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package manifest_parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/mongoose-os/mos/cli/build"
+)
+
+func TestListBoards(t *testing.T) {
+	var m build.FWAppManifest
+	if err := yaml.Unmarshal([]byte(`
+conds:
+  - when: mos.platform == "esp32"
+    apply:
+      conds:
+        - when: build_vars.BOARD == "ESP32-EVB"
+        - when: build_vars.BOARD == "ESP32-DevKitC"
+  - when: mos.platform == "esp8266" && build_vars.BOARD == "esp8266-1M"
+  - when: mos.platform == "esp32" || mos.platform == "esp32c3"
+    apply:
+      conds:
+        - when: build_vars.BOARD == 'M5STACK'
+  - when: build_vars.BOARD == "GENERIC"
+`), &m); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		platform string
+		exp      []string
+	}{
+		{"esp32", []string{"ESP32-DevKitC", "ESP32-EVB", "GENERIC", "M5STACK"}},
+		{"esp8266", []string{"GENERIC", "esp8266-1M"}},
+		{"esp32c3", []string{"GENERIC", "M5STACK"}},
+		{"stm32", []string{"GENERIC"}},
+	} {
+		if res := ListBoards(&m, c.platform); !reflect.DeepEqual(res, c.exp) {
+			t.Errorf("%s: expected %v, got %v", c.platform, c.exp, res)
+		}
+	}
+}
+
+func TestCheckBoard(t *testing.T) {
+	boards := []string{"ESP32-DevKitC", "ESP32-EVB", "M5STACK"}
+	if err := CheckBoard("ESP32-EVB", boards); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	for _, c := range []struct {
+		board, exp string
+	}{
+		{"ESP32-EBV", `did you mean ESP32-EVB?`},
+		{"m5stack", `did you mean M5STACK?`},
+		{"ESP32", `did you mean ESP32-DevKitC or ESP32-EVB?`},
+		{"NUCLEO", `unknown board "NUCLEO".`},
+	} {
+		err := CheckBoard(c.board, boards)
+		if err == nil || !strings.Contains(err.Error(), c.exp) {
+			t.Errorf("%s: expected error containing %q, got %v", c.board, c.exp, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package manifest_parser
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/build"
+)
+
+// CheckDepPolicy returns an error if any of the libs handled by the final
+// manifest matches one of the forbidden rules. For each offending lib the
+// error lists the dependency path from the app that pulled it in.
+func CheckDepPolicy(manifest *build.FWAppManifest, forbidden []build.ForbiddenLib) error {
+	if len(forbidden) == 0 {
+		return nil
+	}
+	locRegexps := make([]*regexp.Regexp, len(forbidden))
+	for i, fl := range forbidden {
+		if fl.Location == "" {
+			continue
+		}
+		re, err := regexp.Compile(fl.Location)
+		if err != nil {
+			return errors.Annotatef(err, "invalid forbidden lib location %q", fl.Location)
+		}
+		locRegexps[i] = re
+	}
+	var violations []string
+	for _, lh := range manifest.LibsHandled {
+		name, err := lh.Lib.GetName()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for i, fl := range forbidden {
+			if fl.Name != "" && fl.Name != name {
+				continue
+			}
+			if locRegexps[i] != nil && !locRegexps[i].MatchString(lh.Lib.Location) {
+				continue
+			}
+			v := fmt.Sprintf("%q (%s)", name, lh.Lib.Location)
+			if fl.Reason != "" {
+				v += ": " + fl.Reason
+			}
+			if path := depPath(manifest.Deps, DepsApp, name); path != nil {
+				v += "\n    pulled in by " + strings.Join(path, " -> ")
+			}
+			violations = append(violations, v)
+			break
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	sort.Strings(violations)
+	return errors.Errorf("forbidden libs in the dependency tree:\n  %s", strings.Join(violations, "\n  "))
+}
+
+// depPath returns the shortest path from one node of the deps graph to
+// another, including both of them, or nil if there is none.
+func depPath(deps map[string][]string, from, to string) []string {
+	prev := map[string]string{from: ""}
+	queue := []string{from}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if node == to {
+			var path []string
+			for n := to; n != from; n = prev[n] {
+				path = append([]string{n}, path...)
+			}
+			return append([]string{from}, path...)
+		}
+		for _, dep := range deps[node] {
+			if _, seen := prev[dep]; !seen {
+				prev[dep] = node
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return nil
+}
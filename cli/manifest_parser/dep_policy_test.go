@@ -0,0 +1,81 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package manifest_parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mongoose-os/mos/cli/build"
+)
+
+func TestCheckDepPolicy(t *testing.T) {
+	m := &build.FWAppManifest{
+		LibsHandled: []build.FWAppManifestLibHandled{
+			{Lib: build.SWModule{Name: "core", Location: "https://github.com/mongoose-os-libs/core"}},
+			{Lib: build.SWModule{Name: "mqtt", Location: "https://github.com/mongoose-os-libs/mqtt"}},
+			{Lib: build.SWModule{Name: "gpl_lib", Location: "https://github.com/someorg/gpl_lib"}},
+		},
+		Deps: map[string][]string{
+			DepsApp:   {"core", "mqtt"},
+			"core":    {},
+			"mqtt":    {"core", "gpl_lib"},
+			"gpl_lib": {},
+		},
+	}
+	if err := CheckDepPolicy(m, nil); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := CheckDepPolicy(m, []build.ForbiddenLib{{Name: "foo"}, {Location: "^https://gitlab"}}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err := CheckDepPolicy(m, []build.ForbiddenLib{{Location: "github.com/someorg/", Reason: "GPL"}})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), `"gpl_lib" (https://github.com/someorg/gpl_lib): GPL`) ||
+		!strings.Contains(err.Error(), "app -> mqtt -> gpl_lib") {
+		t.Errorf("unexpected error: %s", err)
+	}
+	// Name and location must both match.
+	if err := CheckDepPolicy(m, []build.ForbiddenLib{{Name: "core", Location: "someorg"}}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := CheckDepPolicy(m, []build.ForbiddenLib{{Name: "core"}}); err == nil || !strings.Contains(err.Error(), "app -> core") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDepPath(t *testing.T) {
+	deps := map[string][]string{
+		"app": {"a", "b"},
+		"a":   {"c"},
+		"b":   {"d"},
+		"c":   {"d"},
+		"d":   {},
+	}
+	if p := depPath(deps, "app", "d"); !reflect.DeepEqual(p, []string{"app", "b", "d"}) {
+		t.Errorf("unexpected path: %v", p)
+	}
+	if p := depPath(deps, "app", "app"); !reflect.DeepEqual(p, []string{"app"}) {
+		t.Errorf("unexpected path: %v", p)
+	}
+	if p := depPath(deps, "b", "c"); p != nil {
+		t.Errorf("unexpected path: %v", p)
+	}
+}
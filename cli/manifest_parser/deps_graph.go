@@ -0,0 +1,124 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package manifest_parser
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/build"
+)
+
+// DepsGraph is the resolved dependency graph of the app, in a form suitable
+// for external tools. All lists are sorted, so the output is stable.
+type DepsGraph struct {
+	App   string           `json:"app"`
+	Nodes []*DepsGraphNode `json:"nodes"`
+	// Edges go from the dependent node to its dependency. The app node is
+	// DepsApp.
+	Edges []*DepsGraphEdge `json:"edges"`
+	// Order in which libs are initialized.
+	InitDeps []string         `json:"init_deps"`
+	Modules  []*DepsGraphNode `json:"modules,omitempty"`
+}
+
+type DepsGraphNode struct {
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	Variant  string `json:"variant,omitempty"`
+	// Effective version, as requested by the manifests.
+	Version string `json:"version,omitempty"`
+	// Version declared in the lib's own manifest.
+	UserVersion string `json:"user_version,omitempty"`
+	// Git hash of the checkout, if it's a git repo.
+	RepoVersion string `json:"repo_version,omitempty"`
+	RepoDirty   bool   `json:"repo_dirty,omitempty"`
+	// Where the lib was fetched to.
+	Path string `json:"path,omitempty"`
+}
+
+type DepsGraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// GetDepsGraph returns the dependency graph of the manifest returned by
+// ReadManifestFinal. Edges to optional deps which are not present are
+// omitted.
+func GetDepsGraph(manifest *build.FWAppManifest) *DepsGraph {
+	g := &DepsGraph{
+		App:      manifest.Name,
+		Nodes:    []*DepsGraphNode{},
+		Edges:    []*DepsGraphEdge{},
+		InitDeps: append([]string{}, manifest.InitDeps...),
+	}
+	present := map[string]bool{DepsApp: true}
+	for _, lh := range manifest.LibsHandled {
+		present[lh.Lib.Name] = true
+		g.Nodes = append(g.Nodes, &DepsGraphNode{
+			Name:        lh.Lib.Name,
+			Location:    lh.Lib.Location,
+			Variant:     lh.Lib.Variant,
+			Version:     lh.Version,
+			UserVersion: lh.UserVersion,
+			RepoVersion: lh.RepoVersion,
+			RepoDirty:   lh.RepoDirty,
+			Path:        lh.Path,
+		})
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].Name < g.Nodes[j].Name })
+	for from, deps := range manifest.Deps {
+		if !present[from] {
+			continue
+		}
+		for _, to := range deps {
+			if present[to] {
+				g.Edges = append(g.Edges, &DepsGraphEdge{From: from, To: to})
+			}
+		}
+	}
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		return g.Edges[i].To < g.Edges[j].To
+	})
+	for _, m := range manifest.Modules {
+		n := &DepsGraphNode{
+			Name:     m.Name,
+			Location: m.Location,
+			Version:  m.GetVersion(manifest.ModulesVersion),
+		}
+		n.RepoVersion, n.RepoDirty, _ = m.GetRepoVersion()
+		n.Path = m.GetLocalPath()
+		g.Modules = append(g.Modules, n)
+	}
+	sort.Slice(g.Modules, func(i, j int) bool { return g.Modules[i].Name < g.Modules[j].Name })
+	return g
+}
+
+func (g *DepsGraph) WriteJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = w.Write(append(data, '\n'))
+	return errors.Trace(err)
+}
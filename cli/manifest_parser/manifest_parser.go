@@ -45,6 +45,7 @@ import (
 	moscommon "github.com/mongoose-os/mos/cli/common"
 	"github.com/mongoose-os/mos/cli/interpreter"
 	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/cli/trace"
 	"github.com/mongoose-os/mos/version"
 )
 
@@ -65,10 +66,13 @@ const (
 	// - 2020-01-21: added ability to override lib variants from conds in app manifest
 	// - 2020-01-29: added ability to override app name, description and version from app's conds
 	// - 2020-08-02: added asset_api for multiple asset-fetching mechanisms; fs_filters
+	//
+	// Keep manifestVersionChanges in sync with this list.
 	minManifestVersion = "2017-03-17"
 	maxManifestVersion = "2020-08-02"
 
-	depsApp = "app"
+	// DepsApp is the name of the app node in the dependency graph.
+	DepsApp = "app"
 
 	allLibsKeyword = "@all_libs"
 
@@ -80,7 +84,7 @@ const (
 )
 
 var (
-	sourceGlobs = flag.StringSlice("source-glob", []string{"*.c", "*.cpp"}, "glob to use for source dirs. Can be used multiple times.")
+	sourceGlobs = flag.StringSlice("source-glob", []string{"*.c", "*.cpp"}, "glob to use for source dirs which do not set globs in the manifest. Can be used multiple times.")
 )
 
 type ComponentProvider interface {
@@ -121,6 +125,8 @@ func ReadManifestFinal(
 	requireArch, preferPrebuiltLibs bool,
 	binaryLibsUpdateInterval time.Duration,
 ) (*build.FWAppManifest, *RMFOut, error) {
+	defer trace.Span("parse", "ReadManifestFinal")()
+
 	interp = interp.Copy()
 
 	if adjustments == nil {
@@ -181,6 +187,10 @@ func ReadManifestFinal(
 		return nil, nil, errors.Annotatef(err, "while expanding description")
 	}
 
+	mosRepo := build.MosDefaultRepo
+	if adjustments.MosRepoURL != "" {
+		mosRepo = adjustments.MosRepoURL
+	}
 	var mosModule *build.SWModule
 	for i, m := range manifest.Modules {
 		if m.Name == build.MosModuleName {
@@ -191,13 +201,16 @@ func ReadManifestFinal(
 	if mosModule == nil {
 		manifest.Modules = append(manifest.Modules, build.SWModule{
 			Name:     build.MosModuleName,
-			Location: build.MosDefaultRepo,
+			Location: mosRepo,
 			Version:  manifest.MongooseOsVersion,
 		})
 	} else {
 		if mosModule.Version == "" {
 			mosModule.Version = manifest.MongooseOsVersion
 		}
+		if mosModule.Location == build.MosDefaultRepo {
+			mosModule.Location = mosRepo
+		}
 	}
 
 	// Prepare local copies of all sw modules {{{
@@ -214,6 +227,10 @@ func ReadManifestFinal(
 			continue
 		}
 
+		if err := m.ResolveVersionFile(dir); err != nil {
+			return nil, nil, errors.Annotatef(err, "module %q", name)
+		}
+
 		moduleDir, err := cbs.ComponentProvider.GetModuleLocalPath(m, dir, manifest.ModulesVersion, manifest.Platform)
 		if err != nil {
 			return nil, nil, errors.Annotatef(err, "failed to prepare module %q", name)
@@ -297,39 +314,41 @@ func ReadManifestFinal(
 		return nil, nil, errors.Trace(err)
 	}
 
+	// Explicitly listed sources are not globbed, but they must exist.
+	for _, f := range adjustments.ExtraSources {
+		if _, err := os.Stat(f); err != nil {
+			return nil, nil, errors.Annotatef(err, "extra source")
+		}
+		d, err := filepath.Abs(filepath.Dir(f))
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		manifest.Sources = append(manifest.Sources, f)
+		fp.AppSourceDirs = append(fp.AppSourceDirs, d)
+	}
+	manifest.Includes = append(manifest.Includes, adjustments.ExtraIncludes...)
+
 	manifest.Filesystem, fp.AppFSDirs, err = resolvePaths(manifest.Filesystem, []string{"*"})
 	if err != nil {
 		return nil, nil, errors.Trace(err)
 	}
 
-	// Apply fs_filters.
-	var newFs []string
-	for i, f := range manifest.Filesystem {
-		bf := filepath.Base(f)
-		include := true
-		for _, e := range manifest.FSFilters {
-			if e.Include != "" && e.Exclude != "" {
-				return nil, nil, errors.Errorf("fs_filters entry %d: only one of include or exclude is allowed", i)
-			}
-			if e.Include != "" {
-				if matched, _ := path.Match(e.Include, bf); matched {
-					include = true
-					break
-				}
-			}
-			if e.Exclude != "" {
-				if matched, _ := path.Match(e.Exclude, bf); matched {
-					glog.Infof("%q excluded by %q", f, e.Exclude)
-					include = false
-					break
-				}
-			}
-		}
-		if include {
-			newFs = append(newFs, f)
-		}
+	allPlatforms, err := getAllSupportedPlatforms(fp.MosDirEffective)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	fsDirs := fp.AppFSDirs
+	manifest.Filesystem, fp.AppFSDirs, err = addPlatformFSDirs(
+		manifest.Filesystem, fp.AppFSDirs, manifest.Platform, allPlatforms,
+	)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	manifest.Filesystem, err = applyFSFilters(manifest.Filesystem, manifest.FSFilters, fsDirs, fp.AppFSDirs[len(fsDirs):])
+	if err != nil {
+		return nil, nil, errors.Trace(err)
 	}
-	manifest.Filesystem = newFs
 	manifest.FSFilters = nil
 
 	// When building an app, also add all libs' sources or prebuilt binaries.
@@ -380,7 +399,9 @@ func ReadManifestFinal(
 						}
 					}
 					// Try fetching
+					endFetch := trace.Span("fetch", fmt.Sprintf("%s: prebuilt binary (%s)", lcur.Lib.Name, variant))
 					fetchErr := lcur.Lib.FetchPrebuiltBinary(variant, libVersion, bl)
+					endFetch()
 					if fetchErr == nil {
 						ourutil.Freportf(logWriter, "Successfully fetched prebuilt binary for %q to %q", lcur.Lib.Name, bl)
 						binaryLib = bl
@@ -485,11 +506,6 @@ func ReadManifestFinal(
 		return nil, nil, errors.Trace(err)
 	}
 
-	allPlatforms, err := getAllSupportedPlatforms(fp.MosDirEffective)
-	if err != nil {
-		return nil, nil, errors.Trace(err)
-	}
-
 	manifest.Platforms = mergeSupportedPlatforms(manifest.Platforms, allPlatforms)
 	sort.Strings(manifest.Platforms)
 
@@ -512,9 +528,10 @@ type manifestParseContext struct {
 	adjustments build.ManifestAdjustments
 	logWriter   io.Writer
 
-	deps        *Deps
-	initDeps    *Deps
-	libsHandled map[string]*build.FWAppManifestLibHandled
+	deps         *Deps
+	initDeps     *Deps
+	initDepsInfo map[string]*build.InitDepsInfo
+	libsHandled  map[string]*build.FWAppManifestLibHandled
 
 	appManifest *build.FWAppManifest
 	interp      *interpreter.MosInterpreter
@@ -529,6 +546,33 @@ type manifestParseContext struct {
 	libsByName *libByNameMap
 }
 
+// getInitDepsInfo returns init deps info for the node, creating it if needed.
+// Must be called with pc.mtx locked.
+func (pc *manifestParseContext) getInitDepsInfo(node string) *build.InitDepsInfo {
+	idi := pc.initDepsInfo[node]
+	if idi == nil {
+		idi = &build.InitDepsInfo{}
+		pc.initDepsInfo[node] = idi
+	}
+	return idi
+}
+
+// addInitDepInfo records the origin of an init dependency of node on dep.
+// Must be called with pc.mtx locked.
+func (pc *manifestParseContext) addInitDepInfo(node, dep string, explicit bool, reason string) {
+	idi := pc.getInitDepsInfo(node)
+	l := &idi.Implicit
+	if explicit {
+		l = &idi.Explicit
+	}
+	for _, d := range *l {
+		if d.Name == dep && d.Reason == reason {
+			return
+		}
+	}
+	*l = append(*l, build.InitDep{Name: dep, Reason: reason})
+}
+
 // readManifestWithLibs reads manifest from the provided dir, "expands" all
 // libs (so that the returned manifest does not really contain any libs),
 // and also returns the most recent modification time of all encountered
@@ -544,9 +588,9 @@ func readManifestWithLibs(
 
 	// Create a deps structure and add a root node: an "app"
 	deps := NewDeps()
-	deps.AddNode(depsApp)
+	deps.AddNode(DepsApp)
 	initDeps := NewDeps()
-	initDeps.AddNode(depsApp)
+	initDeps.AddNode(DepsApp)
 
 	pc := &manifestParseContext{
 		rootAppDir: dir,
@@ -554,9 +598,10 @@ func readManifestWithLibs(
 		adjustments: *adjustments,
 		logWriter:   logWriter,
 
-		deps:        deps,
-		initDeps:    initDeps,
-		libsHandled: libsHandled,
+		deps:         deps,
+		initDeps:     initDeps,
+		initDepsInfo: map[string]*build.InitDepsInfo{},
+		libsHandled:  libsHandled,
 
 		appManifest: nil,
 		interp:      interp,
@@ -575,20 +620,21 @@ func readManifestWithLibs(
 	}
 
 	pc.prepareLibs = append(pc.prepareLibs, &prepareLibsEntry{
-		parentNodeName: depsApp,
+		parentNodeName: DepsApp,
 		manifest:       manifest,
 	})
 
 	// Set the mos.platform variable
 	interp.MVars.SetVar(interpreter.GetMVarNameMosPlatform(), manifest.Platform)
 
-	pass := 0
+	pass, condsPass := 0, 0
 	for {
 		for len(pc.prepareLibs) != 0 {
 			pass++
 			glog.Infof("Prepare libs pass %d (%d)", pass, len(pc.prepareLibs))
 			pll := pc.prepareLibs
 			pc.prepareLibs = nil
+			endPass := trace.Span("parse", fmt.Sprintf("Prepare libs pass %d", pass))
 			for _, ple := range pll {
 				libsMtime, err := prepareLibs(ple.parentNodeName, ple.manifest, pc)
 				if err != nil {
@@ -599,6 +645,7 @@ func readManifestWithLibs(
 					}
 				}
 			}
+			endPass()
 		}
 
 		// Get all deps in topological order
@@ -609,7 +656,13 @@ func readManifestWithLibs(
 			)
 		}
 
-		// Remove the last item from topo, which is depsApp
+		manifest.Deps = map[string][]string{}
+		for _, node := range deps.GetNodes() {
+			manifest.Deps[node] = append([]string(nil), deps.GetDeps(node)...)
+		}
+		manifest.InitDepsInfo = pc.initDepsInfo
+
+		// Remove the last item from topo, which is DepsApp
 		//
 		// TODO(dfrank): it would be nice to handle an app just another dependency
 		// and generate init code for it, but it would be a breaking change, at least
@@ -640,7 +693,7 @@ func readManifestWithLibs(
 			return
 		}
 		for _, node := range initDeps.GetNodes() {
-			if node == depsApp {
+			if node == DepsApp {
 				continue
 			}
 			// Expand globs in keys (intorduced by init_before)
@@ -688,10 +741,14 @@ func readManifestWithLibs(
 		glog.Infof("libs_handled: %s", lhNames)
 		glog.Infof("init_deps: %s", manifest.InitDeps)
 
-		if err := expandManifestLibsAndConds(manifest, interp, adjustments); err != nil {
+		condsPass++
+		endConds := trace.Span("conds", fmt.Sprintf("Expand conds pass %d", condsPass))
+		err := expandManifestLibsAndConds(manifest, interp, adjustments)
+		endConds()
+		if err != nil {
 			if errors.Cause(err) == libsAddedError {
 				if len(manifest.Libs) > 0 {
-					libsMtime, err := prepareLibs(depsApp, manifest, pc)
+					libsMtime, err := prepareLibs(DepsApp, manifest, pc)
 					if err != nil {
 						return nil, time.Time{}, errors.Trace(err)
 					}
@@ -743,7 +800,9 @@ func readManifestWithLibs2(dir string, pc *manifestParseContext) (*build.FWAppMa
 	if pc.appManifest == nil {
 		pc.appManifest = manifest
 
-		if !manifest.NoImplInitDeps {
+		if manifest.NoImplInitDeps {
+			pc.getInitDepsInfo(DepsApp).ImplicitSuppressed = true
+		} else {
 			found := false
 			for _, l := range manifest.Libs {
 				l.Normalize()
@@ -878,11 +937,12 @@ func prepareLibReencounter(
 	pc.deps.AddDep(parentNodeName, libHad.Name)
 	if !manifest.NoImplInitDeps {
 		pc.initDeps.AddDep(parentNodeName, libHad.Name)
+		pc.addInitDepInfo(parentNodeName, libHad.Name, false, "dependency")
 	}
 	pc.mtx.Unlock()
 
 	// App manifest can override library variants (in conds).
-	if libNow.Variant != "" && parentNodeName == depsApp {
+	if libNow.Variant != "" && parentNodeName == DepsApp {
 		glog.V(1).Infof("%s variant: %q -> %q", libHad.Name,
 			libHad.Variant, libNow.Variant)
 		libHad.Variant = libNow.Variant
@@ -905,6 +965,23 @@ func prepareLib(
 		lpres <- libPrepareResult{err: errors.Trace(err)}
 		return
 	}
+	defer trace.Span("prepare_lib", m.Name)()
+	if err := m.ResolveVersionFile(pc.rootAppDir); err != nil {
+		lpres <- libPrepareResult{err: errors.Annotatef(err, "lib %q", m.Name)}
+		return
+	}
+	if do, ok := pc.adjustments.DepOverrides[m.Name]; ok && m.Location != do.Location {
+		ourutil.Freportf(pc.logWriter, "Lib %q at %q: overridden by %q (--dep-override)...",
+			m.Name, m.Location, do.Location)
+		// Keep the name, the fork may be located in a differently named repo.
+		if libRefName == "" {
+			libRefName = m.Name
+		}
+		m.Location = do.Location
+		if do.Version != "" {
+			m.Version = do.Version
+		}
+	}
 
 	ls := pc.libsByName.AddOrFetchAndLock(m.Name)
 	defer ls.mtx.Unlock()
@@ -1046,6 +1123,7 @@ func prepareLib(
 	pc.deps.AddDep(parentNodeName, name)
 	if !manifest.NoImplInitDeps {
 		pc.initDeps.AddDep(parentNodeName, name)
+		pc.addInitDepInfo(parentNodeName, name, false, "dependency")
 	}
 
 	manifest.BuildVars[haveName] = "1"
@@ -1060,12 +1138,19 @@ func prepareLib(
 	pc.libsHandled[name] = lh
 	ls.Lib = &lh.Lib
 	pc.initDeps.AddNodeWithDeps(name, libManifest.InitAfter)
-	if !libManifest.NoImplInitDeps && name != coreLibName {
+	for _, dep := range libManifest.InitAfter {
+		pc.addInitDepInfo(name, dep, true, "init_after")
+	}
+	if libManifest.NoImplInitDeps {
+		pc.getInitDepsInfo(name).ImplicitSuppressed = true
+	} else if name != coreLibName {
 		// Implicit dep on "core"
 		pc.initDeps.AddDep(name, coreLibName)
+		pc.addInitDepInfo(name, coreLibName, false, "core")
 	}
 	for _, dep := range libManifest.InitBefore {
 		pc.initDeps.AddNodeWithDeps(dep, []string{name})
+		pc.addInitDepInfo(dep, name, true, fmt.Sprintf("init_before in %s", name))
 	}
 	pc.mtx.Unlock()
 
@@ -1085,7 +1170,7 @@ func ReadManifest(
 	}
 
 	manifestFullName := moscommon.GetManifestFilePath(appDir)
-	manifest, mtime, err := ReadManifestFile(manifestFullName, interp, true)
+	manifest, mtime, err := readManifestFile(manifestFullName, interp, true, adjustments.FailOnWarning)
 	if err != nil {
 		return nil, time.Time{}, errors.Trace(err)
 	}
@@ -1105,30 +1190,17 @@ func ReadManifest(
 	}
 
 	if manifest.Platform != "" {
+		// Extend common app manifest with arch-specific things.
 		manifestArchFullName := moscommon.GetManifestArchFilePath(appDir, manifest.Platform)
-		_, err := os.Stat(manifestArchFullName)
-		if err == nil {
-			// Arch-specific mos.yml does exist, so, handle it
-			archManifest, archMtime, err := ReadManifestFile(manifestArchFullName, interp, false)
-			if err != nil {
-				return nil, time.Time{}, errors.Trace(err)
-			}
-
-			// We should return the latest modification date of all encountered
-			// manifests, so let's see if we got the later mtime here
-			if archMtime.After(mtime) {
-				mtime = archMtime
-			}
+		if err := extendManifestWithOverlay(manifest, manifestArchFullName, interp, &mtime, adjustments.FailOnWarning); err != nil {
+			return nil, time.Time{}, errors.Trace(err)
+		}
+	}
 
-			// Extend common app manifest with arch-specific things.
-			if err := extendManifest(manifest, manifest, archManifest, "", "", interp, &extendManifestOptions{
-				skipFailedExpansions: true,
-				extendInitDeps:       true,
-			}); err != nil {
-				return nil, time.Time{}, errors.Trace(err)
-			}
-		} else if !os.IsNotExist(err) {
-			// Some error other than non-existing mos_<arch>.yml; complain.
+	if adjustments.Env != "" {
+		// Environment-specific overlay goes on top of the arch-specific one.
+		manifestEnvFullName := moscommon.GetManifestEnvFilePath(appDir, adjustments.Env)
+		if err := extendManifestWithOverlay(manifest, manifestEnvFullName, interp, &mtime, adjustments.FailOnWarning); err != nil {
 			return nil, time.Time{}, errors.Trace(err)
 		}
 	}
@@ -1143,6 +1215,7 @@ func ReadManifest(
 			BuildVars: adjustments.BuildVars,
 		}, "", "", interp, &extendManifestOptions{
 			skipFailedExpansions: true,
+			failOnWarning:        adjustments.FailOnWarning,
 		},
 	); err != nil {
 		return nil, time.Time{}, errors.Trace(err)
@@ -1151,12 +1224,60 @@ func ReadManifest(
 	return manifest, mtime, nil
 }
 
-func checkWarningAndError(manifest *build.FWAppManifest) error {
+// extendManifestWithOverlay extends manifest with the contents of the overlay
+// file (mos_<arch>.yml or mos.<env>.yml), if it exists. mtime is updated if
+// the overlay is newer.
+func extendManifestWithOverlay(
+	manifest *build.FWAppManifest, overlayFullName string, interp *interpreter.MosInterpreter, mtime *time.Time,
+	failOnWarning bool,
+) error {
+	if _, err := os.Stat(overlayFullName); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		// Some error other than non-existing overlay; complain.
+		return errors.Trace(err)
+	}
+
+	overlayManifest, overlayMtime, err := readManifestFile(overlayFullName, interp, false, failOnWarning)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// We should return the latest modification date of all encountered
+	// manifests, so let's see if we got the later mtime here
+	if overlayMtime.After(*mtime) {
+		*mtime = overlayMtime
+	}
+
+	return errors.Trace(extendManifest(manifest, manifest, overlayManifest, "", "", interp, &extendManifestOptions{
+		skipFailedExpansions: true,
+		extendInitDeps:       true,
+		failOnWarning:        failOnWarning,
+	}))
+}
+
+// setLibsAppDir sets the dir for the libs of the manifest and its conds.
+func setLibsAppDir(manifest *build.FWAppManifest, dir string) {
+	for i := range manifest.Libs {
+		manifest.Libs[i].SetAppDir(dir)
+	}
+	for _, c := range manifest.Conds {
+		if c.Apply != nil {
+			setLibsAppDir(c.Apply, dir)
+		}
+	}
+}
+
+func checkWarningAndError(manifest *build.FWAppManifest, failOnWarning bool) error {
 	if manifest.Error != "" {
 		ourutil.Reportf("Error: %s: %s", manifest.Origin, manifest.Error)
 		return errors.Errorf("%s: %s", manifest.Origin, manifest.Error)
 	}
 	if manifest.Warning != "" {
+		if failOnWarning {
+			return errors.Errorf("%s: %s (--fail-on-manifest-warning is set)", manifest.Origin, manifest.Warning)
+		}
 		ourutil.Reportf("Warning: %s: %s", manifest.Origin, manifest.Warning)
 	}
 	return nil
@@ -1166,6 +1287,12 @@ func checkWarningAndError(manifest *build.FWAppManifest) error {
 // or lib manifest, or some arch-specific adjustment manifest)
 func ReadManifestFile(
 	manifestFullName string, interp *interpreter.MosInterpreter, manifestVersionMandatory bool,
+) (*build.FWAppManifest, time.Time, error) {
+	return readManifestFile(manifestFullName, interp, manifestVersionMandatory, false)
+}
+
+func readManifestFile(
+	manifestFullName string, interp *interpreter.MosInterpreter, manifestVersionMandatory, failOnWarning bool,
 ) (*build.FWAppManifest, time.Time, error) {
 	interp = interp.Copy()
 	var manifestSrc []byte
@@ -1190,11 +1317,20 @@ func ReadManifestFile(
 
 	manifest.Origin = manifestFullName
 
+	if !strings.HasPrefix(manifestFullName, assetPrefix) {
+		// Relative lib locations are relative to the manifest which declares them.
+		manifestDir, err := filepath.Abs(filepath.Dir(manifestFullName))
+		if err != nil {
+			return nil, time.Time{}, errors.Trace(err)
+		}
+		setLibsAppDir(&manifest, manifestDir)
+	}
+
 	if manifest.ManifestVersion != "" {
 		// Check if manifest manifest version is supported by the mos tool
 		if manifest.ManifestVersion < minManifestVersion {
 			return nil, time.Time{}, errors.Errorf(
-				"too old manifest_version %q in %q (oldest supported is %q)",
+				"too old manifest_version %q in %q (oldest supported is %q). Please run \"mos manifest-upgrade\".",
 				manifest.ManifestVersion, manifestFullName, minManifestVersion,
 			)
 		}
@@ -1211,7 +1347,7 @@ func ReadManifestFile(
 		)
 	}
 
-	if err = checkWarningAndError(&manifest); err != nil {
+	if err = checkWarningAndError(&manifest, failOnWarning); err != nil {
 		return nil, time.Time{}, errors.Trace(err)
 	}
 
@@ -1357,7 +1493,8 @@ func expandManifestLibsAndConds(
 
 			if err := extendManifest(
 				&curManifest, commonManifest, &curManifest, "", lcur.Path, interp, &extendManifestOptions{
-					skipSources: true,
+					skipSources:   true,
+					failOnWarning: adjustments.FailOnWarning,
 				},
 			); err != nil {
 				return errors.Annotatef(err, "expanding %q", lcur.Lib.Name)
@@ -1395,7 +1532,10 @@ func expandManifestLibsAndConds(
 		// top-level (app) conds are evaluated first, and then evaluation proceeds
 		// from the bottom (starting with libs with no deps).
 
-		if err := ExpandManifestConds(manifest, commonManifest, interp, true); err != nil {
+		endConds := trace.Span("conds", "app")
+		err := ExpandManifestConds(manifest, commonManifest, interp, true)
+		endConds()
+		if err != nil {
 			return errors.Annotatef(err, "expanding app manifest's conds")
 		}
 		if len(manifest.Libs) > 0 {
@@ -1405,7 +1545,10 @@ func expandManifestLibsAndConds(
 
 		for _, l := range manifest.LibsHandled {
 			if l.Manifest != nil && len(l.Manifest.Conds) > 0 {
-				if err := ExpandManifestConds(l.Manifest, commonManifest, interp, false); err != nil {
+				endConds := trace.Span("conds", l.Lib.Name)
+				err := ExpandManifestConds(l.Manifest, commonManifest, interp, false)
+				endConds()
+				if err != nil {
 					return errors.Annotatef(err, "expanding %q conds", l.Lib.Name)
 				}
 				if len(l.Manifest.Libs) > 0 {
@@ -1571,11 +1714,11 @@ func extendManifest(
 		opts = &extendManifestOptions{}
 	}
 
-	if err := checkWarningAndError(m1); err != nil {
+	if err := checkWarningAndError(m1, opts.failOnWarning); err != nil {
 		return errors.Trace(err)
 	}
 
-	if err := checkWarningAndError(m2); err != nil {
+	if err := checkWarningAndError(m2, opts.failOnWarning); err != nil {
 		return errors.Trace(err)
 	}
 
@@ -1661,6 +1804,7 @@ type extendManifestOptions struct {
 	skipSources          bool
 	skipFailedExpansions bool
 	extendInitDeps       bool
+	failOnWarning        bool
 }
 
 func prependPaths(items []string, dir string) []string {
@@ -2001,6 +2145,120 @@ func globify(srcPaths []string, globs []string) (sources []string, dirs []string
 	return sources, dirs, nil
 }
 
+// addPlatformFSDirs adds files from <dir>/<platform> for each of the
+// filesystem dirs, overriding common files with the same name.
+// Subdirectories named after platforms are not included as such.
+func addPlatformFSDirs(files, dirs []string, platform string, allPlatforms []string) ([]string, []string, error) {
+	isPlatform := map[string]bool{platform: true}
+	for _, p := range allPlatforms {
+		isPlatform[p] = true
+	}
+	isFSDir := map[string]bool{}
+	for _, d := range dirs {
+		isFSDir[d] = true
+	}
+
+	var platformFiles, platformDirs []string
+	for _, d := range dirs {
+		pd := filepath.Join(d, platform)
+		if fi, err := os.Stat(pd); err != nil || !fi.IsDir() {
+			continue
+		}
+		pf, err := filepath.Glob(filepath.Join(pd, "*"))
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		glog.V(1).Infof("%s: adding %d platform-specific files", pd, len(pf))
+		platformFiles = append(platformFiles, pf...)
+		platformDirs = append(platformDirs, pd)
+	}
+
+	overridden := map[string]bool{}
+	for _, f := range platformFiles {
+		overridden[filepath.Base(f)] = true
+	}
+
+	var res []string
+	for _, f := range files {
+		bf := filepath.Base(f)
+		if isFSDir[filepath.Dir(f)] && isPlatform[bf] {
+			if fi, err := os.Stat(f); err == nil && fi.IsDir() {
+				continue
+			}
+		}
+		if overridden[bf] {
+			glog.Infof("%q overridden by a %s-specific file", f, platform)
+			continue
+		}
+		res = append(res, f)
+	}
+
+	return append(res, platformFiles...), append(dirs, platformDirs...), nil
+}
+
+// applyFSFilters applies fs_filters to the filesystem files. Patterns without
+// a slash are matched against the file name, patterns with a slash - against
+// the path relative to the filesystem dir the file comes from, e.g.
+// "conf/*.json". The first matching entry wins; files which don't match any
+// of the entries are included.
+func applyFSFilters(files []string, filters []*build.FSFilterEntry, fsDirs, platformDirs []string) ([]string, error) {
+	for i, e := range filters {
+		if e.Include != "" && e.Exclude != "" {
+			return nil, errors.Errorf("fs_filters entry %d: only one of include or exclude is allowed", i)
+		}
+	}
+	var res []string
+	for _, f := range files {
+		include := true
+		for _, e := range filters {
+			if e.Include != "" && fsFilterMatch(e.Include, f, fsDirs, platformDirs) {
+				include = true
+				break
+			}
+			if e.Exclude != "" && fsFilterMatch(e.Exclude, f, fsDirs, platformDirs) {
+				glog.Infof("%q excluded by %q", f, e.Exclude)
+				include = false
+				break
+			}
+		}
+		if include {
+			res = append(res, f)
+		}
+	}
+	return res, nil
+}
+
+func fsFilterMatch(pattern, f string, fsDirs, platformDirs []string) bool {
+	name := filepath.Base(f)
+	if strings.Contains(pattern, "/") {
+		// Platform-specific files end up in the root, same as the files
+		// they override.
+		if name = fsRelPath(f, platformDirs); name == "" {
+			if name = fsRelPath(f, fsDirs); name == "" {
+				return false
+			}
+		}
+	}
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+// fsRelPath returns the slash-separated path of f relative to the outermost
+// of the dirs containing it, or an empty string if there is none.
+func fsRelPath(f string, dirs []string) string {
+	res := ""
+	for _, d := range dirs {
+		rel, err := filepath.Rel(d, f)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if len(rel) > len(res) {
+			res = rel
+		}
+	}
+	return filepath.ToSlash(res)
+}
+
 func getAllSupportedPlatforms(mosDir string) ([]string, error) {
 	var ret []string
 	sdkVersionFiles, _ := filepath.Glob(moscommon.GetSdkVersionFile(mosDir, "*"))
@@ -23,6 +23,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -41,6 +42,7 @@ const (
 	finalManifestName  = "mos_final.yml"
 	depsInitName       = "mgos_deps_init.c"
 	depsManifestName   = "mgos_deps_manifest.yml"
+	depsGraphName      = "deps.json"
 	testDescriptorName = "test_desc.yml"
 	errorTextFile      = "error.txt"
 
@@ -59,8 +61,10 @@ var (
 
 type TestDescr struct {
 	PreferBinaryLibs bool                 `yaml:"prefer_binary_libs"`
+	Env              string               `yaml:"env"`
 	BuildVars        map[string]string    `yaml:"build_vars"`
 	RepoInfo         map[string]*RepoInfo `yaml:"repo_info"`
+	DepOverrides     map[string]string    `yaml:"dep_overrides"`
 }
 
 type RepoInfo struct {
@@ -89,6 +93,128 @@ func TestParser(t *testing.T) {
 	}
 }
 
+func TestInitDepsInfo(t *testing.T) {
+	appPath := filepath.Join(testManifestsDir, "test_03_weak_dep_used")
+	manifest, _, err := ReadManifestFinal(
+		filepath.Join(appPath, appDir), &build.ManifestAdjustments{Platform: "esp8266"},
+		&bytes.Buffer{}, interpreter.NewInterpreter(newMosVars()),
+		&ReadManifestCallbacks{ComponentProvider: &compProviderTest{descr: &TestDescr{}}}, true, false, 0,
+	)
+	if err != nil {
+		t.Fatal(errors.ErrorStack(err))
+	}
+	idi := manifest.InitDepsInfo["mylib2"]
+	if idi == nil {
+		t.Fatalf("no init deps info for mylib2")
+	}
+	expExplicit := []build.InitDep{{Name: "dummy1", Reason: "init_after"}, {Name: "mylib4*", Reason: "init_after"}}
+	if !reflect.DeepEqual(idi.Explicit, expExplicit) {
+		t.Errorf("unexpected explicit init deps: %+v", idi.Explicit)
+	}
+	expImplicit := []build.InitDep{{Name: "core", Reason: "core"}}
+	if !reflect.DeepEqual(idi.Implicit, expImplicit) || idi.ImplicitSuppressed {
+		t.Errorf("unexpected implicit init deps: %+v", idi)
+	}
+	if idi := manifest.InitDepsInfo["mylib1*"]; idi == nil || len(idi.Explicit) != 1 || idi.Explicit[0].Reason != "init_before in mylib2" {
+		t.Errorf("unexpected init deps info for mylib1*: %+v", idi)
+	}
+}
+
+func TestFailOnWarning(t *testing.T) {
+	m := &build.FWAppManifest{Origin: "mos.yml", Warning: "deprecated"}
+	if err := checkWarningAndError(m, false); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := checkWarningAndError(m, true); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestLibsAppDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest_parser_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	libDir := filepath.Join(dir, "mylib")
+	os.MkdirAll(libDir, 0755)
+	mf := filepath.Join(libDir, "mos.yml")
+	if err := ioutil.WriteFile(mf, []byte(`
+libs:
+  - location: libs/foo
+conds:
+  - when: mos.platform == "esp32"
+    apply:
+      libs:
+        - location: ../bar
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := ReadManifestFile(mf, interpreter.NewInterpreter(newMosVars()), false)
+	if err != nil {
+		t.Fatal(errors.ErrorStack(err))
+	}
+	if len(m.Libs) != 1 || len(m.Conds) != 1 || len(m.Conds[0].Apply.Libs) != 1 {
+		t.Fatalf("unexpected manifest: %+v", m)
+	}
+	// Relative locations are resolved against the dir of the lib manifest,
+	// not the app dir.
+	for lib, exp := range map[*build.SWModule]string{
+		&m.Libs[0]:                filepath.Join(libDir, "libs", "foo"),
+		&m.Conds[0].Apply.Libs[0]: filepath.Join(dir, "bar"),
+	} {
+		if d, err := lib.GetLocalDir("", ""); err != nil || d != exp {
+			t.Errorf("%s: expected %q, got %q %v", lib.Location, exp, d, err)
+		}
+	}
+}
+
+func TestApplyFSFilters(t *testing.T) {
+	fp := func(p string) string { return filepath.FromSlash(p) }
+	files := []string{
+		fp("/app/fs/index.html"),
+		fp("/app/fs/conf/secret.json"),
+		fp("/app/fs/conf/conf1.json"),
+		fp("/app/fs/data/secret.json"),
+		fp("/app/fs/esp8266/conf/secret.json"),
+		fp("/lib/fs/secret.json"),
+	}
+	fsDirs := []string{fp("/app/fs"), fp("/app/fs/conf"), fp("/app/fs/data"), fp("/lib/fs")}
+	platformDirs := []string{fp("/app/fs/esp8266")}
+	for i, c := range []struct {
+		filters []*build.FSFilterEntry
+		exp     []int
+	}{
+		{nil, []int{0, 1, 2, 3, 4, 5}},
+		// Patterns without a slash match the file name.
+		{[]*build.FSFilterEntry{{Exclude: "secret.json"}}, []int{0, 2}},
+		// Patterns with a slash match the path relative to the outermost fs dir,
+		// or to the platform dir for platform-specific files.
+		{[]*build.FSFilterEntry{{Exclude: "conf/secret.json"}}, []int{0, 2, 3, 5}},
+		{[]*build.FSFilterEntry{{Exclude: "*/secret.json"}}, []int{0, 2, 5}},
+		{[]*build.FSFilterEntry{{Exclude: "esp8266/conf/secret.json"}}, []int{0, 1, 2, 3, 4, 5}},
+		// First match wins.
+		{[]*build.FSFilterEntry{{Include: "data/*"}, {Exclude: "*.json"}}, []int{0, 3}},
+		{[]*build.FSFilterEntry{{Exclude: "*.json"}, {Include: "data/*"}}, []int{0}},
+		{[]*build.FSFilterEntry{{Include: "conf/conf1.json"}, {Exclude: "conf/*"}}, []int{0, 2, 3, 5}},
+	} {
+		res, err := applyFSFilters(files, c.filters, fsDirs, platformDirs)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		var exp []string
+		for _, j := range c.exp {
+			exp = append(exp, files[j])
+		}
+		if !reflect.DeepEqual(res, exp) {
+			t.Errorf("%d: expected %q, got %q", i, exp, res)
+		}
+	}
+	if _, err := applyFSFilters(files, []*build.FSFilterEntry{{Include: "a", Exclude: "b"}}, fsDirs, platformDirs); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
 func handleTestSet(t *testing.T, testSetPath string) bool {
 	files, err := ioutil.ReadDir(testSetPath)
 	if err != nil {
@@ -158,6 +284,15 @@ func singleManifestTest(t *testing.T, appPath string) error {
 		platforms = append(platforms, v.Name())
 	}
 
+	depOverrides := map[string]build.DepOverride{}
+	for n, spec := range descr.DepOverrides {
+		_, do, err := build.ParseDepOverride(n + "=" + spec)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		depOverrides[n] = *do
+	}
+
 	for _, platform := range platforms {
 		logWriter := &bytes.Buffer{}
 		interp := interpreter.NewInterpreter(newMosVars())
@@ -167,7 +302,10 @@ func singleManifestTest(t *testing.T, appPath string) error {
 		manifest, _, err := ReadManifestFinal(
 			filepath.Join(appPath, appDir), &build.ManifestAdjustments{
 				Platform:  platform,
+				Env:       descr.Env,
 				BuildVars: descr.BuildVars,
+
+				DepOverrides: depOverrides,
 			}, logWriter, interp,
 			&ReadManifestCallbacks{ComponentProvider: &compProviderTest{descr: &descr}}, true, descr.PreferBinaryLibs, 0,
 		)
@@ -221,6 +359,25 @@ func singleManifestTest(t *testing.T, appPath string) error {
 			}
 		}
 
+		{ // Verify deps graph
+			expectedFilename = filepath.Join(appPath, expectedDir, platform, depsGraphName)
+			if _, err := os.Stat(expectedFilename); err == nil {
+				var buf bytes.Buffer
+				if err := GetDepsGraph(manifest).WriteJSON(&buf); err != nil {
+					return errors.Trace(err)
+				}
+				data, err := addPlaceholders(buf.Bytes(), appPath)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				actualFilename = filepath.Join(buildDir, depsGraphName)
+				ioutil.WriteFile(actualFilename, data, 0644)
+				if err = compareFiles(actualFilename, expectedFilename); err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+
 		{ // Verify deps_init
 			actualFilename = filepath.Join(buildDir, "gen", depsInitName)
 			expectedFilename = filepath.Join(appPath, expectedDir, platform, depsInitName)
@@ -0,0 +1,125 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package manifest_parser
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/juju/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ManifestVersionChange describes a change in manifest semantics introduced
+// in a particular manifest version.
+type ManifestVersionChange struct {
+	Version     string
+	Key         string
+	Description string
+}
+
+// manifestVersionChanges lists top-level manifest keys whose semantics
+// changed, see the comment next to maxManifestVersion. Must be sorted by
+// version.
+var manifestVersionChanges = []ManifestVersionChange{
+	{"2017-06-03", "filesystem", "@all_libs is expanded"},
+	{"2017-06-03", "sources", "@all_libs is expanded"},
+	{"2017-06-16", "conds", "conditions are evaluated as expressions"},
+	{"2017-09-29", "includes", "includes are handled"},
+	{"2018-06-12", "init_deps", "globs are expanded"},
+	{"2018-06-20", "no_implicit_init_deps", "libs are no longer implicitly added to init_deps"},
+	{"2018-08-13", "libs", "non-GitHub Git repos are supported"},
+	{"2018-08-29", "conds", "libs can be added under conds"},
+	{"2018-09-24", "libs", "the \"boards\" lib is handled specially"},
+	{"2019-04-26", "conds", "warning and error are handled"},
+	{"2019-07-28", "init_before", "init order can be adjusted"},
+	{"2020-01-21", "conds", "app conds can override lib variants"},
+	{"2020-01-29", "conds", "app conds can override name, description and version"},
+	{"2020-08-02", "libs", "asset_api selects the asset-fetching mechanism"},
+	{"2020-08-02", "fs_filters", "filesystem filters are applied"},
+}
+
+var manifestVersionRegexp = regexp.MustCompile(`(?m)^manifest_version:.*$`)
+
+// MaxManifestVersion returns the latest manifest version supported.
+func MaxManifestVersion() string {
+	return maxManifestVersion
+}
+
+// GetManifestVersionChanges returns changes introduced after the "from"
+// version up to and including the "to" version which affect the given keys.
+// If keys is nil, all the changes are returned.
+func GetManifestVersionChanges(from, to string, keys map[string]bool) []ManifestVersionChange {
+	var res []ManifestVersionChange
+	for _, c := range manifestVersionChanges {
+		if c.Version <= from || c.Version > to {
+			continue
+		}
+		if keys != nil && !keys[c.Key] {
+			continue
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// UpgradeManifestVersion sets manifest_version in the given manifest file to
+// the latest supported one, leaving the rest of the file intact. Returns old
+// manifest version and the changes affecting the keys used in the manifest.
+func UpgradeManifestVersion(manifestFullName string) (string, []ManifestVersionChange, error) {
+	data, err := ioutil.ReadFile(manifestFullName)
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return "", nil, errors.Annotatef(err, "parsing manifest %q", manifestFullName)
+	}
+	oldVersion := ""
+	if v, ok := m["manifest_version"]; ok {
+		oldVersion = fmt.Sprintf("%v", v)
+	}
+	if oldVersion > maxManifestVersion {
+		return "", nil, errors.Errorf(
+			"too new manifest_version %q in %q (latest supported is %q). Please run \"mos update\".",
+			oldVersion, manifestFullName, maxManifestVersion,
+		)
+	}
+	if oldVersion == maxManifestVersion {
+		return oldVersion, nil, nil
+	}
+
+	keys := map[string]bool{}
+	for k := range m {
+		keys[k] = true
+	}
+	changes := GetManifestVersionChanges(oldVersion, maxManifestVersion, keys)
+
+	newLine := []byte(fmt.Sprintf("manifest_version: %s", maxManifestVersion))
+	if manifestVersionRegexp.Match(data) {
+		data = manifestVersionRegexp.ReplaceAllLiteral(data, newLine)
+	} else {
+		data = append(append(newLine, '\n'), data...)
+	}
+	if err := ioutil.WriteFile(manifestFullName, data, 0644); err != nil {
+		return "", nil, errors.Trace(err)
+	}
+
+	return oldVersion, changes, nil
+}
@@ -0,0 +1,67 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package manifest_parser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpgradeManifestVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest_version_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "mos.yml")
+	data := "author: me\nmanifest_version: 2019-01-01\ninit_before:\n  - foo\nlibs:\n  - location: https://github.com/mongoose-os-libs/boards\n"
+	if err := ioutil.WriteFile(fname, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldVersion, changes, err := UpgradeManifestVersion(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldVersion != "2019-01-01" {
+		t.Errorf("unexpected old version %q", oldVersion)
+	}
+	var keys []string
+	for _, c := range changes {
+		keys = append(keys, c.Key)
+	}
+	if len(keys) != 2 || keys[0] != "init_before" || keys[1] != "libs" {
+		t.Errorf("unexpected changes: %+v", changes)
+	}
+
+	res, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "author: me\nmanifest_version: " + maxManifestVersion + "\ninit_before:\n  - foo\nlibs:\n  - location: https://github.com/mongoose-os-libs/boards\n"
+	if string(res) != exp {
+		t.Errorf("unexpected result:\n%s\nexpected:\n%s", res, exp)
+	}
+
+	oldVersion, changes, err = UpgradeManifestVersion(fname)
+	if err != nil || oldVersion != maxManifestVersion || len(changes) != 0 {
+		t.Errorf("unexpected second upgrade result: %q %+v %v", oldVersion, changes, err)
+	}
+}
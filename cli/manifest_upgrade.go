@@ -0,0 +1,59 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/builder"
+	moscommon "github.com/mongoose-os/mos/cli/common"
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/manifest_parser"
+	"github.com/mongoose-os/mos/cli/ourutil"
+)
+
+func manifestUpgrade(ctx context.Context, devConn dev.DevConn) error {
+	appDir, err := builder.GetCodeDirAbs()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	manifestFullName := moscommon.GetManifestFilePath(appDir)
+
+	oldVersion, changes, err := manifest_parser.UpgradeManifestVersion(manifestFullName)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	newVersion := manifest_parser.MaxManifestVersion()
+	if oldVersion == newVersion {
+		ourutil.Reportf("%s: manifest_version is already %s", manifestFullName, newVersion)
+		return nil
+	}
+
+	if oldVersion == "" {
+		oldVersion = "none"
+	}
+	ourutil.Reportf("%s: manifest_version %s -> %s", manifestFullName, oldVersion, newVersion)
+	if len(changes) > 0 {
+		ourutil.Reportf("Keys with changed semantics, please review:")
+		for _, c := range changes {
+			ourutil.Reportf("  %s (%s): %s", c.Key, c.Version, c.Description)
+		}
+	}
+	return nil
+}
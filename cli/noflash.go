@@ -37,6 +37,14 @@ func esp32EncryptImage(ctx context.Context, devConn dev.DevConn) error {
 	return errors.NotImplementedf("esp32-encrypt-image: this build was built without flashing support")
 }
 
+func macHandler(ctx context.Context, devConn dev.DevConn) error {
+	return errors.NotImplementedf("mac: this build was built without flashing support")
+}
+
+func chipInfo(ctx context.Context, devConn dev.DevConn) error {
+	return errors.NotImplementedf("chip-info: this build was built without flashing support")
+}
+
 func esp32GenKey(ctx context.Context, devConn dev.DevConn) error {
 	return errors.NotImplementedf("esp32-gen-key: this build was built without flashing support")
 }
@@ -0,0 +1,168 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package ota
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/devutil"
+	"github.com/mongoose-os/mos/cli/ourutil"
+)
+
+type batchResult struct {
+	port     string
+	err      error
+	skipped  bool
+	duration time.Duration
+}
+
+// readDevices reads the list of devices: one port or address per line,
+// empty lines and lines starting with # are ignored.
+func readDevices(fname string) ([]string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	var res []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		res = append(res, line)
+	}
+	return res, errors.Trace(scanner.Err())
+}
+
+// batchOp is an operation performed on each device of a batch.
+type batchOp struct {
+	// For messages: "Updating", "Update", "updated".
+	verb, noun, pastPart string
+	run                  func(ctx context.Context, devConn dev.DevConn, reportf func(f string, args ...interface{})) error
+}
+
+func updateOp(img *otaImage, beginArgs string) *batchOp {
+	return &batchOp{
+		verb: "Updating", noun: "Update", pastPart: "updated",
+		run: func(ctx context.Context, devConn dev.DevConn, reportf func(f string, args ...interface{})) error {
+			return otaDevice(ctx, devConn, img, beginArgs, reportf, nil)
+		},
+	}
+}
+
+var activateOp = &batchOp{
+	verb: "Activating update on", noun: "Activation", pastPart: "activated",
+	run: activateDevice,
+}
+
+func runBatch(ctx context.Context, devicesFile string, op *batchOp) error {
+	ports, err := readDevices(devicesFile)
+	if err != nil {
+		return errors.Annotatef(err, "failed to read %s", devicesFile)
+	}
+	if len(ports) == 0 {
+		return errors.Errorf("no devices in %s", devicesFile)
+	}
+	n := *parallelismFlag
+	if n < 1 {
+		n = 1
+	}
+	ourutil.Reportf("%s %d devices, %d at a time...", op.verb, len(ports), n)
+
+	var lock sync.Mutex
+	numFailed := 0
+	aborted := false
+
+	results := make([]*batchResult, len(ports))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, n)
+	for i, port := range ports {
+		wg.Add(1)
+		go func(i int, port string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			res := &batchResult{port: port}
+			results[i] = res
+			lock.Lock()
+			res.skipped = aborted
+			lock.Unlock()
+			if res.skipped {
+				return
+			}
+			start := time.Now()
+			res.err = batchDevice(ctx, port, op)
+			res.duration = time.Since(start)
+			if res.err != nil {
+				ourutil.Reportf("[%s] %s failed: %s", port, op.noun, res.err)
+				lock.Lock()
+				numFailed++
+				if *maxFailuresFlag > 0 && numFailed >= *maxFailuresFlag && !aborted {
+					ourutil.Reportf("%d devices failed, aborting the batch", numFailed)
+					aborted = true
+				}
+				lock.Unlock()
+			} else {
+				ourutil.Reportf("[%s] %s finished", port, op.noun)
+			}
+		}(i, port)
+	}
+	wg.Wait()
+
+	ourutil.Reportf("\nSummary:")
+	numOK, numSkipped := 0, 0
+	for _, r := range results {
+		switch {
+		case r.skipped:
+			numSkipped++
+			ourutil.Reportf("  %s: skipped", r.port)
+		case r.err != nil:
+			ourutil.Reportf("  %s: FAILED (%s): %s", r.port, r.duration.Round(time.Second), r.err)
+		default:
+			numOK++
+			ourutil.Reportf("  %s: ok (%s)", r.port, r.duration.Round(time.Second))
+		}
+	}
+	ourutil.Reportf("%d succeeded, %d failed, %d skipped", numOK, numFailed, numSkipped)
+	if numFailed > 0 || numSkipped > 0 {
+		return errors.Errorf("%d of %d devices were not %s", numFailed+numSkipped, len(ports), op.pastPart)
+	}
+	return nil
+}
+
+func batchDevice(ctx context.Context, port string, op *batchOp) error {
+	reportf := func(f string, args ...interface{}) {
+		ourutil.Reportf("[%s] %s", port, fmt.Sprintf(f, args...))
+	}
+	devConn, err := devutil.CreateDevConnForPort(ctx, port)
+	if err != nil {
+		return errors.Annotatef(err, "failed to connect")
+	}
+	defer devConn.Disconnect(ctx)
+	return errors.Trace(op.run(ctx, devConn, reportf))
+}
@@ -21,13 +21,18 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/juju/errors"
+	"github.com/mongoose-os/mos/cli/buildid"
 	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/devutil"
 	"github.com/mongoose-os/mos/cli/flags"
 	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/common/fwbundle"
 	flag "github.com/spf13/pflag"
+	glog "k8s.io/klog/v2"
 )
 
 var (
@@ -35,10 +40,62 @@ var (
 		"If set, update must be explicitly committed within this time after finishing")
 	updateTimeoutFlag = flag.Duration("update-timeout", 600*time.Second,
 		"Timeout for entire update operation")
+	devicesFlag = flag.String("devices", "",
+		"File with the list of devices to update, one port or address per line")
+	parallelismFlag = flag.Int("parallelism", 4,
+		"With --devices, max number of devices to update in parallel")
+	maxFailuresFlag = flag.Int("max-failures", 0,
+		"With --devices, abort the batch after this many devices failed to update. 0 means no limit")
+	deltaFlag = flag.String("delta", "",
+		"Delta file created by mos fw-delta. Requires --base")
+	baseFlag = flag.String("base", "",
+		"With --delta, the firmware bundle the delta was created against")
+	progressFlag = flag.String("progress", "text",
+		"Progress output: text, or json to print one JSON object per line to stdout: "+
+			"{phase, bytes_sent, total_bytes, percent}, and the final one with the result")
 )
 
+// OTA phases, as reported by --progress=json.
+const (
+	phaseStatus = "status"
+	phaseBegin  = "begin"
+	phaseWrite  = "write"
+	phaseEnd    = "end"
+	// The final object, with the result.
+	phaseDone = "done"
+)
+
+// otaProgress is the progress object printed by --progress=json.
+type otaProgress struct {
+	Phase      string  `json:"phase"`
+	BytesSent  int64   `json:"bytes_sent"`
+	TotalBytes int64   `json:"total_bytes"`
+	Percent    float64 `json:"percent"`
+	// Set in the final object: "ok" or "error".
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func printProgressJSON(p otaProgress) {
+	data, _ := json.Marshal(&p)
+	fmt.Println(string(data))
+}
+
+// otaImage is the firmware to send: the full bundle and, optionally,
+// a delta that is sent instead if the device supports it.
+type otaImage struct {
+	full  []byte
+	delta []byte
+	// Build id of the firmware the delta applies to.
+	deltaBaseBuildID string
+}
+
 func OTA(ctx context.Context, devConn dev.DevConn) error {
 	args := flag.Args()
+	if *deltaFlag != "" {
+		// Firmware file is not needed, it is reconstructed from the delta.
+		args = append([]string{args[0], ""}, args[1:]...)
+	}
 	fwFilename := ""
 	beginArgs := ""
 	switch len(args) {
@@ -53,15 +110,91 @@ func OTA(ctx context.Context, devConn dev.DevConn) error {
 		return errors.Errorf("extra arguments")
 	}
 
-	fwFileData, err := ourutil.ReadOrFetchFile(fwFilename)
+	var img otaImage
+	var err error
+	if *deltaFlag != "" {
+		if err = readDelta(&img); err != nil {
+			return errors.Trace(err)
+		}
+	} else if img.full, err = ourutil.ReadOrFetchFile(fwFilename); err != nil {
+		return errors.Trace(err)
+	}
+
+	var progress func(p otaProgress)
+	switch *progressFlag {
+	case "", "text":
+	case "json":
+		if *devicesFlag != "" {
+			return errors.Errorf("--progress=json is not supported with --devices")
+		}
+		progress = printProgressJSON
+	default:
+		return errors.Errorf("invalid --progress %q, must be text or json", *progressFlag)
+	}
+
+	if *devicesFlag != "" {
+		return errors.Trace(runBatch(ctx, *devicesFlag, updateOp(&img, beginArgs)))
+	}
+
+	if devConn == nil {
+		devConn, err = devutil.CreateDevConnFromFlags(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer devConn.Disconnect(ctx)
+	}
+
+	return errors.Trace(otaDevice(ctx, devConn, &img, beginArgs, ourutil.Reportf, progress))
+}
+
+// readDelta reconstructs the full firmware from --base and --delta and
+// verifies it against the manifest contained in the delta.
+func readDelta(img *otaImage) error {
+	if *baseFlag == "" {
+		return errors.Errorf("--base is required with --delta")
+	}
+	delta, err := ourutil.ReadOrFetchFile(*deltaFlag)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	fwFileSize := len(fwFileData)
+	full, di, err := fwbundle.ApplyDelta(*baseFlag, delta)
+	if err != nil {
+		return errors.Annotatef(err, "failed to apply %s to %s", *deltaFlag, *baseFlag)
+	}
+	ourutil.Reportf("Reconstructed firmware from %s (base version %s, build %s), checksums verified",
+		*deltaFlag, di.BaseVersion, di.BaseBuildID)
+	img.full, img.delta, img.deltaBaseBuildID = full, delta, di.BaseBuildID
+	return nil
+}
+
+// otaDevice performs the update, reporting the progress as text via reportf
+// and, if progress is not nil, as otaProgress objects: one per phase, one for
+// each percent written and the final one with the result.
+func otaDevice(
+	ctx context.Context, devConn dev.DevConn, img *otaImage, beginArgs string,
+	reportf func(f string, args ...interface{}), progress func(p otaProgress),
+) (err error) {
+	var p otaProgress
+	setPhase := func(phase string) {
+		p.Phase = phase
+		if progress != nil {
+			progress(p)
+		}
+	}
+	defer func() {
+		p.Result = "ok"
+		if err != nil {
+			p.Result, p.Error = "error", err.Error()
+		}
+		setPhase(phaseDone)
+	}()
 
-	ourutil.Reportf("Getting current OTA status...")
+	setPhase(phaseStatus)
+	reportf("Getting current OTA status...")
 	st := struct {
-		State int `json:"state"`
+		State             int  `json:"state"`
+		DeltaSupported    bool `json:"delta_supported"`
+		NoRebootSupported bool `json:"no_reboot_supported"`
 	}{State: -1}
 	if err := devConn.Call(ctx, "OTA.Status", nil, &st); err != nil {
 		return errors.Annotatef(err, "unable to get current OTA status")
@@ -69,26 +202,54 @@ func OTA(ctx context.Context, devConn dev.DevConn) error {
 	if st.State != 0 && st.State != 2 /* MGOS_OTA_STATE_ERROR */ {
 		return errors.Errorf("update is already in progress (%d), call OTA.End", st.State)
 	}
+	// Older firmware ignores no_reboot and reboots into the new image.
+	if *flags.NoReboot && !st.NoRebootSupported {
+		return errors.Errorf("device firmware does not support --no-reboot")
+	}
+
+	fwFileData, isDelta := img.full, false
+	if img.delta != nil {
+		devBuildID, err := buildid.FromDevice(ctx, devConn)
+		if err != nil {
+			glog.Warningf("%s", err)
+		}
+		if err := buildid.Compare("delta base", img.deltaBaseBuildID, "device firmware", devBuildID); err != nil {
+			reportf("%s, sending full firmware", err)
+		} else if st.DeltaSupported {
+			reportf("Sending delta (%d bytes instead of %d)", len(img.delta), len(img.full))
+			fwFileData, isDelta = img.delta, true
+		} else {
+			reportf("Device does not support delta updates, sending full firmware")
+		}
+	}
+	fwFileSize := len(fwFileData)
+	p.TotalBytes = int64(fwFileSize)
 
 	if beginArgs == "" {
 		ba := struct {
 			Timeout       int64 `json:"timeout"`
 			CommitTimeout int64 `json:"commit_timeout"`
 			Size          int64 `json:"size"`
+			Delta         bool  `json:"delta,omitempty"`
+			NoReboot      bool  `json:"no_reboot,omitempty"`
 		}{
 			Timeout:       int64(*updateTimeoutFlag) / 1000000000,
 			CommitTimeout: int64(*commitTimeoutFlag) / 1000000000,
 			Size:          int64(fwFileSize),
+			Delta:         isDelta,
+			NoReboot:      *flags.NoReboot,
 		}
 		baJSON, _ := json.Marshal(&ba)
 		beginArgs = string(baJSON)
 	}
-	ourutil.Reportf("Starting an update (args: %s)...", beginArgs)
-	if err = devConn.Call(ctx, "OTA.Begin", beginArgs, nil); err != nil {
+	setPhase(phaseBegin)
+	reportf("Starting an update (args: %s)...", beginArgs)
+	if err := devConn.Call(ctx, "OTA.Begin", beginArgs, nil); err != nil {
 		return errors.Annotatef(err, "unable to start an update")
 	}
 
-	ourutil.Reportf("Writing data...")
+	setPhase(phaseWrite)
+	reportf("Writing data...")
 	fwFile := bytes.NewBuffer(fwFileData)
 	data := make([]byte, *flags.ChunkSize)
 	total := int64(0)
@@ -116,12 +277,92 @@ func OTA(ctx context.Context, devConn dev.DevConn) error {
 			}
 		}
 		total += int64(n)
+		pct := float64(total) * 100.0 / float64(fwFileSize)
 		if total%65536 == 0 || time.Since(lastReport) > 5*time.Second {
-			ourutil.Reportf("  %d of %d (%.2f%%)", total, fwFileSize, float64(total)*100.0/float64(fwFileSize))
+			reportf("  %d of %d (%.2f%%)", total, fwFileSize, pct)
 			lastReport = time.Now()
 		}
+		// Machine-readable progress is reported for every percent.
+		if int(pct) != int(p.Percent) {
+			p.BytesSent, p.Percent = total, pct
+			setPhase(phaseWrite)
+		}
+	}
+	p.BytesSent = total
+
+	setPhase(phaseEnd)
+	reportf("Finalizing update...")
+	if err := devConn.Call(ctx, "OTA.End", nil, nil); err != nil {
+		return errors.Trace(err)
+	}
+	if *flags.NoReboot {
+		reportf("Update is written and verified but not activated, use mos ota-activate to switch to it")
+	}
+	return nil
+}
+
+// bootState is the argument of OTA.SetBootState and the result of OTA.GetBootState.
+type bootState struct {
+	ActiveSlot   int  `json:"active_slot"`
+	IsCommitted  bool `json:"is_committed"`
+	RevertSlot   int  `json:"revert_slot"`
+	BootAttempts int  `json:"boot_attempts"`
+}
+
+// Activate handles "mos ota-activate": switches the device(s) to the firmware
+// staged with "mos ota --no-reboot" and reboots.
+func Activate(ctx context.Context, devConn dev.DevConn) error {
+	if *devicesFlag != "" {
+		return errors.Trace(runBatch(ctx, *devicesFlag, activateOp))
+	}
+
+	if devConn == nil {
+		var err error
+		devConn, err = devutil.CreateDevConnFromFlags(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer devConn.Disconnect(ctx)
 	}
 
-	ourutil.Reportf("Finalizing update...")
-	return devConn.Call(ctx, "OTA.End", nil, nil)
+	return errors.Trace(activateDevice(ctx, devConn, ourutil.Reportf))
+}
+
+func activateDevice(ctx context.Context, devConn dev.DevConn, reportf func(f string, args ...interface{})) error {
+	// An update staged with --no-reboot leaves OTA in the success state until
+	// the device reboots, otherwise the inactive slot holds nothing to activate.
+	st := struct {
+		State int `json:"state"`
+	}{State: -1}
+	if err := devConn.Call(ctx, "OTA.Status", nil, &st); err != nil {
+		return errors.Annotatef(err, "unable to get current OTA status")
+	}
+	if st.State != 3 /* MGOS_OTA_STATE_SUCCESS */ {
+		return errors.Errorf("no staged update (OTA state %d), use mos ota --no-reboot first", st.State)
+	}
+	var bs bootState
+	if err := devConn.Call(ctx, "OTA.GetBootState", nil, &bs); err != nil {
+		return errors.Annotatef(err, "unable to get boot state")
+	}
+	if !bs.IsCommitted {
+		return errors.Errorf("slot %d is running an uncommitted update, commit or revert it first", bs.ActiveSlot)
+	}
+	if bs.ActiveSlot != 0 && bs.ActiveSlot != 1 {
+		return errors.Errorf("unexpected active slot %d", bs.ActiveSlot)
+	}
+	nbs := bootState{
+		ActiveSlot:  1 - bs.ActiveSlot,
+		IsCommitted: false,
+		RevertSlot:  bs.ActiveSlot,
+	}
+	reportf("Activating slot %d (was %d)...", nbs.ActiveSlot, bs.ActiveSlot)
+	if err := devConn.Call(ctx, "OTA.SetBootState", &nbs, nil); err != nil {
+		return errors.Annotatef(err, "unable to set boot state")
+	}
+	reportf("Rebooting...")
+	if err := devConn.Call(ctx, "Sys.Reboot", nil, nil); err != nil {
+		return errors.Annotatef(err, "unable to reboot")
+	}
+	reportf("The update must be committed with OTA.Commit, otherwise the device will revert to slot %d on reboot", bs.ActiveSlot)
+	return nil
 }
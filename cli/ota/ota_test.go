@@ -0,0 +1,176 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package ota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/flags"
+)
+
+// fakeDevConn is a device that accepts the update, optionally failing OTA.End.
+type fakeDevConn struct {
+	written  []byte
+	endErr   error
+	noReboot bool
+}
+
+func (dc *fakeDevConn) Call(ctx context.Context, method string, args interface{}, resp interface{}) error {
+	switch method {
+	case "OTA.Status":
+		return json.Unmarshal([]byte(fmt.Sprintf(`{"state": 0, "no_reboot_supported": %t}`, dc.noReboot)), resp)
+	case "OTA.Begin":
+		return nil
+	case "OTA.Write":
+		var wa struct {
+			Offset int64  `json:"offset"`
+			Data   []byte `json:"data"`
+		}
+		data, _ := json.Marshal(args)
+		if err := json.Unmarshal(data, &wa); err != nil {
+			return err
+		}
+		if wa.Offset != int64(len(dc.written)) {
+			return errors.Errorf("unexpected offset %d", wa.Offset)
+		}
+		dc.written = append(dc.written, wa.Data...)
+		return nil
+	case "OTA.End":
+		return dc.endErr
+	}
+	return errors.Errorf("unexpected call %s", method)
+}
+
+func (dc *fakeDevConn) GetTimeout() time.Duration            { return time.Second }
+func (dc *fakeDevConn) Connect(context.Context, bool) error  { return nil }
+func (dc *fakeDevConn) Disconnect(ctx context.Context) error { return nil }
+
+func runOTAWithProgress(t *testing.T, dc *fakeDevConn, fw []byte) ([]otaProgress, error) {
+	defer func(cs int) { *flags.ChunkSize = cs }(*flags.ChunkSize)
+	*flags.ChunkSize = 4
+	var res []otaProgress
+	err := otaDevice(context.Background(), dc, &otaImage{full: fw}, "",
+		func(f string, args ...interface{}) {},
+		func(p otaProgress) { res = append(res, p) })
+	return res, err
+}
+
+func TestOTAProgress(t *testing.T) {
+	fw := []byte("0123456789abcdef")
+	dc := &fakeDevConn{}
+	res, err := runOTAWithProgress(t, dc, fw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dc.written) != string(fw) {
+		t.Errorf("unexpected data written: %q", dc.written)
+	}
+	exp := []otaProgress{
+		{Phase: phaseStatus},
+		{Phase: phaseBegin, TotalBytes: 16},
+		{Phase: phaseWrite, TotalBytes: 16},
+		{Phase: phaseWrite, BytesSent: 4, TotalBytes: 16, Percent: 25},
+		{Phase: phaseWrite, BytesSent: 8, TotalBytes: 16, Percent: 50},
+		{Phase: phaseWrite, BytesSent: 12, TotalBytes: 16, Percent: 75},
+		{Phase: phaseWrite, BytesSent: 16, TotalBytes: 16, Percent: 100},
+		{Phase: phaseEnd, BytesSent: 16, TotalBytes: 16, Percent: 100},
+		{Phase: phaseDone, BytesSent: 16, TotalBytes: 16, Percent: 100, Result: "ok"},
+	}
+	if !reflect.DeepEqual(res, exp) {
+		t.Errorf("unexpected progress:\n%+v\nexpected:\n%+v", res, exp)
+	}
+}
+
+func TestOTANoRebootUnsupported(t *testing.T) {
+	*flags.NoReboot = true
+	defer func() { *flags.NoReboot = false }()
+	dc := &fakeDevConn{}
+	if _, err := runOTAWithProgress(t, dc, []byte("01234567")); err == nil || !strings.Contains(err.Error(), "--no-reboot") {
+		t.Errorf("expected an error about --no-reboot, got %v", err)
+	}
+	if len(dc.written) != 0 {
+		t.Errorf("data was sent to a device which does not support --no-reboot")
+	}
+	dc = &fakeDevConn{noReboot: true}
+	if _, err := runOTAWithProgress(t, dc, []byte("01234567")); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestOTAProgressError(t *testing.T) {
+	dc := &fakeDevConn{endErr: errors.New("checksum mismatch")}
+	res, err := runOTAWithProgress(t, dc, []byte("01234567"))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	last := res[len(res)-1]
+	if last.Phase != phaseDone || last.Result != "error" || last.Error != "checksum mismatch" {
+		t.Errorf("unexpected final progress: %+v", last)
+	}
+	if prev := res[len(res)-2]; prev.Phase != phaseEnd {
+		t.Errorf("expected the end phase before the result, got %+v", prev)
+	}
+}
+
+// fakeBootDevConn is a device with the given OTA state and boot state.
+type fakeBootDevConn struct {
+	fakeDevConn
+	state  int
+	bs     bootState
+	newBS  *bootState
+	reboot bool
+}
+
+func (dc *fakeBootDevConn) Call(ctx context.Context, method string, args interface{}, resp interface{}) error {
+	switch method {
+	case "OTA.Status":
+		return json.Unmarshal([]byte(fmt.Sprintf(`{"state": %d}`, dc.state)), resp)
+	case "OTA.GetBootState":
+		*(resp.(*bootState)) = dc.bs
+		return nil
+	case "OTA.SetBootState":
+		dc.newBS = args.(*bootState)
+		return nil
+	case "Sys.Reboot":
+		dc.reboot = true
+		return nil
+	}
+	return errors.Errorf("unexpected call %s", method)
+}
+
+func TestActivate(t *testing.T) {
+	reportf := func(f string, args ...interface{}) {}
+	dc := &fakeBootDevConn{state: 0, bs: bootState{ActiveSlot: 0, IsCommitted: true}}
+	if err := activateDevice(context.Background(), dc, reportf); err == nil || dc.newBS != nil || dc.reboot {
+		t.Errorf("expected activation to be refused without a staged update: %v", err)
+	}
+	dc.state = 3
+	if err := activateDevice(context.Background(), dc, reportf); err != nil {
+		t.Fatal(err)
+	}
+	if exp := (bootState{ActiveSlot: 1, RevertSlot: 0}); dc.newBS == nil || *dc.newBS != exp || !dc.reboot {
+		t.Errorf("unexpected boot state %+v, reboot %t", dc.newBS, dc.reboot)
+	}
+}
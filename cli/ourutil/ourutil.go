@@ -28,13 +28,15 @@ import (
 )
 
 func Reportf(f string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, f+"\n", args...)
-	glog.Infof(f, args...)
+	s := Redact(fmt.Sprintf(f, args...))
+	fmt.Fprintln(os.Stderr, s)
+	glog.Info(s)
 }
 
 func Freportf(logFile io.Writer, f string, args ...interface{}) {
-	fmt.Fprintf(logFile, f+"\n", args...)
-	glog.Infof(f, args...)
+	s := Redact(fmt.Sprintf(f, args...))
+	fmt.Fprintln(logFile, s)
+	glog.Info(s)
 }
 
 func Prompt(text string) string {
@@ -0,0 +1,103 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package ourutil
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	redactedText = "***"
+	// Shorter values are not redacted, otherwise we'd mangle the output.
+	minSecretLen = 4
+)
+
+var (
+	secrets     []string
+	secretsLock sync.RWMutex
+)
+
+// RegisterSecret adds a value which must never appear in the output or the
+// logs: it will be replaced with "***" by Reportf, Freportf, writers
+// returned by NewRedactingWriter and glog.
+func RegisterSecret(s string) {
+	s = strings.TrimSpace(s)
+	if len(s) < minSecretLen {
+		return
+	}
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	for _, e := range secrets {
+		if e == s {
+			return
+		}
+	}
+	secrets = append(secrets, s)
+}
+
+// Redact replaces all the registered secrets in s.
+func Redact(s string) string {
+	secretsLock.RLock()
+	defer secretsLock.RUnlock()
+	for _, e := range secrets {
+		s = strings.Replace(s, e, redactedText, -1)
+	}
+	return s
+}
+
+type redactingWriter struct {
+	w io.Writer
+}
+
+// NewRedactingWriter returns a writer which redacts registered secrets from
+// the data before writing it to w. Each Write is redacted separately, so a
+// secret split between two writes won't be caught.
+func NewRedactingWriter(w io.Writer) io.Writer {
+	return &redactingWriter{w: w}
+}
+
+func (rw *redactingWriter) Write(data []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, Redact(string(data))); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// RedactingLogFilter is a glog filter which redacts registered secrets.
+type RedactingLogFilter struct{}
+
+func (RedactingLogFilter) Filter(args []interface{}) []interface{} {
+	return []interface{}{Redact(fmt.Sprint(args...))}
+}
+
+func (RedactingLogFilter) FilterF(format string, args []interface{}) (string, []interface{}) {
+	return "%s", []interface{}{Redact(fmt.Sprintf(format, args...))}
+}
+
+func (RedactingLogFilter) FilterS(msg string, keysAndValues []interface{}) (string, []interface{}) {
+	kvs := make([]interface{}, len(keysAndValues))
+	for i, v := range keysAndValues {
+		if s, ok := v.(string); ok {
+			v = Redact(s)
+		}
+		kvs[i] = v
+	}
+	return Redact(msg), kvs
+}
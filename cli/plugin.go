@@ -0,0 +1,104 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/juju/errors"
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/cli/devutil"
+	"github.com/mongoose-os/mos/cli/flags"
+	"github.com/mongoose-os/mos/version"
+)
+
+// Executables named mos-<name> found on PATH are available as "mos <name>".
+const pluginPrefix = "mos-"
+
+// findPlugin returns the path to the plugin executable for the given command
+// name, or an empty string if there isn't one.
+func findPlugin(name string) string {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return ""
+	}
+	p, err := exec.LookPath(pluginPrefix + name)
+	if err != nil {
+		return ""
+	}
+	return p
+}
+
+// isPluginCommandLine returns true if the command given on the command line
+// is a plugin. Must be called before flags are parsed: flags of the plugin are
+// unknown to us and should not be treated as errors.
+func isPluginCommandLine() bool {
+	for _, arg := range os.Args[1:] {
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if getCommand(arg) != nil {
+			return false
+		}
+		if findPlugin(arg) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// runPlugin runs the plugin executable with all the arguments which follow
+// the command name, as given. Resolved values of some of the flags are passed
+// in the environment, in the same form mos accepts them, so that the plugin
+// can invoke mos and have them applied.
+func runPlugin(ctx context.Context, pluginPath string) error {
+	name := flag.Arg(0)
+	var args []string
+	for i, arg := range os.Args[1:] {
+		if arg == name {
+			args = os.Args[i+2:]
+			break
+		}
+	}
+
+	mosPath, err := os.Executable()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	env := append(os.Environ(),
+		fmt.Sprintf("%sBIN=%s", envPrefix, mosPath),
+		fmt.Sprintf("%sVERSION=%s", envPrefix, version.Version),
+	)
+	if port, err := devutil.GetPort(); err == nil {
+		env = append(env, fmt.Sprintf("%sPORT=%s", envPrefix, port))
+	}
+	if platform := flags.Platform(); platform != "" {
+		env = append(env, fmt.Sprintf("%sPLATFORM=%s", envPrefix, platform))
+	}
+
+	cmd := exec.CommandContext(ctx, pluginPath, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	return cmd.Run()
+}
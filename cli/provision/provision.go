@@ -0,0 +1,264 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	flag "github.com/spf13/pflag"
+	glog "k8s.io/klog/v2"
+
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/ourutil"
+)
+
+var (
+	batchFile   = flag.String("batch", "", "CSV file with the devices to provision, one device per row")
+	steps       = flag.StringSlice("provision-steps", []string{"config-set", "license"}, "mos commands to run for each device, in order")
+	parallelism = flag.Int("provision-parallel", 1, "Number of devices to provision in parallel. Devices on the same port are always provisioned sequentially")
+	resultsFile = flag.String("provision-results", "", "Where to write the results CSV. Default is the batch file name with .results.csv suffix")
+)
+
+const (
+	colPort     = "port"
+	colDeviceID = "device-id"
+	// Space-separated list of key=value pairs, passed to the config-set step.
+	colConfig = "config"
+
+	stepConfigSet = "config-set"
+)
+
+type device struct {
+	row    int
+	fields map[string]string
+}
+
+type result struct {
+	dev      *device
+	failStep string
+	err      error
+	duration time.Duration
+}
+
+// Provision handles "mos provision --batch devices.csv".
+//
+// The first row of the CSV file is a header. The "port" column is required,
+// "device-id" and "config" are optional. All other columns are passed to
+// each step as flags, e.g. a column named "aws-region" becomes
+// --aws-region=<value>. Each step is a separate invocation of mos.
+func Provision(ctx context.Context, devConn dev.DevConn) error {
+	devs, header, err := readBatch(*batchFile)
+	if err != nil {
+		return errors.Annotatef(err, "failed to read %s", *batchFile)
+	}
+	if len(devs) == 0 {
+		return errors.Errorf("no devices in %s", *batchFile)
+	}
+
+	mosPath, err := os.Executable()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	n := *parallelism
+	if n < 1 {
+		n = 1
+	}
+
+	ourutil.Reportf("Provisioning %d devices (steps: %s, parallelism: %d)...",
+		len(devs), strings.Join(*steps, ", "), n)
+
+	results := make([]*result, len(devs))
+	// Devices on the same port are provisioned one after another, in the
+	// order they appear in the file, so each port gets a single worker.
+	var ports []string
+	portDevs := map[string][]int{}
+	for i, d := range devs {
+		port := d.fields[colPort]
+		if portDevs[port] == nil {
+			ports = append(ports, port)
+		}
+		portDevs[port] = append(portDevs[port], i)
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, n)
+	for _, port := range ports {
+		wg.Add(1)
+		go func(idx []int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			for _, i := range idx {
+				results[i] = provisionDevice(ctx, mosPath, devs[i])
+			}
+		}(portDevs[port])
+	}
+	wg.Wait()
+
+	outFile := *resultsFile
+	if outFile == "" {
+		outFile = strings.TrimSuffix(*batchFile, ".csv") + ".results.csv"
+	}
+	if err := writeResults(outFile, header, results); err != nil {
+		return errors.Annotatef(err, "failed to write results")
+	}
+
+	numFailed := 0
+	for _, r := range results {
+		if r.err != nil {
+			numFailed++
+		}
+	}
+	ourutil.Reportf("Done: %d succeeded, %d failed. Results written to %s",
+		len(results)-numFailed, numFailed, outFile)
+	if numFailed > 0 {
+		return errors.Errorf("%d devices failed to provision", numFailed)
+	}
+	return nil
+}
+
+func readBatch(fname string) ([]*device, []string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if len(records) == 0 {
+		return nil, nil, nil
+	}
+
+	header := records[0]
+	for i, h := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(h))
+	}
+	hasPort := false
+	for _, h := range header {
+		if h == colPort {
+			hasPort = true
+		}
+	}
+	if !hasPort {
+		return nil, nil, errors.Errorf("%q column is required", colPort)
+	}
+
+	var devs []*device
+	for i, rec := range records[1:] {
+		d := &device{row: i + 2, fields: map[string]string{}}
+		for j, v := range rec {
+			d.fields[header[j]] = strings.TrimSpace(v)
+		}
+		if d.fields[colPort] == "" {
+			return nil, nil, errors.Errorf("row %d: %q is empty", d.row, colPort)
+		}
+		devs = append(devs, d)
+	}
+	return devs, header, nil
+}
+
+func provisionDevice(ctx context.Context, mosPath string, d *device) *result {
+	res := &result{dev: d}
+	start := time.Now()
+	defer func() {
+		res.duration = time.Since(start)
+	}()
+
+	port := d.fields[colPort]
+	for _, step := range *steps {
+		args := []string{step, "--port", port}
+		for k, v := range d.fields {
+			if k == colPort || k == colConfig || v == "" {
+				continue
+			}
+			args = append(args, fmt.Sprintf("--%s=%s", k, v))
+		}
+		if step == stepConfigSet {
+			cfg := strings.Fields(d.fields[colConfig])
+			if len(cfg) == 0 {
+				continue
+			}
+			args = append(args, cfg...)
+		}
+
+		ourutil.Reportf("[%s] Running mos %s...", port, step)
+		var out bytes.Buffer
+		cmd := exec.CommandContext(ctx, mosPath, args...)
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		err := cmd.Run()
+		glog.Infof("[%s] mos %s output:\n%s", port, strings.Join(args, " "), out.String())
+		if err != nil {
+			res.failStep = step
+			res.err = errors.Errorf("%s: %s", err, lastLine(out.String()))
+			ourutil.Reportf("[%s] mos %s failed: %s", port, step, res.err)
+			return res
+		}
+	}
+	ourutil.Reportf("[%s] Provisioned successfully", port)
+	return res
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func writeResults(fname string, header []string, results []*result) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	return errors.Trace(writeResultsCSV(f, header, results))
+}
+
+func writeResultsCSV(out io.Writer, header []string, results []*result) error {
+	w := csv.NewWriter(out)
+	w.Write(append(append([]string{}, header...), "status", "failed_step", "error", "duration_ms"))
+	for _, r := range results {
+		var rec []string
+		for _, h := range header {
+			rec = append(rec, r.dev.fields[h])
+		}
+		status, errStr := "ok", ""
+		if r.err != nil {
+			status, errStr = "failed", r.err.Error()
+		}
+		rec = append(rec, status, r.failStep, errStr, fmt.Sprintf("%d", r.duration/time.Millisecond))
+		w.Write(rec)
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,88 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package provision
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadBatchAndWriteResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "provision_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "devices.csv")
+	data := "Port, device-id, config\n" +
+		"# comment\n" +
+		"/dev/ttyUSB0, dev1, \"wifi.sta.enable=true debug.level=3\"\n" +
+		"/dev/ttyUSB1, dev2,\n"
+	if err := ioutil.WriteFile(fname, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	devs, header, err := readBatch(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devs) != 2 {
+		t.Fatalf("expected 2 devices, got %d", len(devs))
+	}
+	if devs[0].fields[colPort] != "/dev/ttyUSB0" || devs[0].fields[colDeviceID] != "dev1" {
+		t.Errorf("unexpected fields: %+v", devs[0].fields)
+	}
+	if devs[0].fields[colConfig] != "wifi.sta.enable=true debug.level=3" {
+		t.Errorf("unexpected config: %q", devs[0].fields[colConfig])
+	}
+
+	var out bytes.Buffer
+	results := []*result{
+		{dev: devs[0]},
+		{dev: devs[1], failStep: "license", err: errors.New("boom")},
+	}
+	if err := writeResultsCSV(&out, header, results); err != nil {
+		t.Fatal(err)
+	}
+	exp := "port,device-id,config,status,failed_step,error,duration_ms\n" +
+		"/dev/ttyUSB0,dev1,wifi.sta.enable=true debug.level=3,ok,,,0\n" +
+		"/dev/ttyUSB1,dev2,,failed,license,boom,0\n"
+	if out.String() != exp {
+		t.Errorf("unexpected results:\n%s\nexpected:\n%s", out.String(), exp)
+	}
+}
+
+func TestReadBatchNoPort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "provision_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "devices.csv")
+	if err := ioutil.WriteFile(fname, []byte("device-id\ndev1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readBatch(fname); err == nil {
+		t.Errorf("expected an error")
+	}
+}
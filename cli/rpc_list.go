@@ -0,0 +1,118 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/juju/errors"
+	glog "k8s.io/klog/v2"
+
+	"github.com/mongoose-os/mos/cli/dev"
+)
+
+type rpcMethodInfo struct {
+	Name    string            `json:"name"`
+	ArgsFmt string            `json:"args_fmt,omitempty"`
+	Args    map[string]string `json:"args,omitempty"`
+}
+
+// Matches "key: %spec" entries of the json_scanf format string.
+var argsFmtEntryRegex = regexp.MustCompile(`(\w+)\s*:\s*%(\w+)`)
+
+// rpcList lists RPC methods of the device, with their arguments as reported
+// by RPC.Describe, if available.
+func rpcList(ctx context.Context, devConn dev.DevConn) error {
+	var methods []string
+	if err := devConn.Call(ctx, "RPC.List", nil, &methods); err != nil {
+		return errors.Annotatef(err, "RPC.List")
+	}
+	sort.Strings(methods)
+
+	var res []*rpcMethodInfo
+	for _, m := range methods {
+		mi := &rpcMethodInfo{Name: m}
+		if err := devConn.Call(ctx, "RPC.Describe", map[string]string{"name": m}, mi); err != nil {
+			glog.V(1).Infof("%s: no description: %s", m, err)
+		}
+		mi.Name = m
+		mi.Args = parseArgsFmt(mi.ArgsFmt)
+		res = append(res, mi)
+	}
+
+	if *jsonOutput {
+		data, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Printf("%s\n", data)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, mi := range res {
+		var args []string
+		for _, k := range sortedKeys(mi.Args) {
+			args = append(args, fmt.Sprintf("%s:%s", k, mi.Args[k]))
+		}
+		fmt.Fprintf(w, "%s\t%s\n", mi.Name, strings.Join(args, " "))
+	}
+	return errors.Trace(w.Flush())
+}
+
+// parseArgsFmt converts json_scanf format string, e.g. "{pin: %d, value: %B}",
+// to a map of argument names to their types.
+func parseArgsFmt(argsFmt string) map[string]string {
+	var res map[string]string
+	for _, m := range argsFmtEntryRegex.FindAllStringSubmatch(argsFmt, -1) {
+		if res == nil {
+			res = map[string]string{}
+		}
+		res[m[1]] = argsFmtSpecType(m[2])
+	}
+	return res
+}
+
+func argsFmtSpecType(spec string) string {
+	switch spec[len(spec)-1] {
+	case 'd', 'i', 'u', 'x', 'f', 'g', 'e':
+		return "number"
+	case 'B':
+		return "bool"
+	case 'Q', 's', 'H', 'V':
+		return "string"
+	case 'T', 'M':
+		return "json"
+	}
+	return "any"
+}
+
+func sortedKeys(m map[string]string) []string {
+	var res []string
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
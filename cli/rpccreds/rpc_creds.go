@@ -22,6 +22,8 @@ import (
 
 	"github.com/juju/errors"
 	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/cli/ourutil"
 )
 
 var (
@@ -47,6 +49,7 @@ func getRPCCredsFromString(s string) (username, passwd string, err error) {
 	}
 	parts := strings.Split(s, ":")
 	if len(parts) == 2 {
+		ourutil.RegisterSecret(parts[1])
 		return parts[0], parts[1], nil
 	} else {
 		// TODO(dfrank): handle the case with nothing or only username provided,
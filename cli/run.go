@@ -0,0 +1,146 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/juju/errors"
+	flag "github.com/spf13/pflag"
+	glog "k8s.io/klog/v2"
+
+	moscommon "github.com/mongoose-os/mos/cli/common"
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/common/fwbundle"
+	"github.com/mongoose-os/mos/common/ourio"
+)
+
+// hostPlatform is the platform whose firmware is a host executable.
+const hostPlatform = "ubuntu"
+
+var (
+	runNative = flag.Bool("run-native", runtime.GOOS == "linux",
+		"With mos run, run the executable natively rather than in the build container")
+)
+
+// extractHostExecutable writes the app part of a host platform firmware
+// into the firmware dir as an executable named after the app.
+func extractHostExecutable(fw *fwbundle.FirmwareBundle, buildDir string) (string, error) {
+	app := getAppPart(fw)
+	if app == nil {
+		return "", errors.Errorf("no app part in the firmware")
+	}
+	data, err := fw.GetPartData(app.Name)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	exe, err := filepath.Abs(filepath.Join(moscommon.GetFirmwareDir(buildDir), ourutil.FileNameFromString(fw.Name)))
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if err := ioutil.WriteFile(exe, data, 0755); err != nil {
+		return "", errors.Trace(err)
+	}
+	return exe, nil
+}
+
+// getRunFSDir prepares a fresh copy of the filesystem for mos run: the staging
+// dir of the last local build, which contains files of the app and all libs,
+// or the app's fs/ dir if there's none.
+func getRunFSDir(buildDir string) (string, error) {
+	src := moscommon.GetFilesystemStagingDir(buildDir)
+	if _, err := os.Stat(src); err != nil {
+		src = filepath.Join(projectDir, "fs")
+	}
+	dst, err := filepath.Abs(filepath.Join(buildDir, "run", "fs"))
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return "", errors.Trace(err)
+	}
+	if err := os.MkdirAll(dst, 0777); err != nil {
+		return "", errors.Trace(err)
+	}
+	if _, err := os.Stat(src); err == nil {
+		if err := ourio.CopyDir(src, dst, nil); err != nil {
+			return "", errors.Annotatef(err, "failed to copy %s", src)
+		}
+	}
+	return dst, nil
+}
+
+// runHandler handles "mos run [-- args...]": runs the host executable built
+// with "mos build --platform ubuntu". The executable is run with a copy of
+// the filesystem as its current directory and gets all the extra arguments.
+func runHandler(ctx context.Context, devConn dev.DevConn) error {
+	buildDir := moscommon.GetBuildDir(projectDir)
+	fw, err := fwbundle.ReadZipFirmwareBundle(moscommon.GetFirmwareZipFilePath(buildDir))
+	if err != nil {
+		return errors.Annotatef(err, "no firmware, run \"mos build --platform %s\" first", hostPlatform)
+	}
+	if fw.Platform != hostPlatform {
+		return errors.Errorf("firmware is built for %s, only %s firmware can be run", fw.Platform, hostPlatform)
+	}
+	exe, err := extractHostExecutable(fw, buildDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fsDir, err := getRunFSDir(buildDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	args := flag.Args()[1:]
+
+	var cmd *exec.Cmd
+	if *runNative {
+		cmd = exec.CommandContext(ctx, exe, args...)
+		cmd.Dir = fsDir
+	} else {
+		_, fp, _, err := readFinalManifestFromFlags()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		image, err := getTestImage(fp.MosDirEffective, hostPlatform)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		exeDir := filepath.Dir(exe)
+		dargs := []string{"run", "--rm", "-i",
+			"-v", fmt.Sprintf("%s:%s", exeDir, ourutil.GetPathForDocker(exeDir)),
+			"-v", fmt.Sprintf("%s:%s", fsDir, ourutil.GetPathForDocker(fsDir)),
+			"-w", ourutil.GetPathForDocker(fsDir),
+		}
+		dargs = append(dargs, image, ourutil.GetPathForDocker(exe))
+		dargs = append(dargs, args...)
+		glog.Infof("Running docker %s", strings.Join(dargs, " "))
+		cmd = exec.CommandContext(ctx, "docker", dargs...)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	ourutil.Reportf("Running %s/%s version %s (%s)...", fw.Name, fw.Platform, fw.Version, fw.BuildID)
+	return errors.Trace(cmd.Run())
+}
@@ -0,0 +1,148 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package size_report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/juju/errors"
+)
+
+type Delta struct {
+	Name string `json:"name"`
+	Base int64  `json:"base"`
+	Cur  int64  `json:"cur"`
+}
+
+func (d *Delta) Diff() int64 {
+	return d.Cur - d.Base
+}
+
+// Threshold is the allowed growth of any of the sizes, either in bytes or in
+// percent of the baseline size.
+type Threshold struct {
+	Bytes int64
+	Pct   float64
+}
+
+// ParseThreshold parses threshold given either as a number of bytes or as a
+// percentage, e.g. "1024" or "2%". Empty string means no threshold.
+func ParseThreshold(s string) (*Threshold, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if strings.HasSuffix(s, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || pct < 0 {
+			return nil, errors.Errorf("invalid threshold %q", s)
+		}
+		return &Threshold{Pct: pct}, nil
+	}
+	n, err := strconv.ParseInt(s, 0, 64)
+	if err != nil || n < 0 {
+		return nil, errors.Errorf("invalid threshold %q", s)
+	}
+	return &Threshold{Bytes: n}, nil
+}
+
+func (t *Threshold) Exceeded(d *Delta) bool {
+	if t == nil || d.Diff() <= 0 {
+		return false
+	}
+	if t.Pct > 0 || t.Bytes == 0 {
+		if d.Base == 0 {
+			return true
+		}
+		return float64(d.Diff())*100/float64(d.Base) > t.Pct
+	}
+	return d.Diff() > t.Bytes
+}
+
+func (t *Threshold) String() string {
+	if t.Pct > 0 {
+		return fmt.Sprintf("%g%%", t.Pct)
+	}
+	return fmt.Sprintf("%d bytes", t.Bytes)
+}
+
+// ReadReport reads the report previously saved as JSON.
+func ReadReport(fname string) (*Report, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var r Report
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, errors.Annotatef(err, "failed to parse %s", fname)
+	}
+	return &r, nil
+}
+
+// Compare returns deltas of the ELF section sizes (if present in both
+// reports) and of the firmware parts sizes.
+func Compare(base, cur *Report) []*Delta {
+	var res []*Delta
+	if base.ELFFile != "" && cur.ELFFile != "" {
+		res = append(res,
+			&Delta{Name: "text", Base: int64(base.Text), Cur: int64(cur.Text)},
+			&Delta{Name: "data", Base: int64(base.Data), Cur: int64(cur.Data)},
+			&Delta{Name: "bss", Base: int64(base.BSS), Cur: int64(cur.BSS)},
+		)
+	}
+	baseParts := map[string]*PartSize{}
+	for _, p := range base.Parts {
+		baseParts[p.Name] = p
+	}
+	for _, p := range cur.Parts {
+		d := &Delta{Name: "part " + p.Name, Cur: int64(p.Size)}
+		if bp := baseParts[p.Name]; bp != nil {
+			d.Base = int64(bp.Size)
+			delete(baseParts, p.Name)
+		}
+		res = append(res, d)
+	}
+	for _, p := range base.Parts {
+		if baseParts[p.Name] != nil {
+			res = append(res, &Delta{Name: "part " + p.Name, Base: int64(p.Size)})
+		}
+	}
+	return res
+}
+
+// WriteDiff prints deltas, marking the ones which exceed the threshold.
+// Returns the deltas which exceed the threshold.
+func WriteDiff(w io.Writer, deltas []*Delta, t *Threshold) ([]*Delta, error) {
+	var exceeded []*Delta
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "name\tbase\tcurrent\tdelta\t\n")
+	for _, d := range deltas {
+		mark := ""
+		if t.Exceeded(d) {
+			mark = "  <-- exceeds " + t.String()
+			exceeded = append(exceeded, d)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%+d\t%s\n", d.Name, d.Base, d.Cur, d.Diff(), mark)
+	}
+	return exceeded, errors.Trace(tw.Flush())
+}
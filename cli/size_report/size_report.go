@@ -0,0 +1,267 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package size_report
+
+import (
+	"bufio"
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/common/fwbundle"
+)
+
+type Report struct {
+	ELFFile string        `json:"elf_file,omitempty"`
+	Text    uint64        `json:"text"`
+	Data    uint64        `json:"data"`
+	BSS     uint64        `json:"bss"`
+	Parts   []*PartSize   `json:"parts"`
+	MapFile string        `json:"map_file,omitempty"`
+	Objects []*ObjectSize `json:"objects,omitempty"`
+}
+
+type PartSize struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+	Size int    `json:"size"`
+}
+
+type ObjectSize struct {
+	Object string `json:"object"`
+	Text   uint64 `json:"text"`
+	Data   uint64 `json:"data"`
+	BSS    uint64 `json:"bss"`
+}
+
+func (o *ObjectSize) total() uint64 {
+	return o.Text + o.Data + o.BSS
+}
+
+// GetReport puts together the size report for the firmware bundle and,
+// optionally, ELF and map files (empty names mean they are not available).
+// Up to maxObjects biggest object files are included.
+func GetReport(fw *fwbundle.FirmwareBundle, elfFile, mapFile string, maxObjects int) (*Report, error) {
+	r := &Report{ELFFile: elfFile}
+	for _, p := range fw.PartsByAddr() {
+		data, err := fw.GetPartData(p.Name)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s", p.Name)
+		}
+		r.Parts = append(r.Parts, &PartSize{Name: p.Name, Type: p.Type, Size: len(data)})
+	}
+	if elfFile != "" {
+		var err error
+		r.Text, r.Data, r.BSS, err = GetELFSizes(elfFile)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s", elfFile)
+		}
+	}
+	if mapFile != "" && maxObjects > 0 {
+		f, err := os.Open(mapFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer f.Close()
+		objs, err := ParseMapFile(f)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s", mapFile)
+		}
+		if len(objs) > maxObjects {
+			objs = objs[:maxObjects]
+		}
+		r.MapFile = mapFile
+		r.Objects = objs
+	}
+	return r, nil
+}
+
+// GetELFSizes returns sizes of the allocated sections of the ELF file, in the
+// same way binutils size(1) does: read-only or executable sections are text,
+// writable ones are data and sections without contents are bss.
+func GetELFSizes(fname string) (text, data, bss uint64, err error) {
+	f, err := elf.Open(fname)
+	if err != nil {
+		return 0, 0, 0, errors.Trace(err)
+	}
+	defer f.Close()
+	for _, s := range f.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 {
+			continue
+		}
+		switch {
+		case s.Type == elf.SHT_NOBITS:
+			bss += s.Size
+		case s.Flags&elf.SHF_WRITE == 0 || s.Flags&elf.SHF_EXECINSTR != 0:
+			text += s.Size
+		default:
+			data += s.Size
+		}
+	}
+	return text, data, bss, nil
+}
+
+var (
+	// Input section line of the GNU ld map file, e.g.:
+	//  .text.foo      0x40080000       0x1c build/objs/foo.o
+	// Section name may be on a separate line if it's too long.
+	mapInputSectionRe = regexp.MustCompile(`^ (\S+)?\s+0x([0-9a-fA-F]+)\s+0x([0-9a-fA-F]+)\s+(\S.*)$`)
+	mapSectionNameRe  = regexp.MustCompile(`^ (\S+)$`)
+
+	textSectionPrefixes = []string{".text", ".rodata", ".literal", ".iram", ".irom", ".flash", ".init", ".fini"}
+)
+
+func classifySection(name string) string {
+	if strings.Contains(name, "bss") || name == "COMMON" {
+		return "bss"
+	}
+	for _, p := range textSectionPrefixes {
+		if strings.HasPrefix(name, p) {
+			return "text"
+		}
+	}
+	if strings.Contains(name, "data") {
+		return "data"
+	}
+	return ""
+}
+
+// ParseMapFile parses the GNU ld map file and returns object files sorted by
+// their total size, biggest first.
+func ParseMapFile(r io.Reader) ([]*ObjectSize, error) {
+	objs := map[string]*ObjectSize{}
+	inMap := false
+	pendingName := ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !inMap {
+			inMap = strings.HasPrefix(line, "Linker script and memory map")
+			continue
+		}
+		if m := mapSectionNameRe.FindStringSubmatch(line); m != nil {
+			pendingName = m[1]
+			continue
+		}
+		m := mapInputSectionRe.FindStringSubmatch(line)
+		if m == nil {
+			pendingName = ""
+			continue
+		}
+		name := m[1]
+		if name == "" {
+			name = pendingName
+		}
+		pendingName = ""
+		size, _ := strconv.ParseUint(m[3], 16, 64)
+		if size == 0 {
+			continue
+		}
+		obj := objectName(m[4])
+		o := objs[obj]
+		if o == nil {
+			o = &ObjectSize{Object: obj}
+			objs[obj] = o
+		}
+		switch classifySection(name) {
+		case "text":
+			o.Text += size
+		case "data":
+			o.Data += size
+		case "bss":
+			o.BSS += size
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	var res []*ObjectSize
+	for _, o := range objs {
+		if o.total() > 0 {
+			res = append(res, o)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].total() != res[j].total() {
+			return res[i].total() > res[j].total()
+		}
+		return res[i].Object < res[j].Object
+	})
+	return res, nil
+}
+
+// objectName shortens the path to the object file (or library member, like
+// /path/to/libfoo.a(bar.o)) to its base name.
+func objectName(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "("); i > 0 && strings.HasSuffix(s, ")") {
+		return filepath.Base(s[:i]) + s[i:]
+	}
+	return filepath.Base(s)
+}
+
+// FindMapFile returns the linker map file in the given objects dir, if any.
+func FindMapFile(objsDir string) string {
+	matches, _ := filepath.Glob(filepath.Join(objsDir, "*.map"))
+	if len(matches) == 0 {
+		return ""
+	}
+	sort.Strings(matches)
+	return matches[0]
+}
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return errors.Trace(err)
+}
+
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if r.ELFFile != "" {
+		fmt.Fprintf(tw, "%s\n", r.ELFFile)
+		fmt.Fprintf(tw, "text\tdata\tbss\ttotal\t\n")
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t\n", r.Text, r.Data, r.BSS, r.Text+r.Data+r.BSS)
+		fmt.Fprintf(tw, "\t\t\t\t\n")
+	}
+	fmt.Fprintf(tw, "part\ttype\tsize\t\n")
+	for _, p := range r.Parts {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t\n", p.Name, p.Type, p.Size)
+	}
+	if len(r.Objects) > 0 {
+		fmt.Fprintf(tw, "\t\t\t\t\t\n")
+		fmt.Fprintf(tw, "text\tdata\tbss\ttotal\tobject\t\n")
+		for _, o := range r.Objects {
+			fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%s\t\n", o.Text, o.Data, o.BSS, o.total(), o.Object)
+		}
+	}
+	return errors.Trace(tw.Flush())
+}
@@ -0,0 +1,119 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package size_report
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testMap = `Archive member included to satisfy reference by file (symbol)
+
+/libs/libfoo.a(foo.o)         build/objs/main.o (foo)
+
+Linker script and memory map
+
+LOAD build/objs/main.o
+.text           0x40080000      0x130
+ .text          0x40080000      0x100 build/objs/main.o
+                0x40080000                main
+ .text.a_very_long_function_name
+                0x40080100       0x20 /libs/libfoo.a(foo.o)
+ *fill*         0x40080120       0x10 
+.rodata         0x40090000       0x30
+ .rodata.str1.1
+                0x40090000       0x30 build/objs/main.o
+.data           0x3ffb0000        0x8
+ .data          0x3ffb0000        0x8 /libs/libfoo.a(foo.o)
+.bss            0x3ffb0010       0x44
+ .bss           0x3ffb0010       0x40 build/objs/main.o
+ COMMON         0x3ffb0050        0x4 /libs/libfoo.a(foo.o)
+ .debug_info    0x00000000      0x999 build/objs/main.o
+`
+
+func TestParseMapFile(t *testing.T) {
+	objs, err := ParseMapFile(strings.NewReader(testMap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 2 {
+		t.Fatalf("expected 2 objects, got %d", len(objs))
+	}
+	exp := []ObjectSize{
+		{Object: "main.o", Text: 0x130, Data: 0, BSS: 0x40},
+		{Object: "libfoo.a(foo.o)", Text: 0x20, Data: 0x8, BSS: 0x4},
+	}
+	for i, e := range exp {
+		if *objs[i] != e {
+			t.Errorf("%d: expected %+v, got %+v", i, e, *objs[i])
+		}
+	}
+}
+
+func TestParseMapFileSymbols(t *testing.T) {
+	m := testMap + ` .text.bar      0x400a0000       0x30 build/objs/bar.o
+                0x400a0000                bar
+                0x400a0010                bar_alias
+                0x400a0010                bar2
+`
+	syms, err := ParseMapFileSymbols(strings.NewReader(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := WriteSymbolSizesCSV(&out, syms); err != nil {
+		t.Fatal(err)
+	}
+	exp := `symbol,type,size,object
+main,text,256,main.o
+.bss,bss,64,main.o
+.rodata.str1.1,text,48,main.o
+.text.a_very_long_function_name,text,32,libfoo.a(foo.o)
+bar2,text,32,bar.o
+bar,text,16,bar.o
+.data,data,8,libfoo.a(foo.o)
+COMMON,bss,4,libfoo.a(foo.o)
+`
+	if out.String() != exp {
+		t.Errorf("unexpected symbols:\n%s\nexpected:\n%s", out.String(), exp)
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	for _, c := range []struct {
+		threshold string
+		base, cur int64
+		exceeded  bool
+	}{
+		{"", 100, 200, false},
+		{"10", 100, 110, false},
+		{"10", 100, 111, true},
+		{"5%", 1000, 1050, false},
+		{"5%", 1000, 1051, true},
+		{"5%", 1000, 900, false},
+		{"0", 100, 101, true},
+	} {
+		th, err := ParseThreshold(c.threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := th.Exceeded(&Delta{Base: c.base, Cur: c.cur}); res != c.exceeded {
+			t.Errorf("%q %d -> %d: expected %t, got %t", c.threshold, c.base, c.cur, c.exceeded, res)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package size_report
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+type SymbolSize struct {
+	Symbol string
+	Type   string
+	Size   uint64
+	Object string
+}
+
+// Symbol line of the GNU ld map file, address and name, follows the input
+// section line.
+var mapSymbolRe = regexp.MustCompile(`^\s+0x([0-9a-fA-F]+)\s+([A-Za-z_.$][\w.$]*)$`)
+
+type mapSymbol struct {
+	name string
+	addr uint64
+}
+
+type mapInputSection struct {
+	name       string
+	addr, size uint64
+	obj        string
+	syms       []mapSymbol
+}
+
+// symbols splits the section between its symbols: each symbol runs up to the
+// next one or to the end of the section. Sections without symbols (e.g.
+// static functions, which are not listed in the map) are reported under the
+// section name.
+func (s *mapInputSection) symbols() []*SymbolSize {
+	typ := classifySection(s.name)
+	if typ == "" {
+		return nil
+	}
+	obj := objectName(s.obj)
+	var syms []mapSymbol
+	for _, sym := range s.syms {
+		if sym.addr >= s.addr && sym.addr < s.addr+s.size {
+			syms = append(syms, sym)
+		}
+	}
+	if len(syms) == 0 {
+		return []*SymbolSize{{Symbol: s.name, Type: typ, Size: s.size, Object: obj}}
+	}
+	sort.SliceStable(syms, func(i, j int) bool { return syms[i].addr < syms[j].addr })
+	var res []*SymbolSize
+	for i, sym := range syms {
+		end := s.addr + s.size
+		if i+1 < len(syms) {
+			end = syms[i+1].addr
+		}
+		// Aliases share the address, only the last one gets the size.
+		if end > sym.addr {
+			res = append(res, &SymbolSize{Symbol: sym.name, Type: typ, Size: end - sym.addr, Object: obj})
+		}
+	}
+	return res
+}
+
+// ParseMapFileSymbols parses the GNU ld map file and returns symbols sorted by
+// size, biggest first.
+func ParseMapFileSymbols(r io.Reader) ([]*SymbolSize, error) {
+	var res []*SymbolSize
+	var cur *mapInputSection
+	flush := func() {
+		if cur != nil {
+			res = append(res, cur.symbols()...)
+			cur = nil
+		}
+	}
+	inMap := false
+	pendingName := ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !inMap {
+			inMap = strings.HasPrefix(line, "Linker script and memory map")
+			continue
+		}
+		if m := mapSymbolRe.FindStringSubmatch(line); m != nil && cur != nil {
+			addr, _ := strconv.ParseUint(m[1], 16, 64)
+			cur.syms = append(cur.syms, mapSymbol{name: m[2], addr: addr})
+			continue
+		}
+		flush()
+		if m := mapSectionNameRe.FindStringSubmatch(line); m != nil {
+			pendingName = m[1]
+			continue
+		}
+		m := mapInputSectionRe.FindStringSubmatch(line)
+		if m == nil {
+			pendingName = ""
+			continue
+		}
+		name := m[1]
+		if name == "" {
+			name = pendingName
+		}
+		pendingName = ""
+		addr, _ := strconv.ParseUint(m[2], 16, 64)
+		size, _ := strconv.ParseUint(m[3], 16, 64)
+		if size == 0 {
+			continue
+		}
+		cur = &mapInputSection{name: name, addr: addr, size: size, obj: m[4]}
+	}
+	flush()
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Size != res[j].Size {
+			return res[i].Size > res[j].Size
+		}
+		return res[i].Symbol < res[j].Symbol
+	})
+	return res, nil
+}
+
+func WriteSymbolSizesCSV(w io.Writer, syms []*SymbolSize) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"symbol", "type", "size", "object"})
+	for _, s := range syms {
+		cw.Write([]string{s.Symbol, s.Type, fmt.Sprintf("%d", s.Size), s.Object})
+	}
+	cw.Flush()
+	return errors.Trace(cw.Error())
+}
@@ -0,0 +1,171 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	flag "github.com/spf13/pflag"
+	glog "k8s.io/klog/v2"
+
+	"github.com/mongoose-os/mos/cli/builder"
+	moscommon "github.com/mongoose-os/mos/cli/common"
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/flags"
+	"github.com/mongoose-os/mos/cli/ourutil"
+)
+
+type testEnv struct {
+	platform string
+	appDir   string
+	buildDir string
+	// Build image to run the tests in, empty to run natively.
+	image string
+}
+
+// testHandler handles "mos test": builds the app or lib and runs the
+// executables listed in the "tests" section of the manifest (directories are
+// expanded to the files they contain). For the ubuntu platform on a Linux host
+// tests are run natively, otherwise they are run in the build container.
+// Tests get PLATFORM, APP_DIR, BUILD_DIR and FW_DIR in the environment.
+func testHandler(ctx context.Context, devConn dev.DevConn) error {
+	if flags.Platform() == "" {
+		flag.Set("platform", hostPlatform)
+	}
+
+	if err := buildHandler(ctx, devConn); err != nil {
+		return errors.Annotatef(err, "build failed")
+	}
+
+	manifest, fp, _, err := readFinalManifestFromFlags()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(manifest.Tests) == 0 {
+		return errors.Errorf("no tests defined in the manifest")
+	}
+
+	te := &testEnv{platform: manifest.Platform}
+	if te.appDir, err = builder.GetCodeDirAbs(); err != nil {
+		return errors.Trace(err)
+	}
+	if te.buildDir, err = filepath.Abs(moscommon.GetBuildDir(projectDir)); err != nil {
+		return errors.Trace(err)
+	}
+	if te.platform != hostPlatform || runtime.GOOS != "linux" {
+		if te.image, err = getTestImage(fp.MosDirEffective, te.platform); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	var tests []string
+	for _, t := range manifest.Tests {
+		t, err := filepath.Abs(t)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		st, err := os.Stat(t)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if st.Mode()&0111 == 0 {
+			ourutil.Reportf("Warning: %s is not executable, skipping", t)
+			continue
+		}
+		tests = append(tests, t)
+	}
+	if len(tests) == 0 {
+		return errors.Errorf("no tests to run")
+	}
+
+	numFailed := 0
+	for _, t := range tests {
+		name, _ := filepath.Rel(te.appDir, t)
+		ourutil.Reportf("=== RUN %s", name)
+		start := time.Now()
+		err := runTest(ctx, te, t)
+		d := time.Since(start).Round(10 * time.Millisecond)
+		if err != nil {
+			ourutil.Reportf("--- FAIL %s (%s): %s", name, d, err)
+			numFailed++
+		} else {
+			ourutil.Reportf("--- PASS %s (%s)", name, d)
+		}
+	}
+	ourutil.Reportf("%d passed, %d failed", len(tests)-numFailed, numFailed)
+	if numFailed > 0 {
+		return errors.Errorf("%d tests failed", numFailed)
+	}
+	return nil
+}
+
+func getTestImage(mosDir, platform string) (string, error) {
+	if *flags.BuildImage != "" {
+		return *flags.BuildImage, nil
+	}
+	sdkVersionFile := moscommon.GetSdkVersionFile(mosDir, platform)
+	data, err := ioutil.ReadFile(sdkVersionFile)
+	if err != nil {
+		return "", errors.Annotatef(err, "failed to read sdk version file %q", sdkVersionFile)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func runTest(ctx context.Context, te *testEnv, test string) error {
+	env := map[string]string{
+		"PLATFORM":  te.platform,
+		"APP_DIR":   te.appDir,
+		"BUILD_DIR": te.buildDir,
+		"FW_DIR":    moscommon.GetFirmwareDir(te.buildDir),
+	}
+	var cmd *exec.Cmd
+	if te.image == "" {
+		cmd = exec.CommandContext(ctx, test)
+		cmd.Env = os.Environ()
+		for k, v := range env {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+		}
+		cmd.Dir = te.appDir
+	} else {
+		args := []string{"run", "--rm", "-i"}
+		mounts := map[string]bool{te.appDir: true, te.buildDir: true, filepath.Dir(test): true}
+		for d := range mounts {
+			dd := ourutil.GetPathForDocker(d)
+			args = append(args, "-v", fmt.Sprintf("%s:%s", d, dd))
+		}
+		for k, v := range env {
+			args = append(args, "-e", fmt.Sprintf("%s=%s", k, ourutil.GetPathForDocker(v)))
+		}
+		args = append(args, "-w", ourutil.GetPathForDocker(te.appDir))
+		args = append(args, (*flags.BuildDockerExtra)...)
+		args = append(args, te.image, ourutil.GetPathForDocker(test))
+		glog.Infof("Running docker %s", strings.Join(args, " "))
+		cmd = exec.CommandContext(ctx, "docker", args...)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return errors.Trace(cmd.Run())
+}
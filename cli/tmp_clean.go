@@ -0,0 +1,39 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+
+	"github.com/juju/errors"
+
+	"github.com/mongoose-os/mos/cli/common/paths"
+	"github.com/mongoose-os/mos/cli/dev"
+	"github.com/mongoose-os/mos/cli/flags"
+	"github.com/mongoose-os/mos/cli/ourutil"
+)
+
+// tmpClean removes everything from --temp-dir except temp dirs which are
+// currently in use.
+func tmpClean(ctx context.Context, devConn dev.DevConn) error {
+	n, freed, err := paths.CleanTempDir(0)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ourutil.Reportf("Removed %d entries from %s, %d KB freed", n, *flags.TempDir, freed/1024)
+	return nil
+}
@@ -0,0 +1,156 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package trace records timing spans in the Chrome tracing format, to be
+// viewed in chrome://tracing or https://ui.perfetto.dev (see
+// mos build --trace-profile). Recording is off unless Start is called, and
+// spans are no-ops then.
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+type event struct {
+	Name string `json:"name"`
+	Cat  string `json:"cat"`
+	Ph   string `json:"ph"`
+	// Timestamp and duration are in microseconds.
+	TS  int64 `json:"ts"`
+	Dur int64 `json:"dur"`
+	PID int   `json:"pid"`
+	TID int   `json:"tid"`
+}
+
+type traceFile struct {
+	TraceEvents     []event `json:"traceEvents"`
+	DisplayTimeUnit string  `json:"displayTimeUnit"`
+}
+
+type recorder struct {
+	mtx    sync.Mutex
+	now    func() time.Time
+	start  time.Time
+	events []event
+	// Goroutines don't have ids, so each span takes the lowest lane (tid) not
+	// occupied by a concurrently running span. Concurrent spans thus end up
+	// on separate rows, sequential ones are packed together.
+	lanes []bool
+}
+
+var (
+	mtx sync.Mutex
+	rec *recorder
+)
+
+func newRecorder(now func() time.Time) *recorder {
+	return &recorder{now: now, start: now()}
+}
+
+// Start enables recording.
+func Start() {
+	mtx.Lock()
+	defer mtx.Unlock()
+	rec = newRecorder(time.Now)
+}
+
+// Span begins a span of the given category and name and returns the function
+// that ends it:
+//
+//	defer trace.Span("fetch", name)()
+func Span(cat, name string) func() {
+	mtx.Lock()
+	r := rec
+	mtx.Unlock()
+	if r == nil {
+		return func() {}
+	}
+	return r.span(cat, name)
+}
+
+// Write stops recording and writes the spans recorded so far to fname.
+func Write(fname string) error {
+	mtx.Lock()
+	r := rec
+	rec = nil
+	mtx.Unlock()
+	if r == nil {
+		return errors.Errorf("tracing is not enabled")
+	}
+	f, err := os.Create(fname)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := r.writeJSON(f); err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Close())
+}
+
+func (r *recorder) span(cat, name string) func() {
+	r.mtx.Lock()
+	lane := 0
+	for lane < len(r.lanes) && r.lanes[lane] {
+		lane++
+	}
+	if lane == len(r.lanes) {
+		r.lanes = append(r.lanes, true)
+	} else {
+		r.lanes[lane] = true
+	}
+	start := r.now()
+	r.mtx.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mtx.Lock()
+			defer r.mtx.Unlock()
+			r.events = append(r.events, event{
+				Name: name,
+				Cat:  cat,
+				Ph:   "X",
+				TS:   int64(start.Sub(r.start) / time.Microsecond),
+				Dur:  int64(r.now().Sub(start) / time.Microsecond),
+				PID:  1,
+				TID:  lane + 1,
+			})
+			r.lanes[lane] = false
+		})
+	}
+}
+
+func (r *recorder) writeJSON(w io.Writer) error {
+	r.mtx.Lock()
+	tf := traceFile{TraceEvents: r.events, DisplayTimeUnit: "ms"}
+	if tf.TraceEvents == nil {
+		tf.TraceEvents = []event{}
+	}
+	data, err := json.Marshal(&tf)
+	r.mtx.Unlock()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = w.Write(data)
+	return errors.Trace(err)
+}
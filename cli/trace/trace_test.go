@@ -0,0 +1,71 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := newRecorder(func() time.Time { return now })
+	tick := func(d time.Duration) { now = now.Add(d) }
+
+	endA := r.span("prepare_lib", "a")
+	tick(time.Millisecond)
+	endB := r.span("prepare_lib", "b")
+	tick(2 * time.Millisecond)
+	endA()
+	endA() // Ending twice is harmless.
+	endC := r.span("fetch", "c")
+	tick(time.Millisecond)
+	endC()
+	endB()
+
+	var buf bytes.Buffer
+	if err := r.writeJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var tf traceFile
+	if err := json.Unmarshal(buf.Bytes(), &tf); err != nil {
+		t.Fatalf("%s: %s", err, buf.String())
+	}
+	exp := []event{
+		{Name: "a", Cat: "prepare_lib", Ph: "X", TS: 0, Dur: 3000, PID: 1, TID: 1},
+		// a has finished, so c takes its lane.
+		{Name: "c", Cat: "fetch", Ph: "X", TS: 3000, Dur: 1000, PID: 1, TID: 1},
+		{Name: "b", Cat: "prepare_lib", Ph: "X", TS: 1000, Dur: 3000, PID: 1, TID: 2},
+	}
+	if len(tf.TraceEvents) != len(exp) {
+		t.Fatalf("expected %d events, got %s", len(exp), buf.String())
+	}
+	for i, e := range exp {
+		if tf.TraceEvents[i] != e {
+			t.Errorf("event %d: expected %+v, got %+v", i, e, tf.TraceEvents[i])
+		}
+	}
+}
+
+func TestSpanDisabled(t *testing.T) {
+	Span("fetch", "x")()
+	if err := Write("unused"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
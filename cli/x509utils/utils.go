@@ -18,17 +18,51 @@ package x509utils
 
 import (
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/x509"
 	"encoding/pem"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/juju/errors"
 
 	"github.com/mongoose-os/mos/cli/ourutil"
 )
 
-func WritePEM(derBytes []byte, blockType string, outputFileName string) error {
+const (
+	KeyFormatPEM = "pem"
+	KeyFormatDER = "der"
+	// Raw uncompressed EC point: 0x04 || X || Y.
+	KeyFormatRaw = "raw"
+)
+
+// GetKeyFormat returns the key format to use for the given output file name.
+// If format is not specified explicitly, it is derived from the file
+// extension; PEM is the default.
+func GetKeyFormat(format, outputFileName string) (string, error) {
+	format = strings.ToLower(format)
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(outputFileName)) {
+		case ".der":
+			format = KeyFormatDER
+		case ".raw", ".bin":
+			format = KeyFormatRaw
+		default:
+			format = KeyFormatPEM
+		}
+	}
+	switch format {
+	case KeyFormatPEM, KeyFormatDER, KeyFormatRaw:
+		return format, nil
+	default:
+		return "", errors.Errorf("invalid key format %q, must be one of %s, %s or %s",
+			format, KeyFormatPEM, KeyFormatDER, KeyFormatRaw)
+	}
+}
+
+func writeOutput(data []byte, outputFileName string) error {
 	var out io.Writer
 	switch outputFileName {
 	case "":
@@ -38,7 +72,7 @@ func WritePEM(derBytes []byte, blockType string, outputFileName string) error {
 	case "--":
 		out = os.Stderr
 	default:
-		f, err := os.OpenFile(outputFileName, os.O_RDWR|os.O_CREATE, 0644)
+		f, err := os.OpenFile(outputFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 		if err != nil {
 			return errors.Annotatef(err, "failed to open %s for writing", outputFileName)
 		}
@@ -48,14 +82,33 @@ func WritePEM(derBytes []byte, blockType string, outputFileName string) error {
 			ourutil.Reportf("Wrote %s", outputFileName)
 		}()
 	}
-	pem.Encode(out, &pem.Block{Type: blockType, Bytes: derBytes})
+	if _, err := out.Write(data); err != nil {
+		return errors.Annotatef(err, "failed to write %s", outputFileName)
+	}
 	return nil
 }
 
+func WritePEM(derBytes []byte, blockType string, outputFileName string) error {
+	return writeOutput(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: derBytes}), outputFileName)
+}
+
+// WritePubKey writes the public key to the given file, in PEM format.
 func WritePubKey(pubKey *ecdsa.PublicKey, outputFileName string) error {
+	return WritePubKeyFormat(pubKey, KeyFormatPEM, outputFileName)
+}
+
+// WritePubKeyFormat writes the public key to the given file in the given
+// format (see GetKeyFormat).
+func WritePubKeyFormat(pubKey *ecdsa.PublicKey, format, outputFileName string) error {
+	if format == KeyFormatRaw {
+		return writeOutput(elliptic.Marshal(pubKey.Curve, pubKey.X, pubKey.Y), outputFileName)
+	}
 	pubKeyDERBytes, err := x509.MarshalPKIXPublicKey(pubKey)
 	if err != nil {
 		return errors.Annotatef(err, "failed to marshal public key")
 	}
+	if format == KeyFormatDER {
+		return writeOutput(pubKeyDERBytes, outputFileName)
+	}
 	return WritePEM(pubKeyDERBytes, "PUBLIC KEY", outputFileName)
 }
@@ -0,0 +1,381 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package bsdiff implements binary deltas using the bsdiff algorithm by
+// Colin Percival. The patch format is similar to BSDIFF40 but the blocks are
+// compressed with zlib rather than bzip2, for which Go has no compressor,
+// and so it is not compatible with the original bspatch.
+package bsdiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/juju/errors"
+)
+
+const (
+	magic      = "MOSBSD01"
+	headerSize = len(magic) + 3*8
+)
+
+// Diff computes a patch that turns oldData into newData.
+func Diff(oldData, newData []byte) ([]byte, error) {
+	ctrl, diff, extra := diffBlocks(oldData, newData)
+
+	var blocks [3]bytes.Buffer
+	for i, b := range [][]byte{ctrl, diff, extra} {
+		zw, err := zlib.NewWriterLevel(&blocks[i], zlib.BestCompression)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if _, err := zw.Write(b); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	out := bytes.NewBufferString(magic)
+	binary.Write(out, binary.LittleEndian, int64(blocks[0].Len()))
+	binary.Write(out, binary.LittleEndian, int64(blocks[1].Len()))
+	binary.Write(out, binary.LittleEndian, int64(len(newData)))
+	for i := range blocks {
+		out.Write(blocks[i].Bytes())
+	}
+	return out.Bytes(), nil
+}
+
+// Patch applies a patch produced by Diff to oldData.
+func Patch(oldData, patch []byte) ([]byte, error) {
+	if len(patch) < headerSize || string(patch[:len(magic)]) != magic {
+		return nil, errors.Errorf("invalid patch header")
+	}
+	hdr := patch[len(magic):headerSize]
+	ctrlLen := int64(binary.LittleEndian.Uint64(hdr[0:8]))
+	diffLen := int64(binary.LittleEndian.Uint64(hdr[8:16]))
+	newSize := int64(binary.LittleEndian.Uint64(hdr[16:24]))
+	body := patch[headerSize:]
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 || ctrlLen+diffLen > int64(len(body)) {
+		return nil, errors.Errorf("corrupt patch")
+	}
+	var blocks [3][]byte
+	for i, b := range [][]byte{body[:ctrlLen], body[ctrlLen : ctrlLen+diffLen], body[ctrlLen+diffLen:]} {
+		zr, err := zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, errors.Annotatef(err, "corrupt patch")
+		}
+		if blocks[i], err = ioutil.ReadAll(zr); err != nil {
+			return nil, errors.Annotatef(err, "corrupt patch")
+		}
+	}
+	ctrl := bytes.NewReader(blocks[0])
+	diff, extra := blocks[1], blocks[2]
+
+	newData := make([]byte, newSize)
+	oldSize := int64(len(oldData))
+	var oldPos, newPos int64
+	for newPos < newSize {
+		var c [3]int64
+		for i := range c {
+			if err := binary.Read(ctrl, binary.LittleEndian, &c[i]); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, errors.Annotatef(err, "corrupt patch")
+			}
+		}
+		if c[0] < 0 || c[1] < 0 || newPos+c[0] > newSize || c[0] > int64(len(diff)) {
+			return nil, errors.Errorf("corrupt patch")
+		}
+		copy(newData[newPos:newPos+c[0]], diff[:c[0]])
+		diff = diff[c[0]:]
+		for i := int64(0); i < c[0]; i++ {
+			if oldPos+i >= 0 && oldPos+i < oldSize {
+				newData[newPos+i] += oldData[oldPos+i]
+			}
+		}
+		newPos += c[0]
+		oldPos += c[0]
+
+		if newPos+c[1] > newSize || c[1] > int64(len(extra)) {
+			return nil, errors.Errorf("corrupt patch")
+		}
+		copy(newData[newPos:newPos+c[1]], extra[:c[1]])
+		extra = extra[c[1]:]
+		newPos += c[1]
+		oldPos += c[2]
+	}
+	return newData, nil
+}
+
+func diffBlocks(oldData, newData []byte) (ctrl, diff, extra []byte) {
+	sa := qsufsort(oldData)
+	oldSize, newSize := len(oldData), len(newData)
+
+	var ctrlBuf bytes.Buffer
+	var scan, pos, length, lastScan, lastPos, lastOffset int
+	for scan < newSize {
+		oldScore := 0
+		scan += length
+		for scsc := scan; scan < newSize; scan++ {
+			pos, length = search(sa, oldData, newData[scan:], 0, oldSize)
+			for ; scsc < scan+length; scsc++ {
+				if scsc+lastOffset < oldSize && oldData[scsc+lastOffset] == newData[scsc] {
+					oldScore++
+				}
+			}
+			if (length == oldScore && length != 0) || length > oldScore+8 {
+				break
+			}
+			if scan+lastOffset < oldSize && oldData[scan+lastOffset] == newData[scan] {
+				oldScore--
+			}
+		}
+
+		if length == oldScore && scan != newSize {
+			continue
+		}
+
+		// Extend the previous match forward...
+		s, sf, lenf := 0, 0, 0
+		for i := 0; lastScan+i < scan && lastPos+i < oldSize; {
+			if oldData[lastPos+i] == newData[lastScan+i] {
+				s++
+			}
+			i++
+			if s*2-i > sf*2-lenf {
+				sf, lenf = s, i
+			}
+		}
+
+		// ...and the current one backward.
+		lenb := 0
+		if scan < newSize {
+			s, sb := 0, 0
+			for i := 1; scan >= lastScan+i && pos >= i; i++ {
+				if oldData[pos-i] == newData[scan-i] {
+					s++
+				}
+				if s*2-i > sb*2-lenb {
+					sb, lenb = s, i
+				}
+			}
+		}
+
+		// If they overlap, find the best split point.
+		if lastScan+lenf > scan-lenb {
+			overlap := (lastScan + lenf) - (scan - lenb)
+			s, ss, lens := 0, 0, 0
+			for i := 0; i < overlap; i++ {
+				if newData[lastScan+lenf-overlap+i] == oldData[lastPos+lenf-overlap+i] {
+					s++
+				}
+				if newData[scan-lenb+i] == oldData[pos-lenb+i] {
+					s--
+				}
+				if s > ss {
+					ss, lens = s, i+1
+				}
+			}
+			lenf += lens - overlap
+			lenb -= lens
+		}
+
+		for i := 0; i < lenf; i++ {
+			diff = append(diff, newData[lastScan+i]-oldData[lastPos+i])
+		}
+		extraLen := (scan - lenb) - (lastScan + lenf)
+		extra = append(extra, newData[lastScan+lenf:lastScan+lenf+extraLen]...)
+
+		binary.Write(&ctrlBuf, binary.LittleEndian, int64(lenf))
+		binary.Write(&ctrlBuf, binary.LittleEndian, int64(extraLen))
+		binary.Write(&ctrlBuf, binary.LittleEndian, int64((pos-lenb)-(lastPos+lenf)))
+
+		lastScan, lastPos, lastOffset = scan-lenb, pos-lenb, pos-scan
+	}
+	return ctrlBuf.Bytes(), diff, extra
+}
+
+func matchLen(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// search returns the position and length of the longest prefix of newData
+// found in oldData, using the suffix array sa.
+func search(sa []int, oldData, newData []byte, st, en int) (int, int) {
+	for en-st >= 2 {
+		x := st + (en-st)/2
+		n := len(oldData) - sa[x]
+		if n > len(newData) {
+			n = len(newData)
+		}
+		if bytes.Compare(oldData[sa[x]:sa[x]+n], newData[:n]) < 0 {
+			st = x
+		} else {
+			en = x
+		}
+	}
+	x := matchLen(oldData[sa[st]:], newData)
+	y := matchLen(oldData[sa[en]:], newData)
+	if x > y {
+		return sa[st], x
+	}
+	return sa[en], y
+}
+
+// qsufsort builds a suffix array of buf using the Larsson-Sadakane algorithm.
+// The result has len(buf)+1 entries, the first one being the empty suffix.
+func qsufsort(buf []byte) []int {
+	n := len(buf)
+	I := make([]int, n+1)
+	V := make([]int, n+1)
+
+	var buckets [256]int
+	for _, c := range buf {
+		buckets[c]++
+	}
+	for i := 1; i < 256; i++ {
+		buckets[i] += buckets[i-1]
+	}
+	for i := 255; i > 0; i-- {
+		buckets[i] = buckets[i-1]
+	}
+	buckets[0] = 0
+
+	for i, c := range buf {
+		buckets[c]++
+		I[buckets[c]] = i
+	}
+	I[0] = n
+	for i, c := range buf {
+		V[i] = buckets[c]
+	}
+	V[n] = 0
+	for i := 1; i < 256; i++ {
+		if buckets[i] == buckets[i-1]+1 {
+			I[buckets[i]] = -1
+		}
+	}
+	I[0] = -1
+
+	for h := 1; I[0] != -(n + 1); h += h {
+		l, i := 0, 0
+		for i < n+1 {
+			if I[i] < 0 {
+				l -= I[i]
+				i -= I[i]
+			} else {
+				if l != 0 {
+					I[i-l] = -l
+				}
+				l = V[I[i]] + 1 - i
+				split(I, V, i, l, h)
+				i += l
+				l = 0
+			}
+		}
+		if l != 0 {
+			I[i-l] = -l
+		}
+	}
+
+	for i := 0; i < n+1; i++ {
+		I[V[i]] = i
+	}
+	return I
+}
+
+func split(I, V []int, start, length, h int) {
+	if length < 16 {
+		for k := start; k < start+length; {
+			j, x := 1, V[I[k]+h]
+			for i := 1; k+i < start+length; i++ {
+				if V[I[k+i]+h] < x {
+					x = V[I[k+i]+h]
+					j = 0
+				}
+				if V[I[k+i]+h] == x {
+					I[k+j], I[k+i] = I[k+i], I[k+j]
+					j++
+				}
+			}
+			for i := 0; i < j; i++ {
+				V[I[k+i]] = k + j - 1
+			}
+			if j == 1 {
+				I[k] = -1
+			}
+			k += j
+		}
+		return
+	}
+
+	x := V[I[start+length/2]+h]
+	jj, kk := 0, 0
+	for i := start; i < start+length; i++ {
+		if V[I[i]+h] < x {
+			jj++
+		}
+		if V[I[i]+h] == x {
+			kk++
+		}
+	}
+	jj += start
+	kk += jj
+
+	i, j, k := start, 0, 0
+	for i < jj {
+		if V[I[i]+h] < x {
+			i++
+		} else if V[I[i]+h] == x {
+			I[i], I[jj+j] = I[jj+j], I[i]
+			j++
+		} else {
+			I[i], I[kk+k] = I[kk+k], I[i]
+			k++
+		}
+	}
+	for jj+j < kk {
+		if V[I[jj+j]+h] == x {
+			j++
+		} else {
+			I[jj+j], I[kk+k] = I[kk+k], I[jj+j]
+			k++
+		}
+	}
+
+	if jj > start {
+		split(I, V, start, jj-start, h)
+	}
+	for i := 0; i < kk-jj; i++ {
+		V[I[jj+i]] = kk - 1
+	}
+	if jj == kk-1 {
+		I[jj] = -1
+	}
+	if start+length > kk {
+		split(I, V, kk, start+length-kk, h)
+	}
+}
@@ -0,0 +1,71 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package bsdiff
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDiffPatch(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	rnd := func(n int) []byte {
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+	base := rnd(100000)
+	modified := append([]byte{}, base...)
+	for i := 0; i < 100; i++ {
+		modified[r.Intn(len(modified))] ^= 0x55
+	}
+	modified = append(append(append([]byte{}, modified[:5000]...), rnd(1000)...), modified[5000:]...)
+
+	cases := []struct {
+		name     string
+		old, new []byte
+	}{
+		{"empty", nil, nil},
+		{"from empty", nil, []byte("hello, world")},
+		{"to empty", []byte("hello, world"), nil},
+		{"same", base, base},
+		{"padding", bytes.Repeat([]byte{0xff}, 4096), append(bytes.Repeat([]byte{0xff}, 4000), rnd(200)...)},
+		{"modified", base, modified},
+	}
+	for _, c := range cases {
+		patch, err := Diff(c.old, c.new)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		res, err := Patch(c.old, patch)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if !bytes.Equal(res, c.new) {
+			t.Errorf("%s: patched data does not match", c.name)
+		}
+	}
+
+	patch, _ := Diff(base, modified)
+	if len(patch) > len(modified)/10 {
+		t.Errorf("patch is too big: %d", len(patch))
+	}
+	if _, err := Patch(base, patch[:len(patch)/2]); err == nil {
+		t.Errorf("truncated patch should fail")
+	}
+}
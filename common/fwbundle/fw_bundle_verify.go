@@ -0,0 +1,201 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fwbundle
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+
+	zip "github.com/mongoose-os/mos/common/ourzip"
+)
+
+var sigAttrRegex = regexp.MustCompile(`^sig\d+$`)
+
+// PartVerifyResult is the result of checking a single part against the manifest.
+type PartVerifyResult struct {
+	Name string
+	Src  string
+	// Nil if the part data matches the checksum in the manifest.
+	Err error
+}
+
+// VerifyResult is the result of verifying a signed bundle.
+type VerifyResult struct {
+	NumSignatures int
+	// Indices of the keys for which a valid signature was found.
+	ValidKeys []int
+	Parts     []*PartVerifyResult
+	// Files in the archive that are not referenced by any part and are thus not covered by the signature.
+	Unreferenced []string
+}
+
+// VerifyZipFirmwareBundle checks signatures of a bundle created by
+// WriteSignedZipFirmwareBytes. The signatures cover the manifest, which in turn
+// contains checksums of all the parts. An error is returned if there are
+// no signatures, any of the keys did not sign the manifest or any of the parts
+// does not match its checksum. The result is returned in all of these cases.
+func VerifyZipFirmwareBundle(zipData []byte, keys []*ecdsa.PublicKey) (*VerifyResult, error) {
+	r, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid firmware file")
+	}
+	var manifestFile *zip.File
+	blobs := map[string][]byte{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to open %s", f.Name)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to read %s", f.Name)
+		}
+		blobs[path.Base(f.Name)] = data
+		if path.Base(f.Name) == ManifestFileName {
+			manifestFile = f
+		}
+	}
+	if manifestFile == nil {
+		return nil, errors.Errorf("no %s in the archive", ManifestFileName)
+	}
+	manifestData := blobs[ManifestFileName]
+
+	res := &VerifyResult{}
+	sigs, err := getSignatures(manifestFile.Extra)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	res.NumSignatures = len(sigs)
+	manifestDigest := sha256.Sum256(manifestData)
+	var errs []string
+	for ki, key := range keys {
+		for _, sig := range sigs {
+			if verifyECDSASignature(key, manifestDigest[:], sig) {
+				res.ValidKeys = append(res.ValidKeys, ki)
+				break
+			}
+		}
+	}
+	if len(sigs) == 0 {
+		errs = append(errs, "bundle is not signed")
+	} else if len(res.ValidKeys) != len(keys) {
+		errs = append(errs, fmt.Sprintf("%d of %d keys have no valid signature", len(keys)-len(res.ValidKeys), len(keys)))
+	}
+
+	var fwm FirmwareManifest
+	if err := json.Unmarshal(manifestData, &fwm); err != nil {
+		return nil, errors.Annotatef(err, "failed to parse manifest")
+	}
+	referenced := map[string]bool{ManifestFileName: true}
+	for name, p := range fwm.Parts {
+		if p.Src == "" {
+			continue
+		}
+		pr := &PartVerifyResult{Name: name, Src: p.Src}
+		referenced[p.Src] = true
+		data, ok := blobs[p.Src]
+		switch {
+		case !ok:
+			pr.Err = errors.Errorf("%s not found in the archive", p.Src)
+		case p.ChecksumSHA256 == "" && p.ChecksumSHA1 == "":
+			pr.Err = errors.Errorf("no checksum in the manifest")
+		case p.ChecksumSHA256 != "" && !strings.EqualFold(p.ChecksumSHA256, computeSHA256(data)):
+			pr.Err = errors.Errorf("SHA256 mismatch: expected %s, got %s", p.ChecksumSHA256, computeSHA256(data))
+		case p.ChecksumSHA256 == "" && !strings.EqualFold(p.ChecksumSHA1, computeSHA1(data)):
+			pr.Err = errors.Errorf("SHA1 mismatch: expected %s, got %s", p.ChecksumSHA1, computeSHA1(data))
+		}
+		if pr.Err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", name, pr.Err))
+		}
+		res.Parts = append(res.Parts, pr)
+	}
+	sort.Slice(res.Parts, func(i, j int) bool { return res.Parts[i].Name < res.Parts[j].Name })
+	for name := range blobs {
+		if !referenced[name] {
+			res.Unreferenced = append(res.Unreferenced, name)
+		}
+	}
+	sort.Strings(res.Unreferenced)
+
+	if len(errs) > 0 {
+		return res, errors.Errorf("verification failed: %s", strings.Join(errs, "; "))
+	}
+	return res, nil
+}
+
+// getSignatures extracts signatures from the manifest file's extra data.
+func getSignatures(extra []byte) ([][]byte, error) {
+	var sigs [][]byte
+	eb := bytes.NewBuffer(extra)
+	for eb.Len() >= 4 {
+		var id, size uint16
+		binary.Read(eb, binary.LittleEndian, &id)
+		binary.Read(eb, binary.LittleEndian, &size)
+		if int(size) > eb.Len() {
+			return nil, errors.Errorf("invalid manifest extra data")
+		}
+		data := eb.Next(int(size))
+		if id != zipExtraDataID {
+			continue
+		}
+		var attrs map[string]interface{}
+		if err := json.Unmarshal(data, &attrs); err != nil {
+			return nil, errors.Annotatef(err, "invalid extra attributes")
+		}
+		var keys []string
+		for k := range attrs {
+			if sigAttrRegex.MatchString(k) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v, _ := attrs[k].(string)
+			sig, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, errors.Annotatef(err, "invalid signature %s", k)
+			}
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs, nil
+}
+
+func verifyECDSASignature(key *ecdsa.PublicKey, digest, sig []byte) bool {
+	var rs struct {
+		R, S *big.Int
+	}
+	if rest, err := asn1.Unmarshal(sig, &rs); err != nil || len(rest) != 0 {
+		return false
+	}
+	return ecdsa.Verify(key, digest, rs.R, rs.S)
+}
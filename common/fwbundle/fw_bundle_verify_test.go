@@ -0,0 +1,101 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fwbundle
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	zip "github.com/mongoose-os/mos/common/ourzip"
+)
+
+func makeSignedBundle(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	fwb := NewBundle()
+	fwb.Name = "test"
+	fwb.Platform = "esp32"
+	for name, data := range map[string][]byte{"boot": []byte("boot data"), "app": []byte("app data")} {
+		p := &FirmwarePart{Name: name, Src: name + ".bin"}
+		p.SetData(data)
+		fwb.AddPart(p)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := WriteSignedZipFirmwareBytes(fwb, buf, false, []crypto.Signer{key}, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// rewriteZip copies the archive, replacing contents of the file named replName.
+func rewriteZip(t *testing.T, zipData []byte, replName string, replData []byte) []byte {
+	r, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	for _, f := range r.File {
+		rc, _ := f.Open()
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if f.Name == replName {
+			data = replData
+		}
+		if err := zw.AddFile(&zip.FileHeader{Name: f.Name, Extra: f.Extra, Method: zip.Store}, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestVerifyZipFirmwareBundle(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	zipData := makeSignedBundle(t, key)
+
+	res, err := VerifyZipFirmwareBundle(zipData, []*ecdsa.PublicKey{&key.PublicKey})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if res.NumSignatures != 1 || len(res.ValidKeys) != 1 || len(res.Parts) != 2 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	if _, err := VerifyZipFirmwareBundle(zipData, []*ecdsa.PublicKey{&otherKey.PublicKey}); err == nil {
+		t.Errorf("expected an error with the wrong key")
+	}
+
+	tampered := rewriteZip(t, zipData, "app.bin", []byte("evil data"))
+	res, err = VerifyZipFirmwareBundle(tampered, []*ecdsa.PublicKey{&key.PublicKey})
+	if err == nil || !strings.Contains(err.Error(), "app: SHA256 mismatch") {
+		t.Errorf("expected a mismatch error, got %v", err)
+	}
+	if res == nil || len(res.ValidKeys) != 1 {
+		t.Errorf("manifest signature should still be valid: %+v", res)
+	}
+
+	tampered = rewriteZip(t, zipData, ManifestFileName, []byte(`{"name": "evil"}`))
+	if _, err = VerifyZipFirmwareBundle(tampered, []*ecdsa.PublicKey{&key.PublicKey}); err == nil {
+		t.Errorf("expected an error with the modified manifest")
+	}
+}
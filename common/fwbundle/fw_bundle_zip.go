@@ -50,14 +50,17 @@ const (
 )
 
 func ReadZipFirmwareBundle(fname string) (*FirmwareBundle, error) {
-	var r *zip.Reader
-
 	zipData, err := ourutil.ReadOrFetchFile(fname)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	return ReadZipFirmwareBundleData(fname, zipData)
+}
 
-	r, err = zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+// ReadZipFirmwareBundleData parses the bundle which has already been read
+// from fname, e.g. to get several independent copies of it.
+func ReadZipFirmwareBundleData(fname string, zipData []byte) (*FirmwareBundle, error) {
+	r, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
 	if err != nil {
 		return nil, errors.Annotatef(err, "%s: invalid firmware file", fname)
 	}
@@ -0,0 +1,271 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fwbundle
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/juju/errors"
+	glog "k8s.io/klog/v2"
+
+	"github.com/mongoose-os/mos/cli/ourutil"
+	"github.com/mongoose-os/mos/common/bsdiff"
+	zip "github.com/mongoose-os/mos/common/ourzip"
+)
+
+// A delta is a ZIP archive that contains the manifest of the new firmware
+// bundle (verbatim, including signatures), delta.json that describes how to
+// obtain each part and the data that is needed to do so: bsdiff patches
+// against the same part of the base bundle or full part contents.
+
+const (
+	DeltaInfoFileName = "delta.json"
+
+	DeltaOpCopy  = "copy"
+	DeltaOpPatch = "patch"
+	DeltaOpFull  = "full"
+
+	deltaPatchSuffix = ".bsdiff"
+)
+
+type DeltaPartInfo struct {
+	Op string `json:"op"`
+	// Checksum of the base part, for copy and patch.
+	BaseChecksumSHA256 string `json:"base_cs_sha256,omitempty"`
+}
+
+type DeltaInfo struct {
+	BaseName     string                    `json:"base_name,omitempty"`
+	BasePlatform string                    `json:"base_platform,omitempty"`
+	BaseVersion  string                    `json:"base_version,omitempty"`
+	BaseBuildID  string                    `json:"base_build_id,omitempty"`
+	Parts        map[string]*DeltaPartInfo `json:"parts"`
+}
+
+type rawZipFile struct {
+	data  []byte
+	extra []byte
+}
+
+func readRawZip(data []byte) (map[string]*rawZipFile, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	res := make(map[string]*rawZipFile)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s: failed to open", f.Name)
+		}
+		fd, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s: failed to read", f.Name)
+		}
+		res[f.Name] = &rawZipFile{data: fd, extra: f.Extra}
+	}
+	return res, nil
+}
+
+// MakeDelta creates a delta that turns base bundle into the new one.
+func MakeDelta(baseFile, newFile string) ([]byte, *DeltaInfo, error) {
+	base, err := ReadZipFirmwareBundle(baseFile)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	newZipData, err := ourutil.ReadOrFetchFile(newFile)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	newFiles, err := readRawZip(newZipData)
+	if err != nil {
+		return nil, nil, errors.Annotatef(err, "%s: invalid firmware file", newFile)
+	}
+	nf, err := ReadZipFirmwareBundle(newFile)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	mf := newFiles[ManifestFileName]
+	if mf == nil {
+		return nil, nil, errors.Errorf("%s: no %s in the archive", newFile, ManifestFileName)
+	}
+	if base.Platform != nf.Platform {
+		return nil, nil, errors.Errorf("platform mismatch: %q vs %q", base.Platform, nf.Platform)
+	}
+
+	di := &DeltaInfo{
+		BaseName:     base.Name,
+		BasePlatform: base.Platform,
+		BaseVersion:  base.Version,
+		BaseBuildID:  base.BuildID,
+		Parts:        make(map[string]*DeltaPartInfo),
+	}
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	if err := zw.AddFile(&zip.FileHeader{Name: ManifestFileName, Method: zip.Deflate, Extra: mf.extra}, mf.data); err != nil {
+		return nil, nil, errors.Annotatef(err, "error adding %s", ManifestFileName)
+	}
+	for name, p := range nf.Parts {
+		if p.Src == "" {
+			continue
+		}
+		if p.ChecksumSHA1 == "" && p.ChecksumSHA256 == "" {
+			return nil, nil, errors.Errorf("%s: part has no checksum", name)
+		}
+		data, err := p.GetData()
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		pi := &DeltaPartInfo{Op: DeltaOpFull}
+		var patch []byte
+		if bp := base.Parts[name]; bp != nil && bp.Src != "" {
+			baseData, err := bp.GetData()
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			pi.BaseChecksumSHA256 = computeSHA256(baseData)
+			if bytes.Equal(baseData, data) {
+				pi.Op = DeltaOpCopy
+			} else {
+				if patch, err = bsdiff.Diff(baseData, data); err != nil {
+					return nil, nil, errors.Annotatef(err, "%s: failed to compute delta", name)
+				}
+				glog.Infof("%s: %d bytes, patch %d bytes", name, len(data), len(patch))
+				if len(patch) < len(data) {
+					pi.Op = DeltaOpPatch
+				}
+			}
+		}
+		switch pi.Op {
+		case DeltaOpPatch:
+			err = zw.AddFile(&zip.FileHeader{Name: p.Src + deltaPatchSuffix, Method: zip.Store}, patch)
+		case DeltaOpFull:
+			pi.BaseChecksumSHA256 = ""
+			err = zw.AddFile(&zip.FileHeader{Name: p.Src, Method: zip.Deflate}, data)
+		}
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "%s: error adding data", name)
+		}
+		di.Parts[name] = pi
+	}
+	diData, err := json.MarshalIndent(di, "", " ")
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if err := zw.AddFile(&zip.FileHeader{Name: DeltaInfoFileName, Method: zip.Deflate}, diData); err != nil {
+		return nil, nil, errors.Annotatef(err, "error adding %s", DeltaInfoFileName)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, nil, errors.Annotatef(err, "error closing the archive")
+	}
+	return buf.Bytes(), di, nil
+}
+
+// ApplyDelta reconstructs the new firmware bundle from the base bundle and
+// the delta. Checksums of all the parts are verified against the new manifest.
+// The result is a ZIP bundle equivalent to the one the delta was created from.
+func ApplyDelta(baseFile string, deltaData []byte) ([]byte, *DeltaInfo, error) {
+	base, err := ReadZipFirmwareBundle(baseFile)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	files, err := readRawZip(deltaData)
+	if err != nil {
+		return nil, nil, errors.Annotatef(err, "invalid delta")
+	}
+	mf, dif := files[ManifestFileName], files[DeltaInfoFileName]
+	if mf == nil || dif == nil {
+		return nil, nil, errors.Errorf("invalid delta: no %s or %s", ManifestFileName, DeltaInfoFileName)
+	}
+	var di DeltaInfo
+	if err := json.Unmarshal(dif.data, &di); err != nil {
+		return nil, nil, errors.Annotatef(err, "invalid delta: failed to parse %s", DeltaInfoFileName)
+	}
+	var fm FirmwareManifest
+	if err := json.Unmarshal(mf.data, &fm); err != nil {
+		return nil, nil, errors.Annotatef(err, "invalid delta: failed to parse manifest")
+	}
+
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	if err := zw.AddFile(&zip.FileHeader{Name: ManifestFileName, Method: zip.Deflate, Extra: mf.extra}, mf.data); err != nil {
+		return nil, nil, errors.Annotatef(err, "error adding %s", ManifestFileName)
+	}
+	for name, p := range fm.Parts {
+		if p.Src == "" {
+			continue
+		}
+		p.Name = name
+		pi := di.Parts[name]
+		if pi == nil {
+			return nil, nil, errors.Errorf("%s: not in the delta", name)
+		}
+		if p.ChecksumSHA1 == "" && p.ChecksumSHA256 == "" {
+			return nil, nil, errors.Errorf("%s: part has no checksum", name)
+		}
+		var baseData []byte
+		if pi.Op != DeltaOpFull {
+			bp := base.Parts[name]
+			if bp == nil {
+				return nil, nil, errors.Errorf("%s: not in the base firmware", name)
+			}
+			if baseData, err = bp.GetData(); err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			if cs := computeSHA256(baseData); cs != pi.BaseChecksumSHA256 {
+				return nil, nil, errors.Errorf("%s: base firmware does not match the delta (want %s, got %s)",
+					name, pi.BaseChecksumSHA256, cs)
+			}
+		}
+		var data []byte
+		switch pi.Op {
+		case DeltaOpCopy:
+			data = baseData
+		case DeltaOpPatch:
+			pf := files[p.Src+deltaPatchSuffix]
+			if pf == nil {
+				return nil, nil, errors.Errorf("%s: no patch in the delta", name)
+			}
+			if data, err = bsdiff.Patch(baseData, pf.data); err != nil {
+				return nil, nil, errors.Annotatef(err, "%s: failed to apply patch", name)
+			}
+		case DeltaOpFull:
+			df := files[p.Src]
+			if df == nil {
+				return nil, nil, errors.Errorf("%s: no data in the delta", name)
+			}
+			data = df.data
+		default:
+			return nil, nil, errors.Errorf("%s: unknown op %q", name, pi.Op)
+		}
+		// Let GetData verify the checksums.
+		p.SetDataProvider(func(name, src string) ([]byte, error) { return data, nil })
+		if _, err := p.GetData(); err != nil {
+			return nil, nil, errors.Annotatef(err, "reconstructed firmware is invalid")
+		}
+		if err := zw.AddFile(&zip.FileHeader{Name: p.Src, Method: zip.Deflate}, data); err != nil {
+			return nil, nil, errors.Annotatef(err, "%s: error adding %s", name, p.Src)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, nil, errors.Annotatef(err, "error closing the archive")
+	}
+	return buf.Bytes(), &di, nil
+}
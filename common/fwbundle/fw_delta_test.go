@@ -0,0 +1,112 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fwbundle
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestBundle(t *testing.T, fname, version string, parts map[string][]byte) {
+	fwb := NewBundle()
+	fwb.Name = "test"
+	fwb.Platform = "esp32"
+	fwb.Version = version
+	for name, data := range parts {
+		p := &FirmwarePart{Name: name, Src: name + ".bin"}
+		p.SetData(data)
+		fwb.AddPart(p)
+	}
+	if err := WriteZipFirmwareBundle(fwb, fname, true, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDelta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fw_delta_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := rand.New(rand.NewSource(1))
+	boot := make([]byte, 10000)
+	app1 := make([]byte, 200000)
+	r.Read(boot)
+	r.Read(app1)
+	app2 := append([]byte{}, app1...)
+	for i := 0; i < 50; i++ {
+		app2[r.Intn(len(app2))]++
+	}
+	fs := make([]byte, 5000)
+	r.Read(fs)
+
+	baseFile := filepath.Join(dir, "base.zip")
+	newFile := filepath.Join(dir, "new.zip")
+	writeTestBundle(t, baseFile, "1.0", map[string][]byte{"boot": boot, "app": app1})
+	writeTestBundle(t, newFile, "1.1", map[string][]byte{"boot": boot, "app": app2, "fs": fs})
+
+	delta, di, err := MakeDelta(baseFile, newFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if di.BaseVersion != "1.0" {
+		t.Errorf("unexpected base version %q", di.BaseVersion)
+	}
+	for name, op := range map[string]string{"boot": DeltaOpCopy, "app": DeltaOpPatch, "fs": DeltaOpFull} {
+		if di.Parts[name] == nil || di.Parts[name].Op != op {
+			t.Errorf("%s: expected %s, got %+v", name, op, di.Parts[name])
+		}
+	}
+	if len(delta) > len(app2)/10 {
+		t.Errorf("delta is too big: %d", len(delta))
+	}
+
+	res, _, err := ApplyDelta(baseFile, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resFile := filepath.Join(dir, "res.zip")
+	if err := ioutil.WriteFile(resFile, res, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fwb, err := ReadZipFirmwareBundle(resFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fwb.Version != "1.1" {
+		t.Errorf("unexpected version %q", fwb.Version)
+	}
+	for name, exp := range map[string][]byte{"boot": boot, "app": app2, "fs": fs} {
+		data, err := fwb.GetPartData(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, exp) {
+			t.Errorf("%s: data does not match", name)
+		}
+	}
+
+	// Applying to a wrong base must fail.
+	if _, _, err := ApplyDelta(newFile, delta); err == nil {
+		t.Errorf("expected an error")
+	}
+}
@@ -3,8 +3,20 @@
 
 package ourgit
 
+import (
+	"context"
+	"io"
+)
+
 type OurGit interface {
 	GetCurrentHash(localDir string) (string, error)
+	// GetCurrentBranch returns the name of the checked out branch, or an empty
+	// string if HEAD is detached.
+	GetCurrentBranch(localDir string) (string, error)
+	// Describe is like git describe --tags --always: the most recent tag,
+	// followed by the number of commits since it and the abbreviated hash of
+	// HEAD if HEAD is not at the tag; the abbreviated hash if there are no tags.
+	Describe(localDir string) (string, error)
 	DoesBranchExist(localDir string, branchName string) (bool, error)
 	DoesTagExist(localDir string, tagName string) (bool, error)
 	GetToplevelDir(localDir string) (string, error)
@@ -13,8 +25,16 @@ type OurGit interface {
 	Pull(localDir string, branch string) error
 	Fetch(localDir string, what string, opts FetchOptions) error
 	IsClean(localDir, version string, excludeGlobs []string) (bool, error)
-	Clone(srcURL, localDir string, opts CloneOptions) error
+	// GetChangedFiles returns the files changed since the given ref,
+	// including uncommitted and untracked ones, relative to the top-level dir.
+	GetChangedFiles(localDir, ref string) ([]string, error)
+	Clone(ctx context.Context, srcURL, localDir string, opts CloneOptions) error
 	GetOriginURL(localDir string) (string, error)
+	// ListRemoteRefs returns refs of the remote repo (refs/heads/master,
+	// refs/tags/v1.0, HEAD, etc) with their hashes, like git ls-remote.
+	// For annotated tags, the hash of the commit is returned if the remote
+	// reports it.
+	ListRemoteRefs(srcURL string) (map[string]string, error)
 }
 
 type RefType string
@@ -27,6 +47,9 @@ type CloneOptions struct {
 	Depth int
 	// Head to fetch: it can be a branch name, a tag name, or a hash.
 	Ref string
+	// If set, progress messages (objects counted, received, etc) are written
+	// here. Equivalent of the --progress CLI flag.
+	Progress io.Writer
 }
 
 type FetchOptions struct {
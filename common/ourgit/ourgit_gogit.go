@@ -4,19 +4,24 @@
 package ourgit
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	git "github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/storer"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/juju/errors"
 	glog "k8s.io/klog/v2"
 )
@@ -53,6 +58,86 @@ func (m *ourGitGoGit) GetCurrentHash(localDir string) (string, error) {
 	return head.Hash().String(), nil
 }
 
+func (m *ourGitGoGit) GetCurrentBranch(localDir string) (string, error) {
+	repo, err := git.PlainOpen(localDir)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return "", errors.Annotatef(err, "%s", localDir)
+	}
+
+	if !head.Name().IsBranch() {
+		return "", nil
+	}
+	return head.Name().Short(), nil
+}
+
+func (m *ourGitGoGit) Describe(localDir string) (string, error) {
+	repo, err := git.PlainOpen(localDir)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return "", errors.Annotatef(err, "%s", localDir)
+	}
+
+	// Commits the tags point to, annotated tags are peeled.
+	tagged := map[plumbing.Hash]string{}
+	tags, err := repo.Tags()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		h := ref.Hash()
+		if to, err := repo.TagObject(h); err == nil {
+			c, err := to.Commit()
+			if err != nil {
+				return nil
+			}
+			h = c.Hash
+		}
+		tagged[h] = ref.Name().Short()
+		return nil
+	})
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	tag, n := "", 0
+	if len(tagged) > 0 {
+		commits, err := repo.Log(&git.LogOptions{From: head.Hash()})
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		err = commits.ForEach(func(c *object.Commit) error {
+			if t, ok := tagged[c.Hash]; ok {
+				tag = t
+				return storer.ErrStop
+			}
+			n++
+			return nil
+		})
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+	}
+
+	short := head.Hash().String()[:7]
+	switch {
+	case tag == "":
+		return short, nil
+	case n == 0:
+		return tag, nil
+	default:
+		return fmt.Sprintf("%s-%d-g%s", tag, n, short), nil
+	}
+}
+
 func doesRefExist(iter storer.ReferenceIter, name string) (bool, error) {
 	exists := false
 
@@ -289,7 +374,76 @@ s:
 	return r, nil
 }
 
-func (m *ourGitGoGit) Clone(srcURL, localDir string, opts CloneOptions) error {
+func (m *ourGitGoGit) GetChangedFiles(localDir, ref string) ([]string, error) {
+	repo, err := git.PlainOpenWithOptions(localDir, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	refHash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to resolve %s", ref)
+	}
+	refCommit, err := repo.CommitObject(*refHash)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	refTree, err := refCommit.Tree()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	headCommit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	headTree, err := headCommit.Tree()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Committed changes since ref.
+	changed := map[string]bool{}
+	changes, err := object.DiffTree(refTree, headTree)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, c := range changes {
+		if c.From.Name != "" {
+			changed[c.From.Name] = true
+		}
+		if c.To.Name != "" {
+			changed[c.To.Name] = true
+		}
+	}
+
+	// Uncommitted and untracked changes.
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for fn, fs := range status {
+		if fs.Worktree != git.Unmodified || fs.Staging != git.Unmodified {
+			changed[fn] = true
+		}
+	}
+
+	var res []string
+	for fn := range changed {
+		res = append(res, fn)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (m *ourGitGoGit) Clone(ctx context.Context, srcURL, localDir string, opts CloneOptions) error {
 	// Check if the dir existed before we try to do the clone
 	existed := false
 	if _, err := os.Stat(localDir); !os.IsNotExist(err) {
@@ -307,10 +461,11 @@ func (m *ourGitGoGit) Clone(srcURL, localDir string, opts CloneOptions) error {
 
 	goGitOpts := []git.CloneOptions{
 		git.CloneOptions{
-			Auth:  m.auth,
-			URL:   srcURL,
-			Depth: opts.Depth,
-			Tags:  git.TagFollowing,
+			Auth:     m.auth,
+			URL:      srcURL,
+			Depth:    opts.Depth,
+			Tags:     git.TagFollowing,
+			Progress: opts.Progress,
 		},
 	}
 
@@ -340,8 +495,8 @@ func (m *ourGitGoGit) Clone(srcURL, localDir string, opts CloneOptions) error {
 		if !existed {
 			os.RemoveAll(localDir)
 		}
-		_, err = git.PlainClone(localDir, false, &o)
-		if err == nil {
+		_, err = git.PlainCloneContext(ctx, localDir, false, &o)
+		if err == nil || ctx.Err() != nil {
 			break
 		}
 	}
@@ -373,6 +528,43 @@ func (m *ourGitGoGit) GetOriginURL(localDir string) (string, error) {
 	return "", errors.Errorf("failed to get origin URL")
 }
 
+func (m *ourGitGoGit) ListRemoteRefs(srcURL string) (map[string]string, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{srcURL},
+	})
+	refs, err := remote.List(&git.ListOptions{Auth: m.auth})
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to list refs of %s", srcURL)
+	}
+	res := map[string]string{}
+	peeled := map[string]string{}
+	for _, ref := range refs {
+		name := ref.Name().String()
+		switch ref.Type() {
+		case plumbing.HashReference:
+			if strings.HasSuffix(name, "^{}") {
+				peeled[strings.TrimSuffix(name, "^{}")] = ref.Hash().String()
+			} else {
+				res[name] = ref.Hash().String()
+			}
+		case plumbing.SymbolicReference:
+			// HEAD, resolved below.
+		}
+	}
+	for _, ref := range refs {
+		if ref.Type() == plumbing.SymbolicReference {
+			if h, ok := res[ref.Target().String()]; ok {
+				res[ref.Name().String()] = h
+			}
+		}
+	}
+	for name, hash := range peeled {
+		res[name] = hash
+	}
+	return res, nil
+}
+
 // NewHash return a new Hash from a hexadecimal hash representation
 func newHashSafe(s string) (plumbing.Hash, error) {
 	b, err := hex.DecodeString(s)
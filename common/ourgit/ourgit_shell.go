@@ -6,7 +6,9 @@ package ourgit
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
@@ -43,6 +45,25 @@ func (m *ourGitShell) GetCurrentHash(localDir string) (string, error) {
 	return resp, nil
 }
 
+func (m *ourGitShell) GetCurrentBranch(localDir string) (string, error) {
+	resp, err := m.shellGit(localDir, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return "", errors.Annotatef(err, "failed to get current branch")
+	}
+	if resp == "HEAD" {
+		return "", nil
+	}
+	return resp, nil
+}
+
+func (m *ourGitShell) Describe(localDir string) (string, error) {
+	resp, err := m.shellGit(localDir, "describe", "--tags", "--always")
+	if err != nil {
+		return "", errors.Annotatef(err, "failed to describe HEAD")
+	}
+	return resp, nil
+}
+
 func (m *ourGitShell) DoesBranchExist(localDir string, branch string) (bool, error) {
 	resp, err := m.shellGit(localDir, "branch", "--list", branch)
 	if err != nil {
@@ -186,6 +207,24 @@ scan:
 	return true, nil
 }
 
+func (m *ourGitShell) GetChangedFiles(localDir, ref string) ([]string, error) {
+	diff, err := m.shellGit(localDir, "diff", "--name-only", ref, "--")
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to get changes since %s", ref)
+	}
+	untracked, err := m.shellGit(localDir, "ls-files", "--full-name", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to get untracked files")
+	}
+	var res []string
+	for _, f := range strings.Split(diff+"\n"+untracked, "\n") {
+		if f = strings.TrimSpace(f); f != "" {
+			res = append(res, f)
+		}
+	}
+	return res, nil
+}
+
 func (m *ourGitShell) ResetHard(localDir string) error {
 	_, err := m.shellGit(localDir, "checkout", ".")
 	if err != nil {
@@ -194,9 +233,13 @@ func (m *ourGitShell) ResetHard(localDir string) error {
 	return nil
 }
 
-func (m *ourGitShell) Clone(srcURL, targetDir string, opts CloneOptions) error {
+func (m *ourGitShell) Clone(ctx context.Context, srcURL, targetDir string, opts CloneOptions) error {
 	var args []string
 
+	if opts.Progress != nil {
+		args = append(args, "--progress")
+	}
+
 	if opts.ReferenceDir != "" {
 		args = append(args, "--reference", opts.ReferenceDir)
 	}
@@ -211,7 +254,7 @@ func (m *ourGitShell) Clone(srcURL, targetDir string, opts CloneOptions) error {
 
 	args = append(args, srcURL, targetDir)
 
-	_, err := m.shellGit("", "clone", args...)
+	_, err := m.shellGitContext(ctx, "", opts.Progress, "clone", args...)
 
 	return errors.Trace(err)
 }
@@ -227,6 +270,36 @@ func (m *ourGitShell) GetOriginURL(localDir string) (string, error) {
 	return resp, nil
 }
 
+func (m *ourGitShell) ListRemoteRefs(srcURL string) (map[string]string, error) {
+	resp, err := m.shellGit("", "ls-remote", srcURL)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to list refs of %s", srcURL)
+	}
+	return parseLsRemote(resp), nil
+}
+
+// parseLsRemote parses git ls-remote output. For annotated tags, the hash of
+// the commit (the ^{} entry) is used.
+func parseLsRemote(resp string) map[string]string {
+	res := map[string]string{}
+	peeled := map[string]string{}
+	for _, line := range strings.Split(resp, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			continue
+		}
+		if strings.HasSuffix(parts[1], "^{}") {
+			peeled[strings.TrimSuffix(parts[1], "^{}")] = parts[0]
+		} else {
+			res[parts[1]] = parts[0]
+		}
+	}
+	for ref, hash := range peeled {
+		res[ref] = hash
+	}
+	return res
+}
+
 func (m *ourGitShell) HashesEqual(hash1, hash2 string) bool {
 	minLen := len(hash1)
 	if len(hash2) < minLen {
@@ -242,6 +315,14 @@ func (m *ourGitShell) HashesEqual(hash1, hash2 string) bool {
 }
 
 func (m *ourGitShell) shellGit(localDir string, subcmd string, args ...string) (string, error) {
+	return m.shellGitContext(context.Background(), localDir, nil, subcmd, args...)
+}
+
+// shellGitContext is like shellGit, but the command is killed when ctx is
+// cancelled, and stderr is also copied to progress, if given.
+func (m *ourGitShell) shellGitContext(
+	ctx context.Context, localDir string, progress io.Writer, subcmd string, args ...string,
+) (string, error) {
 	var cmdArgs []string
 
 	// If the user provided credentials, insert ourserves as auth helper.
@@ -258,13 +339,16 @@ func (m *ourGitShell) shellGit(localDir string, subcmd string, args ...string) (
 	cmdArgs = append(cmdArgs, subcmd)
 	cmdArgs = append(cmdArgs, args...)
 
-	cmd := exec.Command("git", cmdArgs...)
+	cmd := exec.CommandContext(ctx, "git", cmdArgs...)
 
 	var b bytes.Buffer
 	var berr bytes.Buffer
 	cmd.Dir = localDir
 	cmd.Stdout = &b
 	cmd.Stderr = &berr
+	if progress != nil {
+		cmd.Stderr = io.MultiWriter(&berr, progress)
+	}
 	glog.V(4).Infof("%s %s %v", "git", localDir, cmdArgs)
 	err := cmd.Run()
 	if err != nil {
@@ -22,3 +22,12 @@ const (
 	// build failure
 	FwbuildExitCodeBuildFailed = 200
 )
+
+// BuildInfo is written by the fwbuild-instance binary to the file given
+// with --build-info, and is used by the manager to collect metrics.
+type BuildInfo struct {
+	App      string `json:"app"`
+	Platform string `json:"platform"`
+	// True if an existing build context was updated incrementally.
+	Incremental bool `json:"incremental"`
+}
@@ -55,6 +55,7 @@ var (
 	reqParFileName    = flag.String("req-params", "", "Request params filename")
 	outputZipFileName = flag.String("output-zip", "", "Output zip filename")
 	timeoutFlag       = flag.Duration("timeout", 15*time.Minute, "Timeout for builds")
+	buildInfoFileName = flag.String("build-info", "", "If set, build info JSON is written to this file")
 
 	locks = &locksStruct{
 		flockByPath: map[string]*flock.Flock{},
@@ -421,6 +422,16 @@ func buildFirmware() error {
 		}
 	}
 
+	if *buildInfoFileName != "" {
+		if err := writeBuildInfo(*buildInfoFileName, &fwbuildcommon.BuildInfo{
+			App:         manifest.Name,
+			Platform:    filepath.Base(appArchRoot),
+			Incremental: !clean,
+		}); err != nil {
+			glog.Warningf("Failed to write build info: %s", err)
+		}
+	}
+
 	// If the build is clean, just vanish existing codeDir (if any), and rename
 	// the uploaded sources to codeDir
 	if clean {
@@ -510,9 +521,11 @@ func buildFirmware() error {
 		return errors.Trace(err)
 	}
 
-	// Pack build directory ignoring build/objs/* except build/objs/*.elf
+	// Pack build directory ignoring build/objs/* except build/objs/*.elf and
+	// the linker map file
 	matcher := ourglob.PatItems{
 		{"build/objs/*.elf", true},
+		{"build/objs/*.map", true},
 		{"build/objs/*", false},
 		{"*", true},
 	}
@@ -545,6 +558,14 @@ func buildFirmware() error {
 	}
 }
 
+func writeBuildInfo(fname string, bi *fwbuildcommon.BuildInfo) error {
+	data, err := json.Marshal(bi)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(fname, data, 0644))
+}
+
 func sendData(w http.ResponseWriter, status int, data []byte) error {
 	// otherwise it defaults to chunked encoding which isn't supported by the
 	// mongoose reverse proxy yet.
@@ -26,6 +26,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -40,6 +41,7 @@ import (
 	"goji.io/pat"
 	glog "k8s.io/klog/v2"
 
+	moscommon "github.com/mongoose-os/mos/cli/common"
 	"github.com/mongoose-os/mos/common/docker"
 	fwbuildcommon "github.com/mongoose-os/mos/fwbuild/common"
 	"github.com/mongoose-os/mos/fwbuild/common/reqpar"
@@ -47,6 +49,10 @@ import (
 	"github.com/mongoose-os/mos/version"
 )
 
+// Suggested delay before retrying a build rejected because of
+// --max-account-builds.
+const accountRetryAfter = 30 * time.Second
+
 var (
 	instanceDockerImage = flag.String("instance-docker-image", "docker.io/mgos/fwbuild-instance", "Fwbuild instance docker image, without a tag")
 	mosImage            = flag.String("mos-image", "docker.io/mgos/mos", "Mos tool docker image, without a tag")
@@ -59,13 +65,24 @@ var (
 	keyFile           = flag.String("key-file", "", "TLS key file")
 	payloadLimit      = flag.Int64("payload-size-limit", 5*1024*1024, "Max upload size")
 	imagePullInterval = flag.Duration("image-pull-interval", 1*time.Hour, "Pull images at this interval")
+	buildTimeout      = flag.Duration("build-timeout", 15*time.Minute, "Max build duration. Requests may ask for a shorter timeout")
+	maxAccountBuilds  = flag.Int("max-account-builds", 0, "Max number of concurrent builds per client IP. 0 - no limit")
+	trustedProxy      = flag.Bool("trusted-proxy", false, "The server is behind a reverse proxy which sets X-Real-Ip, use it as the client IP")
+	metricsAppNames   = flag.Bool("metrics-app-names", false, "Include per-app build counts in /api/metrics. The endpoint is not authenticated, so this exposes app names")
 
 	errBuildFailure = errors.New("build failure")
 
 	imagePullTimestamp     = map[string]time.Time{}
 	imagePullTimestampLock = sync.Mutex{}
+
+	accountBuilds     = map[string]int{}
+	accountBuildsLock = sync.Mutex{}
 )
 
+func init() {
+	flag.Int64Var(payloadLimit, "max-payload", *payloadLimit, "Same as --payload-size-limit")
+}
+
 func main() {
 	glog.InitFlags(nil)
 	glog.LogToStderr(false) // Can be enabled with --logtostderr/--alsologtostderr.
@@ -143,6 +160,7 @@ func CreateHandler() (http.Handler, error) {
 	rAPI := goji.SubMux()
 	rRoot.Handle(pat.New("/api/*"), rAPI)
 	rAPI.HandleFunc(pat.New("/fwbuild/:version/:action"), handleFwbuildAction)
+	rAPI.HandleFunc(pat.Get("/metrics"), handleMetrics)
 
 	if *acmeChallengeDir != "" {
 		rRoot.HandleFunc(pat.New("/.well-known/acme-challenge/:file"), handleACMEChallenge)
@@ -186,18 +204,33 @@ func doPull(ctx context.Context, version string) error {
 // zip data with the build output files; in case of build failure returned
 // error is errBuildFailure; this can be used to distinguish build failures
 // from other kinds of errors.
-func runBuild(ctx context.Context, version string, reqPar *reqpar.RequestParams) ([]byte, error) {
+func runBuild(ctx context.Context, version string, reqPar *reqpar.RequestParams, bt *buildTracker) ([]byte, *fwbuildcommon.BuildInfo, error) {
+	timeout := *buildTimeout
+	if v := reqPar.FormValue(moscommon.FormBuildTimeoutName); v != "" {
+		t, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "invalid %s", moscommon.FormBuildTimeoutName)
+		}
+		if t > 0 && t < timeout {
+			timeout = t
+		}
+	}
+	// Leave some time for the instance to pack the results.
+	ctx, cancel := context.WithTimeout(ctx, timeout+time.Minute)
+	defer cancel()
+
 	cmdArgs := []string{
 		"--alsologtostderr",
 		"--v", flag.Lookup("v").Value.String(),
 		"--volumes-dir", path.Join(*volumesDir, version),
 		"--mos-image", fmt.Sprintf("%s:%s", *mosImage, version),
+		"--timeout", timeout.String(),
 	}
 
 	// Create request params json file {{{
 	reqParFile, err := ioutil.TempFile(*volumesDir, "req_par_")
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, nil, errors.Trace(err)
 	}
 	defer func() {
 		os.RemoveAll(reqParFile.Name())
@@ -206,18 +239,18 @@ func runBuild(ctx context.Context, version string, reqPar *reqpar.RequestParams)
 
 	parData, err := json.MarshalIndent(reqPar, "", "  ")
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, nil, errors.Trace(err)
 	}
 
 	if _, err := reqParFile.Write(parData); err != nil {
-		return nil, errors.Trace(err)
+		return nil, nil, errors.Trace(err)
 	}
 	// }}}
 
 	// Create output zip file {{{
 	outputFile, err := ioutil.TempFile(*volumesDir, "fwbuild_output_zip_")
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, nil, errors.Trace(err)
 	}
 	defer func() {
 		os.RemoveAll(outputFile.Name())
@@ -225,6 +258,15 @@ func runBuild(ctx context.Context, version string, reqPar *reqpar.RequestParams)
 	}()
 	// }}}
 
+	buildInfoFile, err := ioutil.TempFile(*volumesDir, "build_info_")
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	defer func() {
+		os.RemoveAll(buildInfoFile.Name())
+		buildInfoFile.Close()
+	}()
+
 	imageName := getImageName(version)
 
 	// Pull the image first, if necessary.
@@ -248,6 +290,7 @@ func runBuild(ctx context.Context, version string, reqPar *reqpar.RequestParams)
 
 	cmdArgs = append(cmdArgs, "--req-params", reqParFile.Name())
 	cmdArgs = append(cmdArgs, "--output-zip", outputFile.Name())
+	cmdArgs = append(cmdArgs, "--build-info", buildInfoFile.Name())
 
 	cmdArgs = append(cmdArgs, "build")
 
@@ -266,23 +309,62 @@ func runBuild(ctx context.Context, version string, reqPar *reqpar.RequestParams)
 		docker.Cmd(cmdArgs),
 	)
 
+	bt.start()
 	buildErr := docker.Run(ctx, imageName, os.Stdout, runOpts...)
 
 	// Read zip data from output file
 	data, err := ioutil.ReadAll(outputFile)
 
+	bi := readBuildInfo(buildInfoFile.Name())
+
 	// Return data and a proper error (if any)
 	if buildErr != nil {
 		glog.Errorf("Build error: %+v", errors.ErrorStack(buildErr))
 		exitError, ok := errors.Cause(buildErr).(*docker.ExitError)
 		if ok && exitError.Code() == fwbuildcommon.FwbuildExitCodeBuildFailed {
-			return data, errBuildFailure
+			return data, bi, errBuildFailure
 		}
 
-		return data, errors.Trace(buildErr)
+		return data, bi, errors.Trace(buildErr)
+	}
+
+	return data, bi, nil
+}
+
+// getAccount returns the key for the per-account build limit. Requests are
+// not authenticated, so a user name supplied by the client cannot be trusted,
+// client IP is used instead. X-Real-Ip is only used with --trusted-proxy,
+// otherwise any client could set it.
+func getAccount(r *http.Request) string {
+	if ips := r.Header["X-Real-Ip"]; *trustedProxy && len(ips) > 0 {
+		return ips[0]
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// acquireAccountBuild increments the number of builds in progress for the
+// account, returns false if the limit is reached.
+func acquireAccountBuild(account string) bool {
+	accountBuildsLock.Lock()
+	defer accountBuildsLock.Unlock()
+	if *maxAccountBuilds > 0 && accountBuilds[account] >= *maxAccountBuilds {
+		return false
 	}
+	accountBuilds[account]++
+	return true
+}
 
-	return data, nil
+func releaseAccountBuild(account string) {
+	accountBuildsLock.Lock()
+	defer accountBuildsLock.Unlock()
+	accountBuilds[account]--
+	if accountBuilds[account] <= 0 {
+		delete(accountBuilds, account)
+	}
 }
 
 func handleFwbuildAction(w http.ResponseWriter, r *http.Request) {
@@ -292,6 +374,24 @@ func handleFwbuildAction(w http.ResponseWriter, r *http.Request) {
 
 	switch action {
 	case "build":
+		account := getAccount(r)
+		if !acquireAccountBuild(account) {
+			glog.Infof("Too many builds for %q", account)
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", accountRetryAfter/time.Second))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(fmt.Sprintf("too many concurrent builds (max %d), try again later\n", *maxAccountBuilds)))
+			return
+		}
+		defer releaseAccountBuild(account)
+
+		bt := metrics.newBuild()
+		var data []byte
+		var bi *fwbuildcommon.BuildInfo
+		failed := true
+		defer func() {
+			bt.done(failed, bi)
+		}()
+
 		// Get request params to be saved to a json file
 		reqPar, err := reqpar.New(r, *volumesDir, *payloadLimit)
 		if err != nil {
@@ -306,7 +406,8 @@ func handleFwbuildAction(w http.ResponseWriter, r *http.Request) {
 		}()
 
 		// Perform the build
-		data, err := runBuild(ctx, version, reqPar)
+		data, bi, err = runBuild(ctx, version, reqPar, bt)
+		failed = (err != nil)
 		if err != nil {
 			if errors.Cause(err) == errBuildFailure {
 				w.WriteHeader(http.StatusTeapot)
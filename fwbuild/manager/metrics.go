@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2014-2018 Cesanta Software Limited
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the ""License"");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an ""AS IS"" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	glog "k8s.io/klog/v2"
+
+	fwbuildcommon "github.com/mongoose-os/mos/fwbuild/common"
+)
+
+const diskUsageCacheTTL = 5 * time.Minute
+
+// Metrics is returned by the /api/metrics endpoint.
+type Metrics struct {
+	StartTime time.Time `json:"start_time"`
+	// Builds that are running right now.
+	ActiveBuilds int `json:"active_builds"`
+	// Builds that have been accepted but not yet started: receiving the
+	// payload or pulling the image.
+	QueuedBuilds int `json:"queued_builds"`
+	TotalBuilds  int `json:"total_builds"`
+	FailedBuilds int `json:"failed_builds"`
+	// Per-platform build counts.
+	PlatformBuilds map[string]int `json:"platform_builds"`
+	// Per-app build counts, keyed by app/platform. Only collected with
+	// --metrics-app-names, the endpoint is not authenticated.
+	AppBuilds map[string]int `json:"app_builds,omitempty"`
+	// Incremental builds are the ones that reused an existing build context.
+	IncrementalBuilds int     `json:"incremental_builds"`
+	BuildCtxHitRate   float64 `json:"build_ctx_hit_rate"`
+	// Disk usage of --volumes-dir, refreshed at most every diskUsageCacheTTL.
+	VolumesDiskUsage     int64     `json:"volumes_disk_usage"`
+	VolumesDiskUsageTime time.Time `json:"volumes_disk_usage_time"`
+}
+
+type metricsCollector struct {
+	lock sync.Mutex
+	m    Metrics
+	// Number of builds for which build info was received.
+	numBuildInfos int
+	// Set while disk usage is being computed, the walk is done without the lock.
+	diskUsageUpdating bool
+}
+
+var metrics = &metricsCollector{
+	m: Metrics{
+		StartTime:      time.Now(),
+		PlatformBuilds: map[string]int{},
+	},
+}
+
+// buildTracker tracks a single build request.
+type buildTracker struct {
+	mc      *metricsCollector
+	started bool
+}
+
+// newBuild registers a new queued build. Caller must call done() when the
+// request is finished.
+func (mc *metricsCollector) newBuild() *buildTracker {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.m.QueuedBuilds++
+	return &buildTracker{mc: mc}
+}
+
+// start moves the build from the queue to the active set.
+func (bt *buildTracker) start() {
+	bt.mc.lock.Lock()
+	defer bt.mc.lock.Unlock()
+	bt.mc.m.QueuedBuilds--
+	bt.mc.m.ActiveBuilds++
+	bt.started = true
+}
+
+// done records the build result; bi may be nil. Builds that have never been
+// started (e.g. rejected requests) are not counted.
+func (bt *buildTracker) done(failed bool, bi *fwbuildcommon.BuildInfo) {
+	mc := bt.mc
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	if !bt.started {
+		mc.m.QueuedBuilds--
+		return
+	}
+	mc.m.ActiveBuilds--
+	mc.m.TotalBuilds++
+	if failed {
+		mc.m.FailedBuilds++
+	}
+	if bi != nil {
+		mc.m.PlatformBuilds[bi.Platform]++
+		if *metricsAppNames {
+			if mc.m.AppBuilds == nil {
+				mc.m.AppBuilds = map[string]int{}
+			}
+			mc.m.AppBuilds[bi.App+"/"+bi.Platform]++
+		}
+		mc.numBuildInfos++
+		if bi.Incremental {
+			mc.m.IncrementalBuilds++
+		}
+		mc.m.BuildCtxHitRate = float64(mc.m.IncrementalBuilds) / float64(mc.numBuildInfos)
+	}
+}
+
+// get returns a copy of the current metrics.
+func (mc *metricsCollector) get() Metrics {
+	mc.updateDiskUsage()
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	res := mc.m
+	res.PlatformBuilds = map[string]int{}
+	for k, v := range mc.m.PlatformBuilds {
+		res.PlatformBuilds[k] = v
+	}
+	if mc.m.AppBuilds != nil {
+		res.AppBuilds = map[string]int{}
+		for k, v := range mc.m.AppBuilds {
+			res.AppBuilds[k] = v
+		}
+	}
+	return res
+}
+
+// updateDiskUsage refreshes disk usage if it is stale. Only one caller
+// performs the walk, others get the previous value in the meantime.
+func (mc *metricsCollector) updateDiskUsage() {
+	mc.lock.Lock()
+	if mc.diskUsageUpdating || time.Since(mc.m.VolumesDiskUsageTime) <= diskUsageCacheTTL {
+		mc.lock.Unlock()
+		return
+	}
+	mc.diskUsageUpdating = true
+	mc.lock.Unlock()
+
+	usage, err := getDiskUsage(*volumesDir)
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.diskUsageUpdating = false
+	if err != nil {
+		glog.Errorf("Failed to get disk usage of %s: %s", *volumesDir, err)
+		return
+	}
+	mc.m.VolumesDiskUsage = usage
+	mc.m.VolumesDiskUsageTime = time.Now()
+}
+
+func getDiskUsage(dir string) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files may disappear while we walk, this is fine.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, errors.Trace(err)
+}
+
+func readBuildInfo(fname string) *fwbuildcommon.BuildInfo {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	var bi fwbuildcommon.BuildInfo
+	if err := json.Unmarshal(data, &bi); err != nil {
+		glog.Warningf("Invalid build info: %s", err)
+		return nil
+	}
+	return &bi
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	m := metrics.get()
+	data, err := json.MarshalIndent(&m, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	w.Write([]byte("\n"))
+}